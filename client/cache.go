@@ -0,0 +1,139 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/ben-mays/effective-robot/server"
+)
+
+// orderCache holds the responses of orders in a terminal state, which never change again, and the last response
+// from each URL the server gave an ETag, to revalidate instead of fetching it again.
+type orderCache struct {
+	sync.RWMutex
+	orders    map[string]server.OrderResponse
+	responses map[string]cachedResponse
+}
+
+func newOrderCache() *orderCache {
+	return &orderCache{
+		orders:    make(map[string]server.OrderResponse),
+		responses: make(map[string]cachedResponse),
+	}
+}
+
+func terminal(state string) bool {
+	return state == "pickedup" || state == "trashed"
+}
+
+func (c *orderCache) get(orderID string) (*server.OrderResponse, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	order, exists := c.orders[orderID]
+	if !exists {
+		return nil, false
+	}
+	return &order, true
+}
+
+// put caches the order if it's in a terminal state, other orders are ignored.
+func (c *orderCache) put(order *server.OrderResponse) {
+	if !terminal(order.State) {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.orders[order.OrderID] = *order
+}
+
+func (c *orderCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.orders = make(map[string]server.OrderResponse)
+	c.responses = make(map[string]cachedResponse)
+}
+
+// EnableCache caches orders once they're picked up or trashed, so GetOrder no longer fetches them from the
+// server. Orders leave the kitchen once they're terminal, so this also lets GetOrder return them after. Other
+// orders and lists are revalidated, the server skips the body if no order changed state or shelf since, though
+// values will then be as of the cached response.
+func (c *Client) EnableCache() {
+	c.cache = newOrderCache()
+}
+
+// ClearCache drops every cached order and response. It's a noop if the cache isn't enabled.
+func (c *Client) ClearCache() {
+	if c.cache != nil {
+		c.cache.clear()
+	}
+}
+
+// cacheOrder caches the order if the cache is enabled.
+func (c *Client) cacheOrder(order *server.OrderResponse) {
+	if c.cache != nil {
+		c.cache.put(order)
+	}
+}
+
+// maxCachedResponses bounds the responses kept for revalidation, one per URL.
+const maxCachedResponses = 1024
+
+// cachedResponse is the body of a response the server gave an ETag.
+type cachedResponse struct {
+	etag string
+	body []byte
+}
+
+func (c *orderCache) response(uri string) (cachedResponse, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	res, exists := c.responses[uri]
+	return res, exists
+}
+
+func (c *orderCache) putResponse(uri string, res cachedResponse) {
+	c.Lock()
+	defer c.Unlock()
+	if _, exists := c.responses[uri]; !exists && len(c.responses) >= maxCachedResponses {
+		// make room by dropping any one, orders come and go so there's no telling which is stale
+		for evict := range c.responses {
+			delete(c.responses, evict)
+			break
+		}
+	}
+	c.responses[uri] = res
+}
+
+// getCached sends a GET, revalidating the last response from the same URL with If-None-Match. The server
+// answers a 304 if nothing changed, which is turned back into a 200 with the cached body, so callers can't tell
+// the difference.
+func (c *Client) getCached(req *http.Request) (*http.Response, error) {
+	uri := req.URL.String()
+	cached, ok := c.cache.response(uri)
+	if ok {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && ok:
+		resp.Body.Close()
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Body = ioutil.NopCloser(bytes.NewReader(cached.body))
+		resp.ContentLength = int64(len(cached.body))
+	case resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") != "":
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		c.cache.putResponse(uri, cachedResponse{etag: resp.Header.Get("ETag"), body: body})
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return resp, nil
+}
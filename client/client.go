@@ -2,49 +2,292 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/ben-mays/effective-robot/server"
+	"github.com/google/uuid"
 	"go.uber.org/config"
 )
 
+// ErrOrderNotFound is returned by GetOrder when the server has no such order. Orders leave the kitchen once
+// they're picked up or trashed. Other calls return any error response from the server as an *APIError.
+var ErrOrderNotFound = errors.New("order not found")
+
 type ClientConfig struct {
 	Host string `yaml:"url"`
+	// Cache enables caching of terminal orders, see Client.EnableCache
+	Cache bool `yaml:"cache"`
+	// Pool configures the client's connections to the server
+	Pool PoolConfig `yaml:"pool"`
+	// Retry configures retrying requests the server rejects as unavailable
+	Retry RetryConfig `yaml:"retry"`
+	// Debug logs every request to stderr, see Client.Logger
+	Debug bool `yaml:"debug"`
+	// CheckVersion makes LoadConfig fail unless the server's API version is compatible, see Client.CheckVersion
+	CheckVersion bool `yaml:"check_version"`
+}
+
+// RetryConfig configures retrying 503 responses with a Retry-After header, e.g. a create rejected because the
+// kitchen is full. The client waits for as long as the header asks before each retry.
+type RetryConfig struct {
+	MaxRetries int `yaml:"max_retries"`
+	// MaxWait is the longest Retry-After the client will wait for, a longer one is returned as an error
+	MaxWait time.Duration `yaml:"max_wait"`
+}
+
+var defaultRetryConfig = RetryConfig{
+	MaxRetries: 3,
+	MaxWait:    30 * time.Second,
+}
+
+// PoolConfig configures the client's dedicated http.Transport. Go's default keeps only 2 idle connections per
+// host, so a client firing many concurrent requests at the one server keeps opening new ones.
+type PoolConfig struct {
+	MaxIdleConns        int `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int `yaml:"max_idle_conns_per_host"`
+	// MaxConnsPerHost bounds connections to the server, including those in use. Zero is unbounded.
+	MaxConnsPerHost int           `yaml:"max_conns_per_host"`
+	IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+	// KeepAlive is the TCP keep-alive period of each connection
+	KeepAlive time.Duration `yaml:"keep_alive"`
+}
+
+var defaultPoolConfig = PoolConfig{
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 100,
+	IdleConnTimeout:     90 * time.Second,
+	KeepAlive:           30 * time.Second,
+}
+
+// newTransport returns a transport like http.DefaultTransport, with the pool's limits. If socket is set every
+// connection is made to that unix socket, whatever the request's host.
+func newTransport(pool PoolConfig, socket string) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: pool.KeepAlive,
+	}
+	dial := dialer.DialContext
+	proxy := http.ProxyFromEnvironment
+	if socket != "" {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		proxy = nil
+	}
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		MaxIdleConns:          pool.MaxIdleConns,
+		MaxIdleConnsPerHost:   pool.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       pool.MaxConnsPerHost,
+		IdleConnTimeout:       pool.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
 }
 
 type Client struct {
 	BaseURL *url.URL
 
 	Transport *http.Client
+
+	// MaxRetries is how many times a request rejected with a 503 and a Retry-After header is retried, after
+	// waiting for as long as the header asks, up to MaxRetryWait. Zero never retries.
+	MaxRetries   int
+	MaxRetryWait time.Duration
+
+	// Logger, if set, logs the method, URL, status and latency of every request, and the body of error
+	// responses, e.g. to find out why requests fail. Nothing is logged by default.
+	Logger Logger
+
+	cache *orderCache
 }
 
-// LoadConfig returns a valid Client instance using the default http.Client.
+// LoadConfig returns a valid Client instance, with its own pool of connections to the server. A url like
+// unix:///var/run/kitchen.sock connects to a server listening on that unix socket.
 func LoadConfig(provider config.Provider) (*Client, error) {
-	var cfg ClientConfig
+	cfg := ClientConfig{Pool: defaultPoolConfig, Retry: defaultRetryConfig}
 	provider.Get("client").Populate(&cfg)
 	host, err := url.Parse(cfg.Host)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Client{
-		BaseURL:   host,
-		Transport: http.DefaultClient,
-	}, nil
+	var socket string
+	if host.Scheme == "unix" {
+		// requests are still HTTP, the host is a placeholder as every connection goes to the socket
+		socket = host.Path
+		host = &url.URL{Scheme: "http", Host: "unix"}
+	}
+	client := &Client{
+		BaseURL:      host,
+		Transport:    &http.Client{Transport: newTransport(cfg.Pool, socket)},
+		MaxRetries:   cfg.Retry.MaxRetries,
+		MaxRetryWait: cfg.Retry.MaxWait,
+	}
+	if cfg.Cache {
+		client.EnableCache()
+	}
+	if cfg.Debug {
+		client.Logger = log.New(os.Stderr, "client: ", log.LstdFlags)
+	}
+	if cfg.CheckVersion {
+		if err := client.CheckVersion(); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// gzipBody decompresses a response body, closing both readers on Close.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// do sends the request, retrying it while the server is unavailable, see MaxRetries.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(req)
+		if err != nil || attempt >= c.MaxRetries {
+			return resp, err
+		}
+		wait, ok := retryAfter(resp)
+		if !ok || (c.MaxRetryWait > 0 && wait > c.MaxRetryWait) {
+			return resp, nil
+		}
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, nil
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, nil
+			}
+			req.Body = body
+		}
+		// drain the rest so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBody))
+		resp.Body.Close()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send sends the request once, asking for a compressed response and transparently decompressing it.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept-Encoding", "gzip")
+	// retries keep the ID, so they can be told apart from new requests in the server's logs
+	if req.Header.Get(server.RequestIDHeader) == "" {
+		req.Header.Set(server.RequestIDHeader, uuid.New().String())
+	}
+	start := time.Now()
+	resp, err := c.Transport.Do(req)
+	if err != nil {
+		c.logRequest(req, time.Since(start), err)
+		return nil, err
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		resp.Body = gzipBody{Reader: reader, body: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.ContentLength = -1
+	}
+	c.logResponse(req, resp, time.Since(start))
+	return resp, nil
+}
+
+func (c *Client) get(uri string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.cache != nil {
+		return c.getCached(req)
+	}
+	return c.do(req)
+}
+
+func (c *Client) post(uri string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
 }
 
 func (c Client) Healthy() bool {
-	resp, err := c.Transport.Get(c.BaseURL.String() + "/health")
+	resp, err := c.get(c.BaseURL.String() + "/health")
 	if err != nil {
 		return false
 	}
 	return resp.StatusCode == 200
 }
 
+// Version returns the server's build and API versions.
+func (c *Client) Version() (*server.VersionResponse, error) {
+	var version server.VersionResponse
+	resp, err := c.get(c.BaseURL.String() + "/version")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&version)
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// CheckVersion returns a *VersionError unless the server's API major version is the one the client was built
+// against, server.APIVersion. Minor versions only add to the API, so they're compatible either way.
+func (c *Client) CheckVersion() error {
+	version, err := c.Version()
+	if err != nil {
+		return err
+	}
+	if apiMajor(version.APIVersion) != apiMajor(server.APIVersion) {
+		return &VersionError{ServerAPIVersion: version.APIVersion, ClientAPIVersion: server.APIVersion}
+	}
+	return nil
+}
+
+// apiMajor returns the major version of a major.minor API version.
+func apiMajor(version string) string {
+	return strings.SplitN(version, ".", 2)[0]
+}
+
 func (c Client) CreateOrder(req server.CreateOrderRequest) (*server.CreateOrderResponse, error) {
 	var response server.CreateOrderResponse
 	body, err := json.Marshal(req)
@@ -52,10 +295,13 @@ func (c Client) CreateOrder(req server.CreateOrderRequest) (*server.CreateOrderR
 		return nil, err
 	}
 	uri := c.BaseURL.String() + "/order"
-	resp, err := c.Transport.Post(uri, "application/json", bytes.NewReader(body))
+	resp, err := c.post(uri, body)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
 		return nil, err
@@ -64,29 +310,131 @@ func (c Client) CreateOrder(req server.CreateOrderRequest) (*server.CreateOrderR
 }
 
 func (c *Client) GetOrder(orderID string) (*server.OrderResponse, error) {
+	if c.cache != nil {
+		if order, ok := c.cache.get(orderID); ok {
+			return order, nil
+		}
+	}
 	var order server.OrderResponse
 	uri := fmt.Sprintf("%s/order/%s", c.BaseURL.String(), orderID)
-	resp, err := c.Transport.Get(uri)
+	resp, err := c.get(uri)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, ErrOrderNotFound
+	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New("order not found")
+		return nil, parseError(resp)
 	}
 	err = json.NewDecoder(resp.Body).Decode(&order)
 	if err != nil {
 		return nil, err
 	}
+	c.cacheOrder(&order)
 	return &order, err
 }
 
+// WatchOrder polls the order every interval and calls cb with it, until cb returns true, the order reaches a
+// terminal state or the context is done. An order that's no longer in the kitchen has left it, so the watch
+// ends without calling cb. Only the context and unexpected errors are returned.
+func (c *Client) WatchOrder(ctx context.Context, orderID string, interval time.Duration, cb func(*server.OrderResponse) bool) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		order, err := c.GetOrder(orderID)
+		if err == ErrOrderNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if cb(order) || terminal(order.State) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetOrderValue fetches only the state and value fields of an order, which is cheaper than GetOrder.
+func (c *Client) GetOrderValue(orderID string) (*server.OrderValueResponse, error) {
+	var value server.OrderValueResponse
+	uri := fmt.Sprintf("%s/order/%s/value", c.BaseURL.String(), orderID)
+	resp, err := c.get(uri)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	return &value, err
+}
+
+// GetOrderEvents returns every transition of the order, oldest first, including for orders that were recently
+// picked up or trashed.
+func (c *Client) GetOrderEvents(orderID string) (*server.OrderEventsResponse, error) {
+	var events server.OrderEventsResponse
+	uri := fmt.Sprintf("%s/order/%s/events", c.BaseURL.String(), orderID)
+	resp, err := c.get(uri)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&events)
+	if err != nil {
+		return nil, err
+	}
+	return &events, err
+}
+
+// PreviewPlacement returns the shelf a new order of the temp would be placed on, without creating it.
+func (c *Client) PreviewPlacement(temp string) (*server.PreviewResponse, error) {
+	var preview server.PreviewResponse
+	uri := fmt.Sprintf("%s/order/preview?temp=%s", c.BaseURL.String(), url.QueryEscape(temp))
+	resp, err := c.get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&preview)
+	if err != nil {
+		return nil, err
+	}
+	return &preview, nil
+}
+
 func (c *Client) ListOrders() (*server.ListOrdersResponse, error) {
+	return c.listOrders(fmt.Sprintf("%s/order", c.BaseURL.String()))
+}
+
+// ListOrdersWithShelves is ListOrders, plus the utilization of each shelf.
+func (c *Client) ListOrdersWithShelves() (*server.ListOrdersResponse, error) {
+	return c.listOrders(fmt.Sprintf("%s/order?includeShelves=true", c.BaseURL.String()))
+}
+
+func (c *Client) listOrders(uri string) (*server.ListOrdersResponse, error) {
 	var orders server.ListOrdersResponse
-	uri := fmt.Sprintf("%s/order", c.BaseURL.String())
-	resp, err := c.Transport.Get(uri)
+	resp, err := c.get(uri)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
 	err = json.NewDecoder(resp.Body).Decode(&orders)
 	if err != nil {
 		return nil, err
@@ -94,6 +442,130 @@ func (c *Client) ListOrders() (*server.ListOrdersResponse, error) {
 	return &orders, err
 }
 
+// Changes waits for orders to change state since the cursor, 0 to start, returning them and the cursor to pass
+// next time. If none change within timeout, in the server's configured units or 0 for the server's default, the
+// response has no orders and the same cursor. If the response is a Reset, its orders are every order and replace
+// whatever the caller had.
+func (c *Client) Changes(ctx context.Context, cursor uint64, timeout float64) (*server.ChangesResponse, error) {
+	var changes server.ChangesResponse
+	uri := fmt.Sprintf("%s/order?since=%d", c.BaseURL.String(), cursor)
+	if timeout > 0 {
+		uri += fmt.Sprintf("&timeout=%g", timeout)
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&changes)
+	if err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+// StreamOrders lists every order, calling cb for each as it's decoded rather than holding the whole list in
+// memory. An error from cb stops the stream and is returned.
+func (c *Client) StreamOrders(ctx context.Context, cb func(server.OrderResponse) error) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/order", c.BaseURL.String()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return parseError(resp)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if key != "orders" {
+			// skip anything else in the response, e.g. shelves
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := expectDelim(decoder, '['); err != nil {
+			return err
+		}
+		for decoder.More() {
+			var order server.OrderResponse
+			if err := decoder.Decode(&order); err != nil {
+				return err
+			}
+			if err := cb(order); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(decoder, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, '}')
+}
+
+// StreamOrdersNDJSON is StreamOrders, but asks the server to stream the orders as newline delimited JSON, one
+// per line, so neither side holds the whole list in memory.
+func (c *Client) StreamOrdersNDJSON(ctx context.Context, cb func(server.OrderResponse) error) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/order", c.BaseURL.String()), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return parseError(resp)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var order server.OrderResponse
+		if err := decoder.Decode(&order); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := cb(order); err != nil {
+			return err
+		}
+	}
+}
+
+// expectDelim reads the next token, returning an error unless it's the given delimiter.
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("unexpected token %v, expected %v", token, delim)
+	}
+	return nil
+}
+
 func (c *Client) UpdateOrder(orderID string, req server.UpdateOrderRequest) (*server.OrderResponse, error) {
 	var order server.OrderResponse
 	body, err := json.Marshal(req)
@@ -101,12 +573,62 @@ func (c *Client) UpdateOrder(orderID string, req server.UpdateOrderRequest) (*se
 		return nil, err
 	}
 	uri := fmt.Sprintf("%s/order/%s", c.BaseURL.String(), orderID)
-	resp, err := c.Transport.Post(uri, "application/json", bytes.NewReader(body))
+	resp, err := c.post(uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&order)
+	if err != nil {
+		return nil, err
+	}
+	c.cacheOrder(&order)
+	return &order, nil
+}
+
+// UpdateOrders applies many updates in one request. The error is only for the request as a whole, each result
+// has its own status, and the error of updates that failed.
+func (c *Client) UpdateOrders(updates []server.BulkUpdateRequest) ([]server.BulkUpdateResult, error) {
+	var res server.BulkUpdateResponse
+	body, err := json.Marshal(updates)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.post(c.BaseURL.String()+"/orders/update", body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range res.Results {
+		if result.Order != nil {
+			c.cacheOrder(result.Order)
+		}
+	}
+	return res.Results, nil
+}
+
+// SetPriority changes the order's priority, which may move it to a better shelf.
+func (c *Client) SetPriority(orderID string, priority int) (*server.OrderResponse, error) {
+	var order server.OrderResponse
+	body, err := json.Marshal(server.PriorityRequest{Priority: priority})
+	if err != nil {
+		return nil, err
+	}
+	uri := fmt.Sprintf("%s/order/%s/priority", c.BaseURL.String(), orderID)
+	resp, err := c.post(uri, body)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New("update order failed")
+		return nil, parseError(resp)
 	}
 	err = json.NewDecoder(resp.Body).Decode(&order)
 	if err != nil {
@@ -114,3 +636,49 @@ func (c *Client) UpdateOrder(orderID string, req server.UpdateOrderRequest) (*se
 	}
 	return &order, nil
 }
+
+// Cancel trashes a ready order, returning it in its final state. An *APIError with the invalid_transition code
+// is returned if a courier is already enroute, or the order was picked up or trashed.
+func (c *Client) Cancel(orderID string) (*server.OrderResponse, error) {
+	var order server.OrderResponse
+	uri := fmt.Sprintf("%s/order/%s/cancel", c.BaseURL.String(), orderID)
+	resp, err := c.post(uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, parseError(resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// RunLifecycle creates an order, sends a courier for it, waits pickupDelay and picks it up, returning the order
+// in its final state. A failed step is returned as a *LifecycleError naming it. If the wait or pickup fails, the
+// order is returned as it was once the courier was sent. If the create or enroute step fails, the order is nil, though
+// after a failed enroute the error's OrderID names the order that was created. The context only bounds the wait.
+func (c *Client) RunLifecycle(ctx context.Context, req server.CreateOrderRequest, pickupDelay time.Duration) (*server.OrderResponse, error) {
+	created, err := c.CreateOrder(req)
+	if err != nil {
+		return nil, &LifecycleError{Step: StepCreate, Err: err}
+	}
+	order, err := c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "enroute"})
+	if err != nil {
+		return nil, &LifecycleError{Step: StepEnroute, OrderID: created.OrderID, Err: err}
+	}
+	timer := time.NewTimer(pickupDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return order, &LifecycleError{Step: StepWait, OrderID: created.OrderID, Err: ctx.Err()}
+	case <-timer.C:
+	}
+	pickedUp, err := c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "pickedup"})
+	if err != nil {
+		return order, &LifecycleError{Step: StepPickup, OrderID: created.OrderID, Err: err}
+	}
+	return pickedUp, nil
+}
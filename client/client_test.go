@@ -0,0 +1,631 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ben-mays/effective-robot/kitchen"
+	"github.com/ben-mays/effective-robot/server"
+	"github.com/stretchr/testify/assert"
+
+	"go.uber.org/config"
+)
+
+var testConfig = []byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "cold"
+      capacity: 5
+      decay_rate: 0.5
+      supported: 
+        - cold`)
+
+func newTestClient(t *testing.T, cfg []byte) (*Client, *httptest.Server) {
+	provider := config.NewYAMLProviderFromBytes(cfg)
+	k, err := kitchen.NewKitchen(provider)
+	assert.Nil(t, err)
+	app, err := server.Provide(provider, func() config.Provider { return provider }, k, server.BuildInfo{})
+	assert.Nil(t, err)
+
+	ts := httptest.NewServer(app)
+	baseURL, err := url.Parse(ts.URL)
+	assert.Nil(t, err)
+	return &Client{BaseURL: baseURL, Transport: http.DefaultClient}, ts
+}
+
+func testOrder(temp string) server.CreateOrderRequest {
+	return server.CreateOrderRequest{
+		Name:      "test",
+		Temp:      temp,
+		ShelfLife: 100,
+		DecayRate: .2,
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	c, err := LoadConfig(config.NewYAMLProviderFromBytes([]byte(`
+client:
+  url: http://localhost:8080
+  pool:
+    max_idle_conns: 10
+    max_conns_per_host: 20
+    idle_conn_timeout: 5s`)))
+	assert.Nil(t, err)
+	transport := c.Transport.Transport.(*http.Transport)
+	assert.Equal(t, 10, transport.MaxIdleConns)
+	assert.Equal(t, 20, transport.MaxConnsPerHost)
+	assert.Equal(t, 5*time.Second, transport.IdleConnTimeout)
+	// unset limits keep their defaults
+	assert.Equal(t, 100, transport.MaxIdleConnsPerHost)
+	assert.NotEqual(t, http.DefaultTransport, transport)
+}
+
+// countingTransport counts the requests sent to the server, and the 304s it sent back.
+type countingTransport struct {
+	requests    int
+	notModified int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		t.notModified++
+	}
+	return resp, err
+}
+
+func TestOrderCache(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+	transport := &countingTransport{}
+	c.Transport = &http.Client{Transport: transport}
+	c.EnableCache()
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+
+	// orders that can still change are always fetched
+	_, err = c.GetOrder(created.OrderID)
+	assert.Nil(t, err)
+	_, err = c.GetOrder(created.OrderID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, transport.requests)
+
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "enroute"})
+	assert.Nil(t, err)
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "pickedup"})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, transport.requests)
+
+	for i := 0; i < 2; i++ {
+		order, err := c.GetOrder(created.OrderID)
+		assert.Nil(t, err)
+		assert.Equal(t, "pickedup", order.State)
+	}
+	assert.Equal(t, 5, transport.requests)
+
+	// once cleared, the server no longer has the order
+	c.ClearCache()
+	_, err = c.GetOrder(created.OrderID)
+	assert.Equal(t, ErrOrderNotFound, err)
+	assert.Equal(t, 6, transport.requests)
+}
+
+func TestListOrdersWithShelves(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	for _, temp := range []string{"hot", "hot", "cold"} {
+		_, err := c.CreateOrder(testOrder(temp))
+		assert.Nil(t, err)
+	}
+
+	// not included by default
+	res, err := c.ListOrders()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res.Orders))
+	assert.Nil(t, res.Shelves)
+
+	res, err = c.ListOrdersWithShelves()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(res.Orders))
+	assert.Equal(t, map[string]server.ShelfResponse{
+		"hot":  {Used: 2, Capacity: 5},
+		"cold": {Used: 1, Capacity: 5},
+	}, res.Shelves)
+}
+
+func TestGetOrderValue(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+
+	order, err := c.GetOrder(created.OrderID)
+	assert.Nil(t, err)
+	value, err := c.GetOrderValue(created.OrderID)
+	assert.Nil(t, err)
+
+	// values keep decaying between the two calls
+	assert.Equal(t, order.State, value.State)
+	assert.InDelta(t, order.Value, value.Value, .1)
+	assert.InDelta(t, order.NormalValue, value.NormalValue, .01)
+	assert.InDelta(t, order.Decay, value.Decay, .1)
+	assert.InDelta(t, order.Age, value.Age, .1)
+
+	_, err = c.GetOrderValue("missing")
+	assert.NotNil(t, err)
+}
+
+func TestCompressedResponses(t *testing.T) {
+	c, ts := newTestClient(t, append(testConfig, []byte(`
+server:
+  compression: true`)...))
+	defer ts.Close()
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	orders, err := c.ListOrders()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orders.Orders))
+	assert.Equal(t, created.OrderID, orders.Orders[0].OrderID)
+	assert.True(t, c.Healthy())
+}
+
+func TestWatchOrder(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+
+	// drive the order to pickedup while watching it
+	var states []string
+	err = c.WatchOrder(context.Background(), created.OrderID, time.Millisecond, func(order *server.OrderResponse) bool {
+		states = append(states, order.State)
+		switch order.State {
+		case "ready":
+			_, err := c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "enroute"})
+			assert.Nil(t, err)
+		case "enroute":
+			_, err := c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "pickedup"})
+			assert.Nil(t, err)
+		}
+		return false
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ready", "enroute"}, states)
+
+	// the callback can end the watch early
+	created, err = c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	calls := 0
+	err = c.WatchOrder(context.Background(), created.OrderID, time.Millisecond, func(order *server.OrderResponse) bool {
+		calls++
+		return calls == 3
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	// or the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = c.WatchOrder(ctx, created.OrderID, time.Millisecond, func(order *server.OrderResponse) bool {
+		return false
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestStreamOrders(t *testing.T) {
+	// a synthetic list, much larger than any test kitchen
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := server.ListOrdersResponse{
+			Shelves: map[string]server.ShelfResponse{"hot": {Used: 1, Capacity: 2}},
+		}
+		for i := 0; i < 10000; i++ {
+			res.Orders = append(res.Orders, server.OrderResponse{OrderID: strconv.Itoa(i), State: "ready"})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer ts.Close()
+	baseURL, err := url.Parse(ts.URL)
+	assert.Nil(t, err)
+	c := &Client{BaseURL: baseURL, Transport: http.DefaultClient}
+
+	seen := 0
+	err = c.StreamOrders(context.Background(), func(order server.OrderResponse) error {
+		assert.Equal(t, strconv.Itoa(seen), order.OrderID)
+		seen++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, seen)
+
+	// the callback can stop the stream
+	stop := errors.New("stop")
+	seen = 0
+	err = c.StreamOrders(context.Background(), func(order server.OrderResponse) error {
+		seen++
+		if seen == 10 {
+			return stop
+		}
+		return nil
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 10, seen)
+}
+
+func TestStreamOrdersFromServer(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	ids := make(map[string]bool)
+	for _, temp := range []string{"hot", "hot", "cold"} {
+		created, err := c.CreateOrder(testOrder(temp))
+		assert.Nil(t, err)
+		ids[created.OrderID] = true
+	}
+	err := c.StreamOrders(context.Background(), func(order server.OrderResponse) error {
+		assert.True(t, ids[order.OrderID])
+		delete(ids, order.OrderID)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ids))
+}
+
+func TestStreamOrdersNDJSON(t *testing.T) {
+	// compressed, so the flushes go through gzip too
+	c, ts := newTestClient(t, append(testConfig, []byte(`
+server:
+  compression: true`)...))
+	defer ts.Close()
+
+	ids := make(map[string]bool)
+	for _, temp := range []string{"hot", "hot", "cold"} {
+		created, err := c.CreateOrder(testOrder(temp))
+		assert.Nil(t, err)
+		ids[created.OrderID] = true
+	}
+	err := c.StreamOrdersNDJSON(context.Background(), func(order server.OrderResponse) error {
+		assert.True(t, ids[order.OrderID])
+		delete(ids, order.OrderID)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ids))
+
+	stop := errors.New("stop")
+	err = c.StreamOrdersNDJSON(context.Background(), func(order server.OrderResponse) error {
+		return stop
+	})
+	assert.Equal(t, stop, err)
+}
+
+func TestAPIError(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	_, err := c.UpdateOrders(make([]server.BulkUpdateRequest, 1001))
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnprocessableEntity, apiErr.StatusCode)
+	assert.Equal(t, server.CodeInvalid, apiErr.Code)
+	assert.Contains(t, apiErr.Message, "1001")
+
+	// an unknown state lists the valid ones
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "eaten"})
+	apiErr, ok = err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, server.CodeBadRequest, apiErr.Code)
+	assert.Contains(t, apiErr.Message, "eaten")
+	assert.NotEmpty(t, apiErr.ValidStates)
+
+	_, err = c.GetOrderValue("missing")
+	apiErr, ok = err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, server.CodeNotFound, apiErr.Code)
+	assert.Contains(t, apiErr.Error(), "not_found")
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kitchen")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "kitchen.sock")
+
+	provider := config.NewYAMLProviderFromBytes(testConfig, []byte(fmt.Sprintf(`
+server:
+  socket: %s
+client:
+  url: unix://%s`, socket, socket)))
+	k, err := kitchen.NewKitchen(provider)
+	assert.Nil(t, err)
+	app, err := server.Provide(provider, func() config.Provider { return provider }, k, server.BuildInfo{})
+	assert.Nil(t, err)
+	listener, err := app.Listen()
+	assert.Nil(t, err)
+	defer listener.Close()
+	go http.Serve(listener, app)
+
+	c, err := LoadConfig(provider)
+	assert.Nil(t, err)
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	order, err := c.GetOrder(created.OrderID)
+	assert.Nil(t, err)
+	assert.Equal(t, "hot", order.Shelf)
+}
+
+func TestRevalidateWithETag(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+	transport := &countingTransport{}
+	c.Transport = &http.Client{Transport: transport}
+	c.EnableCache()
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	first, err := c.ListOrders()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, transport.notModified)
+
+	// nothing changed, so the server skips the body and the cached one is returned
+	second, err := c.ListOrders()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, transport.notModified)
+	assert.Equal(t, first, second)
+	order, err := c.GetOrder(created.OrderID)
+	assert.Nil(t, err)
+	order, err = c.GetOrder(created.OrderID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, transport.notModified)
+	assert.Equal(t, "ready", order.State)
+
+	// a transition changes the version
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "enroute"})
+	assert.Nil(t, err)
+	third, err := c.ListOrders()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, transport.notModified)
+	assert.Equal(t, "enroute", third.Orders[0].State)
+}
+
+func TestRetryAfter(t *testing.T) {
+	c, ts := newTestClient(t, append(append([]byte{}, testConfig...), "\n  max_total_orders: 1"...))
+	defer ts.Close()
+
+	first, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	_, err = c.CreateOrder(testOrder("hot"))
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Equal(t, server.CodeUnavailable, apiErr.Code)
+	assert.Equal(t, time.Second, apiErr.RetryAfter)
+
+	// the retry waits out the Retry-After, by which time the first order has been picked up
+	c.MaxRetries = 1
+	type result struct {
+		err     error
+		elapsed time.Duration
+	}
+	done := make(chan result)
+	go func() {
+		start := time.Now()
+		_, err := c.CreateOrder(testOrder("hot"))
+		done <- result{err, time.Since(start)}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	_, err = c.UpdateOrder(first.OrderID, server.UpdateOrderRequest{State: "enroute"})
+	assert.Nil(t, err)
+	_, err = c.UpdateOrder(first.OrderID, server.UpdateOrderRequest{State: "pickedup"})
+	assert.Nil(t, err)
+	res := <-done
+	assert.Nil(t, res.err)
+	assert.True(t, res.elapsed >= time.Second, res.elapsed.String())
+}
+
+func TestCancel(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	order, err := c.Cancel(created.OrderID)
+	assert.Nil(t, err)
+	assert.Equal(t, "trashed", order.State)
+
+	_, err = c.Cancel(created.OrderID)
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusConflict, apiErr.StatusCode)
+	assert.Equal(t, "trashed", apiErr.State)
+}
+
+func TestRunLifecycle(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	order, err := c.RunLifecycle(context.Background(), testOrder("hot"), 10*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, "pickedup", order.State)
+
+	// each step's failure is told apart
+	_, err = c.RunLifecycle(context.Background(), testOrder("frozen"), 0)
+	lifecycleErr, ok := err.(*LifecycleError)
+	assert.True(t, ok)
+	assert.Equal(t, StepCreate, lifecycleErr.Step)
+	assert.Equal(t, "", lifecycleErr.OrderID)
+	_, ok = lifecycleErr.Err.(*APIError)
+	assert.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	order, err = c.RunLifecycle(ctx, testOrder("hot"), time.Hour)
+	lifecycleErr, ok = err.(*LifecycleError)
+	assert.True(t, ok)
+	assert.Equal(t, StepWait, lifecycleErr.Step)
+	assert.Equal(t, context.Canceled, lifecycleErr.Err)
+	assert.Equal(t, "enroute", order.State)
+	assert.Equal(t, order.OrderID, lifecycleErr.OrderID)
+}
+
+func TestCheckVersion(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+	version, err := c.Version()
+	assert.Nil(t, err)
+	assert.Equal(t, server.APIVersion, version.APIVersion)
+	assert.Nil(t, c.CheckVersion())
+
+	// a server on another major version is refused, another minor version isn't
+	apiVersion := "2.0"
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(server.VersionResponse{Version: "2.0.0", GitSHA: "abc123", APIVersion: apiVersion})
+	}))
+	defer other.Close()
+	baseURL, err := url.Parse(other.URL)
+	assert.Nil(t, err)
+	c = &Client{BaseURL: baseURL, Transport: http.DefaultClient}
+	err = c.CheckVersion()
+	versionErr, ok := err.(*VersionError)
+	assert.True(t, ok)
+	assert.Equal(t, "2.0", versionErr.ServerAPIVersion)
+	assert.Equal(t, server.APIVersion, versionErr.ClientAPIVersion)
+
+	_, err = LoadConfig(config.NewYAMLProviderFromBytes([]byte(`
+client:
+  url: ` + other.URL + `
+  check_version: true`)))
+	assert.NotNil(t, err)
+
+	apiVersion = strings.SplitN(server.APIVersion, ".", 2)[0] + ".99"
+	assert.Nil(t, c.CheckVersion())
+}
+
+// capturingLogger keeps every line logged to it.
+type capturingLogger struct {
+	lines []string
+}
+
+func (l *capturingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+	logger := &capturingLogger{}
+	c.Logger = logger
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(logger.lines))
+	assert.Contains(t, logger.lines[0], "POST "+ts.URL+"/order 200")
+
+	// failures are logged with their status and body, which is still parsed into the error
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "eaten"})
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, server.CodeBadRequest, apiErr.Code)
+	assert.Equal(t, 2, len(logger.lines))
+	assert.Contains(t, logger.lines[1], fmt.Sprintf("/order/%s 400", created.OrderID))
+	assert.Contains(t, logger.lines[1], server.CodeBadRequest)
+}
+
+func TestRequestID(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+	var serverLogs bytes.Buffer
+	ts.Config.Handler.(*server.ApplicationServer).SetLogger(log.New(&serverLogs, "", 0))
+	logger := &capturingLogger{}
+	c.Logger = logger
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "eaten"})
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+
+	// the ID the client generated is logged by both sides, and echoed back in the error
+	id := apiErr.RequestID
+	assert.NotEmpty(t, id)
+	assert.Contains(t, apiErr.Error(), id)
+	assert.Equal(t, 2, len(logger.lines))
+	assert.Contains(t, logger.lines[1], "["+id+"]")
+	assert.Contains(t, serverLogs.String(), fmt.Sprintf("[%s] POST /order/%s 400", id, created.OrderID))
+	// and every request gets its own
+	assert.NotContains(t, logger.lines[0], "["+id+"]")
+}
+
+func TestGetOrderEvents(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	created, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "enroute"})
+	assert.Nil(t, err)
+	_, err = c.UpdateOrder(created.OrderID, server.UpdateOrderRequest{State: "pickedup"})
+	assert.Nil(t, err)
+
+	res, err := c.GetOrderEvents(created.OrderID)
+	assert.Nil(t, err)
+	states := make([]string, len(res.Events))
+	for i, event := range res.Events {
+		states[i] = event.NewState
+	}
+	assert.Equal(t, []string{"created", "ready", "enroute", "pickedup"}, states)
+
+	_, err = c.GetOrderEvents("missing")
+	apiErr, ok := err.(*APIError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+}
+
+func TestUpdateOrders(t *testing.T) {
+	c, ts := newTestClient(t, testConfig)
+	defer ts.Close()
+
+	first, err := c.CreateOrder(testOrder("hot"))
+	assert.Nil(t, err)
+	second, err := c.CreateOrder(testOrder("cold"))
+	assert.Nil(t, err)
+
+	results, err := c.UpdateOrders([]server.BulkUpdateRequest{
+		{ID: first.OrderID, State: "enroute"},
+		{ID: second.OrderID, State: "pickedup"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, http.StatusOK, results[0].Status)
+	assert.Equal(t, "enroute", results[0].Order.State)
+	assert.Equal(t, http.StatusConflict, results[1].Status)
+	assert.Equal(t, server.CodeInvalidTransition, results[1].Error.Code)
+}
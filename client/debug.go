@@ -0,0 +1,45 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ben-mays/effective-robot/server"
+)
+
+// Logger is where a client logs its requests, see Client.Logger. *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// logRequest logs a request that failed without a response.
+func (c *Client) logRequest(req *http.Request, latency time.Duration, err error) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Printf("[%s] %s %s failed after %s: %v", req.Header.Get(server.RequestIDHeader), req.Method, req.URL, latency, err)
+}
+
+// logResponse logs the response to a request, with the body of error responses. The body is read up to
+// maxErrorBody and replaced, so the caller can still read it all.
+func (c *Client) logResponse(req *http.Request, resp *http.Response, latency time.Duration) {
+	if c.Logger == nil {
+		return
+	}
+	if resp.StatusCode < 400 {
+		c.Logger.Printf("[%s] %s %s %d in %s", req.Header.Get(server.RequestIDHeader), req.Method, req.URL, resp.StatusCode, latency)
+		return
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+	c.Logger.Printf("[%s] %s %s %d in %s: %s", req.Header.Get(server.RequestIDHeader), req.Method, req.URL, resp.StatusCode, latency, bytes.TrimSpace(body))
+}
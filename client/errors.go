@@ -0,0 +1,125 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ben-mays/effective-robot/server"
+)
+
+// maxErrorBody bounds how much of an error response is read.
+const maxErrorBody = 64 * 1024
+
+// APIError is an error response from the server. Code is one of the server.Code constants, and is empty if the
+// response wasn't a JSON error, e.g. from a proxy in front of the server.
+type APIError struct {
+	StatusCode    int
+	Code          string
+	Message       string
+	State         string
+	ExpectedState string
+	ValidStates   []string
+	// RetryAfter is how long the server asked the client to wait before retrying, zero if it didn't
+	RetryAfter time.Duration
+	// RequestID is the ID of the failed request, to find it in the server's logs
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("server returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+	if e.Code == "" {
+		msg = fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+	}
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request %s)", e.RequestID)
+	}
+	return msg
+}
+
+// retryAfter returns how long a 503 response asks the client to wait before retrying, in seconds or until a
+// date. It returns false if the response isn't a 503 or has no valid Retry-After.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	header := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// parseError returns an *APIError for an unsuccessful response, closing its body.
+func parseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	apiErr.RetryAfter, _ = retryAfter(resp)
+	// the server echoes the request's ID, or generates one
+	apiErr.RequestID = resp.Header.Get(server.RequestIDHeader)
+	if apiErr.RequestID == "" && resp.Request != nil {
+		apiErr.RequestID = resp.Request.Header.Get(server.RequestIDHeader)
+	}
+	var res server.ErrorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&res); err != nil {
+		return apiErr
+	}
+	// drain the rest so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxErrorBody))
+	if res.Error.Code == "" {
+		return apiErr
+	}
+	apiErr.Code = res.Error.Code
+	apiErr.Message = res.Error.Message
+	apiErr.State = res.Error.State
+	apiErr.ExpectedState = res.Error.ExpectedState
+	apiErr.ValidStates = res.Error.ValidStates
+	return apiErr
+}
+
+// LifecycleStep is a step of RunLifecycle.
+type LifecycleStep string
+
+const (
+	StepCreate  LifecycleStep = "create"
+	StepEnroute LifecycleStep = "enroute"
+	StepWait    LifecycleStep = "wait"
+	StepPickup  LifecycleStep = "pickup"
+)
+
+// LifecycleError is the error RunLifecycle returns, naming the step that failed. Err is the step's own error,
+// e.g. an *APIError, or the context's error while waiting for the pickup.
+type LifecycleError struct {
+	Step LifecycleStep
+	// OrderID is empty if the order wasn't created
+	OrderID string
+	Err     error
+}
+
+func (e *LifecycleError) Error() string {
+	if e.OrderID == "" {
+		return fmt.Sprintf("%s: %v", e.Step, e.Err)
+	}
+	return fmt.Sprintf("%s order %s: %v", e.Step, e.OrderID, e.Err)
+}
+
+// VersionError is returned by CheckVersion when the server's API major version differs from the client's.
+type VersionError struct {
+	ServerAPIVersion string
+	ClientAPIVersion string
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("server API version %s is incompatible with the client's %s", e.ServerAPIVersion, e.ClientAPIVersion)
+}
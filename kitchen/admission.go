@@ -0,0 +1,119 @@
+package kitchen
+
+import (
+	"fmt"
+	"time"
+)
+
+// AdmissionPredicate decides whether a shelf takes an order, on top of the shelf supporting the order's temps and
+// its affinity rules. at is the kitchen's current time. Predicates are called without the order's lock held.
+type AdmissionPredicate func(order *Order, at time.Time) bool
+
+// WithShelfAdmission adds a predicate every order must pass to be placed on, or moved to, the named shelf. It's
+// checked after any the shelf's config has, see shelfAdmissionConfig.
+func WithShelfAdmission(shelf string, predicate AdmissionPredicate) KitchenOption {
+	return func(k *Kitchen) {
+		if k.shelfAdmission == nil {
+			k.shelfAdmission = make(map[string][]AdmissionPredicate)
+		}
+		k.shelfAdmission[shelf] = append(k.shelfAdmission[shelf], predicate)
+	}
+}
+
+// MinValue admits orders worth at least min. New orders are worth their full value, so it turns away orders with
+// a short shelf life, and the decay minimizer won't move orders there once they've lost too much value.
+func MinValue(min time.Duration) AdmissionPredicate {
+	return func(order *Order, at time.Time) bool {
+		order.RLock()
+		defer order.RUnlock()
+		value := order.value(at)
+		if order.state == "" || order.state == Created {
+			value = order.valueFunc(order.shelfLife, 0)
+		}
+		return value >= float64(min)
+	}
+}
+
+// TempMatch admits orders with any of the temps, e.g. to keep a shelf that supports several temps for one of
+// them.
+func TempMatch(temps ...string) AdmissionPredicate {
+	return func(order *Order, at time.Time) bool {
+		for _, temp := range order.Temps() {
+			for _, match := range temps {
+				if temp == match {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// TimeWindow admits orders from until to, both "15:04" times of day in the location of the kitchen's clock. A
+// window ending before it starts wraps around midnight.
+func TimeWindow(from, to string) (AdmissionPredicate, error) {
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return nil, err
+	}
+	window := decayWindow{from: start, to: end}
+	return func(order *Order, at time.Time) bool {
+		return window.contains(timeOfDay(at))
+	}, nil
+}
+
+// shelfAdmissionConfig builds a shelf's admission predicates from its config. Unset fields admit everything.
+type shelfAdmissionConfig struct {
+	// MinValue turns away orders worth less, see MinValue
+	MinValue time.Duration `yaml:"min_value"`
+	// Temps turns away orders without any of these temps, see TempMatch
+	Temps []string `yaml:"temps"`
+	// From and To only admit orders during a window of the day, see TimeWindow
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// predicates returns the predicates the config describes, or an error if it's invalid.
+func (c shelfAdmissionConfig) predicates() ([]AdmissionPredicate, error) {
+	predicates := make([]AdmissionPredicate, 0)
+	if c.MinValue < 0 {
+		return nil, fmt.Errorf("admission: min_value %s must not be negative", c.MinValue)
+	}
+	if c.MinValue > 0 {
+		predicates = append(predicates, MinValue(c.MinValue))
+	}
+	if len(c.Temps) > 0 {
+		predicates = append(predicates, TempMatch(c.Temps...))
+	}
+	if c.From != "" || c.To != "" {
+		window, err := TimeWindow(c.From, c.To)
+		if err != nil {
+			return nil, fmt.Errorf("admission: %v", err)
+		}
+		predicates = append(predicates, window)
+	}
+	return predicates, nil
+}
+
+// admittingShelf is implemented by shelves with admission predicates.
+type admittingShelf interface {
+	admits(order *Order, at time.Time) bool
+}
+
+// shelfAdmits returns true if the shelf's admission predicates, if it has any, admit the order now.
+func shelfAdmits(shelf Shelf, order *Order) bool {
+	if as, ok := shelf.(admittingShelf); ok {
+		return as.admits(order, order.now())
+	}
+	return true
+}
+
+// placeable returns true if the order's affinity rules and the shelf's admission predicates let the order on the
+// shelf. The shelf's temps aren't checked.
+func placeable(order *Order, shelf Shelf) bool {
+	return order.allows(shelf) && shelfAdmits(shelf, order)
+}
@@ -0,0 +1,148 @@
+package kitchen
+
+import (
+	"sort"
+	"sync"
+)
+
+// batcher groups concurrent creates of orders with the same temp, so a batch of them is put on each shelf under a
+// single acquisition of its lock rather than one per order. There's no background flush: the first create to
+// queue an order for a temp flushes the next batch, and once it's placed hands the queue to the create of the
+// oldest order still queued. A create that arrives alone is placed straight away, as a batch of one.
+type batcher struct {
+	k *Kitchen
+	// the most orders placed in one batch
+	maxBatch int
+
+	lock   sync.Mutex
+	queues map[string]*batchQueue
+}
+
+// batchQueue holds the orders of one temp waiting to be placed. While flushing is set, a create is placing a
+// batch and queued orders wait for it to hand the queue over.
+type batchQueue struct {
+	queued   []*batchEntry
+	flushing bool
+}
+
+type batchEntry struct {
+	order  *Order
+	placed bool
+	// receives true once the order's batch has been placed, or false if its create should flush the next batch
+	done chan bool
+}
+
+func newBatcher(k *Kitchen, maxBatch int) *batcher {
+	return &batcher{k: k, maxBatch: maxBatch, queues: make(map[string]*batchQueue)}
+}
+
+// place queues the new order and returns true once it's been placed on one of the shelves supporting its temp,
+// or false if none had room, in which case the order is left in the Created state, for the caller to admit or
+// trash like any other.
+func (b *batcher) place(order *Order, temp string) bool {
+	// as optimizePlacement does, rather than hold up a batch with an order that can't be placed
+	if order.IsExpired() {
+		b.k.trash(order, order.State(), TrashExpired)
+		return false
+	}
+	entry := &batchEntry{order: order, done: make(chan bool, 1)}
+	b.lock.Lock()
+	queue, ok := b.queues[temp]
+	if !ok {
+		queue = &batchQueue{}
+		b.queues[temp] = queue
+	}
+	// while nothing is flushing, nothing is queued either, so this order leads the next batch
+	queue.queued = append(queue.queued, entry)
+	flush := !queue.flushing
+	queue.flushing = true
+	b.lock.Unlock()
+
+	if !flush && <-entry.done {
+		return entry.placed
+	}
+
+	b.lock.Lock()
+	batch := queue.queued
+	if len(batch) > b.maxBatch {
+		batch = batch[:b.maxBatch]
+	}
+	queue.queued = queue.queued[len(batch):]
+	b.lock.Unlock()
+
+	b.k.placeBatch(batch)
+
+	b.lock.Lock()
+	if len(queue.queued) > 0 {
+		queue.queued[0].done <- false
+	} else {
+		queue.flushing = false
+	}
+	b.lock.Unlock()
+	for _, e := range batch[1:] {
+		e.done <- true
+	}
+	return entry.placed
+}
+
+// batchTemp returns the temp to batch a new order under, and false if it can't be batched with others. Only
+// orders whose shelves are ranked the same for every order of their temp are, see rankedCandidates. Orders
+// already placed are relocated by optimizePlacement instead.
+func (k *Kitchen) batchTemp(order *Order) (string, bool) {
+	if k.batcher == nil || order.State() != Created || len(order.Temps()) != 1 {
+		return "", false
+	}
+	k.RLock()
+	defer k.RUnlock()
+	if !k.presorted || k.sortedIndex == nil || k.hasPreferences(order) || k.unsafeFallbackChain(order) != nil {
+		return "", false
+	}
+	return order.Temps()[0], true
+}
+
+// placeBatch places new orders of the same temp, as far as they fit, on the shelves supporting it, best first,
+// the same as placing each in turn with optimizePlacement would. Each shelf's lock is taken once for the orders
+// that go on it. The orders' locks are all held while they're placed, taken in ID order. They're new, so
+// nothing else holds the lock of one while waiting for the lock of another.
+func (k *Kitchen) placeBatch(batch []*batchEntry) {
+	shelves := k.rankedCandidates(batch[0].order)
+	// admission predicates take the order's lock, so check them first
+	allowed := make([][]bool, len(batch))
+	for i, entry := range batch {
+		allowed[i] = make([]bool, len(shelves))
+		for j, shelf := range shelves {
+			allowed[i][j] = placeable(entry.order, shelf)
+		}
+	}
+
+	locked := append([]*batchEntry(nil), batch...)
+	sort.Slice(locked, func(i, j int) bool {
+		return locked[i].order.ID() < locked[j].order.ID()
+	})
+	for _, entry := range locked {
+		entry.order.Lock()
+		defer entry.order.Unlock()
+	}
+
+	orders := make([]*Order, 0, len(batch))
+	entries := make([]*batchEntry, 0, len(batch))
+	for j, shelf := range shelves {
+		orders, entries = orders[:0], entries[:0]
+		for i, entry := range batch {
+			// reaped while it was queued
+			if entry.placed || entry.order.state != Created || !allowed[i][j] {
+				continue
+			}
+			orders = append(orders, entry.order)
+			entries = append(entries, entry)
+		}
+		if len(orders) == 0 {
+			continue
+		}
+		placed := putBatch(shelf, orders)
+		for _, entry := range entries[:placed] {
+			entry.order.unsafePlaced(shelf)
+			entry.placed = true
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package kitchen
+
+import (
+	"context"
+	"sync"
+)
+
+// changeLogSize is the number of recent changes kept. A cursor older than that has to start over.
+const changeLogSize = 4096
+
+type change struct {
+	seq   uint64
+	order *Order
+}
+
+// changeLog numbers every order transition and move, so clients can ask for just the orders that changed since
+// they last looked. Sequence numbers start at 1 and only increase.
+type changeLog struct {
+	sync.Mutex
+	seq     uint64
+	entries []change
+	// closed and replaced on every change, to wake up waiters
+	changed chan struct{}
+}
+
+func newChangeLog() *changeLog {
+	return &changeLog{changed: make(chan struct{})}
+}
+
+// record logs a change to the order, which the caller must hold the lock for.
+func (l *changeLog) record(order *Order) {
+	l.Lock()
+	defer l.Unlock()
+	l.seq++
+	order.version = l.seq
+	l.entries = append(l.entries, change{seq: l.seq, order: order})
+	if len(l.entries) > changeLogSize {
+		// copy rather than reslice, so the backing array doesn't grow forever
+		l.entries = append(l.entries[:0:0], l.entries[len(l.entries)-changeLogSize:]...)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// since returns the orders changed after the cursor, the cursor to pass next and a channel closed on the next
+// change. ok is false if the log no longer goes back as far as the cursor, or the cursor is from the future.
+func (l *changeLog) since(cursor uint64) (orders []*Order, next uint64, ok bool, changed <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+	if cursor > l.seq || (len(l.entries) > 0 && cursor < l.entries[0].seq-1) {
+		return nil, l.seq, false, l.changed
+	}
+	seen := make(map[*Order]bool)
+	for _, c := range l.entries {
+		if c.seq <= cursor || seen[c.order] {
+			continue
+		}
+		seen[c.order] = true
+		orders = append(orders, c.order)
+	}
+	return orders, l.seq, true, l.changed
+}
+
+// signal returns a channel closed on the next change.
+func (l *changeLog) signal() <-chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	return l.changed
+}
+
+// recent returns the order with the ID that changed most recently, which may since have left the shelves, or
+// nil if it hasn't changed in the last changeLogSize changes.
+func (l *changeLog) recent(orderID string) *Order {
+	l.Lock()
+	defer l.Unlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if l.entries[i].order.ID() == orderID {
+			return l.entries[i].order
+		}
+	}
+	return nil
+}
+
+// Changes returns clones of the orders that transitioned or moved shelves after the cursor, in the order they first did,
+// and the cursor to pass next time. Zero is the cursor before the first change. If the kitchen no longer remembers that far
+// back, ok is false and orders is every order on the shelves instead, as if the caller started over.
+func (k *Kitchen) Changes(cursor uint64) (orders []*Order, next uint64, ok bool) {
+	orders, next, ok, _ = k.changes.since(cursor)
+	if !ok {
+		return k.GetOrders(), next, ok
+	}
+	return cloneAll(orders), next, ok
+}
+
+// Version identifies the latest change to any order. It only increases, so if it hasn't changed then no
+// order has changed state, shelf or priority, or been reheated, though their values will have.
+func (k *Kitchen) Version() uint64 {
+	k.changes.Lock()
+	defer k.changes.Unlock()
+	return k.changes.seq
+}
+
+// WaitForChanges is Changes, but blocks until at least one order has changed since the cursor. If the context
+// is done first, its error is returned along with the unchanged cursor.
+func (k *Kitchen) WaitForChanges(ctx context.Context, cursor uint64) (orders []*Order, next uint64, ok bool, err error) {
+	for {
+		orders, next, ok, changed := k.changes.since(cursor)
+		if !ok {
+			return k.GetOrders(), next, false, nil
+		}
+		if len(orders) > 0 {
+			return cloneAll(orders), next, true, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, cursor, true, ctx.Err()
+		case <-changed:
+		}
+	}
+}
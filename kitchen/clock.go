@@ -0,0 +1,19 @@
+package kitchen
+
+import "time"
+
+// Clock tells the kitchen, and every order it creates, the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// KitchenOption configures optional behavior of a Kitchen.
+type KitchenOption func(*Kitchen)
+
+// WithClock replaces the wall clock for the kitchen and every order it creates, e.g. to time-travel in tests.
+func WithClock(clock Clock) KitchenOption {
+	return func(k *Kitchen) {
+		k.clock = clock
+		k.now = clock.Now
+	}
+}
@@ -0,0 +1,10 @@
+// Package kitchen places orders on shelves to minimize their decay until a courier picks them up. It's served
+// over HTTP by the server package, but can also be embedded directly, see NewFromConfig.
+//
+// A Kitchen and the Orders it returns are safe for concurrent use. Each order is guarded by its own lock, so
+// operations on different orders don't contend, and transitions on the same order are serialized: of two
+// racing transitions from the same state, exactly one succeeds and the other returns a *TransitionError.
+// Reads of an order, e.g. Value, are consistent at a point in time, use ValueSnapshot for several fields at
+// once. Lists like GetOrders are not a consistent snapshot of the whole kitchen, orders may be placed, moved
+// or removed while they're gathered.
+package kitchen
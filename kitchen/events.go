@@ -0,0 +1,74 @@
+package kitchen
+
+import (
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is the number of events a subscriber can fall behind before it starts missing them.
+const subscriberBuffer = 256
+
+// OrderEvent is published whenever an order transitions to a new state, or is reheated.
+type OrderEvent struct {
+	OrderID  string
+	OldState OrderState
+	NewState OrderState
+	At       time.Time
+	// Metadata is the order's metadata, shared by every event for the order and must not be modified
+	Metadata map[string]string
+	// Reason is why the order was trashed, only set when NewState is Trashed
+	Reason TrashReason
+	// KitchenID is the name of the kitchen the order is in, empty if it has none
+	KitchenID string
+	// Reheated is set for a reheat, which recovers value without changing the order's state, see Kitchen.Reheat
+	Reheated bool
+}
+
+// eventBus fans out order events to subscribers. Publishing never blocks, a subscriber that falls
+// too far behind misses events rather than stalling the kitchen.
+type eventBus struct {
+	sync.RWMutex
+	subscribers map[chan OrderEvent]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[chan OrderEvent]struct{})}
+}
+
+func (b *eventBus) subscribe() chan OrderEvent {
+	b.Lock()
+	defer b.Unlock()
+	ch := make(chan OrderEvent, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan OrderEvent) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscribers, ch)
+}
+
+func (b *eventBus) publish(event OrderEvent) {
+	b.RLock()
+	defer b.RUnlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// OrderEvents returns every transition of the order with the ID, oldest first. Orders that have left the shelves
+// can still be found while they're among the recent changes, otherwise ErrOrderNotFound is returned.
+func (k *Kitchen) OrderEvents(orderID string) ([]OrderEvent, error) {
+	order := k.findOrder(orderID)
+	if order == nil {
+		order = k.changes.recent(orderID)
+	}
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	return order.Events(), nil
+}
@@ -0,0 +1,178 @@
+package kitchen
+
+import (
+	"container/heap"
+	"time"
+)
+
+// heapRefreshInterval is how often a heapShelf re-evaluates the values it's keyed on.
+const heapRefreshInterval = time.Second
+
+// valueIndexedShelf is implemented by shelves that can find their least valuable orders without a scan.
+type valueIndexedShelf interface {
+	// lowestValued returns up to n orders, least valuable first. Values are as of the last refresh, so the
+	// order may be slightly off, callers should check the current value of what they pick.
+	lowestValued(n int) []*Order
+}
+
+type heapEntry struct {
+	order *Order
+	value float64
+	index int
+}
+
+// orderHeap is a min-heap of orders by value, for container/heap.
+type orderHeap []*heapEntry
+
+func (h orderHeap) Len() int { return len(h) }
+
+func (h orderHeap) Less(i, j int) bool {
+	if h[i].value != h[j].value {
+		return h[i].value < h[j].value
+	}
+	return h[i].order.ID() < h[j].order.ID()
+}
+
+func (h orderHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *orderHeap) Push(x interface{}) {
+	entry := x.(*heapEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *orderHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// heapShelf is a staticShelf that also keeps its orders in a min-heap by value, so the least valuable order
+// can be found in O(log n) rather than a scan when evicting. Values change over time, at different rates per
+// order, so the heap is keyed on each order's value when it was placed and re-keyed at most every
+// heapRefreshInterval, when it's next queried.
+type heapShelf struct {
+	*staticShelf
+
+	// guarded by the staticShelf's lock
+	heap        orderHeap
+	entries     map[string]*heapEntry
+	refreshedAt time.Time
+}
+
+// NewHeapShelf returns a shelf that finds its least valuable orders without scanning them all.
+func NewHeapShelf(name string, capacity int, reserve int, supported []string, decayRate float64) Shelf {
+	return newHeapShelf(NewReservedStaticShelf(name, capacity, reserve, supported, decayRate).(*staticShelf))
+}
+
+func newHeapShelf(shelf *staticShelf) *heapShelf {
+	return &heapShelf{staticShelf: shelf, entries: make(map[string]*heapEntry, shelf.capacity)}
+}
+
+func (h *heapShelf) Put(o *Order) error {
+	return h.put(o, false)
+}
+
+func (h *heapShelf) PutForced(o *Order) error {
+	return h.put(o, true)
+}
+
+// put keys the order on its value as of now. Orders are only put on a shelf by setShelf, which holds the
+// order's lock, so the value is read without taking it.
+func (h *heapShelf) put(o *Order, forced bool) error {
+	h.Lock()
+	defer h.Unlock()
+	added, err := h.unsafePut(o, forced)
+	if added {
+		h.unsafePush(o)
+	}
+	return err
+}
+
+func (h *heapShelf) PutBatch(orders []*Order) int {
+	h.Lock()
+	defer h.Unlock()
+	for i, o := range orders {
+		added, err := h.unsafePut(o, false)
+		if err != nil {
+			return i
+		}
+		if added {
+			h.unsafePush(o)
+		}
+	}
+	return len(orders)
+}
+
+// unsafe push, keys the order on its value as of now
+func (h *heapShelf) unsafePush(o *Order) {
+	entry := &heapEntry{order: o, value: o.value(o.now())}
+	heap.Push(&h.heap, entry)
+	h.entries[o.ID()] = entry
+}
+
+func (h *heapShelf) Remove(orderID string) error {
+	h.Lock()
+	defer h.Unlock()
+	if err := h.unsafeRemove(orderID); err != nil {
+		return err
+	}
+	heap.Remove(&h.heap, h.entries[orderID].index)
+	delete(h.entries, orderID)
+	return nil
+}
+
+func (h *heapShelf) lowestValued(n int) []*Order {
+	h.refresh()
+	h.Lock()
+	defer h.Unlock()
+	// pop the lowest n and put them back, O(n log size)
+	popped := make([]*heapEntry, 0, n)
+	for len(popped) < n && h.heap.Len() > 0 {
+		popped = append(popped, heap.Pop(&h.heap).(*heapEntry))
+	}
+	orders := make([]*Order, len(popped))
+	for i, entry := range popped {
+		orders[i] = entry.order
+		heap.Push(&h.heap, entry)
+	}
+	return orders
+}
+
+// refresh re-keys the heap on current values, if it's due. Values are computed without the shelf lock, order
+// locks are always taken before shelf locks.
+func (h *heapShelf) refresh() {
+	h.RLock()
+	due := h.now().Sub(h.refreshedAt) >= heapRefreshInterval
+	var entries []*heapEntry
+	if due {
+		entries = make([]*heapEntry, 0, len(h.heap))
+		entries = append(entries, h.heap...)
+	}
+	h.RUnlock()
+	if !due {
+		return
+	}
+
+	values := make([]float64, len(entries))
+	for i, entry := range entries {
+		values[i] = entry.order.Value()
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	for i, entry := range entries {
+		// skip orders removed in the meantime
+		if h.entries[entry.order.ID()] == entry {
+			entry.value = values[i]
+		}
+	}
+	heap.Init(&h.heap)
+	h.refreshedAt = h.now()
+}
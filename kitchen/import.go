@@ -0,0 +1,116 @@
+package kitchen
+
+import (
+	"fmt"
+	"time"
+)
+
+// OrderImport describes an order to place directly on a shelf in a given state, see Kitchen.Import.
+type OrderImport struct {
+	Order *Order
+	// State is Ready or Enroute, the states orders are on a shelf in
+	State OrderState
+	Shelf string
+	// Timestamps of the transitions the order has been through, those that are zero default to the time of
+	// the import. ReadyAt in the past imports an order that's already aged, EnrouteAt is only used if the
+	// State is Enroute.
+	CreatedAt time.Time
+	ReadyAt   time.Time
+	EnrouteAt time.Time
+}
+
+// ImportError is returned by Import when an order can't be imported. Orders before it were imported.
+type ImportError struct {
+	Index   int
+	OrderID string
+	Err     error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("order %d (%s): %v", e.Index, e.OrderID, e.Err)
+}
+
+// validateImport checks what can be checked before anything is imported.
+func (k *Kitchen) validateImport(imp OrderImport) error {
+	switch imp.State {
+	case Ready, Enroute:
+	default:
+		return fmt.Errorf("can't import an order in state %q, only ready or enroute", imp.State)
+	}
+	shelf := k.shelf(imp.Shelf)
+	if shelf == nil {
+		return ErrUnknownShelf
+	}
+	if !supportsAny(shelf, imp.Order.Temps()) {
+		return ErrUnsupportedTemp
+	}
+	return nil
+}
+
+// Import places orders directly on the given shelves in the given states, skipping cooking and placement, e.g.
+// to reproduce the kitchen during an incident. Every order is validated before any is imported, so an unknown
+// shelf or state imports nothing. The orders are then imported in turn, and the first that can't be, because
+// its ID is already live, its shelf is full or the kitchen is at max_total_orders, stops the import with an
+// *ImportError wrapping ErrDuplicateID, ErrShelfFull or ErrKitchenFull. Shelves' reserves may be used.
+func (k *Kitchen) Import(imports []OrderImport) error {
+	seen := make(map[string]bool, len(imports))
+	for i, imp := range imports {
+		if err := k.validateImport(imp); err != nil {
+			return &ImportError{Index: i, OrderID: imp.Order.ID(), Err: err}
+		}
+		if seen[imp.Order.ID()] {
+			return &ImportError{Index: i, OrderID: imp.Order.ID(), Err: ErrDuplicateID}
+		}
+		seen[imp.Order.ID()] = true
+	}
+	for i, imp := range imports {
+		if err := k.importOrder(imp); err != nil {
+			return &ImportError{Index: i, OrderID: imp.Order.ID(), Err: err}
+		}
+	}
+	return nil
+}
+
+func (k *Kitchen) importOrder(imp OrderImport) error {
+	if !k.reserveOrder() {
+		return ErrKitchenFull
+	}
+	order := imp.Order
+	if !k.claimID(order.id) {
+		k.unreserveOrder()
+		return ErrDuplicateID
+	}
+	// the topology may have changed since the import was validated
+	shelf := k.shelf(imp.Shelf)
+	if shelf == nil {
+		k.releaseID(order.id)
+		k.unreserveOrder()
+		return ErrUnknownShelf
+	}
+
+	order.Lock()
+	defer order.Unlock()
+	k.unsafeAdopt(order)
+	now := k.now()
+	order.createdAt = timeOr(imp.CreatedAt, now)
+	order.readyAt = timeOr(imp.ReadyAt, now)
+	if imp.State == Enroute {
+		order.enrouteAt = timeOr(imp.EnrouteAt, now)
+	}
+	if err := order.unsafeSetShelf(shelf, forcedPut(shelf)); err != nil {
+		k.releaseID(order.id)
+		k.unreserveOrder()
+		return ErrShelfFull
+	}
+	order.state = imp.State
+	order.publish("", imp.State)
+	return nil
+}
+
+// timeOr returns t, or def if t is zero.
+func timeOr(t time.Time, def time.Time) time.Time {
+	if t.IsZero() {
+		return def
+	}
+	return t
+}
@@ -1,273 +1,2071 @@
 package kitchen
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"math"
 	"math/rand"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/config"
 )
 
+var (
+	ErrOrderNotFound   = errors.New("order not found")
+	ErrUnknownShelf    = errors.New("unknown shelf")
+	ErrUnsupportedTemp = errors.New("shelf does not support the order's temp")
+	ErrShelfFull       = errors.New("shelf is at capacity")
+	ErrOverloaded      = errors.New("kitchen is overloaded, try again later")
+	ErrKitchenFull     = errors.New("kitchen is at its max total orders")
+	ErrDuplicateID     = errors.New("order ID is already used by a live order")
+	ErrUnknownState    = errors.New("orders can only be moved to ready, enroute or pickedup")
+	ErrReheatLimit     = errors.New("order has been reheated the max number of times")
+	ErrInvalidCapacity = errors.New("capacity must be at least the shelf's reserve")
+	ErrNotResizable    = errors.New("shelf's capacity can't be changed")
+	ErrShelfSnapshot   = errors.New("shelf of a cloned order is a read-only copy")
+	ErrShelfRemoved    = errors.New("shelf was removed from the topology")
+	ErrNotAdmitted     = errors.New("shelf's admission rules or the order's affinity don't allow it there")
+	ErrEmptyTopology   = errors.New("kitchen has no shelves, check the config's topology")
+)
+
 // Kitchen is the stateful dispatcher and the entry point for other packages. There is only
 // a single instance of Kitchen in the application.
 type Kitchen struct {
+	// guards the topology below, which can be swapped at runtime by Reconfigure
+	sync.RWMutex
+
+	// tells kitchens in one process apart in logs, metrics and events, empty for a single kitchen
+	name string
+
 	// shelves are set at app start, these ds are optimizations
 	shelvesAsc     []Shelf // shelves from best decay to worse
 	shelvesDesc    []Shelf // shelves from worse decay to best
 	supportedIndex map[string][]Shelf
+	// shelves supporting each temp from best decay to worst, nil if any shelf's decay varies with a schedule
+	sortedIndex  map[string][]Shelf
+	shelfConfigs map[string]shelfConfig // the config each shelf was built from, keyed by name
+	// the fallback chain of each temp that has one, resolved from fallbacks against the topology
+	fallbackIndex map[string][]Shelf
+
+	// injected into every order the kitchen creates
+	valueFunc ValueFunc
+	// orders age in whole ticks of this long, zero is continuous
+	tick time.Duration
+	// the least every order decays per unit of age, zero is no floor. Copied into each order when it's created,
+	// and fixed at startup, a reload doesn't change it.
+	minDecay float64
+	// guards defaultDecayRates and preferences, which Reconfigure replaces. Ranking reads them with or without
+	// the kitchen lock held, so they have their own.
+	prefsLock sync.RWMutex
+	// base decay rate of orders created without one, by temp
+	defaultDecayRates map[string]float64
+	// rank of each preferred shelf by temp and shelf name, lower is preferred. Unlisted shelves rank after them.
+	preferences map[string]map[string]int
+	// shelf names by temp, the only shelves orders of the temp are placed on, in the order they're tried.
+	// Replaced on Reconfigure, under the kitchen lock.
+	fallbacks map[string][]string
+
+	// orders shelves with equal decay during placement
+	tieBreak tieBreak
+	// ranks the shelves a new order is placed on
+	placer Placer
+	// set when the placer ranks single temp orders without preferences the same as sortedIndex, so they can
+	// skip ranking
+	presorted bool
+
+	// the minimizer demotes orders below this normalized value to the worst shelf, zero disables
+	sacrificeBelow float64
+	// the minimizer leaves orders that have moved shelves this many times in place, zero is unbounded
+	maxShelfHops int
+
+	// when set, a new order that doesn't fit evicts the least valuable resident if it's worth more. admitLock
+	// serializes evictions so two newcomers can't claim the same slot.
+	evictLeastValuable bool
+	admitLock          sync.Mutex
+
+	// when set, shrinking a shelf below its occupancy trashes its least valuable orders rather than failing
+	evictOnShrink bool
+
+	// admission predicates by shelf name from WithShelfAdmission, added to the shelf's configured ones
+	shelfAdmission map[string][]AdmissionPredicate
+
+	// semaphore bounding concurrent creates, nil when unbounded
+	admission chan struct{}
+	// places concurrent creates of the same temp together, nil when they're placed one at a time
+	batcher *batcher
+
+	// orders that aren't picked up or trashed yet, accessed atomically. Creates are rejected once it reaches
+	// maxTotalOrders, zero is unbounded.
+	liveOrders     int64
+	maxTotalOrders int64
+
+	// IDs of the live orders, so a supplied ID can't be used twice at once
+	idsLock sync.Mutex
+	ids     map[string]struct{}
+	// when set, orders without a supplied ID are numbered in creation order instead of a random UUID
+	sequentialIDs bool
+	lastID        uint64
+
+	// every order transition is published here
+	events *eventBus
+	// and numbered here, see Changes
+	changes *changeLog
+
+	// how long orders spend in each state
+	metrics *lifecycleMetrics
+
+	// reused by every decayMinimizer pass to avoid allocating a slice per shelf, guarded by minimizerLock
+	minimizerLock sync.Mutex
+	minimizerBuf  []*Order
 
-	// used for time-travel during testing
-	now func() time.Time
+	// the most orders the minimizer moves at once, zero is one goroutine per order
+	minimizerParallelism int
+
+	// count of orders the minimizer panicked on, accessed atomically
+	minimizerErrors uint64
+	// the minimizer's current sleep between passes, zero if it isn't running, accessed atomically
+	minimizerInterval int64
+
+	// orders that are Created but not yet placed, keyed by ID, so the reaper can find them
+	pendingLock sync.Mutex
+	pending     map[string]*Order
+	reaper      reaperConfig
+
+	reheat reheatConfig
+
+	// closed by Close to stop the background loops, which are tracked by loops
+	done      chan struct{}
+	closeOnce sync.Once
+	loops     sync.WaitGroup
+
+	// used for time-travel during testing. clock is only set when injected with WithClock, in which case
+	// orders share it too.
+	now   func() time.Time
+	clock Clock
 }
 
 type kitchenConfig struct {
-	RunDecayMinimizer bool          `yaml:"minimize_decay"`
-	Topology          []shelfConfig `yaml:"topology"`
+	// Name labels the kitchen's logs, metrics and events, so several in one process can be told apart
+	Name              string          `yaml:"name"`
+	RunDecayMinimizer bool            `yaml:"minimize_decay"`
+	ValueFunction     string          `yaml:"value_function"`
+	DecayModel        string          `yaml:"decay_model"`
+	TieBreak          string          `yaml:"tie_break"`
+	Placer            string          `yaml:"placer"`
+	Overcommit        string          `yaml:"overcommit"`
+	ShrinkPolicy      string          `yaml:"shrink_policy"`
+	EmptyTopology     string          `yaml:"empty_topology"`
+	OrderIDs          string          `yaml:"order_ids"`
+	MaxTotalOrders    int             `yaml:"max_total_orders"`
+	MaxShelfHops      int             `yaml:"max_shelf_hops"`
+	MinDecay          float64         `yaml:"min_decay"`
+	Admission         admissionConfig `yaml:"admission"`
+	Minimizer         minimizerConfig `yaml:"minimizer"`
+	Reaper            reaperConfig    `yaml:"reaper"`
+	Reheat            reheatConfig    `yaml:"reheat"`
+	// base decay rate of orders created without one, by temp
+	DefaultDecayRates map[string]float64 `yaml:"default_decay_rates"`
+	// shelf names by temp, in the order orders of the temp prefer them over any others, whatever their decay
+	Preferences map[string][]string `yaml:"preferences"`
+	// shelf names by temp, the only shelves orders of the temp are placed on, tried in order before the order
+	// is trashed. Temps without a chain are placed on any shelf that supports them.
+	Fallbacks map[string][]string `yaml:"fallbacks"`
+	Topology  []shelfConfig       `yaml:"topology"`
+}
+
+type admissionConfig struct {
+	// MaxConcurrent is the max number of in-flight creates, zero is unbounded
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// MaxBatch is the most concurrent creates of the same temp placed on a shelf at once, see batcher. Zero
+	// places every create on its own.
+	MaxBatch int `yaml:"max_batch"`
+}
+
+type minimizerConfig struct {
+	// SacrificeBelow is the normalized value below which the minimizer moves an order to the worst shelf
+	// that will take it, freeing better shelves for fresher orders. Zero disables it.
+	SacrificeBelow float64 `yaml:"sacrifice_below"`
+	// MinInterval and MaxInterval bound the sleep between passes, see minimizerBackoff
+	MinInterval time.Duration `yaml:"min_interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	// BusyThreshold is the number of relocations in a pass above which the next pass comes sooner
+	BusyThreshold int `yaml:"busy_threshold"`
+	// Parallelism bounds the goroutines moving a shelf's orders at once, zero is one per order
+	Parallelism int `yaml:"parallelism"`
+}
+
+// reaperConfig bounds how long an order can sit in a state, regardless of its value. Zero disables a bound.
+type reaperConfig struct {
+	MaxCreated time.Duration `yaml:"max_created"`
+	MaxReady   time.Duration `yaml:"max_ready"`
 }
 
 type shelfConfig struct {
 	Name      string   `yaml:"name"`
 	Capacity  int      `yaml:"capacity"`
+	Reserve   int      `yaml:"reserve"` // capacity held back from new orders, only the minimizer can use it
+	Group     string   `yaml:"group"`   // orders can have an affinity or anti-affinity to a group
 	Supported []string `yaml:"supported"`
 	DecayRate float64  `yaml:"decay_rate"`
 	Type      string   `yaml:"type"`
+	// Schedule multiplies the decay rate during windows of the day, e.g. at peak hours
+	Schedule []scheduleConfig `yaml:"schedule"`
+	// Admission turns away orders the shelf otherwise supports, e.g. those worth too little
+	Admission shelfAdmissionConfig `yaml:"admission"`
 }
 
 // optimizePlacement will take an order and a set of shelves, attempting to place an order in an shelf that
-// is _atleast_ better with regard to decay.
+// is _atleast_ better with regard to decay, or that the order's temp prefers, see Preferences.
 func (k *Kitchen) optimizePlacement(order *Order, candidates []Shelf) bool {
 	// if order is expired, remove it
 	if order.IsExpired() {
-		order.TransitionOrder(order.State(), Trashed, func(o *Order) error { return nil })
+		k.trash(order, order.State(), TrashExpired)
+		return false
+	}
+
+	// a courier has been dispatched for this order, leave it where it is. checked again under the order's lock
+	// when it's moved, see unsafeSetShelf.
+	if order.State() == Enroute {
 		return false
 	}
 
 	currentShelf := order.Shelf()
-	orderType := order.Temp()
+	if currentShelf != nil && !k.canHop(order) {
+		return false
+	}
+	orderTypes := order.Temps()
+
+	// orders with a fallback chain walk it in order, whatever the candidates. new orders' candidates are
+	// ranked by the placer. when relocating, candidates are sorted by decay, put the preferred shelves first.
+	chain := k.fallbackChain(order)
+	if chain != nil {
+		candidates = chain
+	} else if currentShelf != nil && k.hasPreferences(order) {
+		candidates = append([]Shelf(nil), candidates...)
+		k.rankShelves(order, candidates)
+	}
 
 	// find shelf that supports this type, has capacity
 	for _, shelf := range candidates {
 		// check supported, as candidates may not be filtered already
-		for _, supported := range shelf.Supported() {
-			if orderType == supported {
-				// avoid trying to replace in current shelf
-				if currentShelf != nil && currentShelf == shelf {
-					continue
-				}
-
-				// if the new shelf is worse or equivalent, skip
-				if currentShelf != nil && currentShelf.Decay() <= shelf.Decay() {
-					continue
-				}
+		if !supportsAny(shelf, orderTypes) || !placeable(order, shelf) {
+			continue
+		}
 
-				// try to set new shelf and return if successful
-				err := order.SetShelf(shelf)
-				if err == nil {
-					return true
-				}
+		// avoid trying to replace in current shelf. the rest of a chain is worse, so stop there.
+		if currentShelf != nil && currentShelf == shelf {
+			if chain != nil {
+				break
 			}
+			continue
+		}
+
+		// if the new shelf is worse or equivalent, skip. every shelf earlier in a chain is better.
+		if currentShelf != nil && chain == nil && !k.prefers(order, shelf, currentShelf) {
+			continue
+		}
+
+		// try to set new shelf and return if successful. new orders respect the shelf's reserve, orders
+		// that are already placed may use it.
+		var err error
+		if currentShelf == nil {
+			err = order.SetShelf(shelf)
+		} else {
+			err = order.forceShelf(shelf)
+		}
+		if err == nil {
+			return true
 		}
 	}
 	return false
 }
 
-func (k *Kitchen) decayMinimizer() {
+// canHop returns true if the order can move to another shelf without exceeding max_shelf_hops.
+func (k *Kitchen) canHop(order *Order) bool {
+	return k.maxShelfHops <= 0 || order.Hops() < k.maxShelfHops
+}
+
+// sacrifice moves an order that's nearly worthless onto the worst shelf that will take it, returning true if
+// the order was moved or is already as low as it can go. Unlike optimizePlacement it never trashes an order,
+// expired orders are left for optimizePlacement to clean up.
+func (k *Kitchen) sacrifice(order *Order, shelvesDesc []Shelf) bool {
+	if k.sacrificeBelow <= 0 || order.State() == Enroute || order.IsExpired() || !k.canHop(order) {
+		return false
+	}
+	if order.NormalizedValue() >= k.sacrificeBelow {
+		return false
+	}
+
+	currentShelf := order.Shelf()
+	if currentShelf == nil {
+		return false
+	}
+	chain := k.fallbackChain(order)
+	for _, shelf := range shelvesDesc {
+		if !supportsAny(shelf, order.Temps()) || !placeable(order, shelf) || !onChain(chain, shelf) {
+			continue
+		}
+		// only ever move down
+		if order.decayOn(shelf) <= order.decayOn(currentShelf) {
+			continue
+		}
+		if order.forceShelf(shelf) == nil {
+			return true
+		}
+	}
+	// nowhere worse to go, but don't let optimizePlacement move it back up either
+	return true
+}
+
+// MinimizerErrors returns the number of times the decay minimizer recovered from a panic while moving an order.
+func (k *Kitchen) MinimizerErrors() uint64 {
+	return atomic.LoadUint64(&k.minimizerErrors)
+}
+
+// defaultRetryAfter is RetryAfter when the minimizer isn't running, how often the reaper runs.
+const defaultRetryAfter = time.Second
+
+// RetryAfter estimates how long until a create rejected with ErrKitchenFull or ErrOverloaded could succeed.
+// Room is mostly made by the minimizer trashing expired orders, so it's the time until the next pass.
+func (k *Kitchen) RetryAfter() time.Duration {
+	if interval := atomic.LoadInt64(&k.minimizerInterval); interval > 0 {
+		return time.Duration(interval)
+	}
+	return defaultRetryAfter
+}
+
+// decayMinimizer runs a single pass, returning how full each shelf was before and after it and how many
+// orders it moved.
+func (k *Kitchen) decayMinimizer() MinimizerReport {
+	k.minimizerLock.Lock()
+	defer k.minimizerLock.Unlock()
+	shelvesAsc, shelvesDesc := k.shelves()
+
+	report := MinimizerReport{Shelves: make(map[string]ShelfReport, len(shelvesAsc))}
+	for _, shelf := range shelvesAsc {
+		report.Shelves[shelf.Name()] = ShelfReport{Capacity: shelf.Capacity(), Before: len(shelf.Orders())}
+	}
+	// guards report, the orders of each shelf are moved concurrently
+	var reportLock sync.Mutex
+
+	move := func(order *Order) {
+		// a misbehaving shelf shouldn't take down the process, or the rest of the pass
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.AddUint64(&k.minimizerErrors, 1)
+				k.logf("decay minimizer: recovered from panic moving order %s: %v", order.ID(), r)
+			}
+		}()
+		before := order.Shelf()
+		if !k.sacrifice(order, shelvesDesc) {
+			k.optimizePlacement(order, shelvesAsc)
+		}
+		after := order.Shelf()
+		if after == before {
+			return
+		}
+		reportLock.Lock()
+		defer reportLock.Unlock()
+		report.Relocated++
+		report.moved(before, after)
+	}
+
 	// Start from worst shelves and try to move orders out.
 	// We use a WaitGroup to move each shelf at roughly the same time and to prevent
 	// potential liveness issues from constantly taking locks.
-	for _, shelf := range k.shelvesDesc {
+	for _, shelf := range shelvesDesc {
 		wg := sync.WaitGroup{}
 
-		orders := shelf.Orders()
-		// Start with the most decayed orders
-		sort.Slice(orders, func(i, j int) bool {
-			return orders[i].Decayed() > orders[j].Decayed()
-		})
+		// safe to reuse, the workers below are done with it before the next shelf
+		k.minimizerBuf = shelfOrdersInto(shelf, k.minimizerBuf)
+		orders := k.minimizerBuf
+		// Start with the most decayed orders, the same as shelfOrdersSorted(byDecayDesc) without the allocation
+		sortOrders(orders, byDecayDesc)
 
-		for _, o := range orders {
+		// one worker per order unless bounded. workers take the orders in turn, so the most decayed are
+		// still moved first.
+		workers := len(orders)
+		if k.minimizerParallelism > 0 && workers > k.minimizerParallelism {
+			workers = k.minimizerParallelism
+		}
+		next := int64(-1)
+		for w := 0; w < workers; w++ {
 			wg.Add(1)
-			go func(order *Order) {
+			go func() {
 				defer wg.Done()
-				k.optimizePlacement(order, k.shelvesAsc)
-			}(o)
+				for i := atomic.AddInt64(&next, 1); i < int64(len(orders)); i = atomic.AddInt64(&next, 1) {
+					move(orders[i])
+				}
+			}()
 		}
 		wg.Wait()
 	}
+	for _, shelf := range shelvesAsc {
+		shelfReport := report.Shelves[shelf.Name()]
+		shelfReport.After = len(shelf.Orders())
+		report.Shelves[shelf.Name()] = shelfReport
+	}
+	return report
 }
 
 func loadConfig(provider config.Provider) (kitchenConfig, error) {
-	var cfg kitchenConfig
+	cfg := kitchenConfig{
+		Minimizer: minimizerConfig{
+			MinInterval:   defaultMinInterval,
+			MaxInterval:   defaultMaxInterval,
+			BusyThreshold: defaultBusyThreshold,
+		},
+	}
 	err := provider.Get("kitchen").Populate(&cfg)
-	return cfg, err
-}
-
-func buildShelf(cfg shelfConfig) Shelf {
-	switch strings.ToLower(cfg.Type) {
-	// static is the default type
-	case "static":
-	default:
-		return NewStaticShelf(cfg.Name, cfg.Capacity, cfg.Supported, cfg.DecayRate)
+	if err != nil {
+		return cfg, err
 	}
-	return nil
-}
-
-func buildTopology(cfg kitchenConfig) ([]Shelf, map[string][]Shelf) {
-	shelves := make([]Shelf, 0)
-	index := make(map[string][]Shelf, 0)
+	supportedTemps := make(map[string]map[string]bool, len(cfg.Topology))
 	for _, s := range cfg.Topology {
-		shelf := buildShelf(s)
-		if shelf == nil {
-			continue
+		supportedTemps[s.Name] = make(map[string]bool, len(s.Supported))
+		for _, temp := range s.Supported {
+			supportedTemps[s.Name][temp] = true
 		}
-		for _, supported := range shelf.Supported() {
-			index[supported] = append(index[supported], shelf)
+	}
+	if cfg.Minimizer.MinInterval <= 0 || cfg.Minimizer.MinInterval > cfg.Minimizer.MaxInterval {
+		return cfg, fmt.Errorf("minimizer: min_interval %s must be positive and at most max_interval %s",
+			cfg.Minimizer.MinInterval, cfg.Minimizer.MaxInterval)
+	}
+	for temp, shelves := range cfg.Fallbacks {
+		for _, name := range shelves {
+			supported, ok := supportedTemps[name]
+			if !ok {
+				return cfg, fmt.Errorf("fallbacks: %s falls back to unknown shelf %q", temp, name)
+			}
+			if !supported[temp] {
+				return cfg, fmt.Errorf("fallbacks: %s falls back to shelf %s, which doesn't support it", temp, name)
+			}
 		}
-		shelves = append(shelves, shelf)
 	}
-	return shelves, index
+	if cfg.MaxShelfHops < 0 {
+		return cfg, fmt.Errorf("max_shelf_hops %d must not be negative", cfg.MaxShelfHops)
+	}
+	if !validName(cfg.Name) {
+		return cfg, fmt.Errorf("name %q must be letters, digits and underscores, not starting with a digit", cfg.Name)
+	}
+	if cfg.MinDecay < 0 {
+		return cfg, fmt.Errorf("min_decay %v must not be negative", cfg.MinDecay)
+	}
+	if cfg.Admission.MaxBatch < 0 {
+		return cfg, fmt.Errorf("admission: max_batch %d must not be negative", cfg.Admission.MaxBatch)
+	}
+	if cfg.Minimizer.Parallelism < 0 {
+		return cfg, fmt.Errorf("minimizer: parallelism %d must not be negative", cfg.Minimizer.Parallelism)
+	}
+	if err := cfg.Reheat.validate(); err != nil {
+		return cfg, err
+	}
+	for temp, rate := range cfg.DefaultDecayRates {
+		if rate < 0 {
+			return cfg, fmt.Errorf("default_decay_rates: %s rate %v must not be negative", temp, rate)
+		}
+	}
+	names := make(map[string]bool, len(cfg.Topology))
+	for _, s := range cfg.Topology {
+		names[s.Name] = true
+	}
+	for temp, shelves := range cfg.Preferences {
+		for _, name := range shelves {
+			if !names[name] {
+				return cfg, fmt.Errorf("preferences: %s prefers unknown shelf %q", temp, name)
+			}
+		}
+	}
+	for _, s := range cfg.Topology {
+		if s.Reserve < 0 || s.Reserve > s.Capacity {
+			return cfg, fmt.Errorf("shelf %s: reserve %d must be between 0 and capacity %d", s.Name, s.Reserve, s.Capacity)
+		}
+		if _, err := parseSchedule(s.Schedule); err != nil {
+			return cfg, fmt.Errorf("shelf %s: %v", s.Name, err)
+		}
+		if _, err := s.Admission.predicates(); err != nil {
+			return cfg, fmt.Errorf("shelf %s: %v", s.Name, err)
+		}
+		switch strings.ToLower(s.Type) {
+		case "", "static", "heap":
+		default:
+			return cfg, fmt.Errorf("shelf %s: unknown type %q", s.Name, s.Type)
+		}
+	}
+	return cfg, nil
 }
 
-func NewKitchen(provider config.Provider) (*Kitchen, error) {
-	cfg, err := loadConfig(provider)
-	if err != nil {
-		return nil, err
+func buildValueFunc(name string) (ValueFunc, error) {
+	switch strings.ToLower(name) {
+	// linear is the default
+	case "", "linear":
+		return LinearValue, nil
+	case "step":
+		return StepValue, nil
 	}
+	return nil, fmt.Errorf("unknown value function %q", name)
+}
 
-	shelves, index := buildTopology(cfg)
+// shelfRank is what a tieBreak can see of a shelf. It's computed once per placement so the tie-break doesn't
+// take shelf locks while sorting.
+type shelfRank struct {
+	shelf      Shelf
+	preference int
+	decay      float64
+	free       int
+	capacity   int
+}
 
-	// copy the underlying data into a new slice
-	shelvesAsc := make([]Shelf, len(shelves))
-	shelvesDesc := make([]Shelf, len(shelves))
-	copy(shelvesAsc, shelves)
-	copy(shelvesDesc, shelves)
+// load is the fraction of the shelf in use, a shelf without capacity is fully loaded.
+func (r shelfRank) load() float64 {
+	if r.capacity <= 0 {
+		return 1
+	}
+	return float64(r.capacity-r.free) / float64(r.capacity)
+}
 
-	// sort by decay asc
-	sort.Slice(shelvesAsc, func(i, j int) bool {
-		return shelvesAsc[i].Decay() < shelvesAsc[j].Decay()
-	})
+// tieBreak returns true if a should be preferred over b, when an order decays equally on both.
+type tieBreak func(a, b shelfRank) bool
 
-	// sort by decay desc
-	sort.Slice(shelvesDesc, func(i, j int) bool {
-		return shelvesDesc[i].Decay() > shelvesDesc[j].Decay()
-	})
+// byName prefers shelves in name order, so placement is reproducible.
+func byName(a, b shelfRank) bool {
+	return a.shelf.Name() < b.shelf.Name()
+}
 
-	k := &Kitchen{}
-	k.supportedIndex = index
-	k.shelvesAsc = shelvesAsc
-	k.shelvesDesc = shelvesDesc
-	k.now = time.Now
+// byFreeCapacity prefers the shelf with the most free slots, leaving the fuller shelf room for orders that
+// can't go elsewhere. Ties fall back to name order.
+func byFreeCapacity(a, b shelfRank) bool {
+	if a.free != b.free {
+		return a.free > b.free
+	}
+	return byName(a, b)
+}
 
-	if cfg.RunDecayMinimizer {
-		go func() {
-			for {
-				k.decayMinimizer()
-				// inject jitter
-				jitter := time.Duration(rand.Float64()) + time.Second
-				time.Sleep(jitter)
+func buildTieBreak(name string) (tieBreak, error) {
+	switch strings.ToLower(name) {
+	// name is the default
+	case "", "name":
+		return byName, nil
+	case "free_capacity":
+		return byFreeCapacity, nil
+	}
+	return nil, fmt.Errorf("unknown tie break %q", name)
+}
+
+// buildFallbacks resolves each temp's fallback chain against the shelves, skipping shelves that aren't in the
+// topology anymore.
+func buildFallbacks(fallbacks map[string][]string, shelves []Shelf) map[string][]Shelf {
+	byName := make(map[string]Shelf, len(shelves))
+	for _, shelf := range shelves {
+		byName[shelf.Name()] = shelf
+	}
+	index := make(map[string][]Shelf, len(fallbacks))
+	for temp, names := range fallbacks {
+		chain := make([]Shelf, 0, len(names))
+		for _, name := range names {
+			if shelf, ok := byName[name]; ok {
+				chain = append(chain, shelf)
 			}
-		}()
+		}
+		index[temp] = chain
 	}
+	return index
+}
 
-	return k, nil
+// fallbackChain returns the fallback chain of the order's first temp that has one, or nil if none do. The
+// chain is shared, so it must not be modified.
+func (k *Kitchen) fallbackChain(order *Order) []Shelf {
+	k.RLock()
+	defer k.RUnlock()
+	return k.unsafeFallbackChain(order)
 }
 
-func getOrder(orderID string, shelf Shelf, results chan *Order) {
-	order, _ := shelf.Get(orderID)
-	results <- order
+// unsafe fallbackChain
+func (k *Kitchen) unsafeFallbackChain(order *Order) []Shelf {
+	for _, temp := range order.Temps() {
+		if chain, ok := k.fallbackIndex[temp]; ok {
+			return chain
+		}
+	}
+	return nil
 }
 
-func (k *Kitchen) GetOrder(orderID string) *Order {
-	// scatter gather to all shelves
-	results := make(chan *Order)
-	sent := len(k.shelvesAsc)
-	received := 0
-	for _, s := range k.shelvesAsc {
-		go getOrder(orderID, s, results)
+// onChain returns true if the shelf is on the fallback chain, or there is no chain.
+func onChain(chain []Shelf, shelf Shelf) bool {
+	if chain == nil {
+		return true
 	}
-	for {
-		select {
-		case o := <-results:
-			received++
-			// if not nil, return fast
-			if o != nil {
-				return o
-			}
+	for _, s := range chain {
+		if s == shelf {
+			return true
 		}
-		// if all came back nil, return nil
-		if received == sent {
-			close(results)
-			return nil
+	}
+	return false
+}
+
+// buildPreferences indexes each temp's preferred shelves by name.
+func buildPreferences(preferences map[string][]string) map[string]map[string]int {
+	index := make(map[string]map[string]int, len(preferences))
+	for temp, shelves := range preferences {
+		index[temp] = make(map[string]int, len(shelves))
+		for i, name := range shelves {
+			if _, dup := index[temp][name]; !dup {
+				index[temp][name] = i
+			}
 		}
 	}
+	return index
 }
 
-func (k *Kitchen) GetOrders() []*Order {
-	orders := make([]*Order, 0)
-	for _, shelf := range k.shelvesAsc {
-		for _, o := range shelf.Orders() {
-			orders = append(orders, o)
+// preferenceOf returns the order's preference for the shelf, lower is preferred. The preferences of the order's
+// first temp that has any are used. Shelves that aren't preferred, and every shelf for orders without
+// preferences, rank last and equal, so they fall back to decay.
+func (k *Kitchen) preferenceOf(order *Order, shelf Shelf) int {
+	k.prefsLock.RLock()
+	defer k.prefsLock.RUnlock()
+	for _, temp := range order.Temps() {
+		if prefs, ok := k.preferences[temp]; ok {
+			if rank, ok := prefs[shelf.Name()]; ok {
+				return rank
+			}
+			return math.MaxInt32
 		}
 	}
-	return orders
+	return math.MaxInt32
 }
 
-func (k *Kitchen) CreateOrder(order *Order) error {
-	// move to order into created state
-	order.TransitionOrder("", Created, func(o *Order) error {
-		o.createdAt = k.now()
-		return nil
-	})
-	// ... sleep for cook time
-	return k.SetOrderReady(order)
+// hasPreferences returns true if any of the order's temps prefer shelves.
+func (k *Kitchen) hasPreferences(order *Order) bool {
+	k.prefsLock.RLock()
+	defer k.prefsLock.RUnlock()
+	for _, temp := range order.Temps() {
+		if _, ok := k.preferences[temp]; ok {
+			return true
+		}
+	}
+	return false
 }
 
-func (k *Kitchen) SetOrderReady(order *Order) error {
-	supported, exists := k.supportedIndex[order.Temp()]
-	if !exists {
-		order.TransitionOrder(Created, Trashed, func(o *Order) error {
-			o.state = Trashed
-			o.trashedAt = k.now()
-			removeOrder(order)
-			return nil
-		})
-		return errors.New("no shelves available for this order type")
+// prefers returns true if the order is better off on shelf a than b: a is preferred, or they're preferred equally
+// and the order decays slower on a.
+func (k *Kitchen) prefers(order *Order, a, b Shelf) bool {
+	if pa, pb := k.preferenceOf(order, a), k.preferenceOf(order, b); pa != pb {
+		return pa < pb
 	}
+	return order.decayOn(a) < order.decayOn(b)
+}
 
-	// sort by decay
-	sort.Slice(supported, func(i, j int) bool {
-		return supported[i].Decay() < supported[j].Decay()
+// rankShelves sorts shelves in place from best to worst for the order: its preferred shelves first, then by
+// decay, using the kitchen's tie-break for shelves with equal decay.
+func (k *Kitchen) rankShelves(order *Order, shelves []Shelf) {
+	k.rankShelvesBy(order, shelves, func(a, b shelfRank) bool {
+		if a.decay != b.decay {
+			return a.decay < b.decay
+		}
+		return k.tieBreak(a, b)
 	})
+}
 
-	// try to place on a shelf
-	if k.optimizePlacement(order, supported) {
-		order.TransitionOrder(Created, Ready, func(o *Order) error {
-			o.readyAt = k.now()
-			return nil
-		})
-		return nil
+// rankShelvesBy sorts shelves in place with the order's preferred shelves first, then by less.
+func (k *Kitchen) rankShelvesBy(order *Order, shelves []Shelf, less func(a, b shelfRank) bool) {
+	ranks := make([]shelfRank, len(shelves))
+	for i, shelf := range shelves {
+		capacity := shelf.Capacity()
+		ranks[i] = shelfRank{
+			shelf:      shelf,
+			preference: k.preferenceOf(order, shelf),
+			decay:      order.decayOn(shelf),
+			free:       capacity - len(shelf.Orders()),
+			capacity:   capacity,
+		}
 	}
-
-	// log not placed, discard
-	order.TransitionOrder(Created, Trashed, func(o *Order) error {
-		o.trashedAt = k.now()
-		removeOrder(order)
-		return nil
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].preference != ranks[j].preference {
+			return ranks[i].preference < ranks[j].preference
+		}
+		return less(ranks[i], ranks[j])
 	})
+	for i, rank := range ranks {
+		shelves[i] = rank.shelf
+	}
+}
 
-	return errors.New("failed to place order on a valid shelf")
+// buildShelf returns the shelf for the config, which must have been validated by loadConfig. now is the
+// kitchen's clock, for shelves with a decay schedule, and admission is checked after the config's predicates.
+func buildShelf(cfg shelfConfig, now func() time.Time, admission []AdmissionPredicate) Shelf {
+	shelf := NewReservedStaticShelf(cfg.Name, cfg.Capacity, cfg.Reserve, cfg.Supported, cfg.DecayRate).(*staticShelf)
+	shelf.group = cfg.Group
+	shelf.schedule, _ = parseSchedule(cfg.Schedule)
+	shelf.now = now
+	shelf.admission, _ = cfg.Admission.predicates()
+	shelf.admission = append(shelf.admission, admission...)
+	switch strings.ToLower(cfg.Type) {
+	case "heap":
+		return newHeapShelf(shelf)
+	}
+	// static is the default type
+	return shelf
 }
 
-func (k *Kitchen) SetOrderEnroute(order *Order) error {
-	return order.TransitionOrder(Ready, Enroute, func(o *Order) error {
-		o.enrouteAt = k.now()
-		return nil
-	})
+func buildIndex(shelves []Shelf) map[string][]Shelf {
+	index := make(map[string][]Shelf, 0)
+	for _, shelf := range shelves {
+		for _, supported := range shelf.Supported() {
+			index[supported] = append(index[supported], shelf)
+		}
+	}
+	return index
 }
 
-func (k *Kitchen) SetOrderPickedUp(order *Order) error {
+// setTopology rebuilds the sorted shelves and index. The caller must hold the kitchen lock.
+func (k *Kitchen) setTopology(shelves []Shelf, configs map[string]shelfConfig) {
+	// copy the underlying data into a new slice
+	shelvesAsc := make([]Shelf, len(shelves))
+	shelvesDesc := make([]Shelf, len(shelves))
+	copy(shelvesAsc, shelves)
+	copy(shelvesDesc, shelves)
+
+	// sort by decay asc, then name so equal shelves are always visited in the same order
+	sort.Slice(shelvesAsc, func(i, j int) bool {
+		if shelvesAsc[i].Decay() != shelvesAsc[j].Decay() {
+			return shelvesAsc[i].Decay() < shelvesAsc[j].Decay()
+		}
+		return shelvesAsc[i].Name() < shelvesAsc[j].Name()
+	})
+
+	// sort by decay desc
+	sort.Slice(shelvesDesc, func(i, j int) bool {
+		if shelvesDesc[i].Decay() != shelvesDesc[j].Decay() {
+			return shelvesDesc[i].Decay() > shelvesDesc[j].Decay()
+		}
+		return shelvesDesc[i].Name() > shelvesDesc[j].Name()
+	})
+
+	k.supportedIndex = buildIndex(shelves)
+	k.sortedIndex = buildIndex(shelvesAsc)
+	k.fallbackIndex = buildFallbacks(k.fallbacks, shelves)
+	for _, cfg := range configs {
+		if len(cfg.Schedule) > 0 {
+			k.sortedIndex = nil
+			break
+		}
+	}
+	k.shelvesAsc = shelvesAsc
+	k.shelvesDesc = shelvesDesc
+	k.shelfConfigs = configs
+}
+
+// shelves returns the current topology sorted by decay, ascending and descending. The slices are
+// replaced, never mutated, on Reconfigure so they're safe to use after the lock is released.
+func (k *Kitchen) shelves() ([]Shelf, []Shelf) {
+	k.RLock()
+	defer k.RUnlock()
+	return k.shelvesAsc, k.shelvesDesc
+}
+
+func NewKitchen(provider config.Provider, opts ...KitchenOption) (*Kitchen, error) {
+	cfg, err := loadConfig(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	// options are applied first, shelves with a decay schedule need the clock and shelf admission predicates
+	k := &Kitchen{now: time.Now, name: cfg.Name}
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	shelves := make([]Shelf, 0)
+	configs := make(map[string]shelfConfig, 0)
+	for _, s := range cfg.Topology {
+		shelf := buildShelf(s, k.now, k.shelfAdmission[s.Name])
+		if shelf == nil {
+			continue
+		}
+		shelves = append(shelves, shelf)
+		configs[s.Name] = s
+	}
+
+	valueFunc, err := buildValueFunc(cfg.ValueFunction)
+	if err != nil {
+		return nil, err
+	}
+
+	tieBreak, err := buildTieBreak(cfg.TieBreak)
+	if err != nil {
+		return nil, err
+	}
+
+	placer, err := buildPlacer(cfg.Placer, k)
+	if err != nil {
+		return nil, err
+	}
+
+	var evictLeastValuable bool
+	switch strings.ToLower(cfg.Overcommit) {
+	// trash the newcomer by default
+	case "", "trash_newcomer":
+	case "evict_least_valuable":
+		evictLeastValuable = true
+	default:
+		return nil, fmt.Errorf("unknown overcommit strategy %q", cfg.Overcommit)
+	}
+
+	if err := k.checkTopology(cfg); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(cfg.ShrinkPolicy) {
+	// refuse to shrink a shelf below its occupancy by default
+	case "", "reject":
+	case "evict_least_valuable":
+		k.evictOnShrink = true
+	default:
+		return nil, fmt.Errorf("unknown shrink_policy %q, expected reject or evict_least_valuable", cfg.ShrinkPolicy)
+	}
+
+	switch strings.ToLower(cfg.DecayModel) {
+	// decay accrues continuously by default
+	case "", "continuous":
+	case "discrete":
+		k.tick = time.Second
+	default:
+		return nil, fmt.Errorf("unknown decay_model %q, expected continuous or discrete", cfg.DecayModel)
+	}
+
+	switch strings.ToLower(cfg.OrderIDs) {
+	// random UUIDs by default
+	case "", "uuid":
+	case "sequential":
+		k.sequentialIDs = true
+	default:
+		return nil, fmt.Errorf("unknown order_ids %q", cfg.OrderIDs)
+	}
+
+	// chains are resolved against the topology
+	k.fallbacks = cfg.Fallbacks
+	k.setTopology(shelves, configs)
+	k.valueFunc = valueFunc
+	k.tieBreak = tieBreak
+	// a placer given by WithPlacer wins over the config
+	if k.placer == nil {
+		k.placer = placer
+	}
+	// greedy ranks by decay then name, the same as shelvesAsc
+	_, greedy := k.placer.(greedyPlacer)
+	tieBreakName := strings.ToLower(cfg.TieBreak)
+	k.presorted = greedy && (tieBreakName == "" || tieBreakName == "name")
+	k.sacrificeBelow = cfg.Minimizer.SacrificeBelow
+	k.minimizerParallelism = cfg.Minimizer.Parallelism
+	k.maxShelfHops = cfg.MaxShelfHops
+	k.minDecay = cfg.MinDecay
+	k.evictLeastValuable = evictLeastValuable
+	k.maxTotalOrders = int64(cfg.MaxTotalOrders)
+	k.pending = make(map[string]*Order)
+	k.ids = make(map[string]struct{})
+	k.reaper = cfg.Reaper
+	k.reheat = cfg.Reheat
+	k.defaultDecayRates = cfg.DefaultDecayRates
+	k.preferences = buildPreferences(cfg.Preferences)
+	k.events = newEventBus()
+	k.changes = newChangeLog()
+	k.metrics = newLifecycleMetrics()
+	if cfg.Admission.MaxConcurrent > 0 {
+		k.admission = make(chan struct{}, cfg.Admission.MaxConcurrent)
+	}
+	if cfg.Admission.MaxBatch > 0 {
+		k.batcher = newBatcher(k, cfg.Admission.MaxBatch)
+	}
+
+	k.done = make(chan struct{})
+	if cfg.RunDecayMinimizer {
+		backoff := newMinimizerBackoff(cfg.Minimizer)
+		k.minimizerInterval = int64(backoff.interval)
+		k.loop(func() time.Duration {
+			report := k.decayMinimizer()
+			k.logf("decay minimizer: %s", report)
+			interval := backoff.next(report.Relocated)
+			atomic.StoreInt64(&k.minimizerInterval, int64(interval))
+			// inject up to 10% jitter
+			return interval + time.Duration(rand.Int63n(int64(interval)/10+1))
+		})
+	}
+
+	if k.reaper.MaxCreated > 0 || k.reaper.MaxReady > 0 {
+		k.loop(func() time.Duration {
+			k.reap()
+			return time.Second
+		})
+	}
+
+	return k, nil
+}
+
+// checkTopology warns about a config without shelves, in which every order would be trashed, or returns
+// ErrEmptyTopology if empty_topology is error.
+func (k *Kitchen) checkTopology(cfg kitchenConfig) error {
+	var strict bool
+	switch strings.ToLower(cfg.EmptyTopology) {
+	// allowed with a warning by default
+	case "", "warn":
+	case "error":
+		strict = true
+	default:
+		return fmt.Errorf("unknown empty_topology %q, expected warn or error", cfg.EmptyTopology)
+	}
+	if len(cfg.Topology) > 0 {
+		return nil
+	}
+	if strict {
+		return ErrEmptyTopology
+	}
+	k.logf("warning: %v, every order will be trashed", ErrEmptyTopology)
+	return nil
+}
+
+// Name returns the kitchen's configured name, empty if it has none.
+func (k *Kitchen) Name() string {
+	return k.name
+}
+
+// validName returns true if name is empty or can prefix a metric name.
+func validName(name string) bool {
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// logf logs with the kitchen's name, if it has one.
+func (k *Kitchen) logf(format string, args ...interface{}) {
+	if k.name != "" {
+		format = "kitchen " + k.name + ": " + format
+	}
+	log.Printf(format, args...)
+}
+
+// loop runs fn in the background until the kitchen is closed, sleeping for as long as it returns in between.
+func (k *Kitchen) loop(fn func() time.Duration) {
+	k.loops.Add(1)
+	go func() {
+		defer k.loops.Done()
+		for {
+			timer := time.NewTimer(fn())
+			select {
+			case <-k.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+}
+
+// Close stops the kitchen's background work, the decay minimizer and the reaper, and waits for it to finish.
+// Orders are left where they are and can still be read and updated. Close is safe to call more than once.
+func (k *Kitchen) Close() error {
+	k.closeOnce.Do(func() {
+		close(k.done)
+	})
+	k.loops.Wait()
+	return nil
+}
+
+// Reset trashes every order, empties the shelves and zeroes the kitchen's counters and lifecycle metrics,
+// keeping its topology and config, e.g. to reuse one kitchen across the cases of a fuzz test instead of parsing
+// the config for each. The trashes are published to subscribers and the change log like any other, so versions
+// keep increasing. Reset waits for a running minimizer pass, but nothing else may create, update or move
+// orders until it returns.
+func (k *Kitchen) Reset() {
+	k.minimizerLock.Lock()
+	defer k.minimizerLock.Unlock()
+
+	for _, order := range k.pendingOrders() {
+		k.trash(order, Created, TrashReset)
+	}
+	// each trash takes its order off liveOrders, so the count drains to zero without being overwritten
+	for _, order := range k.allOrders() {
+		k.trash(order, order.State(), TrashReset)
+	}
+
+	atomic.StoreUint64(&k.lastID, 0)
+	atomic.StoreUint64(&k.minimizerErrors, 0)
+	k.idsLock.Lock()
+	k.ids = make(map[string]struct{})
+	k.idsLock.Unlock()
+	k.pendingLock.Lock()
+	k.pending = make(map[string]*Order)
+	k.pendingLock.Unlock()
+	k.metrics.reset()
+}
+
+// NewFromConfig returns a kitchen from a YAML config, in the same format as the files under config/, for
+// embedding the kitchen in another program without the server.
+func NewFromConfig(cfg []byte, opts ...KitchenOption) (*Kitchen, error) {
+	return NewKitchen(config.NewYAMLProviderFromBytes(cfg), opts...)
+}
+
+// Reconfigure applies a new topology to a running kitchen. Shelves whose config is unchanged keep their
+// orders, new shelves are added, and orders on removed (or changed) shelves are moved to the best remaining
+// shelf that supports them, or trashed if none fit. Removed shelves are closed, so creates in flight are placed
+// on the new topology rather than dropped. The fallbacks, preferences and default_decay_rates that go with
+// the topology are applied too, to orders placed from then on and, for default rates, orders created from then
+// on. The rest of the config is fixed when the kitchen is created.
+func (k *Kitchen) Reconfigure(provider config.Provider) error {
+	cfg, err := loadConfig(provider)
+	if err != nil {
+		return err
+	}
+	if err := k.checkTopology(cfg); err != nil {
+		return err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	// before the topology, which resolves the fallbacks against it
+	k.fallbacks = cfg.Fallbacks
+	k.prefsLock.Lock()
+	k.preferences = buildPreferences(cfg.Preferences)
+	k.defaultDecayRates = cfg.DefaultDecayRates
+	k.prefsLock.Unlock()
+
+	removed := make(map[string]Shelf, len(k.shelvesAsc))
+	for _, shelf := range k.shelvesAsc {
+		removed[shelf.Name()] = shelf
+	}
+
+	shelves := make([]Shelf, 0)
+	configs := make(map[string]shelfConfig, 0)
+	for _, s := range cfg.Topology {
+		shelf, exists := removed[s.Name]
+		if exists && reflect.DeepEqual(k.shelfConfigs[s.Name], s) {
+			// keep the existing shelf and its orders
+			delete(removed, s.Name)
+		} else {
+			shelf = buildShelf(s, k.now, k.shelfAdmission[s.Name])
+			if shelf == nil {
+				continue
+			}
+		}
+		shelves = append(shelves, shelf)
+		configs[s.Name] = s
+	}
+	k.setTopology(shelves, configs)
+
+	// creates and moves may have ranked the removed shelves before we took the lock. once closed, their puts
+	// fail and they rank the new topology instead, and anything put before then is listed below.
+	for _, shelf := range removed {
+		closeShelf(shelf)
+	}
+	// we still hold the kitchen lock, so nobody can look for these orders until they're rehomed
+	for _, shelf := range removed {
+		for _, order := range shelf.Orders() {
+			k.rehome(order)
+		}
+	}
+	return nil
+}
+
+// rehome moves an order off a shelf that is no longer in the topology, trashing it if no remaining shelf
+// can take it. Unlike optimizePlacement, the new shelf may be worse than the old one. The caller must hold
+// the kitchen lock.
+func (k *Kitchen) rehome(order *Order) {
+	chain := k.unsafeFallbackChain(order)
+	for _, shelf := range k.shelvesAsc {
+		if supportsAny(shelf, order.Temps()) && placeable(order, shelf) && onChain(chain, shelf) && order.forceShelf(shelf) == nil {
+			return
+		}
+	}
+	k.trash(order, order.State(), TrashShelfRemoved)
+}
+
+// Shelves returns the kitchen's shelves, sorted from best to worst decay.
+func (k *Kitchen) Shelves() []Shelf {
+	shelves, _ := k.shelves()
+	return shelves
+}
+
+// shelf returns the shelf with the given name, or nil if there is none.
+func (k *Kitchen) shelf(name string) Shelf {
+	shelves, _ := k.shelves()
+	for _, shelf := range shelves {
+		if shelf.Name() == name {
+			return shelf
+		}
+	}
+	return nil
+}
+
+// SetShelfCapacity changes the capacity of the named shelf while it's in use. Shrinking it below the orders
+// it holds returns ErrShelfFull, unless the shrink_policy is evict_least_valuable, in which case its least
+// valuable ready orders are trashed until it fits. Orders that are enroute are never trashed, so if they alone
+// keep the shelf over capacity ErrShelfFull is still returned, though the new capacity stands and the shelf
+// takes no more orders until they're picked up. The new capacity lasts until the shelf is next reloaded.
+func (k *Kitchen) SetShelfCapacity(name string, capacity int) error {
+	shelf := k.shelf(name)
+	if shelf == nil {
+		return ErrUnknownShelf
+	}
+	rs, ok := shelf.(resizableShelf)
+	if !ok {
+		return ErrNotResizable
+	}
+	if capacity < 0 || capacity < shelfReserve(shelf) {
+		return ErrInvalidCapacity
+	}
+	if err := rs.SetCapacity(capacity, k.evictOnShrink); err != nil {
+		return err
+	}
+
+	// keep the config in step, so a reload only rebuilds the shelf if its configured capacity differs
+	k.Lock()
+	if cfg, ok := k.shelfConfigs[name]; ok {
+		cfg.Capacity = capacity
+		k.shelfConfigs[name] = cfg
+	}
+	k.Unlock()
+
+	if k.evictOnShrink {
+		for _, order := range shelfOrdersSorted(shelf, byValueAsc) {
+			if len(shelf.Orders()) <= capacity {
+				break
+			}
+			// enroute, or gone since the sort, either way there's nothing to evict
+			if err := k.trash(order, Ready, TrashShelfResized); err != nil {
+				continue
+			}
+		}
+		if len(shelf.Orders()) > capacity {
+			return ErrShelfFull
+		}
+	}
+	return nil
+}
+
+// MoveOrder forces an order onto the named shelf, regardless of whether it's a better placement. Decay
+// accrued on the previous shelf is kept. The shelf must support the order's temp, or ErrUnsupportedTemp is
+// returned, and its admission predicates and the order's affinity must allow it, or ErrNotAdmitted is. An order a
+// courier is on the way for returns a *TransitionError.
+func (k *Kitchen) MoveOrder(orderID string, shelfName string) error {
+	order := k.findOrder(orderID)
+	if order == nil {
+		return ErrOrderNotFound
+	}
+	shelf := k.shelf(shelfName)
+	if shelf == nil {
+		return ErrUnknownShelf
+	}
+	if !supportsAny(shelf, order.Temps()) {
+		return ErrUnsupportedTemp
+	}
+	if !placeable(order, shelf) {
+		return ErrNotAdmitted
+	}
+	err := order.forceShelf(shelf)
+	if terr, ok := err.(*TransitionError); ok {
+		if terr.State == Enroute {
+			return terr
+		}
+		// picked up or trashed since it was found, so it has left the kitchen
+		return ErrOrderNotFound
+	}
+	if err == ErrShelfRemoved {
+		// removed by a reload since it was looked up
+		return ErrUnknownShelf
+	}
+	if err != nil {
+		return ErrShelfFull
+	}
+	return nil
+}
+
+// SetPriority changes the order's priority and re-evaluates its placement, returning a *TransitionError if
+// the order was picked up or trashed. A ready order moves to a better shelf if one has room, otherwise it swaps
+// shelves with the lowest priority order below its new priority on the best shelf it can, see swapShelves.
+// Lowering an order's priority never moves it, it just stops protecting the order's place.
+func (k *Kitchen) SetPriority(orderID string, priority int) (*Order, error) {
+	order := k.findOrder(orderID)
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	if err := order.setPriority(priority); err != nil {
+		return order, err
+	}
+	k.reprioritize(order)
+	return order, nil
+}
+
+// reprioritize moves a ready order to a better shelf, displacing a lower priority order if none has room. It
+// returns true if the order moved. Holding the minimizer lock keeps passes from moving either order midway, and
+// serializes swaps so they can't lock the same two orders in opposite orders.
+func (k *Kitchen) reprioritize(order *Order) bool {
+	k.minimizerLock.Lock()
+	defer k.minimizerLock.Unlock()
+	if order.State() != Ready {
+		return false
+	}
+	shelvesAsc, _ := k.shelves()
+	if k.optimizePlacement(order, shelvesAsc) {
+		return true
+	}
+
+	current := order.Shelf()
+	if current == nil {
+		return false
+	}
+	priority := order.Priority()
+	chain := k.fallbackChain(order)
+	for _, shelf := range shelvesAsc {
+		if !supportsAny(shelf, order.Temps()) || !placeable(order, shelf) || !onChain(chain, shelf) {
+			continue
+		}
+		// shelves are sorted best first, so nothing further is better either
+		if order.decayOn(shelf) >= order.decayOn(current) {
+			break
+		}
+		resident := lowestPriority(shelf, current, priority)
+		if resident == nil {
+			continue
+		}
+		moved, displaced := swapShelves(order, resident)
+		if displaced {
+			k.place(resident, shelvesAsc)
+		}
+		if moved {
+			return true
+		}
+	}
+	return false
+}
+
+// lowestPriority returns the ready order on the shelf with the lowest priority below the given one that could
+// take its place on dest, or nil if there is none. Ties go to the least valuable order.
+func lowestPriority(shelf Shelf, dest Shelf, below int) *Order {
+	var lowest *Order
+	var lowestPriority int
+	var lowestValue float64
+	for _, order := range shelf.Orders() {
+		if !supportsAny(dest, order.Temps()) || !placeable(order, dest) {
+			continue
+		}
+		order.RLock()
+		state, priority, value := order.state, order.priority, order.value(order.now())
+		order.RUnlock()
+		if state != Ready || priority >= below {
+			continue
+		}
+		if lowest == nil || priority < lowestPriority || priority == lowestPriority && value < lowestValue {
+			lowest, lowestPriority, lowestValue = order, priority, value
+		}
+	}
+	return lowest
+}
+
+// swapShelves moves order onto resident's shelf and resident onto order's old shelf. Both orders are locked for
+// the whole swap, so the caller must make sure no other swap can lock them in the opposite order. Moving resident
+// off its shelf frees a slot that a new order could take before order does, in which case order stays put.
+// Either way, resident can lose its slot too. displaced is true if it did and must be placed by the caller.
+func swapShelves(order *Order, resident *Order) (moved bool, displaced bool) {
+	order.Lock()
+	defer order.Unlock()
+	resident.Lock()
+	defer resident.Unlock()
+	if order.state != Ready || resident.state != Ready || order.shelf == nil || resident.shelf == nil {
+		return false, false
+	}
+	from, to := order.shelf, resident.shelf
+
+	removeOrder(resident)
+	moved = order.unsafeSetShelf(to, forcedPut(to)) == nil
+	dest := from
+	if !moved {
+		dest = to
+	}
+	displaced = resident.unsafeSetShelf(dest, forcedPut(dest)) != nil
+	return moved, displaced
+}
+
+// place puts an order that lost its shelf on the best shelf with room, trashing it if none has any.
+func (k *Kitchen) place(order *Order, shelvesAsc []Shelf) {
+	chain := k.fallbackChain(order)
+	for _, shelf := range shelvesAsc {
+		if supportsAny(shelf, order.Temps()) && placeable(order, shelf) && onChain(chain, shelf) && order.forceShelf(shelf) == nil {
+			return
+		}
+	}
+	k.trash(order, Ready, TrashNoCapacity)
+}
+
+// Subscribe returns a channel of every order transition in the kitchen, and a function to cancel the
+// subscription. Events are dropped if the subscriber falls too far behind.
+func (k *Kitchen) Subscribe() (<-chan OrderEvent, func()) {
+	ch := k.events.subscribe()
+	return ch, func() {
+		k.events.unsubscribe(ch)
+	}
+}
+
+// WaitForState blocks until the order reaches the target state or the context is done. If the order
+// reaches a different terminal state first, a TransitionError is returned. The order has to have been
+// created: ErrOrderNotFound is returned unless it's on a shelf, waiting to be placed, or among the recent
+// changes.
+func (k *Kitchen) WaitForState(ctx context.Context, orderID string, target OrderState) error {
+	// the change log wakes every waiter on each change, unlike the event bus it never drops one. take the
+	// signal before checking the state, so a transition in between isn't missed.
+	changed := k.changes.signal()
+	order := k.findOrder(orderID)
+	if order == nil {
+		k.pendingLock.Lock()
+		order = k.pending[orderID]
+		k.pendingLock.Unlock()
+	}
+	if order == nil {
+		order = k.changes.recent(orderID)
+	}
+	if order == nil {
+		return ErrOrderNotFound
+	}
+
+	for {
+		if err := checkState(orderID, order.State(), target); err != errNotYet {
+			return err
+		}
+		select {
+		case <-changed:
+			changed = k.changes.signal()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+var errNotYet = errors.New("order has not reached the target state")
+
+func checkState(orderID string, state OrderState, target OrderState) error {
+	if state == target {
+		return nil
+	}
+	switch state {
+	case PickedUp, Trashed:
+		return &TransitionError{OrderID: orderID, State: state, Expected: target}
+	}
+	return errNotYet
+}
+
+func getOrder(orderID string, shelf Shelf, results chan *Order) {
+	order, _ := shelf.Get(orderID)
+	results <- order
+}
+
+// GetOrder returns a clone of the order with the ID, or nil if it isn't on a shelf. See Order.Clone.
+func (k *Kitchen) GetOrder(orderID string) *Order {
+	order := k.findOrder(orderID)
+	if order == nil {
+		return nil
+	}
+	return order.Clone()
+}
+
+// GetOrders returns clones of every order on the shelves.
+func (k *Kitchen) GetOrders() []*Order {
+	return cloneAll(k.allOrders())
+}
+
+// cloneAll clones each of the orders, in place.
+func cloneAll(orders []*Order) []*Order {
+	for i, order := range orders {
+		orders[i] = order.Clone()
+	}
+	return orders
+}
+
+// findOrder returns the kitchen's own order with the ID, or nil if it isn't on a shelf.
+func (k *Kitchen) findOrder(orderID string) *Order {
+	shelves, _ := k.shelves()
+	// nothing would ever be received below
+	if len(shelves) == 0 {
+		return nil
+	}
+
+	// scatter gather to all shelves. results is buffered to the number of shelves so that
+	// stragglers can complete their send after we've returned on the first hit.
+	results := make(chan *Order, len(shelves))
+	sent := len(shelves)
+	received := 0
+	for _, s := range shelves {
+		go getOrder(orderID, s, results)
+	}
+	for {
+		select {
+		case o := <-results:
+			received++
+			// if not nil, return fast
+			if o != nil {
+				return o
+			}
+		}
+		// if all came back nil, return nil
+		if received == sent {
+			close(results)
+			return nil
+		}
+	}
+}
+
+// allOrders returns the kitchen's own orders on every shelf.
+func (k *Kitchen) allOrders() []*Order {
+	shelves, _ := k.shelves()
+	orders := make([]*Order, 0)
+	for _, shelf := range shelves {
+		for _, o := range shelf.Orders() {
+			orders = append(orders, o)
+		}
+	}
+	return orders
+}
+
+// ShelfInfo is a shelf's config and the orders on it, see ShelfByName.
+type ShelfInfo struct {
+	Name string
+	// Type is static or heap
+	Type      string
+	Group     string
+	Supported []string
+	Capacity  int
+	Reserve   int
+	// DecayRate is the configured rate, Decay the rate now, which the shelf's schedule may multiply
+	DecayRate float64
+	Decay     float64
+	// Orders are clones of the orders on the shelf, sorted by ID
+	Orders []*Order
+}
+
+// ShelfByName returns the named shelf's config and orders, or false if there is no such shelf. It's meant for
+// debugging, an order in the middle of a move is only listed under the shelf it ends up on.
+func (k *Kitchen) ShelfByName(name string) (ShelfInfo, bool) {
+	shelf := k.shelf(name)
+	if shelf == nil {
+		return ShelfInfo{}, false
+	}
+	k.RLock()
+	cfg := k.shelfConfigs[name]
+	k.RUnlock()
+	info := ShelfInfo{
+		Name:      shelf.Name(),
+		Type:      strings.ToLower(cfg.Type),
+		Group:     shelfGroup(shelf),
+		Supported: shelf.Supported(),
+		Capacity:  shelf.Capacity(),
+		Reserve:   shelfReserve(shelf),
+		DecayRate: cfg.DecayRate,
+		Decay:     shelf.Decay(),
+		Orders:    make([]*Order, 0),
+	}
+	if info.Type == "" {
+		info.Type = "static"
+	}
+	for _, order := range shelf.Orders() {
+		// blocks until an in-flight move has finished, it holds the order lock
+		if clone := order.Clone(); clone.shelf != nil && clone.shelf.Name() == name {
+			info.Orders = append(info.Orders, clone)
+		}
+	}
+	sort.Slice(info.Orders, func(i, j int) bool {
+		return info.Orders[i].ID() < info.Orders[j].ID()
+	})
+	return info, true
+}
+
+// OrdersByShelf returns clones of the orders on each shelf, keyed by shelf name. Every order appears exactly
+// once, even if it's being moved: shelves are listed together, then each order is filed under the shelf it's on
+// once any move it's in the middle of has finished. Every shelf in the topology has an entry, empty or not.
+func (k *Kitchen) OrdersByShelf() map[string][]*Order {
+	shelves, _ := k.shelves()
+	layout := make(map[string][]*Order, len(shelves))
+	for _, shelf := range shelves {
+		layout[shelf.Name()] = make([]*Order, 0)
+	}
+	seen := make(map[*Order]bool)
+	for _, orders := range listAtOnce(shelves) {
+		for _, order := range orders {
+			if seen[order] {
+				continue
+			}
+			seen[order] = true
+			// blocks until an in-flight move has finished, it holds the order lock
+			if clone := order.Clone(); clone.shelf != nil {
+				layout[clone.shelf.Name()] = append(layout[clone.shelf.Name()], clone)
+			}
+		}
+	}
+	return layout
+}
+
+// LeastValuableOrder returns a clone of the order with the lowest current value on any shelf supporting the temp, or nil
+// if there is none. The order itself may be of any temp, evicting it still frees a slot for the temp. Orders a courier is already on the way for can't be evicted and are skipped. Each order's
+// value is computed live, once, under its own lock.
+func (k *Kitchen) LeastValuableOrder(temp string) *Order {
+	least, _ := leastValuable(k.candidates([]string{temp}))
+	if least == nil {
+		return nil
+	}
+	return least.Clone()
+}
+
+// leastValuable returns the order that isn't enroute with the lowest current value on the shelves, and its
+// value. The order is nil if there is none. Shelves indexed by value only have their lowest few orders
+// checked, so their pick is as fresh as their index.
+func leastValuable(shelves []Shelf) (*Order, float64) {
+	var least *Order
+	var leastValue float64
+	for _, shelf := range shelves {
+		for _, order := range evictionCandidates(shelf) {
+			snapshot := order.ValueSnapshot()
+			if snapshot.State == Enroute {
+				continue
+			}
+			if least == nil || snapshot.Value < leastValue {
+				least = order
+				leastValue = snapshot.Value
+			}
+		}
+	}
+	return least, leastValue
+}
+
+// indexedCandidates is how many of its lowest valued orders an indexed shelf is asked for, enough that a few
+// of them being enroute doesn't force a scan.
+const indexedCandidates = 8
+
+// evictionCandidates returns the orders on the shelf that could be its least valuable.
+func evictionCandidates(shelf Shelf) []*Order {
+	indexed, ok := shelf.(valueIndexedShelf)
+	if !ok {
+		return shelf.Orders()
+	}
+	candidates := indexed.lowestValued(indexedCandidates)
+	if len(candidates) < indexedCandidates {
+		return candidates
+	}
+	for _, order := range candidates {
+		if order.State() != Enroute {
+			return candidates
+		}
+	}
+	// every candidate is enroute, fall back to a scan
+	return shelf.Orders()
+}
+
+// admit makes room for a new order that didn't fit on any of its shelves, by trashing the least valuable
+// order on those shelves if the newcomer is worth more. It returns true if the newcomer was placed.
+func (k *Kitchen) admit(order *Order, shelves []Shelf) bool {
+	k.admitLock.Lock()
+	defer k.admitLock.Unlock()
+
+	// another admit may have freed a slot while we waited
+	if k.optimizePlacement(order, shelves) {
+		return true
+	}
+
+	allowed := make([]Shelf, 0, len(shelves))
+	for _, shelf := range shelves {
+		if placeable(order, shelf) {
+			allowed = append(allowed, shelf)
+		}
+	}
+	for {
+		resident, residentValue := leastValuable(allowed)
+		if resident == nil || residentValue >= order.freshValue() {
+			return false
+		}
+		// if the resident was picked up in the meantime that frees a slot too. if it was dispatched it can't
+		// be evicted, and leastValuable skips it from now on, so look for another.
+		if err := k.trash(resident, Ready, TrashEvicted); err == nil || resident.State() != Enroute {
+			break
+		}
+	}
+	return k.optimizePlacement(order, shelves)
+}
+
+// CreateOrder moves a new order into the Created state and places it on a shelf. If the kitchen is
+// already handling its max number of concurrent creates, ErrOverloaded is returned and the order is
+// left untouched. Likewise ErrKitchenFull if it already holds max_total_orders live orders, even if the
+// order's shelves have room, and ErrDuplicateID if a live order already has the order's ID.
+func (k *Kitchen) CreateOrder(order *Order) error {
+	if k.admission != nil {
+		select {
+		case k.admission <- struct{}{}:
+			defer func() { <-k.admission }()
+		default:
+			return ErrOverloaded
+		}
+	}
+
+	if !k.reserveOrder() {
+		return ErrKitchenFull
+	}
+	if k.sequentialIDs && order.generatedID {
+		// skip numbers a live order was given as its ID by the caller
+		order.id = strconv.FormatUint(atomic.AddUint64(&k.lastID, 1), 10)
+		for !k.claimID(order.id) {
+			order.id = strconv.FormatUint(atomic.AddUint64(&k.lastID, 1), 10)
+		}
+	} else if !k.claimID(order.id) {
+		k.unreserveOrder()
+		return ErrDuplicateID
+	}
+	k.acceptOrder(order)
+	// ... sleep for cook time
+	return k.SetOrderReady(order)
+}
+
+// CreateOrderWithID is CreateOrder, with the given ID instead of the order's own. IDs only need to be unique
+// among live orders, ErrDuplicateID is returned if one already has it.
+func (k *Kitchen) CreateOrderWithID(id string, order *Order) error {
+	WithID(id)(order)
+	return k.CreateOrder(order)
+}
+
+// claimID reserves the ID for a new order, returning false if a live order already has it.
+func (k *Kitchen) claimID(id string) bool {
+	k.idsLock.Lock()
+	defer k.idsLock.Unlock()
+	if _, exists := k.ids[id]; exists {
+		return false
+	}
+	k.ids[id] = struct{}{}
+	return true
+}
+
+// releaseID frees the ID of an order that's no longer live for reuse.
+func (k *Kitchen) releaseID(id string) {
+	k.idsLock.Lock()
+	defer k.idsLock.Unlock()
+	delete(k.ids, id)
+}
+
+// acceptOrder moves an order into the Created state and tracks it until SetOrderReady.
+func (k *Kitchen) acceptOrder(order *Order) {
+	order.TransitionOrder("", Created, func(o *Order) error {
+		k.unsafeAdopt(o)
+		o.createdAt = k.now()
+		return nil
+	})
+	k.pendingLock.Lock()
+	k.pending[order.ID()] = order
+	k.pendingLock.Unlock()
+}
+
+// unsafeAdopt injects the kitchen's clock, value function and hooks into a new order. The caller must hold the
+// order's lock.
+func (k *Kitchen) unsafeAdopt(o *Order) {
+	if k.clock != nil {
+		o.now = k.clock.Now
+	}
+	o.valueFunc = k.valueFunc
+	o.tick = k.tick
+	o.minDecay = k.minDecay
+	o.kitchenID = k.name
+	o.onTransition = k.onTransition
+	o.onMove = k.changes.record
+	if o.baseDecayRate == 0 {
+		o.baseDecayRate = k.defaultDecayRate(o.temps)
+	}
+	for _, shelf := range k.candidates(o.temps) {
+		if o.allows(shelf) && shelf.Decay() > o.worstDecay {
+			o.worstDecay = shelf.Decay()
+		}
+	}
+}
+
+// defaultDecayRate returns the base decay rate for an order of the temps created without one, the highest of
+// their configured defaults, or zero if none have one.
+func (k *Kitchen) defaultDecayRate(temps []string) float64 {
+	k.prefsLock.RLock()
+	defer k.prefsLock.RUnlock()
+	rate := 0.0
+	for _, temp := range temps {
+		if r := k.defaultDecayRates[temp]; r > rate {
+			rate = r
+		}
+	}
+	return rate
+}
+
+// reserveOrder counts a new order towards the live orders, returning false if the kitchen is full.
+func (k *Kitchen) reserveOrder() bool {
+	if live := atomic.AddInt64(&k.liveOrders, 1); k.maxTotalOrders > 0 && live > k.maxTotalOrders {
+		atomic.AddInt64(&k.liveOrders, -1)
+		return false
+	}
+	return true
+}
+
+// unreserveOrder undoes reserveOrder, for an order that was picked up, trashed or never accepted.
+func (k *Kitchen) unreserveOrder() {
+	atomic.AddInt64(&k.liveOrders, -1)
+}
+
+// onTransition is called by every order the kitchen accepted after each of its transitions.
+func (k *Kitchen) onTransition(order *Order, event OrderEvent) {
+	switch event.NewState {
+	case PickedUp, Trashed:
+		// every way an order dies is observed, including the expiry a transition can turn into
+		k.metrics.observe(order)
+		k.unreserveOrder()
+		k.releaseID(event.OrderID)
+	}
+	k.changes.record(order)
+	k.events.publish(event)
+}
+
+// LiveOrders returns the number of orders that haven't been picked up or trashed yet.
+func (k *Kitchen) LiveOrders() int {
+	return int(atomic.LoadInt64(&k.liveOrders))
+}
+
+// pendingOrders returns the orders that are Created but not yet placed.
+func (k *Kitchen) pendingOrders() []*Order {
+	k.pendingLock.Lock()
+	defer k.pendingLock.Unlock()
+	orders := make([]*Order, 0, len(k.pending))
+	for _, order := range k.pending {
+		orders = append(orders, order)
+	}
+	return orders
+}
+
+// reap trashes orders that have sat in Created or Ready longer than the reaper allows, whatever their value.
+func (k *Kitchen) reap() {
+	now := k.now()
+	if k.reaper.MaxCreated > 0 {
+		for _, order := range k.pendingOrders() {
+			if now.Sub(order.CreatedAt()) > k.reaper.MaxCreated {
+				k.trash(order, Created, TrashReaped)
+			}
+		}
+	}
+	if k.reaper.MaxReady > 0 {
+		for _, order := range k.allOrders() {
+			if order.State() == Ready && now.Sub(order.ReadyAt()) > k.reaper.MaxReady {
+				k.trash(order, Ready, TrashReaped)
+			}
+		}
+	}
+}
+
+// SweepExpired trashes every order on the shelves that has expired, returning the number trashed. Unlike a
+// minimizer pass it doesn't move anything, so it's cheap enough to call on demand. Each shelf is only locked
+// while its orders are listed, and each order while it's trashed.
+func (k *Kitchen) SweepExpired() int {
+	shelves, _ := k.shelves()
+	trashed := 0
+	for _, shelf := range shelves {
+		for _, order := range shelf.Orders() {
+			if !order.IsExpired() {
+				continue
+			}
+			// the transition trashes expired orders itself and reports it as an error, only a TransitionError
+			// means it was already trashed or picked up by someone else
+			if _, lost := k.trash(order, order.State(), TrashExpired).(*TransitionError); !lost {
+				trashed++
+			}
+		}
+	}
+	return trashed
+}
+
+// trash moves the order from the expected state to Trashed and takes it off its shelf.
+func (k *Kitchen) trash(order *Order, expected OrderState, reason TrashReason) error {
+	return order.TransitionOrder(expected, Trashed, func(o *Order) error {
+		o.trashedAt = k.now()
+		o.trashedReason = reason
+		removeOrder(o)
+		return nil
+	})
+}
+
+// candidates returns a new slice of the shelves supporting any of the given order types, without duplicates.
+func (k *Kitchen) candidates(orderTypes []string) []Shelf {
+	k.RLock()
+	defer k.RUnlock()
+	return k.unsafeCandidates(orderTypes)
+}
+
+// rankedCandidates returns a new slice of the shelves supporting the order, ranked by the placer. Orders of a
+// single temp without preferences are usually already ranked in sortedIndex, and skip ranking. Orders with a
+// fallback chain get the chain instead, in its order.
+func (k *Kitchen) rankedCandidates(order *Order) []Shelf {
+	k.RLock()
+	if chain := k.unsafeFallbackChain(order); chain != nil {
+		shelves := append([]Shelf{}, chain...)
+		k.RUnlock()
+		return shelves
+	}
+	if k.presorted && k.sortedIndex != nil && len(order.Temps()) == 1 && !k.hasPreferences(order) {
+		// the index is shared, so copy out of it
+		shelves := append([]Shelf(nil), k.sortedIndex[order.Temps()[0]]...)
+		k.RUnlock()
+		return shelves
+	}
+	shelves := k.unsafeCandidates(order.Temps())
+	k.RUnlock()
+	k.placer.Rank(order, shelves)
+	return shelves
+}
+
+// unsafe candidates
+func (k *Kitchen) unsafeCandidates(orderTypes []string) []Shelf {
+	// the index is shared across all orders, so always copy out of it
+	candidates := make([]Shelf, 0)
+	seen := make(map[Shelf]bool)
+	for _, orderType := range orderTypes {
+		for _, shelf := range k.supportedIndex[orderType] {
+			if !seen[shelf] {
+				seen[shelf] = true
+				candidates = append(candidates, shelf)
+			}
+		}
+	}
+	return candidates
+}
+
+// PreviewPlacement returns the name of the shelf a new order of the temp would be placed on right now, without
+// placing anything. ok is false if no shelf has room, in which case the order would be trashed, or evict an
+// order when overcommit is least_valuable. The topology is read locked for the whole preview, so it can't
+// change midway, but orders may come and go before the order is actually created.
+func (k *Kitchen) PreviewPlacement(temp string) (shelfName string, ok bool) {
+	k.RLock()
+	defer k.RUnlock()
+	probe := NewOrder("preview", temp, 0, 0)
+	if chain := k.unsafeFallbackChain(probe); chain != nil {
+		for _, shelf := range chain {
+			if hasRoom(shelf) {
+				return shelf.Name(), true
+			}
+		}
+		return "", false
+	}
+	shelves := k.unsafeCandidates(probe.temps)
+	for _, shelf := range shelves {
+		if shelf.Decay() > probe.worstDecay {
+			probe.worstDecay = shelf.Decay()
+		}
+	}
+	k.placer.Rank(probe, shelves)
+	for _, shelf := range shelves {
+		if hasRoom(shelf) {
+			return shelf.Name(), true
+		}
+	}
+	return "", false
+}
+
+func (k *Kitchen) SetOrderReady(order *Order) error {
+	order, err := k.resolve(order)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		k.pendingLock.Lock()
+		delete(k.pending, order.ID())
+		k.pendingLock.Unlock()
+	}()
+	// only new orders are placed, the transition would fail anyway, but not before placing the order again
+	if state := order.State(); state != Created {
+		return &TransitionError{OrderID: order.ID(), State: state, Expected: Created}
+	}
+
+	supported := k.rankedCandidates(order)
+	if len(supported) == 0 {
+		order.TransitionOrder(Created, Trashed, func(o *Order) error {
+			o.state = Trashed
+			o.trashedAt = k.now()
+			o.trashedReason = TrashUnsupported
+			removeOrder(order)
+			return nil
+		})
+		if len(k.Shelves()) == 0 {
+			return ErrEmptyTopology
+		}
+		return errors.New("no shelves available for this order type")
+	}
+
+	// try to place on a shelf, along with any other new orders of its temp. if we're out of room, see if the
+	// order is worth more than one already placed.
+	var placed bool
+	if temp, ok := k.batchTemp(order); ok {
+		placed = k.batcher.place(order, temp)
+	} else {
+		placed = k.optimizePlacement(order, supported)
+	}
+	// a reload may have removed shelves since they were ranked, if so rank the current ones
+	for !placed && order.State() == Created && anyClosed(supported) {
+		supported = k.rankedCandidates(order)
+		placed = k.optimizePlacement(order, supported)
+	}
+	if !placed && k.evictLeastValuable && order.State() == Created {
+		placed = k.admit(order, supported)
+	}
+	if placed {
+		err := order.TransitionOrder(Created, Ready, func(o *Order) error {
+			o.readyAt = k.now()
+			return nil
+		})
+		if err != nil {
+			// reaped while it was being placed, don't leave it on the shelf
+			order.Lock()
+			if order.state == Trashed {
+				removeOrder(order)
+			}
+			order.Unlock()
+			return err
+		}
+		return nil
+	}
+
+	// log not placed, discard
+	order.TransitionOrder(Created, Trashed, func(o *Order) error {
+		o.trashedAt = k.now()
+		o.trashedReason = TrashNoCapacity
+		removeOrder(order)
+		return nil
+	})
+
+	return errors.New("failed to place order on a valid shelf")
+}
+
+// UpdateOrder moves the order with the ID to the state, returning ErrUnknownState if it isn't one orders can
+// be moved to, ErrOrderNotFound if the order isn't on a shelf, or a *TransitionError if the order isn't in the
+// state before it.
+func (k *Kitchen) UpdateOrder(orderID string, state OrderState) (*Order, error) {
+	transition, _, err := k.transitionTo(state)
+	if err != nil {
+		return nil, err
+	}
+	order := k.findOrder(orderID)
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	return order, transition(order)
+}
+
+// UpdateOrderFrom is UpdateOrder, but only moves the order if it's in the expected state when it's moved. If it
+// isn't, the *TransitionError expects the expected state, so the caller can tell a failed precondition from a
+// transition that's never valid, e.g. expecting created and moving to pickedup. An order that was recently
+// picked up or trashed fails the precondition too, so a retry of the update that finished it gets a
+// *TransitionError rather than ErrOrderNotFound.
+func (k *Kitchen) UpdateOrderFrom(orderID string, expected OrderState, state OrderState) (*Order, error) {
+	transition, from, err := k.transitionTo(state)
+	if err != nil {
+		return nil, err
+	}
+	order := k.findOrder(orderID)
+	if order == nil {
+		recent := k.finishedOrder(orderID)
+		if recent == nil {
+			return nil, ErrOrderNotFound
+		}
+		current := recent.State()
+		if current == expected {
+			expected = from
+		}
+		return recent, &TransitionError{OrderID: orderID, State: current, Expected: expected}
+	}
+	// the transition checks its own from state atomically, any other expected state fails either way
+	if expected != from {
+		current := order.State()
+		if current == expected {
+			expected = from
+		}
+		return order, &TransitionError{OrderID: orderID, State: current, Expected: expected}
+	}
+	return order, transition(order)
+}
+
+// transitionTo returns the kitchen's transition into the state and the state it moves orders from, or
+// ErrUnknownState if orders can't be moved to it.
+func (k *Kitchen) transitionTo(state OrderState) (func(*Order) error, OrderState, error) {
+	switch state {
+	case Ready:
+		return k.SetOrderReady, Created, nil
+	case Enroute:
+		return k.SetOrderEnroute, Ready, nil
+	case PickedUp:
+		return k.SetOrderPickedUp, Enroute, nil
+	}
+	return nil, "", ErrUnknownState
+}
+
+// CancelOrder trashes a ready order and takes it off its shelf. Once a courier is enroute the order can no
+// longer be cancelled and a *TransitionError is returned, as it is for an order that was recently picked up or
+// trashed.
+func (k *Kitchen) CancelOrder(orderID string) (*Order, error) {
+	order := k.findOrder(orderID)
+	if order == nil {
+		if recent := k.finishedOrder(orderID); recent != nil {
+			return recent, &TransitionError{OrderID: orderID, State: recent.State(), Expected: Ready}
+		}
+		return nil, ErrOrderNotFound
+	}
+	return order, k.trash(order, Ready, TrashCancelled)
+}
+
+// finishedOrder returns the order with the ID if it was recently picked up or trashed, nil otherwise.
+func (k *Kitchen) finishedOrder(orderID string) *Order {
+	recent := k.changes.recent(orderID)
+	if recent == nil {
+		return nil
+	}
+	if state := recent.State(); state != PickedUp && state != Trashed {
+		return nil
+	}
+	return recent
+}
+
+// resolve returns the kitchen's own order for a clone handed out by a getter, so clones can be passed back in.
+// Other orders are returned as they are. A clone of an order that has left the shelves returns ErrOrderNotFound,
+// transitioning the clone would only change the copy.
+func (k *Kitchen) resolve(order *Order) (*Order, error) {
+	if !order.cloned {
+		return order, nil
+	}
+	if own := k.findOrder(order.id); own != nil {
+		return own, nil
+	}
+	return nil, ErrOrderNotFound
+}
+
+func (k *Kitchen) SetOrderEnroute(order *Order) error {
+	order, err := k.resolve(order)
+	if err != nil {
+		return err
+	}
+	return order.TransitionOrder(Ready, Enroute, func(o *Order) error {
+		o.enrouteAt = k.now()
+		return nil
+	})
+}
+
+func (k *Kitchen) SetOrderPickedUp(order *Order) error {
+	order, err := k.resolve(order)
+	if err != nil {
+		return err
+	}
 	return order.TransitionOrder(Enroute, PickedUp, func(o *Order) error {
 		o.pickedUpAt = k.now()
 		removeOrder(order)
@@ -1,9 +1,15 @@
 package kitchen
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -123,6 +129,123 @@ kitchen:
 	assert.Equal(t, "good", orders[2].Shelf().Name())
 }
 
+func TestKitchenEnrouteNotRelocated(t *testing.T) {
+	top := []byte(`--- 
+kitchen: 
+  topology: 
+    - capacity: 1
+      decay_rate: 1
+      name: bad
+      supported: 
+        - hot
+    - capacity: 1
+      decay_rate: 0
+      name: best
+      supported: 
+        - hot`)
+	provider := config.NewYAMLProviderFromBytes(top)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	orders := []*Order{
+		NewOrder("test1", "hot", 100*time.Second, .2),
+		NewOrder("test2", "hot", 100*time.Second, .2),
+	}
+	for _, o := range orders {
+		k.CreateOrder(o)
+	}
+	assert.Equal(t, "best", orders[0].Shelf().Name())
+	assert.Equal(t, "bad", orders[1].Shelf().Name())
+
+	// dispatch a courier for test2, then free up the best shelf
+	assert.Nil(t, k.SetOrderEnroute(orders[1]))
+	k.SetOrderEnroute(orders[0])
+	k.SetOrderPickedUp(orders[0])
+
+	assert.False(t, k.optimizePlacement(orders[1], k.shelvesAsc))
+	k.decayMinimizer()
+	// even if it was dispatched after the minimizer looked, the move itself is refused
+	err = orders[1].forceShelf(k.shelf("best"))
+	assert.IsType(t, &TransitionError{}, err)
+
+	// test2 stays put until it's picked up
+	assert.Equal(t, Enroute, orders[1].State())
+	assert.Equal(t, "bad", orders[1].Shelf().Name())
+}
+
+func TestKitchenMoveOrder(t *testing.T) {
+	cfg := []byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 2
+      decay_rate: 2
+      group: shared
+      supported: 
+        - hot
+        - cold
+    - name: "cold"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - cold`)
+	provider := config.NewYAMLProviderFromBytes(cfg)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	hot := NewOrder("test1", "hot", 100*time.Second, .2)
+	cold := NewOrder("test2", "cold", 100*time.Second, .2)
+	k.CreateOrder(hot)
+	k.CreateOrder(cold)
+	assert.Equal(t, "hot", hot.Shelf().Name())
+
+	// move to a worse shelf, decay accrued on hot is kept
+	nowPlus := func() time.Time {
+		return time.Now().Add(10 * time.Second)
+	}
+	hot.now = nowPlus
+	assert.Nil(t, k.MoveOrder(hot.ID(), "overflow"))
+	assert.Equal(t, "overflow", hot.Shelf().Name())
+	assert.True(t, hot.prevDecayed > 0)
+	assert.Equal(t, 0, len(k.shelf("hot").Orders()))
+	assert.Equal(t, 1, len(k.shelf("overflow").Orders()))
+
+	// moving to the current shelf is a noop
+	assert.Nil(t, k.MoveOrder(hot.ID(), "overflow"))
+	assert.Equal(t, 1, len(k.shelf("overflow").Orders()))
+
+	assert.Equal(t, ErrOrderNotFound, k.MoveOrder("missing", "hot"))
+	assert.Equal(t, ErrUnknownShelf, k.MoveOrder(hot.ID(), "freezer"))
+	assert.Equal(t, ErrUnsupportedTemp, k.MoveOrder(hot.ID(), "cold"))
+
+	// fill the hot shelf back up and try to move onto it
+	another := NewOrder("test3", "hot", 100*time.Second, .2)
+	k.CreateOrder(another)
+	assert.Equal(t, "hot", another.Shelf().Name())
+	assert.Equal(t, ErrShelfFull, k.MoveOrder(hot.ID(), "hot"))
+	assert.Equal(t, "overflow", hot.Shelf().Name())
+
+	// the order's affinity still applies
+	assert.Nil(t, k.MoveOrder(cold.ID(), "overflow"))
+	picky := NewOrder("test4", "cold", 100*time.Second, .2, WithAntiAffinity("shared"))
+	assert.Nil(t, k.CreateOrder(picky))
+	assert.Equal(t, ErrNotAdmitted, k.MoveOrder(picky.ID(), "overflow"))
+	assert.Equal(t, "cold", picky.Shelf().Name())
+
+	// and an order a courier is on the way for stays put
+	assert.Nil(t, k.SetOrderEnroute(another))
+	err = k.MoveOrder(another.ID(), "overflow")
+	terr, ok := err.(*TransitionError)
+	assert.True(t, ok)
+	assert.Equal(t, Enroute, terr.State)
+	assert.Equal(t, "hot", another.Shelf().Name())
+}
+
 func TestOrderExpireBackground(t *testing.T) {
 	cfg := []byte(`
         kitchen:
@@ -166,280 +289,4094 @@ func TestOrderExpireBackground(t *testing.T) {
 	assert.Nil(t, order.Shelf())
 }
 
-func makeOrders(count int, orderType string) []*Order {
-	orders := make([]*Order, count)
-	for i := 0; i < count; i++ {
-		orders[i] = NewOrder(fmt.Sprintf("test_%d", count), orderType, 1*time.Second, .2)
+func TestOrderMaxAge(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "cold"
+      capacity: 5
+      decay_rate: 0
+      supported: 
+        - cold`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	// barely decays, so without a max age it would sit on the shelf for ~100s
+	lingering := NewOrder("test1", "cold", 100*time.Second, .0001)
+	limited := NewOrder("test2", "cold", 100*time.Second, .0001, WithMaxAge(5*time.Second))
+	assert.Equal(t, 5*time.Second, limited.MaxAge())
+	k.CreateOrder(lingering)
+	k.CreateOrder(limited)
+
+	travel := func(d time.Duration) {
+		nowPlus := func() time.Time {
+			return time.Now().Add(d)
+		}
+		k.now = nowPlus
+		lingering.now = nowPlus
+		limited.now = nowPlus
 	}
-	return orders
+
+	travel(4 * time.Second)
+	k.decayMinimizer()
+	assert.Equal(t, Ready, limited.State())
+	assert.Equal(t, Ready, lingering.State())
+
+	travel(6 * time.Second)
+	k.decayMinimizer()
+	assert.Equal(t, Trashed, limited.State())
+	assert.Nil(t, limited.Shelf())
+	assert.Equal(t, Ready, lingering.State())
+	assert.True(t, lingering.Value() > 0)
 }
 
-func TestKitchenCapacity(t *testing.T) {
-	cfg := []byte(`
-        kitchen:
-          minimize_decay: false
-          topology:
-            - name: "hot"
-              capacity: 5
-              decay_rate: 1
-              supported: 
-                - hot
-            - name: "cold"
-              capacity: 5
-              decay_rate: 0.5
-              supported: 
-                - cold`)
+func TestValueFunctions(t *testing.T) {
+	shelfLife := 10 * time.Second
+	ages := []time.Duration{0, 2500 * time.Millisecond, 5 * time.Second, 9 * time.Second, 10 * time.Second, 15 * time.Second}
+	linear := []float64{10, 7.5, 5, 1, 0, -5}
+	step := []float64{10, 10, 10, 10, 0, 0}
+	for i, age := range ages {
+		assert.Equal(t, linear[i], LinearValue(shelfLife, age)/float64(time.Second))
+		assert.Equal(t, step[i], StepValue(shelfLife, age)/float64(time.Second))
+	}
 
-	provider := config.NewYAMLProviderFromBytes(cfg)
-	k, err := NewKitchen(provider)
-	assert.NotNil(t, k)
-	assert.Nil(t, err)
+	_, err := NewKitchen(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  value_function: cliff`)))
+	assert.NotNil(t, err)
+}
 
-	orders := makeOrders(6, "hot")
+func TestKitchenValueFunction(t *testing.T) {
+	cfg := `
+kitchen:
+  value_function: %s
+  topology:
+    - name: "cold"
+      capacity: 5
+      decay_rate: 0
+      supported: 
+        - cold`
 
-	// populate kitchen with 5 orders
-	for i := 0; i < len(orders)-1; i++ {
-		k.CreateOrder(orders[i])
-		k.SetOrderReady(orders[i])
-		assert.Equal(t, Ready, orders[i].State())
+	orders := make(map[string]*Order)
+	for _, fn := range []string{"linear", "step"} {
+		provider := config.NewYAMLProviderFromBytes([]byte(fmt.Sprintf(cfg, fn)))
+		k, err := NewKitchen(provider)
+		assert.Nil(t, err)
+
+		order := NewOrder(fn, "cold", 10*time.Second, 0)
+		k.CreateOrder(order)
+		orders[fn] = order
 	}
 
-	k.CreateOrder(orders[len(orders)-1])
-	k.SetOrderReady(orders[len(orders)-1])
+	travel := func(d time.Duration) {
+		for _, o := range orders {
+			readyAt := o.readyAt
+			o.now = func() time.Time {
+				return readyAt.Add(d)
+			}
+		}
+	}
 
-	// assert that last order is trashed is expired
-	assert.Equal(t, "test_6", orders[len(orders)-1].Name())
-	assert.Equal(t, Trashed, orders[len(orders)-1].State())
-	assert.True(t, 0 >= orders[len(orders)-1].Value())
-	assert.Nil(t, orders[len(orders)-1].Shelf())
+	travel(5 * time.Second)
+	assert.Equal(t, .5, orders["linear"].NormalizedValue())
+	assert.Equal(t, 1.0, orders["step"].NormalizedValue())
+	assert.False(t, orders["linear"].IsExpired())
+	assert.False(t, orders["step"].IsExpired())
+
+	travel(9 * time.Second)
+	assert.InDelta(t, .1, orders["linear"].NormalizedValue(), .0001)
+	assert.Equal(t, 1.0, orders["step"].NormalizedValue())
+
+	// both fall off at the end of the shelf life
+	travel(10 * time.Second)
+	assert.True(t, orders["linear"].IsExpired())
+	assert.True(t, orders["step"].IsExpired())
+	assert.Equal(t, 0.0, orders["step"].Value())
 }
 
-func TestKitchenUnsupported(t *testing.T) {
-	// topology only has hot or cold shelves
-	provider := config.NewYAMLProviderFromBytes(simpleConfig)
+func TestDiffOrders(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported: 
+        - hot`))
 	k, err := NewKitchen(provider)
-	assert.NotNil(t, k)
 	assert.Nil(t, err)
 
-	orders := makeOrders(5, "frozen")
+	order := NewOrder("test1", "hot", 100*time.Second, .2)
+	k.CreateOrder(order)
+	before := order.Snapshot()
+	assert.Equal(t, order.ID(), before.ID)
+	assert.Equal(t, Ready, before.State)
+	assert.Equal(t, "hot", before.Shelf)
 
-	// populate kitchen with 5 orders that are unsupported
-	for i := 0; i < len(orders)-1; i++ {
-		k.CreateOrder(orders[i])
-		k.SetOrderReady(orders[i])
-		// they get trashed since there is no shelf for them
-		assert.Equal(t, Trashed, orders[i].State())
-		assert.True(t, 0 >= orders[i].Value())
-		assert.Nil(t, orders[i].Shelf())
+	// no change
+	assert.Nil(t, DiffOrders(before, order.Snapshot()))
+
+	// shelf change, which also accrues decay from the old shelf
+	assert.Nil(t, k.MoveOrder(order.ID(), "overflow"))
+	after := order.Snapshot()
+	changes := DiffOrders(before, after)
+	fields := make([]string, len(changes))
+	for i, c := range changes {
+		fields[i] = c.Field
 	}
+	assert.Equal(t, []string{"Shelf", "PrevDecayed", "PlacedAt", "Hops"}, fields)
+	assert.Equal(t, FieldChange{Field: "Shelf", Old: "hot", New: "overflow"}, changes[0])
+
+	// state change
+	before = after
+	k.SetOrderEnroute(order)
+	after = order.Snapshot()
+	assert.Equal(t, []FieldChange{
+		{Field: "State", Old: Ready, New: Enroute},
+		{Field: "EnrouteAt", Old: time.Time{}, New: after.EnrouteAt},
+	}, DiffOrders(before, after))
 }
 
-func setupKitchen(cfg []byte, types []string, numOrders int, expiry time.Duration) ([]*Order, *Kitchen) {
-	provider := config.NewYAMLProviderFromBytes(cfg)
-	k, _ := NewKitchen(provider)
-	rand.Seed(1)
-	orders := make([]*Order, numOrders)
-	for i := 0; i < numOrders; i++ {
-		r := rand.Float64()
-		orderType := types[int(r)*len(types)]
-		if expiry == 0 {
-			expiry = time.Duration(rand.Intn(15)) * time.Second
+func TestResponseSnapshotConsistent(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported: 
+        - hot`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	order := NewOrder("test1", "hot", 100*time.Second, .2)
+	k.CreateOrder(order)
+
+	// bounce the order between shelves, then pick it up
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			k.MoveOrder(order.ID(), "overflow")
+			k.MoveOrder(order.ID(), "hot")
+		}
+		k.SetOrderEnroute(order)
+		k.SetOrderPickedUp(order)
+	}()
+
+	check := func(snapshot ResponseSnapshot) {
+		// every derived field is computed from the same instant
+		raw := LinearValue(snapshot.Order.ShelfLife, snapshot.Value.Age)
+		assert.Equal(t, raw-snapshot.Value.Decayed, snapshot.Value.Value)
+		assert.Equal(t, snapshot.Value.Value/float64(snapshot.Order.ShelfLife), snapshot.Value.NormalizedValue)
+		assert.Equal(t, snapshot.Order.State, snapshot.Value.State)
+		if snapshot.Order.State == PickedUp {
+			assert.Equal(t, "", snapshot.Order.Shelf)
+		} else {
+			assert.NotEqual(t, "", snapshot.Order.Shelf)
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			check(order.ResponseSnapshot())
+			assert.Equal(t, PickedUp, order.State())
+			return
+		default:
+			check(order.ResponseSnapshot())
 		}
-		order := NewOrder(fmt.Sprintf("bench_%d", i), orderType, expiry, rand.Float64())
-		orders[i] = order
-		k.CreateOrder(order)
 	}
-	return orders, k
 }
 
-func TestManyOrders(t *testing.T) {
-	cfg := []byte(`
-        kitchen:
-          minimize_decay: true
-          topology:
-            - name: "storage"
-              capacity: 15
-              decay_rate: 2
-              supported: 
-                - cold
-                - hot
-            - name: "hot"
-              capacity: 15
-              decay_rate: 1
-              supported: 
-                - hot
-            - name: "cold"
-              capacity: 15
-              decay_rate: 0.5
-              supported: 
-                - cold`)
-	orders, k := setupKitchen(cfg, []string{"cold", "hot"}, 30, time.Second*30)
-	wg := sync.WaitGroup{}
-	for _, order := range orders {
-		wg.Add(1)
-		go func(o *Order) {
-			defer wg.Done()
-			sleep := time.Second * time.Duration(rand.Intn(10))
-			k.SetOrderReady(o)
-			k.SetOrderEnroute(o)
-			time.Sleep(sleep)
-			k.SetOrderPickedUp(o)
-		}(order)
+func TestPreservingShelf(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "freezer"
+      capacity: 5
+      decay_rate: -1
+      supported: 
+        - frozen
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - frozen`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	clock := func() time.Time {
+		return now
 	}
-	wg.Wait()
+	k.now = clock
 
-	values := make([]float64, len(orders))
-	rawValues := make([]float64, len(orders))
-	normalValues := make([]float64, len(orders))
-	decayValues := make([]float64, len(orders))
-	counts := map[OrderState]int{
-		Created:  0,
-		Ready:    0,
-		Enroute:  0,
-		PickedUp: 0,
-		Trashed:  0,
+	preserved := NewOrder("test1", "frozen", 10*time.Second, .5)
+	moved := NewOrder("test2", "frozen", 10*time.Second, .5)
+	for _, o := range []*Order{preserved, moved} {
+		o.now = clock
+		k.CreateOrder(o)
+		assert.Equal(t, "freezer", o.Shelf().Name())
 	}
-	for i, order := range orders {
-		values[i] = order.Value()
-		rawValues[i] = order.RawValue()
-		normalValues[i] = order.NormalizedValue()
-		decayValues[i] = order.Decayed()
-		counts[order.State()]++
+
+	// the freezer outpaces base decay, the value is held at the raw value and never above shelf life
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, preserved.RawValue(), preserved.Value())
+		assert.True(t, preserved.Value() <= float64(preserved.ShelfLife()))
+		assert.True(t, preserved.Value() >= 0)
+		assert.False(t, preserved.IsExpired())
+		now = now.Add(250 * time.Millisecond)
 	}
 
-	// assert that all orders completed
-	assert.Equal(t, len(orders), counts[PickedUp])
-	assert.Equal(t, 0, counts[Trashed])
+	// 5s in the freezer doesn't bank any credit for the overflow shelf
+	assert.Nil(t, k.MoveOrder(moved.ID(), "overflow"))
+	now = now.Add(1 * time.Second)
+	// raw 4s - (-2.5s floor at the move + 1s on overflow + 3s base decay)
+	assert.InDelta(t, 2.5, moved.Value()/float64(time.Second), .0001)
+	assert.False(t, moved.IsExpired())
+	assert.True(t, preserved.Value() >= 0)
+	assert.Equal(t, preserved.RawValue(), preserved.Value())
 }
 
-func BenchmarkOrders(b *testing.B) {
-	cfg := []byte(`
-        kitchen:
-          minimize_decay: true
-          topology:
-            - name: "storage"
-              capacity: 1500
-              decay_rate: 2
-              supported: 
-                - cold
-                - hot
-                - frozen
+func TestKitchenWaitForState(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes(simpleConfig)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// an order that was never created isn't waited on
+	assert.Equal(t, ErrOrderNotFound, k.WaitForState(ctx, "missing", Ready))
+
+	// already there
+	order := NewOrder("test1", "hot", time.Minute, .2)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Nil(t, k.WaitForState(ctx, order.ID(), Ready))
+
+	// never gets there
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	assert.Equal(t, context.DeadlineExceeded, k.WaitForState(short, order.ID(), PickedUp))
+
+	// picked up while waiting, with more transitions in between than a subscriber can fall behind by
+	pickedUp := make(chan error)
+	go func() {
+		pickedUp <- k.WaitForState(ctx, order.ID(), PickedUp)
+	}()
+	for i := 0; i < subscriberBuffer; i++ {
+		k.CreateOrder(NewOrder("filler", "frozen", time.Minute, .2))
+	}
+	assert.Nil(t, k.SetOrderEnroute(order))
+	assert.Nil(t, k.SetOrderPickedUp(order))
+	assert.Nil(t, <-pickedUp)
+	// and once it's left the shelves, it's found among the recent changes
+	assert.Nil(t, k.WaitForState(ctx, order.ID(), PickedUp))
+
+	// trashed before it could be picked up
+	doomed := NewOrder("test2", "cold", time.Minute, .2)
+	assert.Nil(t, k.CreateOrder(doomed))
+	trashed := make(chan error)
+	go func() {
+		trashed <- k.WaitForState(ctx, doomed.ID(), PickedUp)
+	}()
+	_, err = k.CancelOrder(doomed.ID())
+	assert.Nil(t, err)
+	err = <-trashed
+	assert.IsType(t, &TransitionError{}, err)
+	assert.Equal(t, Trashed, err.(*TransitionError).State)
+}
+
+func TestUpdateOrderFrom(t *testing.T) {
+	k, err := NewFromConfig(simpleConfig)
+	assert.Nil(t, err)
+	order := NewOrder("test", "hot", time.Minute, .2)
+	assert.Nil(t, k.CreateOrder(order))
+
+	// a precondition that doesn't hold names the expected state
+	_, err = k.UpdateOrderFrom(order.ID(), Enroute, PickedUp)
+	assert.Equal(t, &TransitionError{OrderID: order.ID(), State: Ready, Expected: Enroute}, err)
+	// one that holds, but the transition can't be made from, names the state it's made from
+	_, err = k.UpdateOrderFrom(order.ID(), Ready, PickedUp)
+	assert.Equal(t, &TransitionError{OrderID: order.ID(), State: Ready, Expected: Enroute}, err)
+	assert.Equal(t, Ready, order.State())
+
+	_, err = k.UpdateOrderFrom(order.ID(), Ready, Enroute)
+	assert.Nil(t, err)
+	assert.Equal(t, Enroute, order.State())
+	_, err = k.UpdateOrderFrom(order.ID(), Ready, Trashed)
+	assert.Equal(t, ErrUnknownState, err)
+
+	// a retry of the pickup that finished the order fails its precondition, rather than not finding the order
+	_, err = k.UpdateOrderFrom(order.ID(), Enroute, PickedUp)
+	assert.Nil(t, err)
+	_, err = k.UpdateOrderFrom(order.ID(), Enroute, PickedUp)
+	assert.Equal(t, &TransitionError{OrderID: order.ID(), State: PickedUp, Expected: Enroute}, err)
+	_, err = k.UpdateOrderFrom("missing", Enroute, PickedUp)
+	assert.Equal(t, ErrOrderNotFound, err)
+}
+
+func TestKitchenSubscribe(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes(simpleConfig)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	events, cancel := k.Subscribe()
+	defer cancel()
+
+	order := NewOrder("test1", "hot", time.Minute, .2)
+	k.CreateOrder(order)
+	k.SetOrderEnroute(order)
+	k.SetOrderPickedUp(order)
+
+	expected := []OrderState{Created, Ready, Enroute, PickedUp}
+	for i, state := range expected {
+		event := <-events
+		assert.Equal(t, order.ID(), event.OrderID)
+		assert.Equal(t, state, event.NewState)
+		if i > 0 {
+			assert.Equal(t, expected[i-1], event.OldState)
+		}
+	}
+}
+
+func TestKitchenName(t *testing.T) {
+	events := make([]OrderEvent, 0)
+	for _, name := range []string{"north", "south"} {
+		k, err := NewFromConfig([]byte(`
+kitchen:
+  name: ` + name + `
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`))
+		assert.Nil(t, err)
+		assert.Equal(t, name, k.Name())
+		ch, cancel := k.Subscribe()
+		assert.Nil(t, k.CreateOrder(NewOrder("test", "hot", time.Minute, .2)))
+		events = append(events, <-ch)
+		cancel()
+
+		_, ok := k.LifecycleMetrics()[name+"_"+CreatedToReadyMetric]
+		assert.True(t, ok)
+	}
+	assert.Equal(t, "north", events[0].KitchenID)
+	assert.Equal(t, "south", events[1].KitchenID)
+
+	// unnamed kitchens keep the plain metric names
+	k, err := NewFromConfig(simpleConfig)
+	assert.Nil(t, err)
+	_, ok := k.LifecycleMetrics()[CreatedToReadyMetric]
+	assert.True(t, ok)
+
+	for _, name := range []string{"1st", "north-east", "a b"} {
+		_, err := NewFromConfig([]byte("kitchen:\n  name: " + name))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestOrderMetadata(t *testing.T) {
+	k, err := NewFromConfig(simpleConfig)
+	assert.Nil(t, err)
+	events, unsubscribe := k.Subscribe()
+	defer unsubscribe()
+
+	metadata := map[string]string{"customer": "42"}
+	order := NewOrder("test", "hot", time.Hour, 0, WithMetadata(metadata))
+	// the order keeps its own copy
+	metadata["customer"] = "43"
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Equal(t, map[string]string{"customer": "42"}, order.Metadata())
+	assert.Equal(t, map[string]string{"customer": "42"}, order.Snapshot().Metadata)
+	for _, state := range []OrderState{Created, Ready} {
+		event := <-events
+		assert.Equal(t, state, event.NewState)
+		assert.Equal(t, map[string]string{"customer": "42"}, event.Metadata)
+	}
+
+	assert.Nil(t, NewOrder("test", "hot", time.Hour, 0).Metadata())
+}
+
+func TestTransitionSideEffectFailure(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes(simpleConfig)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	order := NewOrder("test1", "hot", time.Minute, .2)
+	assert.Nil(t, k.CreateOrder(order))
+	events, cancel := k.Subscribe()
+	defer cancel()
+
+	failure := errors.New("courier unavailable")
+	err = order.TransitionOrder(Ready, Enroute, func(o *Order) error {
+		assert.Equal(t, Ready, o.state)
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, Ready, order.State())
+	assert.True(t, order.EnrouteAt().IsZero())
+	assert.Equal(t, 0, len(events))
+
+	// and the order can still make the transition
+	assert.Nil(t, k.SetOrderEnroute(order))
+	assert.Equal(t, Enroute, order.State())
+	assert.Equal(t, Enroute, (<-events).NewState)
+}
+
+// manualClock only moves when advanced.
+type manualClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestKitchenWithClock(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot`))
+	k, err := NewKitchen(provider, WithClock(clock))
+	assert.Nil(t, err)
+
+	short := NewOrder("short", "hot", 10*time.Second, 0)
+	long := NewOrder("long", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(short))
+	assert.Nil(t, k.CreateOrder(long))
+	assert.Equal(t, clock.Now(), short.CreatedAt())
+	assert.Equal(t, time.Duration(0), short.Age())
+
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Minute, long.Age())
+	assert.True(t, short.IsExpired())
+	assert.False(t, long.IsExpired())
+
+	k.decayMinimizer()
+	assert.Equal(t, Trashed, short.State())
+	assert.Equal(t, Ready, long.State())
+	assert.Nil(t, k.GetOrder(short.ID()))
+}
+
+func TestShelfDecaySchedule(t *testing.T) {
+	clock := &manualClock{now: time.Date(2019, 6, 1, 11, 50, 0, 0, time.UTC)}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+      schedule:
+        - from: "12:00"
+          to: "13:00"
+          multiplier: 2
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 3
+      supported:
+        - hot`), WithClock(clock))
+	assert.Nil(t, err)
+	hot := k.shelf("hot")
+
+	order := NewOrder("test", "hot", 10*time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Equal(t, 1.0, hot.Decay())
+
+	// the current leg decays at the rate in effect at each moment, 10m before the peak and 10m into it
+	clock.Advance(20 * time.Minute)
+	assert.Equal(t, 2.0, hot.Decay())
+	assert.Equal(t, float64(10*time.Minute)+2*float64(10*time.Minute), order.DecayBreakdown().CurrentShelf)
+
+	// and is banked the same, so moving doesn't change the value
+	value := order.Value()
+	assert.Nil(t, k.MoveOrder(order.ID(), "overflow"))
+	assert.Equal(t, float64(10*time.Minute)+2*float64(10*time.Minute), order.DecayBreakdown().PreviousShelves)
+	assert.Equal(t, value, order.Value())
+
+	// placed during the peak, leaving after it
+	assert.Nil(t, k.MoveOrder(order.ID(), "hot"))
+	clock.Advance(70 * time.Minute)
+	assert.Equal(t, 1.0, hot.Decay())
+	current := order.DecayBreakdown().CurrentShelf
+	assert.Equal(t, 2*float64(50*time.Minute)+float64(20*time.Minute), current)
+	assert.Nil(t, k.MoveOrder(order.ID(), "overflow"))
+	assert.Equal(t, 3*float64(10*time.Minute)+current, order.DecayBreakdown().PreviousShelves)
+
+	// a clone decays the same as the order, across the schedule
+	assert.Nil(t, k.MoveOrder(order.ID(), "hot"))
+	clone := k.GetOrder(order.ID())
+	clock.Advance(23 * time.Hour)
+	assert.Equal(t, order.DecayBreakdown(), clone.DecayBreakdown())
+}
+
+func TestScheduledDecay(t *testing.T) {
+	windows, err := parseSchedule([]scheduleConfig{{From: "22:00", To: "02:00", Multiplier: .5}, {From: "12:00", To: "13:00", Multiplier: 2}})
+	assert.Nil(t, err)
+	at := func(day, hour int) time.Time { return time.Date(2019, 6, day, hour, 0, 0, 0, time.UTC) }
+	// outside any window
+	assert.Equal(t, float64(time.Hour), scheduledDecay(1, windows, at(1, 8), at(1, 9)))
+	// across midnight, 21:00-22:00 at 1, then four hours at .5
+	assert.Equal(t, 3*float64(time.Hour), scheduledDecay(1, windows, at(1, 21), at(2, 2)))
+	// a whole day: 19 hours at 1, 4 at .5 and the lunch hour at 2
+	assert.Equal(t, 3*float64(23*time.Hour), scheduledDecay(3, windows, at(1, 8), at(2, 8)))
+	assert.Equal(t, 0.0, scheduledDecay(1, windows, at(1, 9), at(1, 8)))
+}
+
+func TestDecayWindowWrapsMidnight(t *testing.T) {
+	windows, err := parseSchedule([]scheduleConfig{{From: "22:00", To: "02:00", Multiplier: .5}})
+	assert.Nil(t, err)
+	at := func(hour int) time.Time { return time.Date(2019, 6, 1, hour, 0, 0, 0, time.UTC) }
+	assert.Equal(t, .5, multiplierAt(windows, at(23)))
+	assert.Equal(t, .5, multiplierAt(windows, at(1)))
+	assert.Equal(t, 1.0, multiplierAt(windows, at(2)))
+	assert.Equal(t, 1.0, multiplierAt(windows, at(12)))
+
+	_, err = NewFromConfig(append(simpleConfig, []byte(`
+      schedule:
+        - from: "noon"
+          to: "13:00"
+          multiplier: 2`)...))
+	assert.Contains(t, err.Error(), "invalid time of day")
+}
+
+func TestSweepExpired(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "cold"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - cold`), WithClock(clock))
+	assert.Nil(t, err)
+
+	var expiring, fresh []*Order
+	for _, temp := range []string{"hot", "cold"} {
+		short := NewOrder("short", temp, 10*time.Second, 0)
+		long := NewOrder("long", temp, time.Hour, 0)
+		assert.Nil(t, k.CreateOrder(short))
+		assert.Nil(t, k.CreateOrder(long))
+		expiring = append(expiring, short)
+		fresh = append(fresh, long)
+	}
+	// a courier being on the way doesn't save it
+	assert.Nil(t, k.SetOrderEnroute(expiring[1]))
+
+	assert.Equal(t, 0, k.SweepExpired())
+	clock.Advance(time.Minute)
+	assert.Equal(t, 2, k.SweepExpired())
+	for _, order := range expiring {
+		assert.Equal(t, Trashed, order.State())
+		assert.Nil(t, k.GetOrder(order.ID()))
+	}
+	for _, order := range fresh {
+		assert.Equal(t, Ready, order.State())
+		assert.NotNil(t, k.GetOrder(order.ID()))
+	}
+	assert.Equal(t, 0, k.SweepExpired())
+}
+
+var groupConfig = []byte(`
+kitchen:
+  topology:
+    - name: "freezer"
+      group: "freezer"
+      capacity: 5
+      decay_rate: .5
+      supported: 
+        - frozen
+        - cold
+    - name: "fridge"
+      group: "refrigerated"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - cold
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported: 
+        - cold`)
+
+func TestShelfAntiAffinity(t *testing.T) {
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes(groupConfig))
+	assert.Nil(t, err)
+
+	plain := NewOrder("plain", "cold", time.Minute, 0)
+	assert.Nil(t, k.CreateOrder(plain))
+	assert.Equal(t, "freezer", plain.Shelf().Name())
+
+	// the freezer is the best shelf for cold, but this order can't go there
+	salad := NewOrder("salad", "cold", time.Minute, 0, WithAntiAffinity("freezer"))
+	assert.Nil(t, k.CreateOrder(salad))
+	assert.Equal(t, "fridge", salad.Shelf().Name())
+
+	// nor will the minimizer move it there from a worse shelf
+	k.MoveOrder(salad.ID(), "overflow")
+	k.decayMinimizer()
+	assert.Equal(t, "fridge", salad.Shelf().Name())
+}
+
+func TestShelfAffinity(t *testing.T) {
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes(groupConfig))
+	assert.Nil(t, err)
+
+	orders := make([]*Order, 6)
+	for i := range orders {
+		orders[i] = NewOrder("milk", "cold", time.Minute, 0, WithAffinity("refrigerated"))
+	}
+	for _, order := range orders[:5] {
+		assert.Nil(t, k.CreateOrder(order))
+		assert.Equal(t, "fridge", order.Shelf().Name())
+	}
+	// there's room on other shelves, but none in the group
+	assert.NotNil(t, k.CreateOrder(orders[5]))
+	assert.Equal(t, Trashed, orders[5].State())
+}
+
+var reaperTestConfig = []byte(`
+kitchen:
+  reaper:
+    max_created: 30s
+    max_ready: 10m
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 0
+      supported: 
+        - hot`)
+
+func TestReaperReady(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes(reaperTestConfig), WithClock(clock))
+	assert.Nil(t, err)
+	assert.Equal(t, 10*time.Minute, k.reaper.MaxReady)
+
+	// both would keep their value for hours, so only the reaper will trash them
+	stale := NewOrder("stale", "hot", 24*time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(stale))
+	clock.Advance(5 * time.Minute)
+	fresh := NewOrder("fresh", "hot", 24*time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(fresh))
+	enroute := NewOrder("enroute", "hot", 24*time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(enroute))
+	assert.Nil(t, k.SetOrderEnroute(enroute))
+
+	k.reap()
+	assert.Equal(t, Ready, stale.State())
+
+	clock.Advance(5*time.Minute + time.Second)
+	k.reap()
+	assert.Equal(t, Trashed, stale.State())
+	assert.Nil(t, k.GetOrder(stale.ID()))
+	assert.Equal(t, Ready, fresh.State())
+	// a courier is on the way, it's not idle
+	assert.Equal(t, Enroute, enroute.State())
+}
+
+func TestReaperCreated(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes(reaperTestConfig), WithClock(clock))
+	assert.Nil(t, err)
+
+	// stuck cooking, it never makes it to SetOrderReady
+	order := NewOrder("stuck", "hot", 24*time.Hour, 0)
+	k.acceptOrder(order)
+	k.reap()
+	assert.Equal(t, Created, order.State())
+
+	clock.Advance(31 * time.Second)
+	k.reap()
+	assert.Equal(t, Trashed, order.State())
+
+	// and if it ever finishes cooking, it doesn't take up a shelf
+	assert.NotNil(t, k.SetOrderReady(order))
+	assert.Equal(t, 0, len(k.GetOrders()))
+	assert.Equal(t, 0, len(k.pendingOrders()))
+}
+
+func TestDecayBreakdown(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported: 
+        - hot`))
+	k, err := NewKitchen(provider, WithClock(clock))
+	assert.Nil(t, err)
+
+	order := NewOrder("test", "hot", time.Hour, .5)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Nil(t, k.MoveOrder(order.ID(), "overflow"))
+	clock.Advance(10 * time.Second)
+	assert.Nil(t, k.MoveOrder(order.ID(), "hot"))
+	clock.Advance(4 * time.Second)
+
+	breakdown := order.DecayBreakdown()
+	assert.Equal(t, .5*float64(14*time.Second), breakdown.Base)
+	assert.Equal(t, float64(4*time.Second), breakdown.CurrentShelf)
+	assert.Equal(t, 2*float64(10*time.Second), breakdown.PreviousShelves)
+	assert.Equal(t, 0.0, breakdown.Floor)
+	assert.Equal(t, order.Decayed(), breakdown.Base+breakdown.CurrentShelf+breakdown.PreviousShelves)
+	assert.Equal(t, breakdown, order.ValueSnapshot().Breakdown)
+}
+
+func TestLifecycleMetrics(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes(simpleConfig), WithClock(clock))
+	assert.Nil(t, err)
+
+	order := NewOrder("test", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Nil(t, k.SetOrderEnroute(order))
+	clock.Advance(2 * time.Second)
+
+	// nothing is observed until the order reaches a terminal state
+	assert.Equal(t, uint64(0), k.LifecycleMetrics()[ReadyToPickedUpMetric].Count)
+	assert.Nil(t, k.SetOrderPickedUp(order))
+
+	metrics := k.LifecycleMetrics()
+	pickedUp := metrics[ReadyToPickedUpMetric]
+	assert.Equal(t, uint64(1), pickedUp.Count)
+	assert.Equal(t, 2.0, pickedUp.Sum)
+	for i, bucket := range pickedUp.Buckets {
+		if bucket < 2 {
+			assert.Equal(t, uint64(0), pickedUp.Counts[i], bucket)
+		} else {
+			assert.Equal(t, uint64(1), pickedUp.Counts[i], bucket)
+		}
+	}
+	// created and placed at the same instant
+	ready := metrics[CreatedToReadyMetric]
+	assert.Equal(t, uint64(1), ready.Count)
+	assert.Equal(t, uint64(1), ready.Counts[0])
+
+	// an order that expires on the shelf is observed too, when a transition finds it expired
+	expired := NewOrder("test", "hot", time.Second, 0)
+	assert.Nil(t, k.CreateOrder(expired))
+	clock.Advance(2 * time.Second)
+	assert.NotNil(t, k.SetOrderEnroute(expired))
+	assert.Equal(t, TrashExpired, expired.TrashedReason())
+	metrics = k.LifecycleMetrics()
+	assert.Equal(t, uint64(2), metrics[CreatedToReadyMetric].Count)
+	assert.Equal(t, uint64(1), metrics[ReadyToPickedUpMetric].Count)
+}
+
+func TestCompositeTemps(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "freezer"
+      capacity: 5
+      decay_rate: 0.5
+      supported: 
+        - frozen`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	order := NewOrder("test1", "hot, cold", 100*time.Second, .2)
+	assert.Equal(t, "hot, cold", order.Temp())
+	assert.Equal(t, []string{"hot", "cold"}, order.Temps())
+
+	// only the hot component is supported, which is enough
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Equal(t, Ready, order.State())
+	assert.Equal(t, "hot", order.Shelf().Name())
+	assert.Equal(t, 1.0, order.decayOn(order.Shelf()))
+
+	assert.NotNil(t, k.CreateOrder(NewOrder("test2", "cold", 100*time.Second, .2)))
+}
+
+func TestCompositeTempsDecay(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "cold"
+      capacity: 5
+      decay_rate: 3
+      supported: 
+        - cold
+    - name: "storage"
+      capacity: 1
+      decay_rate: 2
+      supported: 
+        - hot
+        - cold`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	// storage keeps both components at temp, everywhere else decays at the worst matching rate
+	first := NewOrder("test1", "hot,cold", 100*time.Second, .2)
+	assert.Nil(t, k.CreateOrder(first))
+	assert.Equal(t, "storage", first.Shelf().Name())
+	assert.Equal(t, 3.0, first.worstDecay)
+	assert.Equal(t, 2.0, first.decayOn(k.shelf("storage")))
+	assert.Equal(t, 3.0, first.decayOn(k.shelf("hot")))
+	assert.Equal(t, 3.0, first.decayOn(k.shelf("cold")))
+
+	// storage is full, so the next one lands on a partial match. both decay equally, so by name.
+	second := NewOrder("test2", "hot,cold", 100*time.Second, .2)
+	assert.Nil(t, k.CreateOrder(second))
+	assert.Equal(t, "cold", second.Shelf().Name())
+
+	// single temp orders are unaffected
+	hot := NewOrder("test3", "hot", 100*time.Second, .2)
+	assert.Nil(t, k.CreateOrder(hot))
+	assert.Equal(t, "hot", hot.Shelf().Name())
+	assert.Equal(t, 1.0, hot.decayOn(hot.Shelf()))
+}
+
+func TestShelfReserve(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 3
+      reserve: 1
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported: 
+        - hot`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+	hot := k.shelf("hot")
+	overflow := k.shelf("overflow")
+
+	// new orders stop at capacity - reserve
+	orders := makeOrders(3, "hot")
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Equal(t, 2, len(hot.Orders()))
+	assert.Equal(t, overflow, orders[2].Shelf())
+
+	// the minimizer can use the reserve
+	k.decayMinimizer()
+	assert.Equal(t, 3, len(hot.Orders()))
+	assert.Equal(t, hot, orders[2].Shelf())
+
+	// but not beyond capacity
+	order := NewOrder("test", "hot", 100*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	k.decayMinimizer()
+	assert.Equal(t, overflow, order.Shelf())
+	assert.Equal(t, 3, len(hot.Orders()))
+}
+
+func TestShelfReserveValidation(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 3
+      reserve: 4
+      decay_rate: 1
+      supported: 
+        - hot`))
+	_, err := NewKitchen(provider)
+	assert.NotNil(t, err)
+}
+
+func TestPlacementTieBreak(t *testing.T) {
+	topology := `
+  topology:
+    - name: "b"
+      capacity: 3
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "a"
+      capacity: 2
+      decay_rate: 1
+      supported: 
+        - hot`
+
+	// by name, "a" fills up first regardless of config order
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes([]byte("kitchen:" + topology)))
+	assert.Nil(t, err)
+	orders := makeOrders(3, "hot")
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Equal(t, "a", orders[0].Shelf().Name())
+	assert.Equal(t, "a", orders[1].Shelf().Name())
+	assert.Equal(t, "b", orders[2].Shelf().Name())
+
+	// by free capacity, orders alternate once the shelves are level
+	k, err = NewKitchen(config.NewYAMLProviderFromBytes([]byte("kitchen:\n  tie_break: free_capacity" + topology)))
+	assert.Nil(t, err)
+	orders = makeOrders(4, "hot")
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Equal(t, "b", orders[0].Shelf().Name())
+	assert.Equal(t, "a", orders[1].Shelf().Name())
+	assert.Equal(t, "b", orders[2].Shelf().Name())
+	assert.Equal(t, "a", orders[3].Shelf().Name())
+
+	_, err = NewKitchen(config.NewYAMLProviderFromBytes([]byte("kitchen:\n  tie_break: coin_flip" + topology)))
+	assert.NotNil(t, err)
+}
+
+func TestPreviewPlacement(t *testing.T) {
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  tie_break: free_capacity
+  topology:
+    - name: "hot"
+      capacity: 2
+      reserve: 1
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "b"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot
+        - cold
+    - name: "a"
+      capacity: 1
+      decay_rate: 2
+      supported:
+        - hot`)))
+	assert.Nil(t, err)
+
+	for i, order := range makeOrders(4, "hot") {
+		shelf, ok := k.PreviewPlacement("hot")
+		assert.True(t, ok)
+		// previewing doesn't place anything
+		assert.Equal(t, i, len(k.GetOrders()))
+		assert.Nil(t, k.CreateOrder(order))
+		assert.Equal(t, shelf, order.Shelf().Name())
+	}
+
+	_, ok := k.PreviewPlacement("hot")
+	assert.False(t, ok)
+	assert.NotNil(t, k.CreateOrder(NewOrder("test", "hot", time.Second, 0)))
+	_, ok = k.PreviewPlacement("frozen")
+	assert.False(t, ok)
+}
+
+func TestLeastValuableOrder(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "storage"
+      capacity: 5
+      decay_rate: 2
+      supported: 
+        - hot
+        - cold`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+	assert.Nil(t, k.LeastValuableOrder("hot"))
+
+	slow := NewOrder("slow", "hot", 20*time.Second, 0)
+	fast := NewOrder("fast", "hot", 30*time.Second, 5)
+	fresh := NewOrder("fresh", "hot", 100*time.Second, 0)
+	cold := NewOrder("cold", "cold", 200*time.Second, 0)
+	for _, order := range []*Order{slow, fast, fresh, cold} {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+
+	assert.Equal(t, slow.ID(), k.LeastValuableOrder("hot").ID())
+	assert.Equal(t, cold.ID(), k.LeastValuableOrder("cold").ID())
+
+	// fast decays faster, so it overtakes slow
+	nowPlus := func() time.Time {
+		return time.Now().Add(3 * time.Second)
+	}
+	for _, order := range []*Order{slow, fast, fresh} {
+		order.now = nowPlus
+	}
+	assert.Equal(t, fast.ID(), k.LeastValuableOrder("hot").ID())
+
+	// a courier is on the way, so it can't be evicted
+	assert.Nil(t, k.SetOrderEnroute(fast))
+	assert.Equal(t, slow.ID(), k.LeastValuableOrder("hot").ID())
+	assert.Nil(t, k.LeastValuableOrder("frozen"))
+
+	// evicting any order from a shelf supporting hot frees a slot for hot, whatever the order's temp
+	expiring := NewOrder("expiring", "cold", 1*time.Second, 0)
+	assert.Nil(t, k.CreateOrder(expiring))
+	assert.Equal(t, expiring.ID(), k.LeastValuableOrder("hot").ID())
+}
+
+func TestSacrificeBelow(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  minimizer:
+    sacrifice_below: .5
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: .1
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 5
+      decay_rate: .2
+      supported: 
+        - hot`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	low := NewOrder("low", "hot", 10*time.Second, 0)
+	high := NewOrder("high", "hot", 100*time.Second, 0)
+	for _, order := range []*Order{low, high} {
+		assert.Nil(t, k.CreateOrder(order))
+		assert.Equal(t, "hot", order.Shelf().Name())
+	}
+
+	// nothing to sacrifice yet
+	k.decayMinimizer()
+	assert.Equal(t, "hot", low.Shelf().Name())
+
+	// low is down to ~.34 normalized value, high is still fresh
+	nowPlus := func() time.Time {
+		return time.Now().Add(6 * time.Second)
+	}
+	low.now = nowPlus
+	high.now = nowPlus
+	k.decayMinimizer()
+	assert.Equal(t, "overflow", low.Shelf().Name())
+	assert.Equal(t, Ready, low.State())
+	assert.True(t, low.Value() > 0)
+	assert.Equal(t, "hot", high.Shelf().Name())
+
+	// and it isn't moved back up on the next pass
+	k.decayMinimizer()
+	assert.Equal(t, "overflow", low.Shelf().Name())
+}
+
+func makeOrders(count int, orderType string) []*Order {
+	orders := make([]*Order, count)
+	for i := 0; i < count; i++ {
+		orders[i] = NewOrder(fmt.Sprintf("test_%d", count), orderType, 1*time.Second, .2)
+	}
+	return orders
+}
+
+func TestShelfOrdersSorted(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	shelf := NewStaticShelf("test", 10, []string{"hot"}, 0)
+	var ties []string
+	for i, rate := range []float64{0, 1, 0, 2, 0} {
+		order := NewOrder(fmt.Sprintf("test_%d", i), "hot", time.Hour, rate)
+		order.now = clock.Now
+		order.readyAt = clock.Now()
+		assert.Nil(t, shelf.Put(order))
+		if rate == 0 {
+			ties = append(ties, order.ID())
+		}
+	}
+	clock.Advance(time.Second)
+
+	first := shelfOrdersSorted(shelf, byDecayDesc)
+	assert.Equal(t, 2.0, first[0].baseDecayRate)
+	assert.Equal(t, 1.0, first[1].baseDecayRate)
+	// equally decayed orders fall back to their IDs
+	assert.True(t, first[2].ID() < first[3].ID() && first[3].ID() < first[4].ID())
+	assert.ElementsMatch(t, ties, []string{first[2].ID(), first[3].ID(), first[4].ID()})
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, shelfOrdersSorted(shelf, byDecayDesc))
+	}
+}
+
+func TestKitchenCapacity(t *testing.T) {
+	cfg := []byte(`
+        kitchen:
+          minimize_decay: false
+          topology:
+            - name: "hot"
+              capacity: 5
+              decay_rate: 1
+              supported: 
+                - hot
+            - name: "cold"
+              capacity: 5
+              decay_rate: 0.5
+              supported: 
+                - cold`)
+
+	provider := config.NewYAMLProviderFromBytes(cfg)
+	k, err := NewKitchen(provider)
+	assert.NotNil(t, k)
+	assert.Nil(t, err)
+
+	orders := makeOrders(6, "hot")
+
+	// populate kitchen with 5 orders
+	for i := 0; i < len(orders)-1; i++ {
+		k.CreateOrder(orders[i])
+		k.SetOrderReady(orders[i])
+		assert.Equal(t, Ready, orders[i].State())
+	}
+
+	k.CreateOrder(orders[len(orders)-1])
+	k.SetOrderReady(orders[len(orders)-1])
+
+	// assert that last order is trashed is expired
+	assert.Equal(t, "test_6", orders[len(orders)-1].Name())
+	assert.Equal(t, Trashed, orders[len(orders)-1].State())
+	assert.True(t, 0 >= orders[len(orders)-1].Value())
+	assert.Nil(t, orders[len(orders)-1].Shelf())
+}
+
+func TestKitchenEvictLeastValuable(t *testing.T) {
+	cfg := []byte(`
+        kitchen:
+          overcommit: evict_least_valuable
+          topology:
+            - name: "hot"
+              capacity: 5
+              decay_rate: 1
+              supported: 
+                - hot
+            - name: "cold"
+              capacity: 5
+              decay_rate: 0.5
+              supported: 
+                - cold`)
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes(cfg))
+	assert.Nil(t, err)
+
+	residents := make([]*Order, 5)
+	for i := range residents {
+		residents[i] = NewOrder(fmt.Sprintf("resident_%d", i), "hot", time.Hour, 0)
+		assert.Nil(t, k.CreateOrder(residents[i]))
+	}
+	// one resident is nearly expired
+	expiring := residents[2]
+	expiring.now = func() time.Time {
+		return time.Now().Add(29 * time.Minute)
+	}
+
+	// a valuable newcomer takes its slot
+	newcomer := NewOrder("newcomer", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(newcomer))
+	assert.Equal(t, Ready, newcomer.State())
+	assert.Equal(t, "hot", newcomer.Shelf().Name())
+	assert.Equal(t, Trashed, expiring.State())
+	assert.Nil(t, expiring.Shelf())
+	assert.Equal(t, 5, len(k.shelf("hot").Orders()))
+
+	// but one worth less than everything on the shelf is still trashed
+	cheap := NewOrder("cheap", "hot", time.Minute, 0)
+	assert.NotNil(t, k.CreateOrder(cheap))
+	assert.Equal(t, Trashed, cheap.State())
+	for _, order := range k.shelf("hot").Orders() {
+		assert.Equal(t, Ready, order.State())
+	}
+
+	_, err = NewKitchen(config.NewYAMLProviderFromBytes([]byte("kitchen:\n  overcommit: yolo")))
+	assert.NotNil(t, err)
+}
+
+// blockingShelf holds every Put until release is closed.
+type blockingShelf struct {
+	Shelf
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingShelf) Put(o *Order) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.Shelf.Put(o)
+}
+
+// panickyShelf panics on every Put.
+type panickyShelf struct {
+	Shelf
+}
+
+func (s *panickyShelf) Put(o *Order) error {
+	panic("shelf is on fire")
+}
+
+func TestMinimizerBackoff(t *testing.T) {
+	b := newMinimizerBackoff(minimizerConfig{MinInterval: time.Second, MaxInterval: 8 * time.Second, BusyThreshold: 2})
+	// a fake minimizer's relocation counts: idle, then busy, then a trickle that leaves the interval alone
+	relocated := []int{0, 0, 0, 0, 5, 5, 5, 5, 1}
+	expected := []time.Duration{2, 4, 8, 8, 4, 2, 1, 1, 1}
+	for i, count := range relocated {
+		assert.Equal(t, expected[i]*time.Second, b.next(count), i)
+	}
+
+	_, err := NewKitchen(config.NewYAMLProviderFromBytes(append(simpleConfig, []byte(`
+  minimizer:
+    min_interval: 10s
+    max_interval: 1s`)...)))
+	assert.NotNil(t, err)
+}
+
+func TestMinimizerRelocationCount(t *testing.T) {
+	k, err := NewKitchen(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot`)))
+	assert.Nil(t, err)
+	orders := makeOrders(2, "hot")
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Equal(t, 0, k.decayMinimizer().Relocated)
+
+	// freeing the better shelf gives the minimizer something to do, once
+	assert.Nil(t, k.SetOrderEnroute(orders[0]))
+	assert.Nil(t, k.SetOrderPickedUp(orders[0]))
+	report := k.decayMinimizer()
+	assert.Equal(t, 1, report.Relocated)
+	assert.Equal(t, ShelfReport{Capacity: 1, Before: 0, After: 1, MovedIn: 1}, report.Shelves["hot"])
+	assert.Equal(t, ShelfReport{Capacity: 2, Before: 1, After: 0, MovedOut: 1}, report.Shelves["overflow"])
+	assert.Equal(t, 1.0, report.Shelves["hot"].Utilization())
+	assert.Equal(t, "relocated 1: hot 0->1/1 (+1 -0), overflow 1->0/2 (+0 -1)", report.String())
+	assert.Equal(t, "hot", orders[1].Shelf().Name())
+	assert.Equal(t, 0, k.decayMinimizer().Relocated)
+}
+
+func TestMinimizerRecoversPanic(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported: 
+        - hot`))
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	stuck := NewOrder("stuck", "hot", time.Minute, 0)
+	expired := NewOrder("expired", "hot", time.Minute, 0)
+	assert.Nil(t, k.CreateOrder(stuck))
+	assert.Nil(t, k.CreateOrder(expired))
+	expired.now = func() time.Time {
+		return time.Now().Add(time.Hour)
+	}
+
+	// the minimizer will try to move orders onto the better, broken, shelf
+	overflow := k.shelf("overflow")
+	k.setTopology([]Shelf{overflow, &panickyShelf{NewStaticShelf("hot", 5, []string{"hot"}, 1)}}, nil)
+	k.decayMinimizer()
+
+	assert.Equal(t, uint64(1), k.MinimizerErrors())
+	assert.Equal(t, Ready, stuck.State())
+	assert.Equal(t, overflow, stuck.Shelf())
+	// the rest of the pass still ran
+	assert.Equal(t, Trashed, expired.State())
+
+	k.decayMinimizer()
+	assert.Equal(t, uint64(2), k.MinimizerErrors())
+}
+
+func TestKitchenAdmission(t *testing.T) {
+	cfg := []byte(`
+        kitchen:
+          admission:
+            max_concurrent: 4`)
+
+	provider := config.NewYAMLProviderFromBytes(cfg)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	shelf := &blockingShelf{
+		Shelf:   NewStaticShelf("hot", 50, []string{"hot"}, 1),
+		entered: make(chan struct{}, 50),
+		release: make(chan struct{}),
+	}
+	k.setTopology([]Shelf{shelf}, nil)
+
+	// fill every slot with a create that's stuck placing its order
+	inflight := makeOrders(4, "hot")
+	errs := make(chan error, len(inflight))
+	for _, order := range inflight {
+		go func(o *Order) {
+			errs <- k.CreateOrder(o)
+		}(order)
+	}
+	for range inflight {
+		<-shelf.entered
+	}
+
+	// everything else is turned away and left untouched
+	rejected := makeOrders(6, "hot")
+	wg := sync.WaitGroup{}
+	for _, order := range rejected {
+		wg.Add(1)
+		go func(o *Order) {
+			defer wg.Done()
+			assert.Equal(t, ErrOverloaded, k.CreateOrder(o))
+		}(order)
+	}
+	wg.Wait()
+	for _, o := range rejected {
+		assert.Equal(t, OrderState(""), o.State())
+	}
+
+	// the in-flight creates complete, freeing their slots
+	close(shelf.release)
+	for range inflight {
+		assert.Nil(t, <-errs)
+	}
+	for _, o := range inflight {
+		assert.Equal(t, Ready, o.State())
+	}
+	assert.Nil(t, k.CreateOrder(rejected[0]))
+	assert.Equal(t, Ready, rejected[0].State())
+}
+
+func TestKitchenMaxTotalOrders(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  max_total_orders: 3
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+
+	orders := makeOrders(3, "hot")
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Equal(t, 3, k.LiveOrders())
+
+	// the shelf has room, the kitchen doesn't
+	rejected := NewOrder("test", "hot", time.Second, 0)
+	assert.Equal(t, ErrKitchenFull, k.CreateOrder(rejected))
+	assert.Equal(t, OrderState(""), rejected.State())
+	assert.Equal(t, 3, k.LiveOrders())
+
+	// enroute orders still count, only terminal ones free a slot
+	assert.Nil(t, k.SetOrderEnroute(orders[0]))
+	assert.Equal(t, ErrKitchenFull, k.CreateOrder(rejected))
+	assert.Nil(t, k.SetOrderPickedUp(orders[0]))
+	assert.Equal(t, 2, k.LiveOrders())
+	assert.Nil(t, k.CreateOrder(rejected))
+	assert.Equal(t, 3, k.LiveOrders())
+}
+
+func TestCreateOrderWithID(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+
+	first := NewOrder("test", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrderWithID("pizza-1", first))
+	assert.Equal(t, "pizza-1", first.ID())
+	assert.Equal(t, first, k.findOrder("pizza-1"))
+
+	second := NewOrder("test", "hot", time.Hour, 0, WithID("pizza-1"))
+	assert.Equal(t, ErrDuplicateID, k.CreateOrder(second))
+	assert.Equal(t, OrderState(""), second.State())
+	assert.Equal(t, 1, k.LiveOrders())
+
+	// the ID is free again once the first order is done with
+	assert.Nil(t, k.SetOrderEnroute(first))
+	assert.Nil(t, k.SetOrderPickedUp(first))
+	assert.Nil(t, k.CreateOrder(second))
+	assert.Equal(t, second, k.findOrder("pizza-1"))
+}
+
+func TestSequentialOrderIDs(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  order_ids: sequential
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+
+	orders := makeOrders(3, "hot")
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Equal(t, "1", orders[0].ID())
+	assert.Equal(t, "2", orders[1].ID())
+	assert.Equal(t, "3", orders[2].ID())
+
+	// supplied IDs are left alone, and can't collide with the sequence
+	supplied := NewOrder("test", "hot", time.Hour, 0, WithID("2"))
+	assert.Equal(t, ErrDuplicateID, k.CreateOrder(supplied))
+
+	// and the sequence skips IDs the caller already used
+	supplied = NewOrder("test", "hot", time.Hour, 0, WithID("4"))
+	assert.Nil(t, k.CreateOrder(supplied))
+	next := NewOrder("test", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(next))
+	assert.Equal(t, "5", next.ID())
+
+	_, err = NewFromConfig(append(simpleConfig, []byte("\n  order_ids: snowflake")...))
+	assert.NotNil(t, err)
+}
+
+func TestKitchenUnsupported(t *testing.T) {
+	// topology only has hot or cold shelves
+	provider := config.NewYAMLProviderFromBytes(simpleConfig)
+	k, err := NewKitchen(provider)
+	assert.NotNil(t, k)
+	assert.Nil(t, err)
+
+	orders := makeOrders(5, "frozen")
+
+	// populate kitchen with 5 orders that are unsupported
+	for i := 0; i < len(orders)-1; i++ {
+		k.CreateOrder(orders[i])
+		k.SetOrderReady(orders[i])
+		// they get trashed since there is no shelf for them
+		assert.Equal(t, Trashed, orders[i].State())
+		assert.True(t, 0 >= orders[i].Value())
+		assert.Nil(t, orders[i].Shelf())
+	}
+}
+
+func TestKitchenConcurrentReadyIndex(t *testing.T) {
+	// storage is indexed first for both temps, but is the worst shelf
+	cfg := []byte(`
+        kitchen:
+          minimize_decay: false
+          topology:
+            - name: "storage"
+              capacity: 50
+              decay_rate: 2
+              supported: 
+                - cold
+                - hot
+            - name: "hot"
+              capacity: 50
+              decay_rate: 1
+              supported: 
+                - hot
+            - name: "cold"
+              capacity: 50
+              decay_rate: 0.5
+              supported: 
+                - cold`)
+
+	provider := config.NewYAMLProviderFromBytes(cfg)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	hot := []Shelf{k.supportedIndex["hot"][0], k.supportedIndex["hot"][1]}
+	cold := []Shelf{k.supportedIndex["cold"][0], k.supportedIndex["cold"][1]}
+	assert.Equal(t, "storage", hot[0].Name())
+	assert.Equal(t, "storage", cold[0].Name())
+
+	orders := append(makeOrders(25, "hot"), makeOrders(25, "cold")...)
+	wg := sync.WaitGroup{}
+	for _, order := range orders {
+		wg.Add(1)
+		go func(o *Order) {
+			defer wg.Done()
+			k.CreateOrder(o)
+		}(order)
+	}
+	wg.Wait()
+
+	// the index must be untouched
+	assert.Equal(t, hot, k.supportedIndex["hot"])
+	assert.Equal(t, cold, k.supportedIndex["cold"])
+
+	// and every order landed on the best shelf for its temp
+	for _, o := range orders {
+		assert.Equal(t, Ready, o.State())
+		assert.Equal(t, o.Temp(), o.Shelf().Name())
+	}
+}
+
+func TestKitchenReconfigureAddShelf(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes(simpleConfig)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	hot := NewOrder("test1", "hot", 100*time.Second, .2)
+	k.CreateOrder(hot)
+	assert.Equal(t, "hot", hot.Shelf().Name())
+	hotShelf := hot.Shelf()
+
+	// a frozen order can't be placed yet
+	frozen := NewOrder("test2", "frozen", 100*time.Second, .2)
+	assert.NotNil(t, k.CreateOrder(frozen))
+
+	err = k.Reconfigure(config.NewYAMLProviderFromBytes(simpleConfig, []byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "cold"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - cold
+    - name: "freezer"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - frozen`)))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(k.shelvesAsc))
+
+	// the unchanged shelf and its order are untouched
+	assert.Equal(t, Ready, hot.State())
+	assert.True(t, hotShelf == hot.Shelf())
+	assert.Equal(t, hot, k.findOrder(hot.ID()))
+
+	frozen = NewOrder("test3", "frozen", 100*time.Second, .2)
+	assert.Nil(t, k.CreateOrder(frozen))
+	assert.Equal(t, "freezer", frozen.Shelf().Name())
+}
+
+func TestKitchenReconfigurePlacement(t *testing.T) {
+	topology := `
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+        - cold
+    - name: "storage"
+      capacity: 5
+      decay_rate: 2
+      supported:
+        - hot
+        - cold`
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  default_decay_rates:
+    hot: 0.5` + topology))
+	assert.Nil(t, err)
+	defer k.Close()
+
+	before := NewOrder("before", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(before))
+	assert.Equal(t, "hot", before.Shelf().Name())
+	assert.Equal(t, 0.5, before.DecayRate())
+
+	err = k.Reconfigure(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  default_decay_rates:
+    hot: 0.25
+  preferences:
+    hot:
+      - storage
+  fallbacks:
+    cold:
+      - storage` + topology)))
+	assert.Nil(t, err)
+
+	// new orders are placed and rated by the reloaded config
+	hot := NewOrder("hot", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(hot))
+	assert.Equal(t, "storage", hot.Shelf().Name())
+	assert.Equal(t, 0.25, hot.DecayRate())
+	cold := NewOrder("cold", "cold", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(cold))
+	assert.Equal(t, "storage", cold.Shelf().Name())
+	name, ok := k.PreviewPlacement("cold")
+	assert.True(t, ok)
+	assert.Equal(t, "storage", name)
+
+	// orders already created keep their base rate
+	assert.Equal(t, 0.5, before.DecayRate())
+
+	// and dropping them on a later reload drops them from placement too
+	assert.Nil(t, k.Reconfigure(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:`+topology))))
+	cold = NewOrder("cold2", "cold", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(cold))
+	assert.Equal(t, "hot", cold.Shelf().Name())
+	hot = NewOrder("hot2", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(hot))
+	assert.Equal(t, "hot", hot.Shelf().Name())
+	assert.Equal(t, 0.0, hot.DecayRate())
+}
+
+func TestKitchenReconfigureRemoveShelf(t *testing.T) {
+	cfg := []byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 1
+      decay_rate: 2
+      supported: 
+        - hot
+        - cold
+    - name: "cold"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - cold`)
+	provider := config.NewYAMLProviderFromBytes(cfg)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	orders := append(makeOrders(1, "hot"), makeOrders(2, "cold")...)
+	for _, o := range orders {
+		assert.Nil(t, k.CreateOrder(o))
+	}
+	assert.Equal(t, "hot", orders[0].Shelf().Name())
+	assert.Equal(t, "cold", orders[1].Shelf().Name())
+	assert.Equal(t, "overflow", orders[2].Shelf().Name())
+
+	// drop cold, its order has nowhere to go since overflow is full
+	err = k.Reconfigure(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - hot
+    - name: "overflow"
+      capacity: 1
+      decay_rate: 2
+      supported: 
+        - hot
+        - cold`)))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(k.shelvesAsc))
+	assert.Equal(t, 1, len(k.supportedIndex["cold"]))
+
+	assert.Equal(t, "hot", orders[0].Shelf().Name())
+	assert.Equal(t, Trashed, orders[1].State())
+	assert.Nil(t, orders[1].Shelf())
+	assert.Equal(t, "overflow", orders[2].Shelf().Name())
+
+	// now swap the overflow for a cold shelf
+	err = k.Reconfigure(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - hot
+    - name: "cold"
+      capacity: 1
+      decay_rate: 0.5
+      supported: 
+        - cold`)))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(k.shelvesAsc))
+
+	// the order from overflow moved to the new cold shelf, and is still reachable
+	assert.Equal(t, "hot", orders[0].Shelf().Name())
+	assert.Equal(t, Ready, orders[2].State())
+	assert.Equal(t, "cold", orders[2].Shelf().Name())
+	assert.Equal(t, orders[2], k.findOrder(orders[2].ID()))
+	assert.Equal(t, 2, len(k.GetOrders()))
+}
+
+func TestKitchenReconfigureConcurrentCreates(t *testing.T) {
+	topology := func(capacity int) []byte {
+		return []byte(fmt.Sprintf(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: %d
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: %d
+      decay_rate: 2
+      supported:
+        - hot`, capacity, capacity))
+	}
+	k, err := NewFromConfig(topology(1000))
+	assert.Nil(t, err)
+	defer k.Close()
+
+	// every reload replaces both shelves while orders are being placed on them
+	done := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			assert.Nil(t, k.Reconfigure(config.NewYAMLProviderFromBytes(topology(1000+i%2))))
+		}
+	}()
+	orders := make([]*Order, 200)
+	var creates sync.WaitGroup
+	for i := range orders {
+		orders[i] = NewOrder("test", "hot", time.Hour, 1)
+		creates.Add(1)
+		go func(order *Order) {
+			defer creates.Done()
+			assert.Nil(t, k.CreateOrder(order))
+		}(orders[i])
+	}
+	creates.Wait()
+	close(done)
+	reloads.Wait()
+
+	// none were left behind on a removed shelf
+	shelves := make(map[Shelf]bool)
+	for _, shelf := range k.Shelves() {
+		shelves[shelf] = true
+	}
+	for _, order := range orders {
+		assert.Equal(t, Ready, order.State())
+		assert.True(t, shelves[order.Shelf()], order.ID())
+		assert.Equal(t, order, k.findOrder(order.ID()))
+	}
+	assert.Equal(t, len(orders), k.LiveOrders())
+}
+
+func TestGetOrderNoLeak(t *testing.T) {
+	provider := config.NewYAMLProviderFromBytes(simpleConfig)
+	k, err := NewKitchen(provider)
+	assert.Nil(t, err)
+
+	order := NewOrder("test1", "hot", 1*time.Minute, .2)
+	k.CreateOrder(order)
+	assert.Equal(t, Ready, order.State())
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 1000; i++ {
+		assert.NotNil(t, k.GetOrder(order.ID()))
+	}
+
+	// give the losing shelves a moment to finish their sends
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, runtime.NumGoroutine() <= before)
+}
+
+func setupKitchen(cfg []byte, types []string, numOrders int, expiry time.Duration) ([]*Order, *Kitchen) {
+	provider := config.NewYAMLProviderFromBytes(cfg)
+	k, _ := NewKitchen(provider)
+	rand.Seed(1)
+	orders := make([]*Order, numOrders)
+	for i := 0; i < numOrders; i++ {
+		r := rand.Float64()
+		orderType := types[int(r)*len(types)]
+		if expiry == 0 {
+			expiry = time.Duration(rand.Intn(15)) * time.Second
+		}
+		order := NewOrder(fmt.Sprintf("bench_%d", i), orderType, expiry, rand.Float64())
+		orders[i] = order
+		k.CreateOrder(order)
+	}
+	return orders, k
+}
+
+func TestManyOrders(t *testing.T) {
+	cfg := []byte(`
+        kitchen:
+          minimize_decay: true
+          topology:
+            - name: "storage"
+              capacity: 15
+              decay_rate: 2
+              supported: 
+                - cold
+                - hot
+            - name: "hot"
+              capacity: 15
+              decay_rate: 1
+              supported: 
+                - hot
+            - name: "cold"
+              capacity: 15
+              decay_rate: 0.5
+              supported: 
+                - cold`)
+	orders, k := setupKitchen(cfg, []string{"cold", "hot"}, 30, time.Second*30)
+	wg := sync.WaitGroup{}
+	for _, order := range orders {
+		wg.Add(1)
+		go func(o *Order) {
+			defer wg.Done()
+			sleep := time.Second * time.Duration(rand.Intn(10))
+			k.SetOrderReady(o)
+			// the minimizer only relocates orders until a courier is dispatched
+			time.Sleep(sleep)
+			k.SetOrderEnroute(o)
+			k.SetOrderPickedUp(o)
+		}(order)
+	}
+	wg.Wait()
+
+	values := make([]float64, len(orders))
+	rawValues := make([]float64, len(orders))
+	normalValues := make([]float64, len(orders))
+	decayValues := make([]float64, len(orders))
+	counts := map[OrderState]int{
+		Created:  0,
+		Ready:    0,
+		Enroute:  0,
+		PickedUp: 0,
+		Trashed:  0,
+	}
+	for i, order := range orders {
+		values[i] = order.Value()
+		rawValues[i] = order.RawValue()
+		normalValues[i] = order.NormalizedValue()
+		decayValues[i] = order.Decayed()
+		counts[order.State()]++
+	}
+
+	// assert that all orders completed
+	assert.Equal(t, len(orders), counts[PickedUp])
+	assert.Equal(t, 0, counts[Trashed])
+}
+
+func BenchmarkOrders(b *testing.B) {
+	benchmarkMinimizer(b, 0)
+}
+
+// BenchmarkOrdersBounded is BenchmarkOrders with the minimizer's goroutines bounded, see minimizer.parallelism.
+func BenchmarkOrdersBounded(b *testing.B) {
+	benchmarkMinimizer(b, runtime.NumCPU())
+}
+
+func benchmarkMinimizer(b *testing.B, parallelism int) {
+	cfg := []byte(fmt.Sprintf(`
+        kitchen:
+          minimize_decay: true
+          minimizer:
+            parallelism: %d
+          topology:
+            - name: "storage"
+              capacity: 1500
+              decay_rate: 2
+              supported: 
+                - cold
+                - hot
+                - frozen
             - name: "hot"
               capacity: 400
               decay_rate: 1
               supported: 
-                - hot
-            - name: "cold"
-              capacity: 400
-              decay_rate: 0.5
+                - hot
+            - name: "cold"
+              capacity: 400
+              decay_rate: 0.5
+              supported: 
+                - cold`, parallelism))
+	orders, k := setupKitchen(cfg, []string{"cold", "hot", "frozen"}, 2000, 0)
+	for _, o := range orders {
+		k.CreateOrder(o)
+		k.SetOrderReady(o)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		k.decayMinimizer()
+	}
+}
+
+func benchmarkShelf(b *testing.B) Shelf {
+	shelf := NewStaticShelf("hot", 1000, []string{"hot"}, 1)
+	for _, o := range makeOrders(1000, "hot") {
+		shelf.Put(o)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return shelf
+}
+
+func BenchmarkShelfOrders(b *testing.B) {
+	shelf := benchmarkShelf(b)
+	for n := 0; n < b.N; n++ {
+		shelf.Orders()
+	}
+}
+
+// OrdersInto should be allocation free once the buffer has grown.
+func BenchmarkShelfOrdersInto(b *testing.B) {
+	shelf := benchmarkShelf(b)
+	var buf []*Order
+	for n := 0; n < b.N; n++ {
+		buf = shelfOrdersInto(shelf, buf)
+	}
+}
+
+// Benchmark scatter-gather GetOrder implementation.
+
+func BenchmarkGetOrder(b *testing.B) {
+	cfg := []byte(`
+        kitchen:
+          minimize_decay: false
+          topology:
+            - name: "test1"
+              capacity: 5
+              decay_rate: 1
+              supported: 
+                - test1
+            - name: "test2"
+              capacity: 5
+              decay_rate: 1
               supported: 
-                - cold`)
-	orders, k := setupKitchen(cfg, []string{"cold", "hot", "frozen"}, 2000, 0)
+                - test2
+            - name: "test3"
+              capacity: 5
+              decay_rate: 1
+              supported: 
+                - test3`)
+	orders, k := setupKitchen(cfg, []string{"test1", "test2", "test3"}, 30, time.Hour)
+	for _, o := range orders {
+		k.CreateOrder(o)
+		k.SetOrderReady(o)
+	}
+	id := orders[0].ID()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		k.GetOrder(id)
+	}
+}
+
+// Benchmark scatter-gather GetOrder implementation when many running in parallel.
+func BenchmarkGetOrderContention(b *testing.B) {
+	cfg := []byte(`
+    kitchen:
+      minimize_decay: false
+      topology:
+        - name: "test1"
+          capacity: 5
+          decay_rate: 1
+          supported: 
+            - test1
+        - name: "test2"
+          capacity: 5
+          decay_rate: 1
+          supported: 
+            - test2
+        - name: "test3"
+          capacity: 5
+          decay_rate: 1
+          supported: 
+            - test3`)
+	orders, k := setupKitchen(cfg, []string{"test1", "test2", "test3"}, 30, time.Hour)
 	for _, o := range orders {
 		k.CreateOrder(o)
 		k.SetOrderReady(o)
 	}
-	for n := 0; n < b.N; n++ {
-		k.decayMinimizer()
+	id := orders[0].ID()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			k.GetOrder(id)
+		}
+	})
+}
+
+func BenchmarkCreateOrderContention(b *testing.B) {
+	cfg := []byte(`
+    kitchen:
+      minimize_decay: false
+      topology:
+        - name: "test1"
+          capacity: 5
+          decay_rate: 1
+          supported: 
+            - test1
+        - name: "test2"
+          capacity: 5
+          decay_rate: 1
+          supported: 
+            - test2
+        - name: "test3"
+          capacity: 5
+          decay_rate: 1
+          supported: 
+            - test3`)
+	orders, k := setupKitchen(cfg, []string{"test1", "test2", "test3"}, 30, time.Hour)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			o := orders[rand.Intn(30)]
+			k.CreateOrder(o)
+			k.SetOrderReady(o)
+		}
+	})
+}
+
+// benchmarkShelfPut puts orders on a shelf from parallel goroutines, maxBatch at a time the way the batcher
+// places them, taking each off again so the shelf never fills. Each goroutine reuses its own orders, so the
+// shelf's lock is most of the work.
+func benchmarkShelfPut(b *testing.B, maxBatch int) {
+	shelf := NewStaticShelf("hot", 1024, []string{"hot"}, 1)
+	var goroutines int32
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddInt32(&goroutines, 1)
+		orders := make([]*Order, maxBatch)
+		for i := range orders {
+			orders[i] = NewOrder("bench", "hot", time.Hour, 1, WithID(fmt.Sprintf("%d-%d", id, i)))
+		}
+		batch := orders[:0]
+		for pb.Next() {
+			batch = append(batch, orders[len(batch)])
+			if len(batch) < maxBatch {
+				continue
+			}
+			if maxBatch == 1 {
+				shelf.Put(batch[0])
+			} else {
+				putBatch(shelf, batch)
+			}
+			for _, o := range batch {
+				shelf.Remove(o.ID())
+			}
+			batch = batch[:0]
+		}
+	})
+}
+
+func BenchmarkShelfPutUnbatched(b *testing.B) {
+	benchmarkShelfPut(b, 1)
+}
+
+func BenchmarkShelfPutBatched(b *testing.B) {
+	benchmarkShelfPut(b, 32)
+}
+
+func TestBatchedAdmission(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	newKitchen := func(maxBatch int) *Kitchen {
+		k, err := NewFromConfig([]byte(fmt.Sprintf(`
+kitchen:
+  admission:
+    max_batch: %d
+  topology:
+    - name: "hot"
+      type: heap
+      capacity: 2
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "warm"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot
+      admission:
+        min_value: 30s
+    - name: "overflow"
+      capacity: 2
+      decay_rate: 3
+      supported:
+        - hot`, maxBatch)), WithClock(clock))
+		assert.Nil(t, err)
+		return k
+	}
+	shelfLives := []time.Duration{60, 10, 60, 20, 20, 60, 60, 60}
+	newOrders := func() []*Order {
+		orders := make([]*Order, len(shelfLives))
+		for i, shelfLife := range shelfLives {
+			orders[i] = NewOrder("test", "hot", shelfLife*time.Second, 1, WithID(fmt.Sprintf("o%d", i)))
+		}
+		return orders
+	}
+	layout := func(orders []*Order) map[string]string {
+		shelves := make(map[string]string, len(orders))
+		for _, order := range orders {
+			if order.Shelf() != nil {
+				shelves[order.ID()] = order.Shelf().Name()
+			}
+		}
+		return shelves
+	}
+
+	// one at a time
+	unbatched := newKitchen(0)
+	defer unbatched.Close()
+	assert.Nil(t, unbatched.batcher)
+	expected := newOrders()
+	for _, order := range expected {
+		unbatched.CreateOrder(order)
+	}
+
+	// all in one batch, the orders worth less than 30s skip warm and only six fit
+	batched := newKitchen(len(shelfLives))
+	defer batched.Close()
+	orders := newOrders()
+	batch := make([]*batchEntry, len(orders))
+	for i, order := range orders {
+		assert.True(t, batched.claimID(order.ID()))
+		batched.acceptOrder(order)
+		batch[i] = &batchEntry{order: order}
+	}
+	batched.placeBatch(batch)
+	assert.Equal(t, layout(expected), layout(orders))
+	assert.Len(t, layout(orders), 6)
+	for i, entry := range batch {
+		assert.Equal(t, entry.order.Shelf() != nil, entry.placed, i)
+	}
+	assert.Len(t, batched.shelf("hot").(*heapShelf).lowestValued(3), 2)
+
+	// concurrent creates are placed once each, on shelves that never go over capacity
+	batched = newKitchen(4)
+	defer batched.Close()
+	orders = make([]*Order, 20)
+	var wg sync.WaitGroup
+	for i := range orders {
+		orders[i] = NewOrder("test", "hot", time.Minute, 1)
+		wg.Add(1)
+		go func(order *Order) {
+			defer wg.Done()
+			batched.CreateOrder(order)
+		}(orders[i])
+	}
+	wg.Wait()
+	onShelves := make(map[string]string)
+	for _, shelf := range batched.Shelves() {
+		assert.True(t, len(shelf.Orders()) <= shelf.Capacity(), shelf.Name())
+		for _, order := range shelf.Orders() {
+			_, seen := onShelves[order.ID()]
+			assert.False(t, seen, order.ID())
+			onShelves[order.ID()] = shelf.Name()
+		}
+	}
+	assert.Equal(t, layout(orders), onShelves)
+	assert.Len(t, onShelves, 6)
+	for _, order := range orders {
+		if order.Shelf() == nil {
+			assert.Equal(t, Trashed, order.State())
+			assert.Equal(t, TrashNoCapacity, order.TrashedReason())
+		} else {
+			assert.Equal(t, Ready, order.State())
+		}
+	}
+
+	// orders already placed aren't placed again
+	var placed *Order
+	for _, order := range orders {
+		if order.Shelf() != nil {
+			placed = order
+			break
+		}
+	}
+	if placed == nil {
+		t.Fatal("no order was placed")
+	}
+	shelf := placed.Shelf()
+	clock.Advance(time.Minute)
+	assert.IsType(t, &TransitionError{}, batched.SetOrderReady(placed))
+	assert.Equal(t, Ready, placed.State())
+	assert.True(t, shelf == placed.Shelf())
+
+	_, err := NewFromConfig([]byte(`
+kitchen:
+  admission:
+    max_batch: -1`))
+	assert.NotNil(t, err)
+}
+
+func ExampleNewFromConfig() {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 10
+      decay_rate: 1
+      supported:
+        - hot`))
+	if err != nil {
+		panic(err)
+	}
+	defer k.Close()
+
+	order := NewOrder("pizza", "hot", time.Hour, 0)
+	if err := k.CreateOrder(order); err != nil {
+		panic(err)
+	}
+	fmt.Println(order.State(), order.Shelf().Name(), len(k.GetOrders()))
+
+	for _, state := range []OrderState{Enroute, PickedUp} {
+		if _, err := k.UpdateOrder(order.ID(), state); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println(order.State(), len(k.GetOrders()))
+	// Output:
+	// ready hot 1
+	// pickedup 0
+}
+
+func TestCancelOrder(t *testing.T) {
+	k, err := NewFromConfig(simpleConfig)
+	assert.Nil(t, err)
+	_, err = k.CancelOrder("missing")
+	assert.Equal(t, ErrOrderNotFound, err)
+
+	order := NewOrder("test", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(order))
+	_, err = k.CancelOrder(order.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, Trashed, order.State())
+	assert.Nil(t, k.GetOrder(order.ID()))
+
+	// too late once the courier is on the way
+	order = NewOrder("test", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(order))
+	_, err = k.UpdateOrder(order.ID(), Enroute)
+	assert.Nil(t, err)
+	_, err = k.CancelOrder(order.ID())
+	assert.IsType(t, &TransitionError{}, err)
+	assert.Equal(t, Enroute, order.State())
+
+	_, err = k.UpdateOrder(order.ID(), Trashed)
+	assert.Equal(t, ErrUnknownState, err)
+}
+
+// TestConcurrentMovesConserveDecay moves the same orders between shelves from many goroutines at once, along
+// with minimizer passes. Orders are locked before shelves on every path, so this mustn't deadlock, and each
+// leg on a shelf must be banked exactly once however the moves interleave.
+func TestConcurrentMovesConserveDecay(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "a"
+      capacity: 20
+      decay_rate: 0.5
+      supported:
+        - hot
+    - name: "b"
+      capacity: 20
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "c"
+      capacity: 20
+      decay_rate: 2
+      supported:
+        - hot
+    - name: "d"
+      capacity: 20
+      decay_rate: 3
+      supported:
+        - hot`), WithClock(clock))
+	assert.Nil(t, err)
+	names := []string{"a", "b", "c", "d"}
+
+	orders := make([]*Order, 20)
+	for i := range orders {
+		orders[i] = NewOrder(fmt.Sprintf("test_%d", i), "hot", 24*time.Hour, 0)
+		assert.Nil(t, k.CreateOrder(orders[i]))
+	}
+	expected := make([]float64, len(orders))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 0; round < 20; round++ {
+			wg := sync.WaitGroup{}
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(seed))
+					for i := 0; i < 50; i++ {
+						order := orders[r.Intn(len(orders))]
+						k.MoveOrder(order.ID(), names[r.Intn(len(names))])
+					}
+				}(int64(round*8 + g))
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				k.decayMinimizer()
+			}()
+			wg.Wait()
+
+			// the kitchen is quiet between rounds, so each order decays at its shelf's rate until the next
+			for i, order := range orders {
+				expected[i] += order.Shelf().Decay() * float64(time.Second)
+			}
+			clock.Advance(time.Second)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("deadlocked moving orders")
+	}
+
+	total := 0
+	for _, name := range names {
+		total += len(k.shelf(name).Orders())
+	}
+	assert.Equal(t, len(orders), total)
+	for i, order := range orders {
+		assert.Equal(t, Ready, order.State())
+		assert.InEpsilon(t, expected[i], order.Decayed(), 1e-9, order.ID())
+	}
+}
+
+func TestConcurrentOptimizeKeepsOrdersShelved(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "a"
+      capacity: 4
+      decay_rate: 0.5
+      supported:
+        - hot
+    - name: "b"
+      capacity: 4
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "c"
+      capacity: 40
+      decay_rate: 2
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+	shelvesAsc, _ := k.shelves()
+
+	orders := make([]*Order, 30)
+	for i := range orders {
+		orders[i] = NewOrder(fmt.Sprintf("test_%d", i), "hot", 24*time.Hour, 0)
+		assert.Nil(t, k.CreateOrder(orders[i]))
+	}
+
+	// a live order is on exactly the shelf it points to, every time it's looked at. moves hold the order's lock
+	// from the put on the new shelf to the removal from the old one, so the read lock sees either side of it.
+	var misplaced int64
+	check := func(order *Order) {
+		order.RLock()
+		defer order.RUnlock()
+		switch order.state {
+		case PickedUp, Trashed:
+			if order.shelf != nil {
+				atomic.AddInt64(&misplaced, 1)
+			}
+		default:
+			if order.shelf == nil {
+				atomic.AddInt64(&misplaced, 1)
+			} else if _, err := order.shelf.Get(order.id); err != nil {
+				atomic.AddInt64(&misplaced, 1)
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	checked := make(chan struct{})
+	go func() {
+		defer close(checked)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, order := range orders {
+				check(order)
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wg := sync.WaitGroup{}
+		// optimize passes race each other for the few slots on a and b, so puts fail after the room was checked
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < 500; i++ {
+					k.optimizePlacement(orders[r.Intn(len(orders))], shelvesAsc)
+				}
+			}(int64(g))
+		}
+		// while orders are demoted to free slots, and picked up
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(100))
+			for i := 0; i < 500; i++ {
+				k.MoveOrder(orders[r.Intn(len(orders))].ID(), "c")
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, order := range orders[:10] {
+				k.SetOrderEnroute(order)
+				k.SetOrderPickedUp(order)
+			}
+		}()
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("deadlocked optimizing placements")
+	}
+	close(stop)
+	<-checked
+
+	for _, order := range orders {
+		check(order)
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&misplaced))
+	total := 0
+	for _, shelf := range shelvesAsc {
+		total += len(shelf.Orders())
+	}
+	assert.Equal(t, 20, total)
+}
+
+func TestOrdersByShelf(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "a"
+      capacity: 10
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "b"
+      capacity: 10
+      decay_rate: 2
+      supported:
+        - hot
+    - name: "empty"
+      capacity: 10
+      decay_rate: 1
+      supported:
+        - cold`))
+	assert.Nil(t, err)
+	orders := makeOrders(15, "hot")
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+
+	layout := k.OrdersByShelf()
+	assert.Equal(t, 10, len(layout["a"]))
+	assert.Equal(t, 5, len(layout["b"]))
+	assert.Equal(t, 0, len(layout["empty"]))
+
+	// orders being moved are still reported exactly once
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				k.MoveOrder(orders[r.Intn(len(orders))].ID(), []string{"a", "b"}[r.Intn(2)])
+			}
+		}(rand.New(rand.NewSource(int64(g))))
+	}
+	for i := 0; i < 200; i++ {
+		seen := make(map[string]bool)
+		for _, shelfOrders := range k.OrdersByShelf() {
+			for _, order := range shelfOrders {
+				assert.False(t, seen[order.ID()])
+				seen[order.ID()] = true
+			}
+		}
+		assert.Equal(t, len(orders), len(seen))
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestTrashReasons(t *testing.T) {
+	hotConfig := func(extra string) []byte {
+		return []byte(`
+kitchen:` + extra + `
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`)
+	}
+
+	t.Run("expired", func(t *testing.T) {
+		clock := &manualClock{now: time.Now()}
+		k, err := NewFromConfig(hotConfig(""), WithClock(clock))
+		assert.Nil(t, err)
+		events, unsubscribe := k.Subscribe()
+		defer unsubscribe()
+		order := NewOrder("test", "hot", 10*time.Second, 0)
+		assert.Nil(t, k.CreateOrder(order))
+		clock.Advance(time.Minute)
+		k.decayMinimizer()
+		assert.Equal(t, TrashExpired, order.TrashedReason())
+		for event := range events {
+			if event.NewState == Trashed {
+				assert.Equal(t, TrashExpired, event.Reason)
+				break
+			}
+			assert.Equal(t, TrashReason(""), event.Reason)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		k, err := NewFromConfig(hotConfig(""))
+		assert.Nil(t, err)
+		order := NewOrder("test", "frozen", time.Hour, 0)
+		assert.NotNil(t, k.CreateOrder(order))
+		assert.Equal(t, TrashUnsupported, order.TrashedReason())
+	})
+
+	t.Run("no capacity", func(t *testing.T) {
+		k, err := NewFromConfig(hotConfig(""))
+		assert.Nil(t, err)
+		orders := makeOrders(2, "hot")
+		assert.Nil(t, k.CreateOrder(orders[0]))
+		assert.NotNil(t, k.CreateOrder(orders[1]))
+		assert.Equal(t, TrashReason(""), orders[0].TrashedReason())
+		assert.Equal(t, TrashNoCapacity, orders[1].TrashedReason())
+	})
+
+	t.Run("evicted", func(t *testing.T) {
+		k, err := NewFromConfig(hotConfig("\n  overcommit: evict_least_valuable"))
+		assert.Nil(t, err)
+		resident := NewOrder("resident", "hot", time.Second, 0)
+		assert.Nil(t, k.CreateOrder(resident))
+		assert.Nil(t, k.CreateOrder(NewOrder("newcomer", "hot", time.Hour, 0)))
+		assert.Equal(t, TrashEvicted, resident.TrashedReason())
+	})
+
+	t.Run("reaped", func(t *testing.T) {
+		clock := &manualClock{now: time.Now()}
+		k, err := NewFromConfig(reaperTestConfig, WithClock(clock))
+		assert.Nil(t, err)
+		order := NewOrder("test", "hot", 24*time.Hour, 0)
+		assert.Nil(t, k.CreateOrder(order))
+		clock.Advance(time.Hour)
+		k.reap()
+		assert.Equal(t, TrashReaped, order.TrashedReason())
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		k, err := NewFromConfig(hotConfig(""))
+		assert.Nil(t, err)
+		order := NewOrder("test", "hot", time.Hour, 0)
+		assert.Nil(t, k.CreateOrder(order))
+		_, err = k.CancelOrder(order.ID())
+		assert.Nil(t, err)
+		assert.Equal(t, TrashCancelled, order.TrashedReason())
+		assert.Equal(t, TrashCancelled, order.Snapshot().TrashedReason)
+	})
+
+	t.Run("shelf removed", func(t *testing.T) {
+		k, err := NewFromConfig(hotConfig(""))
+		assert.Nil(t, err)
+		order := NewOrder("test", "hot", time.Hour, 0)
+		assert.Nil(t, k.CreateOrder(order))
+		assert.Nil(t, k.Reconfigure(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  topology:
+    - name: "cold"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - cold`))))
+		assert.Equal(t, TrashShelfRemoved, order.TrashedReason())
+	})
+}
+
+func heapConfig(shelfType string, capacity int) []byte {
+	return []byte(fmt.Sprintf(`
+kitchen:
+  topology:
+    - name: "hot"
+      type: %s
+      capacity: %d
+      decay_rate: 1
+      supported:
+        - hot`, shelfType, capacity))
+}
+
+func TestHeapShelfMatchesScan(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig(heapConfig("heap", 50), WithClock(clock))
+	assert.Nil(t, err)
+	shelf := k.shelf("hot")
+	assert.IsType(t, &heapShelf{}, shelf)
+
+	r := rand.New(rand.NewSource(1))
+	orders := make([]*Order, 50)
+	for i := range orders {
+		shelfLife := time.Duration(60+r.Intn(600)) * time.Second
+		orders[i] = NewOrder(fmt.Sprintf("test_%d", i), "hot", shelfLife, r.Float64())
+		assert.Nil(t, k.CreateOrder(orders[i]))
+	}
+
+	// bruteForce is the least valuable order that isn't enroute, by scanning
+	bruteForce := func() *Order {
+		var least *Order
+		for _, order := range shelf.Orders() {
+			if order.State() != Enroute && (least == nil || order.Value() < least.Value()) {
+				least = order
+			}
+		}
+		return least
+	}
+
+	for step := 0; step < 20; step++ {
+		// values are only exact right after a refresh
+		clock.Advance(heapRefreshInterval)
+		assert.Equal(t, bruteForce().ID(), k.LeastValuableOrder("hot").ID(), "step %d", step)
+
+		sorted := shelfOrdersSorted(shelf, func(a, b *Order) bool { return a.Value() < b.Value() })
+		assert.Equal(t, sorted[:5], shelf.(*heapShelf).lowestValued(5), "step %d", step)
+
+		// churn the shelf between steps
+		order := orders[r.Intn(len(orders))]
+		switch r.Intn(3) {
+		case 0:
+			k.SetOrderEnroute(order)
+		case 1:
+			k.CancelOrder(order.ID())
+		}
+	}
+	assert.Equal(t, len(shelf.Orders()), shelf.(*heapShelf).heap.Len())
+}
+
+func benchmarkLeastValuable(b *testing.B, shelfType string) {
+	k, err := NewFromConfig(heapConfig(shelfType, 1000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		k.CreateOrder(NewOrder("test", "hot", time.Duration(60+i)*time.Second, rand.Float64()))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k.LeastValuableOrder("hot")
+	}
+}
+
+func BenchmarkLeastValuableStatic(b *testing.B) {
+	benchmarkLeastValuable(b, "static")
+}
+
+func BenchmarkLeastValuableHeap(b *testing.B) {
+	benchmarkLeastValuable(b, "heap")
+}
+
+func TestSetPriority(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 0.5
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+
+	resident := NewOrder("resident", "hot", time.Hour, 0)
+	low := NewOrder("low", "hot", time.Hour, 0, WithPriority(-1))
+	order := NewOrder("order", "hot", time.Hour, 0)
+	for _, o := range []*Order{resident, low, order} {
+		assert.Nil(t, k.CreateOrder(o))
+	}
+	assert.Equal(t, "hot", resident.Shelf().Name())
+
+	// an equal priority doesn't displace the resident
+	_, err = k.SetPriority(order.ID(), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "overflow", order.Shelf().Name())
+
+	// a higher one swaps their shelves, orders already below the better shelf are left alone
+	_, err = k.SetPriority(order.ID(), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, order.Priority())
+	assert.Equal(t, "hot", order.Shelf().Name())
+	assert.Equal(t, "overflow", resident.Shelf().Name())
+	assert.Equal(t, "overflow", low.Shelf().Name())
+
+	// lowering it again leaves the order where it is
+	_, err = k.SetPriority(order.ID(), -5)
+	assert.Nil(t, err)
+	assert.Equal(t, "hot", order.Shelf().Name())
+
+	_, err = k.SetPriority("missing", 1)
+	assert.Equal(t, ErrOrderNotFound, err)
+
+	// terminal orders are rejected, even if they're still found
+	assert.Nil(t, k.trash(low, Ready, TrashCancelled))
+	assert.IsType(t, &TransitionError{}, low.setPriority(1))
+	assert.Equal(t, -1, low.Priority())
+}
+
+func TestReheat(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  reheat:
+    max_reheats: 2
+    penalty: 0.5
+  topology:
+    - name: "hot"
+      capacity: 2
+      decay_rate: 1
+      supported:
+        - hot`), WithClock(clock))
+	assert.Nil(t, err)
+
+	order := NewOrder("test", "hot", 100*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	clock.Advance(10 * time.Second)
+	// 90s raw, less 10s of base decay and 10s on the shelf
+	assert.Equal(t, float64(70*time.Second), order.Value())
+
+	// half of the decay is recovered each time, and each reheat is published and counted as a change
+	events, cancel := k.Subscribe()
+	defer cancel()
+	version := k.Version()
+	assert.Nil(t, k.Reheat(order))
+	assert.Equal(t, float64(80*time.Second), order.Value())
+	event := <-events
+	assert.Equal(t, order.ID(), event.OrderID)
+	assert.Equal(t, Ready, event.OldState)
+	assert.Equal(t, Ready, event.NewState)
+	assert.True(t, event.Reheated)
+	assert.True(t, k.Version() > version)
+	assert.Nil(t, k.Reheat(order))
+	assert.Equal(t, float64(85*time.Second), order.Value())
+	assert.Equal(t, 2, order.Reheats())
+	assert.Equal(t, clock.Now(), order.Snapshot().ReheatedAt)
+	assert.Equal(t, ErrReheatLimit, k.Reheat(order))
+
+	// decay keeps accruing from where the reheat left it
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, float64(55*time.Second), order.Value())
+
+	enroute := NewOrder("enroute", "hot", 100*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(enroute))
+	assert.Nil(t, k.SetOrderEnroute(enroute))
+	assert.IsType(t, &TransitionError{}, k.Reheat(enroute))
+	assert.Equal(t, 0, enroute.Reheats())
+
+	_, err = NewFromConfig([]byte(`
+kitchen:
+  reheat:
+    penalty: 2`))
+	assert.NotNil(t, err)
+}
+
+func TestReheatNeverExceedsRawValue(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  reheat:
+    max_reheats: 1
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`), WithClock(clock))
+	assert.Nil(t, err)
+
+	order := NewOrder("test", "hot", 100*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	clock.Advance(10 * time.Second)
+	// without a penalty every bit of decay is recovered, but the age isn't
+	assert.Nil(t, k.Reheat(order))
+	assert.Equal(t, order.RawValue(), order.Value())
+	assert.Equal(t, float64(90*time.Second), order.Value())
+
+	// reheating is disabled by default
+	k, err = NewFromConfig(simpleConfig)
+	assert.Nil(t, err)
+	order = NewOrder("test", "hot", 100*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Equal(t, ErrReheatLimit, k.Reheat(order))
+}
+
+func TestChanges(t *testing.T) {
+	k, err := NewFromConfig(simpleConfig)
+	assert.Nil(t, err)
+	orders, cursor, ok := k.Changes(0)
+	assert.True(t, ok)
+	assert.Empty(t, orders)
+	assert.Equal(t, uint64(0), cursor)
+
+	order := NewOrder("test", "hot", time.Hour, 0)
+	assert.Nil(t, k.CreateOrder(order))
+	// created, placed on a shelf and ready are three changes to one order
+	orders, cursor, ok = k.Changes(0)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, order.ID(), orders[0].ID())
+	assert.Equal(t, uint64(3), cursor)
+	assert.Equal(t, cursor, order.Version())
+	assert.Equal(t, cursor, k.Version())
+
+	orders, next, ok := k.Changes(cursor)
+	assert.True(t, ok)
+	assert.Empty(t, orders)
+	assert.Equal(t, cursor, next)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, next, _, err = k.WaitForChanges(ctx, cursor)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, cursor, next)
+
+	// a cursor from the future, e.g. from before a restart, starts over with every order
+	orders, next, ok = k.Changes(cursor + 10)
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, order.ID(), orders[0].ID())
+	assert.Equal(t, cursor, next)
+}
+
+func TestTrashedOrderKeepsItsAge(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig(simpleConfig, WithClock(clock))
+	assert.Nil(t, err)
+
+	order := NewOrder("test", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	clock.Advance(10 * time.Second)
+	_, err = k.CancelOrder(order.ID())
+	assert.Nil(t, err)
+
+	// the order stops aging when it's trashed, along with its decay
+	clock.Advance(time.Minute)
+	assert.Equal(t, 10*time.Second, order.Age())
+	assert.Equal(t, float64(10*time.Second), order.DecayBreakdown().Base)
+	assert.Equal(t, 0.0, order.RawValue())
+
+	// the shelf is full, so this one is trashed without ever being ready
+	unplaced := NewOrder("unplaced", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(NewOrder("resident", "hot", time.Hour, 1)))
+	assert.NotNil(t, k.CreateOrder(unplaced))
+	assert.Equal(t, Trashed, unplaced.State())
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Duration(0), unplaced.Age())
+}
+
+func TestDiscreteDecayModel(t *testing.T) {
+	values := make(map[string]float64)
+	for _, model := range []string{"continuous", "discrete"} {
+		clock := &manualClock{now: time.Now()}
+		k, err := NewFromConfig([]byte(`
+kitchen:
+  decay_model: `+model+`
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`), WithClock(clock))
+		assert.Nil(t, err)
+		order := NewOrder("test", "hot", 100*time.Second, 1)
+		assert.Nil(t, k.CreateOrder(order))
+		clock.Advance(2500 * time.Millisecond)
+		values[model] = order.Value()
+	}
+	// 97.5s raw, less 2.5s of base decay and 2.5s on the shelf
+	assert.Equal(t, float64(92500*time.Millisecond), values["continuous"])
+	// the half second doesn't count until it's a whole one
+	assert.Equal(t, float64(94*time.Second), values["discrete"])
+
+	_, err := NewFromConfig([]byte(`
+kitchen:
+  decay_model: quantum`))
+	assert.NotNil(t, err)
+}
+
+func TestCloseStopsBackgroundWork(t *testing.T) {
+	// minimizer passes of other tests' kitchens come and go, wait for them to settle
+	goroutines := func() int {
+		time.Sleep(10 * time.Millisecond)
+		return runtime.NumGoroutine()
+	}
+	baseline := goroutines()
+
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  minimize_decay: true
+  reaper:
+    max_ready: 10m
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+
+	assert.Nil(t, k.Close())
+	deadline := time.Now().Add(time.Second)
+	for goroutines() > baseline && time.Now().Before(deadline) {
+	}
+	assert.True(t, runtime.NumGoroutine() <= baseline)
+	// closing twice is fine
+	assert.Nil(t, k.Close())
+}
+
+func TestImport(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot
+        - cold`), WithClock(clock))
+	assert.Nil(t, err)
+
+	readyAt := clock.Now().Add(-10 * time.Second)
+	ready := NewOrder("ready", "hot", time.Hour, 1, WithID("a"))
+	enroute := NewOrder("enroute", "cold", time.Hour, 1, WithID("b"))
+	assert.Nil(t, k.Import([]OrderImport{
+		// imported onto overflow, though hot has room
+		{Order: ready, State: Ready, Shelf: "overflow", ReadyAt: readyAt},
+		{Order: enroute, State: Enroute, Shelf: "overflow"},
+	}))
+	assert.Equal(t, ready, k.findOrder("a"))
+	assert.Equal(t, Ready, ready.State())
+	assert.Equal(t, "overflow", ready.Shelf().Name())
+	assert.Equal(t, 10*time.Second, ready.Age())
+	assert.Equal(t, enroute, k.findOrder("b"))
+	assert.Equal(t, Enroute, enroute.State())
+	assert.Equal(t, "overflow", enroute.Shelf().Name())
+
+	// an unknown shelf imports nothing
+	err = k.Import([]OrderImport{
+		{Order: NewOrder("c", "hot", time.Hour, 1, WithID("c")), State: Ready, Shelf: "hot"},
+		{Order: NewOrder("d", "hot", time.Hour, 1, WithID("d")), State: Ready, Shelf: "freezer"},
+	})
+	ierr, ok := err.(*ImportError)
+	assert.True(t, ok)
+	assert.Equal(t, 1, ierr.Index)
+	assert.Equal(t, ErrUnknownShelf, ierr.Err)
+	assert.Nil(t, k.GetOrder("c"))
+
+	// a live ID can't be imported again
+	err = k.Import([]OrderImport{{Order: NewOrder("a", "hot", time.Hour, 1, WithID("a")), State: Ready, Shelf: "hot"}})
+	assert.Equal(t, ErrDuplicateID, err.(*ImportError).Err)
+	assert.Equal(t, ready, k.findOrder("a"))
+
+	// picking up an imported order frees its place
+	_, err = k.UpdateOrder("b", PickedUp)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(k.shelf("overflow").Orders()))
+}
+
+func TestDefaultDecayRates(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  default_decay_rates:
+    hot: 0.5
+    cold: 2
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+        - cold`))
+	assert.Nil(t, err)
+
+	omitted := NewOrder("omitted", "hot", time.Hour, 0)
+	explicit := NewOrder("explicit", "hot", time.Hour, 0.75)
+	both := NewOrder("both", "hot,cold", time.Hour, 0)
+	unknown := NewOrder("unknown", "frozen", time.Hour, 0)
+	for _, order := range []*Order{omitted, explicit, both, unknown} {
+		k.CreateOrder(order)
+	}
+	assert.Equal(t, 0.5, omitted.DecayRate())
+	assert.Equal(t, 0.75, explicit.DecayRate())
+	// the worst of the order's temps
+	assert.Equal(t, 2.0, both.DecayRate())
+	assert.Equal(t, 0.0, unknown.DecayRate())
+
+	_, err = NewFromConfig([]byte(`
+kitchen:
+  default_decay_rates:
+    hot: -1`))
+	assert.NotNil(t, err)
+}
+
+func TestPreferences(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  preferences:
+    hot:
+      - storage
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot
+        - cold
+    - name: "storage"
+      capacity: 1
+      decay_rate: 2
+      supported:
+        - hot
+        - cold`))
+	assert.Nil(t, err)
+
+	// storage is preferred, though the order decays faster on it
+	preferred := NewOrder("preferred", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(preferred))
+	assert.Equal(t, "storage", preferred.Shelf().Name())
+	// and the minimizer doesn't move it
+	assert.Equal(t, 0, k.decayMinimizer().Relocated)
+	assert.Equal(t, "storage", preferred.Shelf().Name())
+
+	// once storage is full, the rest are ranked by decay
+	overflow := NewOrder("overflow", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(overflow))
+	assert.Equal(t, "hot", overflow.Shelf().Name())
+
+	// temps without preferences are ranked by decay
+	k, err = NewFromConfig([]byte(`
+kitchen:
+  preferences:
+    hot:
+      - storage
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - cold
+    - name: "storage"
+      capacity: 1
+      decay_rate: 2
+      supported:
+        - cold`))
+	assert.Nil(t, err)
+	cold := NewOrder("cold", "cold", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(cold))
+	assert.Equal(t, "hot", cold.Shelf().Name())
+
+	_, err = NewFromConfig([]byte(`
+kitchen:
+  preferences:
+    hot:
+      - freezer`))
+	assert.NotNil(t, err)
+}
+
+func TestSetShelfCapacity(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig(simpleConfig, WithClock(clock))
+	assert.Nil(t, err)
+
+	// growing the shelf makes room straight away
+	assert.Nil(t, k.CreateOrder(NewOrder("a", "hot", time.Hour, 1)))
+	assert.NotNil(t, k.CreateOrder(NewOrder("rejected", "hot", time.Hour, 1)))
+	assert.Nil(t, k.SetShelfCapacity("hot", 3))
+	assert.Equal(t, 3, k.shelf("hot").Capacity())
+	assert.Nil(t, k.CreateOrder(NewOrder("b", "hot", 2*time.Hour, 1)))
+	assert.Equal(t, 2, len(k.shelf("hot").Orders()))
+
+	// by default shrinking below the occupancy is rejected
+	assert.Equal(t, ErrShelfFull, k.SetShelfCapacity("hot", 1))
+	assert.Equal(t, 3, k.shelf("hot").Capacity())
+	assert.Equal(t, ErrInvalidCapacity, k.SetShelfCapacity("hot", -1))
+	assert.Equal(t, ErrUnknownShelf, k.SetShelfCapacity("freezer", 1))
+
+	// or evicts the least valuable
+	k.evictOnShrink = true
+	least := shelfOrdersSorted(k.shelf("hot"), byValueAsc)[0]
+	assert.Equal(t, "a", least.Name())
+	assert.Nil(t, k.SetShelfCapacity("hot", 1))
+	assert.Equal(t, Trashed, least.State())
+	assert.Equal(t, TrashShelfResized, least.TrashedReason())
+	orders := k.shelf("hot").Orders()
+	assert.Equal(t, 1, len(orders))
+	assert.Equal(t, "b", orders[0].Name())
+
+	// enroute orders can't be evicted, so a shrink they keep the shelf over is reported
+	assert.Nil(t, k.SetOrderEnroute(orders[0]))
+	assert.Equal(t, ErrShelfFull, k.SetShelfCapacity("hot", 0))
+	assert.Equal(t, 0, k.shelf("hot").Capacity())
+	assert.Equal(t, Enroute, orders[0].State())
+}
+
+func TestClone(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig(simpleConfig, WithClock(clock))
+	assert.Nil(t, err)
+	order := NewOrder("test", "hot", time.Hour, 1, WithMetadata(map[string]string{"customer": "42"}))
+	assert.Nil(t, k.CreateOrder(order))
+	clock.Advance(time.Minute)
+
+	clone := k.GetOrder(order.ID())
+	assert.False(t, clone == order)
+	assert.Equal(t, order.Snapshot(), clone.Snapshot())
+	assert.Equal(t, order.Value(), clone.Value())
+
+	// moving the clone along doesn't move the kitchen's order, or count as a change
+	version := k.Version()
+	assert.Nil(t, clone.TransitionOrder(Ready, Enroute, func(o *Order) error { return nil }))
+	assert.Equal(t, Enroute, clone.State())
+	assert.Equal(t, Ready, order.State())
+	assert.Equal(t, version, k.Version())
+	// nor can anything be put on its shelf
+	assert.Equal(t, ErrShelfSnapshot, clone.Shelf().Put(NewOrder("sneaky", "hot", time.Hour, 1)))
+	assert.Equal(t, 1, len(k.shelf("hot").Orders()))
+
+	// but clones can be passed back to the kitchen
+	assert.Nil(t, k.SetOrderEnroute(k.GetOrder(order.ID())))
+	assert.Equal(t, Enroute, order.State())
+
+	// unless the order has left the shelves, when only the clone would move
+	clone = k.GetOrder(order.ID())
+	assert.Nil(t, k.SetOrderPickedUp(clone))
+	assert.Equal(t, ErrOrderNotFound, k.SetOrderPickedUp(clone))
+	assert.Equal(t, Enroute, clone.State())
+	assert.Equal(t, PickedUp, order.State())
+
+	cancelled := NewOrder("test", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(cancelled))
+	clone = k.GetOrder(cancelled.ID())
+	_, err = k.CancelOrder(cancelled.ID())
+	assert.Nil(t, err)
+	assert.Equal(t, ErrOrderNotFound, k.SetOrderEnroute(clone))
+	assert.Equal(t, ErrOrderNotFound, k.SetOrderPickedUp(clone))
+	assert.Equal(t, ErrOrderNotFound, k.Reheat(clone))
+	assert.Equal(t, ErrOrderNotFound, k.SetOrderReady(clone))
+	assert.Equal(t, Ready, clone.State())
+	assert.Equal(t, Trashed, cancelled.State())
+
+	// readying a clone of a placed order fails against the kitchen's own order, and never puts the copy on a shelf
+	placed := NewOrder("test", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(placed))
+	shelf := placed.Shelf()
+	clone = k.GetOrder(placed.ID())
+	assert.Equal(t, &TransitionError{OrderID: placed.ID(), State: Ready, Expected: Created}, k.SetOrderReady(clone))
+	assert.True(t, shelf == placed.Shelf())
+	for _, s := range k.Shelves() {
+		for _, o := range s.Orders() {
+			assert.False(t, o == clone, s.Name())
+		}
+	}
+}
+
+// worstFirst is a custom placer that places orders on the shelf they decay fastest on.
+type worstFirst struct{}
+
+func (worstFirst) Rank(order *Order, shelves []Shelf) {
+	sort.Slice(shelves, func(i, j int) bool {
+		return shelves[i].Decay() > shelves[j].Decay()
+	})
+}
+
+func TestPlacers(t *testing.T) {
+	topology := `
+  topology:
+    - name: "hot"
+      capacity: 4
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "storage"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot`
+	place := func(k *Kitchen, n int) []string {
+		shelves := make([]string, n)
+		for i := range shelves {
+			order := NewOrder(strconv.Itoa(i), "hot", time.Hour, 1)
+			assert.Nil(t, k.CreateOrder(order))
+			shelves[i] = order.Shelf().Name()
+		}
+		return shelves
+	}
+
+	// greedy fills the best shelf first
+	k, err := NewFromConfig([]byte("kitchen:" + topology))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hot", "hot", "hot", "hot", "storage"}, place(k, 5))
+
+	// balanced places on the least loaded shelf, then by decay
+	k, err = NewFromConfig([]byte("kitchen:\n  placer: balanced" + topology))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hot", "storage", "hot", "hot", "storage"}, place(k, 5))
+
+	// a custom placer wins over the config
+	k, err = NewFromConfig([]byte("kitchen:\n  placer: balanced"+topology), WithPlacer(worstFirst{}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"storage", "storage", "hot"}, place(k, 3))
+
+	_, err = NewFromConfig([]byte("kitchen:\n  placer: random" + topology))
+	assert.NotNil(t, err)
+}
+
+func TestOrderEvents(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig(simpleConfig, WithClock(clock))
+	assert.Nil(t, err)
+	_, err = k.OrderEvents("missing")
+	assert.Equal(t, ErrOrderNotFound, err)
+
+	order := NewOrder("test", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	clock.Advance(time.Second)
+	_, err = k.UpdateOrder(order.ID(), Enroute)
+	assert.Nil(t, err)
+	clock.Advance(time.Second)
+	_, err = k.UpdateOrder(order.ID(), PickedUp)
+	assert.Nil(t, err)
+
+	// the log outlives the order on the shelf
+	events, err := k.OrderEvents(order.ID())
+	assert.Nil(t, err)
+	expected := []OrderState{"", Created, Ready, Enroute, PickedUp}
+	assert.Equal(t, len(expected)-1, len(events))
+	for i, event := range events {
+		assert.Equal(t, expected[i], event.OldState)
+		assert.Equal(t, expected[i+1], event.NewState)
+		if i > 0 {
+			assert.False(t, event.At.Before(events[i-1].At))
+		}
+	}
+	assert.True(t, events[3].At.After(events[2].At))
+}
+
+func TestMinimizerParallelism(t *testing.T) {
+	run := func(parallelism int) (*Kitchen, []*Order, MinimizerReport) {
+		clock := &manualClock{now: time.Now()}
+		k, err := NewFromConfig([]byte(fmt.Sprintf(`
+kitchen:
+  minimizer:
+    parallelism: %d
+  topology:
+    - name: "hot"
+      capacity: 2
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 4
+      decay_rate: 2
+      supported:
+        - hot`, parallelism)), WithClock(clock))
+		assert.Nil(t, err)
+		first, second := NewOrder("first", "hot", time.Hour, 1), NewOrder("second", "hot", time.Hour, 1)
+		assert.Nil(t, k.CreateOrder(first))
+		assert.Nil(t, k.CreateOrder(second))
+		// the oldest overflow orders are the most decayed
+		overflow := make([]*Order, 4)
+		for i := range overflow {
+			overflow[i] = NewOrder(strconv.Itoa(i), "hot", time.Hour, 1)
+			assert.Nil(t, k.CreateOrder(overflow[i]))
+			assert.Equal(t, "overflow", overflow[i].Shelf().Name())
+			clock.Advance(time.Minute)
+		}
+		for _, order := range []*Order{first, second} {
+			assert.Nil(t, k.SetOrderEnroute(order))
+			assert.Nil(t, k.SetOrderPickedUp(order))
+		}
+		return k, overflow, k.decayMinimizer()
+	}
+
+	// unbounded, either two overflow orders are moved
+	k, _, report := run(0)
+	assert.Equal(t, 2, report.Relocated)
+	assert.Equal(t, 2, len(k.shelf("hot").Orders()))
+
+	// one worker moves the most decayed first
+	k, overflow, report := run(1)
+	assert.Equal(t, 2, report.Relocated)
+	for i, order := range overflow {
+		expected := "overflow"
+		if i < 2 {
+			expected = "hot"
+		}
+		assert.Equal(t, expected, order.Shelf().Name())
+	}
+
+	_, err := NewFromConfig([]byte("kitchen:\n  minimizer:\n    parallelism: -1"))
+	assert.NotNil(t, err)
+}
+
+func TestTimeToExpiry(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig(simpleConfig, WithClock(clock))
+	assert.Nil(t, err)
+	order := NewOrder("test", "hot", 100*time.Second, 1)
+	assert.Equal(t, NeverExpires, order.TimeToExpiry())
+	assert.Nil(t, k.CreateOrder(order))
+
+	// raw value falls at 1, and decay grows at 1 from the order and 1 from the shelf
+	ttl := order.TimeToExpiry()
+	assert.InDelta(t, float64(100*time.Second/3), float64(ttl), float64(time.Millisecond))
+	clock.Advance(ttl - time.Millisecond)
+	assert.False(t, order.IsExpired())
+	assert.InDelta(t, float64(time.Millisecond), float64(order.TimeToExpiry()), float64(time.Microsecond))
+	clock.Advance(2 * time.Millisecond)
+	assert.True(t, order.IsExpired())
+	assert.Equal(t, time.Duration(0), order.TimeToExpiry())
+
+	// without decay, the shelf life is the limit
+	order = NewOrder("step", "hot", 10*time.Second, 0)
+	k, err = NewFromConfig([]byte(`
+kitchen:
+  value_function: step
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 0
+      supported:
+        - hot`), WithClock(clock))
+	assert.Nil(t, err)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Equal(t, 10*time.Second, order.TimeToExpiry())
+	clock.Advance(10 * time.Second)
+	assert.True(t, order.IsExpired())
+
+	// picked up orders stop decaying
+	order = NewOrder("pickedup", "hot", 10*time.Second, 0)
+	k, err = NewFromConfig(simpleConfig, WithClock(clock))
+	assert.Nil(t, err)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Nil(t, k.SetOrderEnroute(order))
+	assert.Nil(t, k.SetOrderPickedUp(order))
+	assert.Equal(t, NeverExpires, order.TimeToExpiry())
+}
+
+func TestLinearExpiry(t *testing.T) {
+	for _, model := range []string{"continuous", "discrete"} {
+		for _, minDecay := range []string{"0", "3"} {
+			clock := &manualClock{now: time.Now()}
+			k, err := NewFromConfig([]byte(`
+kitchen:
+  decay_model: `+model+`
+  min_decay: `+minDecay+`
+  topology:
+    - name: "hot"
+      capacity: 2
+      decay_rate: 0.5
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot
+        - cold`), WithClock(clock))
+			assert.Nil(t, err)
+			order := NewOrder("test", "hot", 100*time.Second, 0.3)
+			assert.Nil(t, k.CreateOrder(order))
+			aged := NewOrder("aged", "hot", 100*time.Second, 0, WithMaxAge(20*time.Second))
+			assert.Nil(t, k.CreateOrder(aged))
+
+			// the closed form agrees with the search, on the first shelf and after a move part way through a tick
+			check := func(order *Order) {
+				order.RLock()
+				defer order.RUnlock()
+				now := clock.Now()
+				expiry, ok := order.linearExpiry(now, order.shelfLife)
+				assert.True(t, ok, "%s %s %s", model, minDecay, order.ID())
+				assert.Equal(t, order.searchExpiry(now, order.shelfLife), expiry, "%s %s %s", model, minDecay, order.ID())
+			}
+			clock.Advance(1300 * time.Millisecond)
+			check(order)
+			assert.Nil(t, order.forceShelf(k.shelf("overflow")))
+			clock.Advance(2700 * time.Millisecond)
+			check(order)
+			assert.Equal(t, 16*time.Second, aged.TimeToExpiry())
+		}
+	}
+
+	// other value functions are searched
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  value_function: step
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+	order := NewOrder("step", "hot", 10*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	order.RLock()
+	_, ok := order.linearExpiry(order.now(), order.shelfLife)
+	order.RUnlock()
+	assert.False(t, ok)
+}
+
+func TestProjectValue(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig(simpleConfig, WithClock(clock))
+	assert.Nil(t, err)
+	order := NewOrder("test", "hot", 100*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(order))
+
+	// the projection matches the value once the time comes
+	assert.Equal(t, order.Value(), order.ProjectValue(clock.Now()))
+	projected := order.ProjectValue(clock.Now().Add(10 * time.Second))
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, order.Value(), projected)
+
+	// it only falls, and is zero from the expiry on
+	ttl := order.TimeToExpiry()
+	points := order.Projection(ttl+10*time.Second, time.Second)
+	assert.Equal(t, int((ttl+10*time.Second)/time.Second)+1, len(points))
+	for i := 1; i < len(points); i++ {
+		assert.Equal(t, time.Duration(i)*time.Second, points[i].Offset)
+		if points[i-1].Value > 0 {
+			assert.True(t, points[i].Value < points[i-1].Value, "%v", points[i])
+		}
+		assert.Equal(t, points[i].Offset >= ttl, points[i].Value == 0, "%v", points[i])
+	}
+}
+
+func TestShelfDecayMultiplier(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "warm"
+      capacity: 2
+      decay_rate: 2
+      supported:
+        - hot
+    - name: "hot"
+      capacity: 2
+      decay_rate: 1
+      supported:
+        - hot`), WithClock(clock))
+	assert.Nil(t, err)
+
+	plain := NewOrder("plain", "hot", 100*time.Second, 0)
+	fragile := NewOrder("fragile", "hot", 100*time.Second, 0, WithShelfDecayMultiplier(2))
+	assert.Equal(t, float64(1), plain.ShelfDecayMultiplier())
+	assert.Equal(t, float64(2), fragile.ShelfDecayMultiplier())
+	assert.Nil(t, k.CreateOrder(plain))
+	assert.Nil(t, k.CreateOrder(fragile))
+	assert.Equal(t, "hot", plain.Shelf().Name())
+	assert.Equal(t, "hot", fragile.Shelf().Name())
+
+	// on the same shelf, the fragile order's shelf decay is double the plain order's, its base decay isn't
+	clock.Advance(10 * time.Second)
+	assert.Equal(t, float64(10*time.Second), plain.DecayBreakdown().CurrentShelf)
+	assert.Equal(t, float64(20*time.Second), fragile.DecayBreakdown().CurrentShelf)
+	assert.Equal(t, plain.DecayBreakdown().Base, fragile.DecayBreakdown().Base)
+	assert.True(t, fragile.Value() < plain.Value())
+
+	// the multiplier carries over to the legs banked when the orders move
+	assert.Nil(t, k.MoveOrder(plain.ID(), "warm"))
+	assert.Nil(t, k.MoveOrder(fragile.ID(), "warm"))
+	clock.Advance(10 * time.Second)
+	second := float64(time.Second)
+	assert.Equal(t, DecayBreakdown{CurrentShelf: 20 * second, PreviousShelves: 10 * second}, plain.DecayBreakdown())
+	assert.Equal(t, DecayBreakdown{CurrentShelf: 40 * second, PreviousShelves: 20 * second}, fragile.DecayBreakdown())
+	assert.Equal(t, float64(2), fragile.Clone().ShelfDecayMultiplier())
+}
+
+func TestShelfByName(t *testing.T) {
+	k, err := NewFromConfig(simpleConfig)
+	assert.Nil(t, err)
+	hot := NewOrder("hot", "hot", 100*time.Second, 1)
+	cold := NewOrder("cold", "cold", 100*time.Second, 1)
+	assert.Nil(t, k.CreateOrder(hot))
+	assert.Nil(t, k.CreateOrder(cold))
+
+	info, ok := k.ShelfByName("cold")
+	assert.True(t, ok)
+	assert.Equal(t, "cold", info.Name)
+	assert.Equal(t, "static", info.Type)
+	assert.Equal(t, []string{"cold"}, info.Supported)
+	assert.Equal(t, 1, info.Capacity)
+	assert.Equal(t, 0.5, info.DecayRate)
+	assert.Equal(t, 0.5, info.Decay)
+	assert.Equal(t, 1, len(info.Orders))
+	assert.Equal(t, cold.ID(), info.Orders[0].ID())
+
+	_, ok = k.ShelfByName("freezer")
+	assert.False(t, ok)
+}
+
+func TestMinDecay(t *testing.T) {
+	topology := `
+kitchen:
+  %s
+  topology:
+    - name: "rack"
+      capacity: 1
+      decay_rate: 0
+      supported:
+        - hot`
+	orders := make([]*Order, 0)
+	clock := &manualClock{now: time.Now()}
+	for _, minDecay := range []string{"", "min_decay: 1"} {
+		k, err := NewFromConfig([]byte(fmt.Sprintf(topology, minDecay)), WithClock(clock))
+		assert.Nil(t, err)
+		order := NewOrder("test", "hot", 100*time.Second, 0.0001)
+		assert.Nil(t, k.CreateOrder(order))
+		orders = append(orders, order)
 	}
+	unfloored, floored := orders[0], orders[1]
+
+	// the floor takes over from the near zero decay, so the order's value runs out at half its shelf life
+	clock.Advance(49 * time.Second)
+	assert.False(t, floored.IsExpired())
+	assert.InDelta(t, float64(49*time.Second), floored.Decayed(), 1)
+	// the floor makes up the difference in the breakdown
+	breakdown := floored.DecayBreakdown()
+	assert.True(t, breakdown.Floor > 0)
+	assert.Equal(t, floored.Decayed(), breakdown.Base+breakdown.CurrentShelf+breakdown.PreviousShelves+breakdown.Floor)
+	assert.Equal(t, 0.0, unfloored.DecayBreakdown().Floor)
+	clock.Advance(2 * time.Second)
+	assert.True(t, floored.IsExpired())
+	assert.False(t, unfloored.IsExpired())
+
+	_, err := NewFromConfig([]byte(fmt.Sprintf(topology, "min_decay: -1")))
+	assert.NotNil(t, err)
 }
 
-// Benchmark scatter-gather GetOrder implementation.
+func TestMaxShelfHops(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  max_shelf_hops: 1
+  topology:
+    - name: "a"
+      capacity: 1
+      decay_rate: 3
+      supported:
+        - hot
+    - name: "b"
+      capacity: 1
+      decay_rate: 2
+      supported:
+        - hot
+    - name: "c"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`))
+	assert.Nil(t, err)
+	blockers := []*Order{NewOrder("c", "hot", time.Hour, 1), NewOrder("b", "hot", time.Hour, 1)}
+	for _, blocker := range blockers {
+		assert.Nil(t, k.CreateOrder(blocker))
+	}
+	order := NewOrder("test", "hot", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	assert.Equal(t, "a", order.Shelf().Name())
+	// the first placement isn't a hop
+	assert.Equal(t, 0, order.Hops())
 
-func BenchmarkGetOrder(b *testing.B) {
-	cfg := []byte(`
-        kitchen:
-          minimize_decay: false
-          topology:
-            - name: "test1"
-              capacity: 5
-              decay_rate: 1
-              supported: 
-                - test1
-            - name: "test2"
-              capacity: 5
-              decay_rate: 1
-              supported: 
-                - test2
-            - name: "test3"
-              capacity: 5
-              decay_rate: 1
-              supported: 
-                - test3`)
-	orders, k := setupKitchen(cfg, []string{"test1", "test2", "test3"}, 30, time.Hour)
-	for _, o := range orders {
-		k.CreateOrder(o)
-		k.SetOrderReady(o)
+	pickUp := func(order *Order) {
+		assert.Nil(t, k.SetOrderEnroute(order))
+		assert.Nil(t, k.SetOrderPickedUp(order))
 	}
-	id := orders[0].ID()
-	b.ResetTimer()
-	for n := 0; n < b.N; n++ {
-		k.GetOrder(id)
+	pickUp(blockers[1])
+	assert.Equal(t, 1, k.decayMinimizer().Relocated)
+	assert.Equal(t, "b", order.Shelf().Name())
+	assert.Equal(t, 1, order.Hops())
+
+	// c is better still, but the order is out of hops
+	pickUp(blockers[0])
+	assert.Equal(t, 0, k.decayMinimizer().Relocated)
+	assert.Equal(t, "b", order.Shelf().Name())
+	assert.Equal(t, 1, order.Snapshot().Hops)
+
+	_, err = NewFromConfig([]byte("kitchen:\n  max_shelf_hops: -1"))
+	assert.NotNil(t, err)
+}
+
+func TestClockSkew(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 1
+      decay_rate: 2
+      supported:
+        - hot`), WithClock(clock))
+	assert.Nil(t, err)
+	order := NewOrder("test", "hot", time.Minute, 1)
+	assert.Nil(t, k.CreateOrder(order))
+	fresh := order.Value()
+
+	// set the clock back before the order was ready or placed
+	clock.Advance(-time.Hour)
+	assert.Equal(t, time.Duration(0), order.Age())
+	assert.Equal(t, 0.0, order.Decayed())
+	assert.Equal(t, fresh, order.Value())
+	assert.Equal(t, fresh, order.RawValue())
+
+	// moving it doesn't bank negative decay from the old shelf
+	assert.Nil(t, k.MoveOrder(order.ID(), "overflow"))
+	breakdown := order.DecayBreakdown()
+	assert.Equal(t, 0.0, breakdown.PreviousShelves)
+	assert.Equal(t, 0.0, breakdown.CurrentShelf)
+	assert.Equal(t, fresh, order.Value())
+}
+
+var indexConfig = []byte(`
+kitchen:
+  topology:
+    - name: "overflow"
+      capacity: 100
+      decay_rate: 2
+      supported:
+        - hot
+        - cold
+    - name: "warm"
+      capacity: 100
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "hot"
+      capacity: 100
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "cold"
+      capacity: 100
+      decay_rate: 0.5
+      supported:
+        - cold`)
+
+func shelfNames(shelves []Shelf) []string {
+	names := make([]string, len(shelves))
+	for i, shelf := range shelves {
+		names[i] = shelf.Name()
 	}
+	return names
 }
 
-// Benchmark scatter-gather GetOrder implementation when many running in parallel.
-func BenchmarkGetOrderContention(b *testing.B) {
-	cfg := []byte(`
-    kitchen:
-      minimize_decay: false
-      topology:
-        - name: "test1"
-          capacity: 5
-          decay_rate: 1
-          supported: 
-            - test1
-        - name: "test2"
-          capacity: 5
-          decay_rate: 1
-          supported: 
-            - test2
-        - name: "test3"
-          capacity: 5
-          decay_rate: 1
-          supported: 
-            - test3`)
-	orders, k := setupKitchen(cfg, []string{"test1", "test2", "test3"}, 30, time.Hour)
-	for _, o := range orders {
-		k.CreateOrder(o)
-		k.SetOrderReady(o)
+func TestRankedCandidates(t *testing.T) {
+	k, err := NewFromConfig(indexConfig)
+	assert.Nil(t, err)
+	order := NewOrder("test", "hot", time.Hour, 1)
+
+	// the index is ranked the same as the placer would
+	ranked := k.candidates(order.Temps())
+	k.placer.Rank(order, ranked)
+	presorted := k.rankedCandidates(order)
+	assert.Equal(t, []string{"hot", "warm", "overflow"}, shelfNames(presorted))
+	assert.Equal(t, shelfNames(ranked), shelfNames(presorted))
+
+	// and can't be changed through the returned slice
+	presorted[0], presorted[1] = presorted[1], presorted[0]
+	assert.Equal(t, []string{"hot", "warm", "overflow"}, shelfNames(k.rankedCandidates(order)))
+
+	// composite orders are ranked by the placer
+	composite := NewOrder("both", "hot,cold", time.Hour, 1)
+	assert.Equal(t, []string{"cold", "hot", "warm", "overflow"}, shelfNames(k.rankedCandidates(composite)))
+
+	// as is everything once decay varies with a schedule
+	k, err = NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot
+      schedule:
+        - from: "11:00"
+          to: "14:00"
+          multiplier: 2`))
+	assert.Nil(t, err)
+	assert.Nil(t, k.sortedIndex)
+	assert.Equal(t, []string{"hot"}, shelfNames(k.rankedCandidates(order)))
+}
+
+func TestFallbacks(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  fallbacks:
+    hot:
+      - hot
+      - overflow
+      - storage
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "storage"
+      capacity: 1
+      decay_rate: 1.5
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 1
+      decay_rate: 2
+      supported:
+        - hot
+        - cold
+    - name: "spare"
+      capacity: 5
+      decay_rate: 0.5
+      supported:
+        - hot
+        - cold`))
+	assert.Nil(t, err)
+	defer k.Close()
+
+	// the chain is walked in order, whatever the decay, and shelves off it are never used
+	orders := makeOrders(4, "hot")
+	for _, order := range orders[:3] {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Equal(t, "hot", orders[0].Shelf().Name())
+	assert.Equal(t, "overflow", orders[1].Shelf().Name())
+	assert.Equal(t, "storage", orders[2].Shelf().Name())
+	name, ok := k.PreviewPlacement("hot")
+	assert.False(t, ok, name)
+
+	// trashed only once the whole chain is full
+	assert.NotNil(t, k.CreateOrder(orders[3]))
+	assert.Equal(t, Trashed, orders[3].State())
+	assert.Equal(t, TrashNoCapacity, orders[3].TrashedReason())
+	assert.Equal(t, 0, len(k.shelf("spare").Orders()))
+
+	// the minimizer moves orders up the chain as it frees up
+	assert.Nil(t, k.SetOrderEnroute(orders[0]))
+	assert.Nil(t, k.SetOrderPickedUp(orders[0]))
+	assert.Equal(t, 2, k.decayMinimizer().Relocated)
+	assert.Equal(t, "hot", orders[1].Shelf().Name())
+	assert.Equal(t, "overflow", orders[2].Shelf().Name())
+	assert.Equal(t, 0, len(k.shelf("spare").Orders()))
+
+	// temps without a chain use any shelf
+	cold := NewOrder("cold", "cold", time.Hour, 1)
+	assert.Nil(t, k.CreateOrder(cold))
+	assert.Equal(t, "spare", cold.Shelf().Name())
+
+	for _, fallbacks := range []string{"[freezer]", "[hot, spare]"} {
+		_, err = NewFromConfig([]byte(`
+kitchen:
+  fallbacks:
+    cold: ` + fallbacks + `
+  topology:
+    - name: "hot"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot
+        - cold
+    - name: "spare"
+      capacity: 1
+      decay_rate: 1
+      supported:
+        - hot`))
+		assert.NotNil(t, err, fallbacks)
 	}
-	id := orders[0].ID()
-	b.ResetTimer()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			k.GetOrder(id)
-		}
-	})
 }
 
-func BenchmarkCreateOrderContention(b *testing.B) {
+func TestReset(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  order_ids: sequential
+  topology:
+    - name: "hot"
+      capacity: 2
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "cold"
+      capacity: 2
+      decay_rate: 1
+      supported:
+        - cold`))
+	assert.Nil(t, err)
+	shelves := k.Shelves()
+
+	orders := append(makeOrders(2, "hot"), makeOrders(1, "cold")...)
+	for _, order := range orders {
+		assert.Nil(t, k.CreateOrder(order))
+	}
+	assert.Nil(t, k.SetOrderEnroute(orders[1]))
+	assert.Nil(t, k.SetOrderPickedUp(orders[1]))
+	assert.Equal(t, uint64(1), k.LifecycleMetrics()[ReadyToPickedUpMetric].Count)
+	histogram := k.metrics.readyToPickedUp
+
+	k.Reset()
+	// the trashes drain the live count, and the histograms are cleared in place
+	assert.Equal(t, 0, k.LiveOrders())
+	assert.Equal(t, 0, len(k.GetOrders()))
+	assert.Equal(t, uint64(0), k.LifecycleMetrics()[ReadyToPickedUpMetric].Count)
+	assert.Equal(t, uint64(0), k.LifecycleMetrics()[CreatedToReadyMetric].Count)
+	assert.True(t, histogram == k.metrics.readyToPickedUp)
+	for _, order := range []*Order{orders[0], orders[2]} {
+		assert.Equal(t, Trashed, order.State())
+		assert.Equal(t, TrashReset, order.TrashedReason())
+	}
+	assert.Equal(t, PickedUp, orders[1].State())
+
+	// the shelves are the same, and work as before
+	assert.Equal(t, shelves, k.Shelves())
+	for _, shelf := range shelves {
+		assert.Equal(t, 2, shelf.Capacity())
+		assert.Equal(t, 0, len(shelf.Orders()))
+	}
+	fresh := makeOrders(2, "hot")
+	for _, order := range fresh {
+		assert.Nil(t, k.CreateOrder(order))
+		assert.Equal(t, "hot", order.Shelf().Name())
+	}
+	// numbering starts over
+	assert.Equal(t, "1", fresh[0].ID())
+	assert.Equal(t, 2, k.LiveOrders())
+}
+
+func TestShelfAdmission(t *testing.T) {
+	clock := &manualClock{now: time.Date(2019, 3, 1, 9, 0, 0, 0, time.UTC)}
 	cfg := []byte(`
-    kitchen:
-      minimize_decay: false
-      topology:
-        - name: "test1"
-          capacity: 5
-          decay_rate: 1
-          supported: 
-            - test1
-        - name: "test2"
-          capacity: 5
-          decay_rate: 1
-          supported: 
-            - test2
-        - name: "test3"
-          capacity: 5
-          decay_rate: 1
-          supported: 
-            - test3`)
-	orders, k := setupKitchen(cfg, []string{"test1", "test2", "test3"}, 30, time.Hour)
-	b.ResetTimer()
-	b.RunParallel(func(pb *testing.PB) {
-		for pb.Next() {
-			o := orders[rand.Intn(30)]
-			k.CreateOrder(o)
-			k.SetOrderReady(o)
-		}
+kitchen:
+  topology:
+    - name: "premium"
+      capacity: 5
+      decay_rate: 0.5
+      supported:
+        - hot
+      admission:
+        min_value: 30s
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "lunch"
+      capacity: 5
+      decay_rate: 0
+      supported:
+        - hot
+        - cold
+      admission:
+        temps: [cold]
+        from: "11:00"
+        to: "14:00"`)
+	// predicates can be registered too
+	notBanned := WithShelfAdmission("hot", func(order *Order, at time.Time) bool {
+		return order.Name() != "banned"
 	})
+	k, err := NewFromConfig(cfg, WithClock(clock), notBanned)
+	assert.Nil(t, err)
+
+	// the temp matches, but the order is worth too little
+	cheap := NewOrder("cheap", "hot", 10*time.Second, 0)
+	assert.Nil(t, k.CreateOrder(cheap))
+	assert.Equal(t, "hot", cheap.Shelf().Name())
+	pricey := NewOrder("pricey", "hot", time.Minute, 0)
+	assert.Nil(t, k.CreateOrder(pricey))
+	assert.Equal(t, "premium", pricey.Shelf().Name())
+	// nor will the minimizer move it there
+	k.decayMinimizer()
+	assert.Equal(t, "hot", cheap.Shelf().Name())
+	banned := NewOrder("banned", "hot", 10*time.Second, 0)
+	assert.NotNil(t, k.CreateOrder(banned))
+	assert.Equal(t, TrashNoCapacity, banned.TrashedReason())
+
+	// lunch is closed in the morning, and never takes hot orders
+	cold := NewOrder("cold", "cold", time.Minute, 0)
+	assert.NotNil(t, k.CreateOrder(cold))
+	assert.Equal(t, TrashNoCapacity, cold.TrashedReason())
+	clock.Advance(3 * time.Hour)
+	cold = NewOrder("cold", "cold", time.Minute, 0)
+	assert.Nil(t, k.CreateOrder(cold))
+	assert.Equal(t, "lunch", cold.Shelf().Name())
+	hot := NewOrder("hot", "hot", 10*time.Second, 0)
+	assert.Nil(t, k.CreateOrder(hot))
+	assert.Equal(t, "hot", hot.Shelf().Name())
+
+	for _, admission := range []string{"min_value: -1s", "from: \"25:00\"\n        to: \"26:00\""} {
+		_, err = NewFromConfig([]byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+      admission:
+        ` + admission))
+		assert.NotNil(t, err, admission)
+	}
+}
+
+func TestEmptyTopology(t *testing.T) {
+	k, err := NewFromConfig([]byte(`
+kitchen:
+  minimize_decay: false`))
+	assert.Nil(t, err)
+
+	// looking for an order on no shelves returns rather than waiting forever
+	found := make(chan *Order)
+	go func() {
+		found <- k.GetOrder("missing")
+	}()
+	select {
+	case order := <-found:
+		assert.Nil(t, order)
+	case <-time.After(time.Second):
+		t.Fatal("GetOrder blocked with no shelves")
+	}
+	assert.Equal(t, ErrOrderNotFound, k.MoveOrder("missing", "hot"))
+
+	order := NewOrder("test", "hot", time.Hour, 1)
+	assert.Equal(t, ErrEmptyTopology, k.CreateOrder(order))
+	assert.Equal(t, TrashUnsupported, order.TrashedReason())
+
+	// which can be made an error instead
+	_, err = NewFromConfig([]byte(`
+kitchen:
+  empty_topology: error`))
+	assert.Equal(t, ErrEmptyTopology, err)
+	assert.Equal(t, ErrEmptyTopology, k.Reconfigure(config.NewYAMLProviderFromBytes([]byte(`
+kitchen:
+  empty_topology: error`))))
+	_, err = NewFromConfig(append(simpleConfig, []byte("\n  empty_topology: ignore")...))
+	assert.NotNil(t, err)
+}
+
+// benchmarkRankedCandidates measures the per-create work of finding where a new order can go.
+func benchmarkRankedCandidates(b *testing.B, presorted bool) {
+	k, err := NewFromConfig(indexConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	k.presorted = presorted
+	order := NewOrder("bench", "hot", time.Hour, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		k.rankedCandidates(order)
+	}
+}
+
+func BenchmarkRankedCandidatesPresorted(b *testing.B) {
+	benchmarkRankedCandidates(b, true)
+}
+
+func BenchmarkRankedCandidatesRanked(b *testing.B) {
+	benchmarkRankedCandidates(b, false)
 }
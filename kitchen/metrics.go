@@ -0,0 +1,125 @@
+package kitchen
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// lifecycleBuckets are the upper bounds, in seconds, of the lifecycle histograms.
+var lifecycleBuckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 120, 300}
+
+// Metric names of the lifecycle histograms.
+const (
+	CreatedToReadyMetric  = "order_created_to_ready_seconds"
+	ReadyToPickedUpMetric = "order_ready_to_pickedup_seconds"
+)
+
+// histogram counts observations into fixed buckets, in the style of a Prometheus histogram.
+type histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.Lock()
+	defer h.Unlock()
+	// observations above the last bucket only count towards +Inf, i.e. count
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// HistogramSnapshot is a copy of a histogram. Counts are cumulative, Counts[i] is the number of observations
+// less than or equal to Buckets[i]. Count includes observations above the last bucket.
+type HistogramSnapshot struct {
+	Buckets []float64
+	Counts  []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// reset clears the histogram's observations, keeping its buckets.
+func (h *histogram) reset() {
+	h.Lock()
+	defer h.Unlock()
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.sum = 0
+	h.count = 0
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	h.Lock()
+	defer h.Unlock()
+	counts := make([]uint64, len(h.counts))
+	var total uint64
+	for i, count := range h.counts {
+		total += count
+		counts[i] = total
+	}
+	return HistogramSnapshot{Buckets: h.buckets, Counts: counts, Sum: h.sum, Count: h.count}
+}
+
+// lifecycleMetrics tracks how long orders spend in each state, observed when they reach a terminal state.
+type lifecycleMetrics struct {
+	createdToReady  *histogram
+	readyToPickedUp *histogram
+}
+
+func newLifecycleMetrics() *lifecycleMetrics {
+	return &lifecycleMetrics{
+		createdToReady:  newHistogram(lifecycleBuckets),
+		readyToPickedUp: newHistogram(lifecycleBuckets),
+	}
+}
+
+// reset clears the histograms in place, so observations racing with it aren't lost to a replaced histogram.
+func (m *lifecycleMetrics) reset() {
+	m.createdToReady.reset()
+	m.readyToPickedUp.reset()
+}
+
+// observe records the order's lifecycle. Must be called by a function that is holding the lock for this order,
+// once the order's terminal timestamp is set.
+func (m *lifecycleMetrics) observe(order *Order) {
+	if order.readyAt.IsZero() {
+		// trashed before it was ever placed
+		return
+	}
+	m.createdToReady.observe(seconds(order.readyAt.Sub(order.createdAt)))
+	if !order.pickedUpAt.IsZero() {
+		m.readyToPickedUp.observe(seconds(order.pickedUpAt.Sub(order.readyAt)))
+	}
+}
+
+func seconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
+
+// LifecycleMetrics returns the order lifecycle histograms, keyed by metric name. The names are prefixed with the
+// kitchen's name and an underscore if it has one.
+func (k *Kitchen) LifecycleMetrics() map[string]HistogramSnapshot {
+	return map[string]HistogramSnapshot{
+		k.MetricPrefix() + CreatedToReadyMetric:  k.metrics.createdToReady.snapshot(),
+		k.MetricPrefix() + ReadyToPickedUpMetric: k.metrics.readyToPickedUp.snapshot(),
+	}
+}
+
+// MetricPrefix returns what the kitchen's metric names are prefixed with, empty if it has no name.
+func (k *Kitchen) MetricPrefix() string {
+	if k.name == "" {
+		return ""
+	}
+	return k.name + "_"
+}
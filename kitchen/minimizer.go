@@ -0,0 +1,117 @@
+package kitchen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMinInterval   = 250 * time.Millisecond
+	defaultMaxInterval   = 10 * time.Second
+	defaultBusyThreshold = 10
+)
+
+// minimizerBackoff adapts the sleep between minimizer passes to load. A pass that moves nothing doubles the
+// interval, up to max, so an idle kitchen isn't contending for locks. A pass that moves more than the busy
+// threshold halves it, down to min, so a busy kitchen is rebalanced sooner. It isn't thread-safe, the
+// minimizer loop is its only user.
+type minimizerBackoff struct {
+	min      time.Duration
+	max      time.Duration
+	busy     int
+	interval time.Duration
+}
+
+func newMinimizerBackoff(cfg minimizerConfig) *minimizerBackoff {
+	b := &minimizerBackoff{
+		min:      cfg.MinInterval,
+		max:      cfg.MaxInterval,
+		busy:     cfg.BusyThreshold,
+		interval: time.Second,
+	}
+	// start at the old fixed interval, if the bounds allow it
+	if b.interval < b.min {
+		b.interval = b.min
+	}
+	if b.interval > b.max {
+		b.interval = b.max
+	}
+	return b
+}
+
+// next returns how long to sleep after a pass that relocated the given number of orders.
+func (b *minimizerBackoff) next(relocated int) time.Duration {
+	switch {
+	case relocated == 0:
+		b.interval *= 2
+		if b.interval > b.max {
+			b.interval = b.max
+		}
+	case relocated > b.busy:
+		b.interval /= 2
+		if b.interval < b.min {
+			b.interval = b.min
+		}
+	}
+	return b.interval
+}
+
+// MinimizerReport describes a single minimizer pass, e.g. to tell whether the kitchen is short of capacity.
+type MinimizerReport struct {
+	// Relocated is the number of orders moved off their shelf, including expired orders that were trashed
+	Relocated int
+	// Shelves is keyed by shelf name
+	Shelves map[string]ShelfReport
+}
+
+// ShelfReport is how a shelf's utilization changed over a minimizer pass. Orders can come and go during the
+// pass, so Before plus MovedIn less MovedOut needn't equal After.
+type ShelfReport struct {
+	Capacity int
+	Before   int
+	After    int
+	// MovedIn and MovedOut count the orders the pass moved onto and off the shelf. Orders trashed on it are
+	// moved out.
+	MovedIn  int
+	MovedOut int
+}
+
+// moved counts an order moving from one shelf to another, either of which may be nil.
+func (r MinimizerReport) moved(from Shelf, to Shelf) {
+	if from != nil {
+		shelf := r.Shelves[from.Name()]
+		shelf.MovedOut++
+		r.Shelves[from.Name()] = shelf
+	}
+	if to != nil {
+		shelf := r.Shelves[to.Name()]
+		shelf.MovedIn++
+		r.Shelves[to.Name()] = shelf
+	}
+}
+
+// Utilization returns how full the shelf was after the pass, between 0 and 1.
+func (r ShelfReport) Utilization() float64 {
+	if r.Capacity == 0 {
+		return 0
+	}
+	return float64(r.After) / float64(r.Capacity)
+}
+
+// String formats the report on one line, with shelves sorted by name.
+func (r MinimizerReport) String() string {
+	names := make([]string, 0, len(r.Shelves))
+	for name := range r.Shelves {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	shelves := make([]string, len(names))
+	for i, name := range names {
+		shelf := r.Shelves[name]
+		shelves[i] = fmt.Sprintf("%s %d->%d/%d (+%d -%d)",
+			name, shelf.Before, shelf.After, shelf.Capacity, shelf.MovedIn, shelf.MovedOut)
+	}
+	return fmt.Sprintf("relocated %d: %s", r.Relocated, strings.Join(shelves, ", "))
+}
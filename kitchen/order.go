@@ -2,6 +2,10 @@ package kitchen
 
 import (
 	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,6 +25,60 @@ const (
 	Trashed  OrderState = "trashed"
 )
 
+// ValueFunc computes the raw value of an order, before decay, given its shelf life and age.
+type ValueFunc func(shelfLife time.Duration, age time.Duration) float64
+
+// LinearValue ramps down from the full shelf life to zero as the order ages.
+func LinearValue(shelfLife time.Duration, age time.Duration) float64 {
+	return float64(shelfLife - age)
+}
+
+// StepValue keeps the full shelf life as value until the order is as old as its shelf life, then drops to zero.
+func StepValue(shelfLife time.Duration, age time.Duration) float64 {
+	if age < shelfLife {
+		return float64(shelfLife)
+	}
+	return 0
+}
+
+// TrashReason is why an order was trashed.
+type TrashReason string
+
+const (
+	// TrashExpired orders ran out of value, or exceeded their max age
+	TrashExpired TrashReason = "expired"
+	// TrashUnsupported orders had no shelf supporting their temp
+	TrashUnsupported TrashReason = "unsupported"
+	// TrashNoCapacity orders had no room on any shelf supporting their temp
+	TrashNoCapacity TrashReason = "no_capacity"
+	// TrashEvicted orders made room for a more valuable new order
+	TrashEvicted TrashReason = "evicted"
+	// TrashReaped orders sat in a state longer than the reaper allows
+	TrashReaped TrashReason = "reaped"
+	// TrashCancelled orders were cancelled before a courier was dispatched
+	TrashCancelled TrashReason = "cancelled"
+	// TrashShelfRemoved orders were on a shelf removed from the topology, with no room left elsewhere
+	TrashShelfRemoved TrashReason = "shelf_removed"
+	// TrashShelfResized orders were the least valuable on a shelf shrunk below its occupancy
+	TrashShelfResized TrashReason = "shelf_resized"
+	// TrashReset orders were on the shelves, or waiting to be placed, when the kitchen was reset
+	TrashReset TrashReason = "reset"
+)
+
+// TransitionError is returned when an order isn't in a state that allows the requested transition.
+type TransitionError struct {
+	OrderID  string
+	State    OrderState
+	Expected OrderState
+}
+
+func (e *TransitionError) Error() string {
+	if e.State != e.Expected {
+		return fmt.Sprintf("order %s in incorrect state %s, expected %s", e.OrderID, e.State, e.Expected)
+	}
+	return fmt.Sprintf("order %s was in terminal state %s, invalid transition", e.OrderID, e.State)
+}
+
 // Order is the basic primitive representing a incoming order from a customer.
 type Order struct {
 	sync.RWMutex
@@ -29,16 +87,66 @@ type Order struct {
 	name string
 	temp string
 
+	// true unless the ID was supplied, a kitchen with sequential IDs replaces generated IDs
+	generatedID bool
+
+	// the components of temp, composite orders like "hot,cold" have more than one
+	temps []string
+
+	// the decay rate on shelves that only support some of a composite order's temps, set by the kitchen
+	worstDecay float64
+
 	// ShelfLife is the max shelf time for an order
 	shelfLife time.Duration
 
+	// MaxAge is an optional hard limit on age, regardless of value
+	maxAge time.Duration
+
+	// optional shelf group the order must be placed in, or must not be placed in
+	affinity     string
+	antiAffinity string
+
+	// orders with a higher priority can take the place of lower priority orders on better shelves, see
+	// Kitchen.SetPriority
+	priority int
+
+	// opaque to the kitchen, echoed back to correlate orders with other systems. Never modified after
+	// construction, so it's shared with events without copying.
+	metadata map[string]string
+
 	// BaseDecayRate is the rate of decay per second
 	baseDecayRate float64
 	state         OrderState
 
-	// track previous decayed amount from older shelves
+	// computes raw value from shelf life and age, set by the kitchen
+	valueFunc ValueFunc
+
+	// when set, age and time on the current shelf are rounded down to whole ticks, set by the kitchen
+	tick time.Duration
+
+	// the least the order decays per unit of age, whatever its shelves, set by the kitchen
+	minDecay float64
+
+	// the name of the kitchen that adopted the order, copied to its events
+	kitchenID string
+
+	// called after every successful transition, and every move to another shelf, set by the kitchen
+	onTransition func(*Order, OrderEvent)
+	onMove       func(*Order)
+
+	// the kitchen's change sequence number when the order last transitioned or moved, see Kitchen.Changes
+	version uint64
+
+	// track previous decayed amount from older shelves, less any recovered by reheating
 	prevDecayed float64
 
+	// how many times the order was reheated, and when it last was
+	reheats    int
+	reheatedAt time.Time
+
+	// how many times the order moved from one shelf to another, its first placement isn't a hop
+	hops int
+
 	// Store timestamps for each state
 	createdAt  time.Time
 	readyAt    time.Time
@@ -46,12 +154,86 @@ type Order struct {
 	pickedUpAt time.Time
 	trashedAt  time.Time
 
+	// why the order was trashed, set with trashedAt
+	trashedReason TrashReason
+
+	// every transition the order has made, oldest first
+	events []OrderEvent
+
 	// Keep a pointer to current shelf
 	shelf    Shelf
 	placedAt time.Time
+	// multiplies every shelf's decay rate for this order, e.g. for fragile items, 1 by default
+	shelfDecayMultiplier float64
 
 	// used for time-travel during testing
 	now func() time.Time
+
+	// set on copies made by Clone, which the kitchen resolves to its own order when they're passed back
+	cloned bool
+}
+
+// OrderOption sets optional attributes on an Order at construction.
+type OrderOption func(*Order)
+
+// WithMaxAge sets an absolute limit on the order's age. Once exceeded the order is expired, even
+// if it still has value. Zero means no limit.
+func WithMaxAge(maxAge time.Duration) OrderOption {
+	return func(o *Order) {
+		o.maxAge = maxAge
+	}
+}
+
+// WithAffinity restricts the order to shelves in the given group.
+func WithAffinity(group string) OrderOption {
+	return func(o *Order) {
+		o.affinity = group
+	}
+}
+
+// WithAntiAffinity keeps the order off shelves in the given group.
+func WithAntiAffinity(group string) OrderOption {
+	return func(o *Order) {
+		o.antiAffinity = group
+	}
+}
+
+// WithPriority sets the order's priority, zero by default. Higher is more important.
+func WithPriority(priority int) OrderOption {
+	return func(o *Order) {
+		o.priority = priority
+	}
+}
+
+// WithShelfDecayMultiplier multiplies the decay rate of every shelf the order is on, e.g. 2 for a fragile item
+// that decays twice as fast wherever it's kept. It must not be negative. The order's own decay rate isn't
+// affected.
+func WithShelfDecayMultiplier(multiplier float64) OrderOption {
+	return func(o *Order) {
+		o.shelfDecayMultiplier = multiplier
+	}
+}
+
+// WithID gives the order the ID instead of a random UUID. The kitchen rejects an order whose ID is already
+// used by a live order with ErrDuplicateID.
+func WithID(id string) OrderOption {
+	return func(o *Order) {
+		o.id = id
+		o.generatedID = false
+	}
+}
+
+// WithMetadata attaches arbitrary key/values to the order, e.g. a customer ID. The map is copied.
+func WithMetadata(metadata map[string]string) OrderOption {
+	return func(o *Order) {
+		if len(metadata) == 0 {
+			return
+		}
+		o.metadata = make(map[string]string, len(metadata))
+		for key, value := range metadata {
+			o.metadata[key] = value
+		}
+	}
 }
 
 func NewOrder(
@@ -59,14 +241,23 @@ func NewOrder(
 	temp string,
 	shelfLife time.Duration,
 	decayRate float64,
+	opts ...OrderOption,
 ) *Order {
 	o := &Order{
 		id:            uuid.New().String(),
+		generatedID:   true,
 		name:          name,
 		temp:          temp,
+		temps:         parseTemps(temp),
 		shelfLife:     shelfLife,
 		baseDecayRate: decayRate,
+		valueFunc:     LinearValue,
 		now:           time.Now,
+
+		shelfDecayMultiplier: 1,
+	}
+	for _, opt := range opts {
+		opt(o)
 	}
 	return o
 }
@@ -83,6 +274,119 @@ func (order *Order) Temp() string {
 	return order.temp
 }
 
+// Temps returns the components of the order's temp. Most orders have one, composite orders like
+// "hot,cold" can be placed on a shelf that supports any of them.
+func (order *Order) Temps() []string {
+	return order.temps
+}
+
+func parseTemps(temp string) []string {
+	temps := make([]string, 0)
+	for _, t := range strings.Split(temp, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			temps = append(temps, t)
+		}
+	}
+	return temps
+}
+
+// decayOn returns the rate the order decays at on the given shelf, times its shelf decay multiplier. A
+// composite order on a shelf that doesn't support all of its temps decays at the worst rate of the shelves
+// that match it.
+func (order *Order) decayOn(shelf Shelf) float64 {
+	if len(order.temps) > 1 && !supportsAll(shelf, order.temps) && order.worstDecay > shelf.Decay() {
+		return order.worstDecay * order.shelfDecayMultiplier
+	}
+	return shelf.Decay() * order.shelfDecayMultiplier
+}
+
+// legDecay returns what the order decays on the shelf from start until end, at the rate decayOn gives but
+// following the shelf's schedule, if it has one, as it changes. The same leg is valued the same while the order
+// sits on the shelf and once it's banked on leaving, see removeOrder.
+func (order *Order) legDecay(shelf Shelf, start time.Time, end time.Time) float64 {
+	if len(order.temps) > 1 && !supportsAll(shelf, order.temps) && order.worstDecay > shelf.Decay() {
+		return order.worstDecay * order.shelfDecayMultiplier * float64(elapsed(start, end))
+	}
+	return decayBetween(shelf, start, end) * order.shelfDecayMultiplier
+}
+
+// legRate returns the constant rate legDecay accrues at on the shelf, or false if the shelf's rate follows a
+// schedule.
+func (order *Order) legRate(shelf Shelf) (float64, bool) {
+	if len(order.temps) > 1 && !supportsAll(shelf, order.temps) && order.worstDecay > shelf.Decay() {
+		return order.worstDecay * order.shelfDecayMultiplier, true
+	}
+	if ss, ok := shelf.(scheduledShelf); ok && ss.scheduled() {
+		return 0, false
+	}
+	return shelf.Decay() * order.shelfDecayMultiplier, true
+}
+
+// ShelfDecayMultiplier returns what the decay rate of every shelf the order is on is multiplied by.
+func (order *Order) ShelfDecayMultiplier() float64 {
+	return order.shelfDecayMultiplier
+}
+
+// allows returns true if the order's affinity rules allow it on the shelf. The shelf's temps aren't checked.
+func (order *Order) allows(shelf Shelf) bool {
+	group := shelfGroup(shelf)
+	if order.affinity != "" && group != order.affinity {
+		return false
+	}
+	if order.antiAffinity != "" && group == order.antiAffinity {
+		return false
+	}
+	return true
+}
+
+// Affinity returns the shelf group the order must be placed in, if any.
+func (order *Order) Affinity() string {
+	return order.affinity
+}
+
+// AntiAffinity returns the shelf group the order must not be placed in, if any.
+func (order *Order) AntiAffinity() string {
+	return order.antiAffinity
+}
+
+// Priority returns the order's priority, higher is more important.
+func (order *Order) Priority() int {
+	order.RLock()
+	defer order.RUnlock()
+	return order.priority
+}
+
+// setPriority changes the order's priority, returning a *TransitionError if the order is already picked up
+// or trashed. A change of priority counts as a change to the order, see Version.
+func (order *Order) setPriority(priority int) error {
+	order.Lock()
+	defer order.Unlock()
+	switch order.state {
+	case PickedUp, Trashed:
+		return &TransitionError{OrderID: order.id, State: order.state, Expected: order.state}
+	}
+	if order.priority == priority {
+		return nil
+	}
+	order.priority = priority
+	if order.onMove != nil {
+		order.onMove(order)
+	}
+	return nil
+}
+
+// Metadata returns a copy of the order's metadata, nil if it has none.
+func (order *Order) Metadata() map[string]string {
+	if order.metadata == nil {
+		return nil
+	}
+	metadata := make(map[string]string, len(order.metadata))
+	for key, value := range order.metadata {
+		metadata[key] = value
+	}
+	return metadata
+}
+
 func (order *Order) ShelfLife() time.Duration {
 	return order.shelfLife
 }
@@ -91,6 +395,11 @@ func (order *Order) DecayRate() float64 {
 	return order.baseDecayRate
 }
 
+// MaxAge returns the order's age limit, or zero if it has none.
+func (order *Order) MaxAge() time.Duration {
+	return order.maxAge
+}
+
 func (order *Order) State() OrderState {
 	order.RLock()
 	defer order.RUnlock()
@@ -104,39 +413,132 @@ func (order *Order) Shelf() Shelf {
 	return order.shelf
 }
 
-// Age is the duration that has elapsed since the order entered the Ready state.
+// CreatedAt returns when the order was created, or the zero time if it hasn't been.
+func (order *Order) CreatedAt() time.Time {
+	order.RLock()
+	defer order.RUnlock()
+	return order.createdAt
+}
+
+// ReadyAt returns when the order was placed on a shelf, or the zero time if it hasn't been.
+func (order *Order) ReadyAt() time.Time {
+	order.RLock()
+	defer order.RUnlock()
+	return order.readyAt
+}
+
+// EnrouteAt returns when a courier was dispatched for the order, or the zero time if one hasn't been.
+func (order *Order) EnrouteAt() time.Time {
+	order.RLock()
+	defer order.RUnlock()
+	return order.enrouteAt
+}
+
+// PickedUpAt returns when the order was picked up, or the zero time if it hasn't been.
+func (order *Order) PickedUpAt() time.Time {
+	order.RLock()
+	defer order.RUnlock()
+	return order.pickedUpAt
+}
+
+// TrashedAt returns when the order was trashed, or the zero time if it hasn't been.
+func (order *Order) TrashedAt() time.Time {
+	order.RLock()
+	defer order.RUnlock()
+	return order.trashedAt
+}
+
+// Version identifies the last change to the order's state, shelf or priority, or its last reheat. It only
+// increases, and is unique across the kitchen's orders. Zero until the kitchen accepts the order.
+func (order *Order) Version() uint64 {
+	order.RLock()
+	defer order.RUnlock()
+	return order.version
+}
+
+// Reheats returns how many times the order was reheated.
+func (order *Order) Reheats() int {
+	order.RLock()
+	defer order.RUnlock()
+	return order.reheats
+}
+
+// Hops returns how many times the order moved from one shelf to another.
+func (order *Order) Hops() int {
+	order.RLock()
+	defer order.RUnlock()
+	return order.hops
+}
+
+// TrashedReason returns why the order was trashed, empty unless it was.
+func (order *Order) TrashedReason() TrashReason {
+	order.RLock()
+	defer order.RUnlock()
+	return order.trashedReason
+}
+
+// Age is the duration that has elapsed since the order entered the Ready state. Picked up and trashed orders
+// stop aging, and report the age they were at. Orders trashed before they were ready have no age.
 func (order *Order) Age() time.Duration {
 	order.RLock()
 	defer order.RUnlock()
-	return order.age()
+	return order.age(order.now())
 }
 
-// unsafe age function
-func (order *Order) age() time.Duration {
-	t := order.now()
+// unsafe age function, as of the given time
+func (order *Order) age(at time.Time) time.Duration {
+	t := at
 	switch order.state {
 	case PickedUp:
 		t = order.pickedUpAt
 	case Trashed:
-		return 0
+		// trashed on the way to ready, e.g. for lack of room
+		if order.readyAt.IsZero() {
+			return 0
+		}
+		t = order.trashedAt
+	}
+	return order.ticks(elapsed(order.readyAt, t))
+}
+
+// elapsed returns the time from start to end, or zero if the clock says end is before start, e.g. after it was
+// set back. Decay can't be undone by a clock going backwards.
+func elapsed(start, end time.Time) time.Duration {
+	if d := end.Sub(start); d > 0 {
+		return d
 	}
-	return t.Sub(order.readyAt)
+	return 0
+}
+
+// ticks rounds the duration down to whole ticks, if the order has them.
+func (order *Order) ticks(d time.Duration) time.Duration {
+	if order.tick <= 0 {
+		return d
+	}
+	return d.Truncate(order.tick)
 }
 
 // RawValue is the value for the Order, not including Decay.
 func (order *Order) RawValue() float64 {
 	order.RLock()
 	defer order.RUnlock()
-	return order.rawValue()
+	return order.rawValue(order.now())
 }
 
 // unsafe rawValue
-func (order *Order) rawValue() float64 {
+func (order *Order) rawValue(at time.Time) float64 {
 	switch order.state {
 	case "", Created, Trashed:
 		return 0
 	}
-	return float64(order.shelfLife - order.age())
+	return order.valueFunc(order.shelfLife, order.age(at))
+}
+
+// freshValue is the value the order has once it's ready, before any age or decay.
+func (order *Order) freshValue() float64 {
+	order.RLock()
+	defer order.RUnlock()
+	return order.valueFunc(order.shelfLife, 0)
 }
 
 // Value represents the _real_ value of the order at the current age. Decay
@@ -144,94 +546,524 @@ func (order *Order) rawValue() float64 {
 func (order *Order) Value() float64 {
 	order.RLock()
 	defer order.RUnlock()
-	return order.value()
+	return order.value(order.now())
 }
 
 // unsafe value
-func (order *Order) value() float64 {
-	return order.rawValue() - order.decayed()
+func (order *Order) value(at time.Time) float64 {
+	return order.rawValue(at) - order.decayed(at)
 }
 
 // NormalizedValue is the value over the shelflife.
 func (order *Order) NormalizedValue() float64 {
 	order.RLock()
 	defer order.RUnlock()
-	return order.value() / float64(order.shelfLife)
+	return order.value(order.now()) / float64(order.shelfLife)
 }
 
-// IsExpired returns true when the order is expired, meaning that the value is less than zero.
+// IsExpired returns true when the order is expired, meaning that the value is less than zero or the
+// order has outlived its shelf life or max age.
 func (order *Order) IsExpired() bool {
 	order.RLock()
 	defer order.RUnlock()
-	return order.isExpired()
+	return order.isExpired(order.now())
 }
 
 // unsafe isExpired
-func (order *Order) isExpired() bool {
+func (order *Order) isExpired(at time.Time) bool {
 	switch order.state {
 	case "", Created, PickedUp, Trashed:
 		return false
 	}
+	// orders with little to no decay would otherwise linger, so age is a hard limit
+	age := order.age(at)
+	if age >= order.shelfLife || (order.maxAge > 0 && age >= order.maxAge) {
+		return true
+	}
 	// decayed represents total decay amount, including previous shelves
-	return order.value() <= 0
+	return order.value(at) <= 0
+}
+
+// ProjectValue returns the value the order will have at the given time if it stays on its current shelf at the
+// decay rates it has now, floored at zero once it would have expired.
+func (order *Order) ProjectValue(at time.Time) float64 {
+	order.RLock()
+	defer order.RUnlock()
+	return order.projectValue(at)
+}
+
+// unsafe ProjectValue
+func (order *Order) projectValue(at time.Time) float64 {
+	if order.isExpired(at) {
+		return 0
+	}
+	return math.Max(order.value(at), 0)
+}
+
+// ProjectedValue is the value an order is projected to have Offset from now.
+type ProjectedValue struct {
+	Offset time.Duration
+	Value  float64
+}
+
+// Projection projects the order's value every step from now through horizon, see ProjectValue. The points are
+// taken under a single read lock, so they're consistent with each other. step must be positive.
+func (order *Order) Projection(horizon, step time.Duration) []ProjectedValue {
+	order.RLock()
+	defer order.RUnlock()
+	now := order.now()
+	points := make([]ProjectedValue, 0, horizon/step+1)
+	for offset := time.Duration(0); offset <= horizon; offset += step {
+		points = append(points, ProjectedValue{Offset: offset, Value: order.projectValue(now.Add(offset))})
+	}
+	return points
+}
+
+// NeverExpires is the TimeToExpiry of orders that aren't decaying, because they aren't ready yet or were
+// picked up.
+const NeverExpires time.Duration = math.MaxInt64
+
+// TimeToExpiry returns how long until the order expires if the decay rates it has now don't change, or zero if
+// it already has. Moving the order, or a shelf's decay schedule, changes the answer.
+func (order *Order) TimeToExpiry() time.Duration {
+	order.RLock()
+	defer order.RUnlock()
+	return order.timeToExpiry(order.now())
+}
+
+// unsafe timeToExpiry
+func (order *Order) timeToExpiry(at time.Time) time.Duration {
+	switch order.state {
+	case "", Created, PickedUp:
+		return NeverExpires
+	case Trashed:
+		return 0
+	}
+	if order.isExpired(at) {
+		return 0
+	}
+	// age is a hard limit, so the order has expired by then at the latest
+	limit := order.shelfLife
+	if order.maxAge > 0 && order.maxAge < limit {
+		limit = order.maxAge
+	}
+	if expiry, ok := order.linearExpiry(at, limit); ok {
+		return expiry
+	}
+	return order.searchExpiry(at, limit)
+}
+
+// searchExpiry is timeToExpiry for any value function and decay rates, by searching for the first instant the
+// order is expired before its age reaches the limit. The caller must hold the order's lock.
+func (order *Order) searchExpiry(at time.Time, limit time.Duration) time.Duration {
+	// a tick more covers the age being rounded down
+	hi := limit - elapsed(order.readyAt, at) + order.tick
+	// value only falls while the rates are fixed, so search for the first instant the order is expired
+	lo := time.Duration(0)
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if order.isExpired(at.Add(mid)) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
+
+// linearExpiry solves for timeToExpiry directly, for orders whose raw value falls linearly and whose decay rates
+// are all constant, or returns false for timeToExpiry to search instead. The caller must hold the order's lock.
+func (order *Order) linearExpiry(at time.Time, limit time.Duration) (time.Duration, bool) {
+	if reflect.ValueOf(order.valueFunc).Pointer() != reflect.ValueOf(LinearValue).Pointer() {
+		return 0, false
+	}
+	var shelfRate float64
+	var onShelf time.Duration
+	if order.shelf != nil {
+		rate, ok := order.legRate(order.shelf)
+		if !ok {
+			return 0, false
+		}
+		shelfRate, onShelf = rate, elapsed(order.placedAt, at)
+	}
+	age := elapsed(order.readyAt, at)
+
+	// the value is the least of the raw value less the summed decay, less the min_decay floor, and the raw value
+	// itself, as decay is floored at zero. each falls linearly, so without ticks the order expires when the
+	// first of them reaches zero, or at the age limit.
+	shelfLife := float64(order.shelfLife)
+	a, p := float64(age), float64(onShelf)
+	first := float64(limit - age)
+	if rate := 1 + order.baseDecayRate + shelfRate; rate > 0 {
+		first = math.Min(first, (shelfLife-a*(1+order.baseDecayRate)-p*shelfRate-order.prevDecayed)/rate)
+	}
+	first = math.Min(first, shelfLife/(1+order.minDecay)-a)
+	if first < 0 {
+		return 0, false
+	}
+
+	// ticks only hold the value up, so the order expires at the first tick of its age or of its time on the
+	// shelf from then on. rounding can be a nanosecond out either way, so the neighbours are candidates too.
+	from := time.Duration(math.Ceil(first))
+	candidates := []time.Duration{from - 1, from, from + 1}
+	if order.tick > 0 {
+		nextTick := func(elapsed time.Duration) time.Duration {
+			return (elapsed+from+order.tick-1)/order.tick*order.tick - elapsed
+		}
+		candidates = []time.Duration{nextTick(age), nextTick(onShelf)}
+		candidates = append(candidates, candidates[0]+order.tick, candidates[1]+order.tick)
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+	}
+	for _, d := range candidates {
+		if d < 0 || !order.isExpired(at.Add(d)) {
+			continue
+		}
+		// the answer must be the first expired instant, or the search is left to find it
+		if d > 0 && order.isExpired(at.Add(d-1)) {
+			return 0, false
+		}
+		return d, true
+	}
+	return 0, false
 }
 
 func (order *Order) Decayed() float64 {
 	order.RLock()
 	defer order.RUnlock()
-	return order.decayed()
+	return order.decayed(order.now())
 }
 
 // unsafe decayed
-func (order *Order) decayed() float64 {
+func (order *Order) decayed(at time.Time) float64 {
+	// decayed represents total decay amount, including previous shelves. preserving shelves have
+	// a negative decay rate, but can't push the value above the raw value.
+	total := order.decayBreakdown(at).sum()
+	if total < 0 {
+		return 0
+	}
+	return total
+}
+
+// DecayBreakdown splits an order's decay into its components. Decayed is their sum, floored at zero.
+type DecayBreakdown struct {
+	// Base is the decay from the order's own decay rate
+	Base float64
+	// CurrentShelf is the decay accrued on the shelf the order is on now
+	CurrentShelf float64
+	// PreviousShelves is the decay accrued on every shelf the order was on before
+	PreviousShelves float64
+	// Floor is the decay added to bring the rest up to the kitchen's min_decay floor, zero unless they fall short
+	Floor float64
+}
+
+func (d DecayBreakdown) sum() float64 {
+	return d.Base + d.CurrentShelf + d.PreviousShelves + d.Floor
+}
+
+// DecayBreakdown returns the components of the order's decay, e.g. to debug placement decisions.
+func (order *Order) DecayBreakdown() DecayBreakdown {
+	order.RLock()
+	defer order.RUnlock()
+	return order.decayBreakdown(order.now())
+}
+
+// unsafe decayBreakdown
+func (order *Order) decayBreakdown(at time.Time) DecayBreakdown {
+	breakdown := DecayBreakdown{PreviousShelves: order.prevDecayed}
 	// if there is an existing shelf (and the order is still active), calc running decay
-	var decay float64
 	if order.shelf != nil {
-		t := order.now()
+		t := at
 		if order.state == PickedUp {
 			t = order.pickedUpAt
 		}
-		timeAt := t.Sub(order.placedAt)
-		decay = order.shelf.Decay() * float64(timeAt)
+		timeAt := order.ticks(elapsed(order.placedAt, t))
+		breakdown.CurrentShelf = order.legDecay(order.shelf, order.placedAt, order.placedAt.Add(timeAt))
 	}
+	breakdown.Base = order.baseDecayRate * float64(order.age(at))
+	// the kitchen's floor, so orders with next to no decay still expire
+	if floor := order.minDecay * float64(order.age(at)); order.minDecay > 0 && breakdown.sum() < floor {
+		breakdown.Floor = floor - breakdown.sum()
+	}
+	return breakdown
+}
 
-	// add base decay
-	decay += order.baseDecayRate * float64(order.age())
-	// decayed represents total decay amount, including previous shelves
-	return order.prevDecayed + decay
+// OrderValue is the order's state and derived value at a point in time.
+type OrderValue struct {
+	State           OrderState
+	Value           float64
+	NormalizedValue float64
+	Decayed         float64
+	Breakdown       DecayBreakdown
+	Age             time.Duration
+}
+
+// ValueSnapshot computes the order's value under a single read lock, so the fields are consistent with
+// each other and cheaper than calling each accessor.
+func (order *Order) ValueSnapshot() OrderValue {
+	order.RLock()
+	defer order.RUnlock()
+	return order.valueSnapshot(order.now())
+}
+
+// unsafe valueSnapshot, every field is computed as of the same time
+func (order *Order) valueSnapshot(at time.Time) OrderValue {
+	raw := order.rawValue(at)
+	decayed := order.decayed(at)
+	return OrderValue{
+		State:           order.state,
+		Value:           raw - decayed,
+		NormalizedValue: (raw - decayed) / float64(order.shelfLife),
+		Decayed:         decayed,
+		Breakdown:       order.decayBreakdown(at),
+		Age:             order.age(at),
+	}
+}
+
+// Clone returns a deep copy of the order, taken under a single read lock, that's safe to hand to code outside
+// the kitchen. Its value keeps ticking like the original's, but nothing done to the clone reaches the kitchen:
+// it has none of the kitchen's hooks, and its shelf is a read-only copy that takes no orders, with the decay rate
+// the original shelf had at the time of the clone.
+func (order *Order) Clone() *Order {
+	order.RLock()
+	defer order.RUnlock()
+	clone := &Order{
+		id:            order.id,
+		name:          order.name,
+		temp:          order.temp,
+		generatedID:   order.generatedID,
+		temps:         append([]string(nil), order.temps...),
+		worstDecay:    order.worstDecay,
+		shelfLife:     order.shelfLife,
+		maxAge:        order.maxAge,
+		affinity:      order.affinity,
+		antiAffinity:  order.antiAffinity,
+		priority:      order.priority,
+		metadata:      order.metadata, // never modified
+		baseDecayRate: order.baseDecayRate,
+		state:         order.state,
+		valueFunc:     order.valueFunc,
+		tick:          order.tick,
+		minDecay:      order.minDecay,
+		kitchenID:     order.kitchenID,
+		version:       order.version,
+		prevDecayed:   order.prevDecayed,
+		reheats:       order.reheats,
+		reheatedAt:    order.reheatedAt,
+		hops:          order.hops,
+		createdAt:     order.createdAt,
+		readyAt:       order.readyAt,
+		enrouteAt:     order.enrouteAt,
+		pickedUpAt:    order.pickedUpAt,
+		trashedAt:     order.trashedAt,
+		trashedReason: order.trashedReason,
+		placedAt:      order.placedAt,
+		events:        append([]OrderEvent(nil), order.events...),
+		now:           order.now,
+		cloned:        true,
+
+		shelfDecayMultiplier: order.shelfDecayMultiplier,
+	}
+	if order.shelf != nil {
+		clone.shelf = newShelfSnapshot(order.shelf)
+	}
+	return clone
+}
+
+// OrderSnapshot is an immutable copy of an Order's fields at a point in time.
+type OrderSnapshot struct {
+	ID          string
+	Name        string
+	Temp        string
+	ShelfLife   time.Duration
+	MaxAge      time.Duration
+	DecayRate   float64
+	Priority    int
+	State       OrderState
+	Shelf       string
+	PrevDecayed float64
+	CreatedAt   time.Time
+	ReadyAt     time.Time
+	EnrouteAt   time.Time
+	PickedUpAt  time.Time
+	TrashedAt   time.Time
+	PlacedAt    time.Time
+	Reheats     int
+	// ReheatedAt is when the order was last reheated, the zero time if it never was
+	ReheatedAt time.Time
+	// Hops is how many times the order moved from one shelf to another
+	Hops int
+	// TrashedReason is empty unless the order was trashed
+	TrashedReason TrashReason
+	// Metadata is shared with the order, which never modifies it, and must not be modified
+	Metadata map[string]string
+}
+
+// Snapshot returns a consistent copy of the order's fields, taken under a single read lock.
+func (order *Order) Snapshot() OrderSnapshot {
+	order.RLock()
+	defer order.RUnlock()
+	return order.snapshot()
+}
+
+// unsafe snapshot
+func (order *Order) snapshot() OrderSnapshot {
+	var shelfName string
+	if order.shelf != nil {
+		shelfName = order.shelf.Name()
+	}
+	return OrderSnapshot{
+		ID:            order.id,
+		Name:          order.name,
+		Temp:          order.temp,
+		ShelfLife:     order.shelfLife,
+		MaxAge:        order.maxAge,
+		DecayRate:     order.baseDecayRate,
+		Priority:      order.priority,
+		State:         order.state,
+		Shelf:         shelfName,
+		PrevDecayed:   order.prevDecayed,
+		CreatedAt:     order.createdAt,
+		ReadyAt:       order.readyAt,
+		EnrouteAt:     order.enrouteAt,
+		PickedUpAt:    order.pickedUpAt,
+		TrashedAt:     order.trashedAt,
+		PlacedAt:      order.placedAt,
+		Reheats:       order.reheats,
+		ReheatedAt:    order.reheatedAt,
+		Hops:          order.hops,
+		TrashedReason: order.trashedReason,
+		Metadata:      order.metadata,
+	}
+}
+
+// ResponseSnapshot is an order's fields along with its derived value.
+type ResponseSnapshot struct {
+	Order OrderSnapshot
+	Value OrderValue
+	// TimeToExpiry is as of the same time as Value, see Order.TimeToExpiry
+	TimeToExpiry time.Duration
+}
+
+// ResponseSnapshot takes the read lock once and computes everything needed to describe the order, so
+// the fields can't be torn by a concurrent transition or move.
+func (order *Order) ResponseSnapshot() ResponseSnapshot {
+	order.RLock()
+	defer order.RUnlock()
+	now := order.now()
+	return ResponseSnapshot{
+		Order:        order.snapshot(),
+		Value:        order.valueSnapshot(now),
+		TimeToExpiry: order.timeToExpiry(now),
+	}
+}
+
+// FieldChange is a single field that differs between two snapshots.
+type FieldChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+// DiffOrders returns the fields that changed from a to b, in field order. It returns nil if nothing changed.
+func DiffOrders(a OrderSnapshot, b OrderSnapshot) []FieldChange {
+	var changes []FieldChange
+	av := reflect.ValueOf(a)
+	bv := reflect.ValueOf(b)
+	for i := 0; i < av.NumField(); i++ {
+		before := av.Field(i).Interface()
+		after := bv.Field(i).Interface()
+		if !reflect.DeepEqual(before, after) {
+			changes = append(changes, FieldChange{Field: av.Type().Field(i).Name, Old: before, New: after})
+		}
+	}
+	return changes
 }
 
 // SetShelf updates the current shelf of the Order and pushes a OrderRecord on the history.
 func (order *Order) SetShelf(shelf Shelf) error {
+	return order.setShelf(shelf, shelf.Put)
+}
+
+// forceShelf is SetShelf, but may use capacity the shelf holds back from new orders.
+func (order *Order) forceShelf(shelf Shelf) error {
+	return order.setShelf(shelf, forcedPut(shelf))
+}
+
+// forcedPut returns a put function for setShelf that may use the shelf's held back capacity.
+func forcedPut(shelf Shelf) func(*Order) error {
+	return func(o *Order) error {
+		return putForced(shelf, o)
+	}
+}
+
+func (order *Order) setShelf(shelf Shelf, put func(*Order) error) error {
 	order.Lock()
 	defer order.Unlock()
+	return order.unsafeSetShelf(shelf, put)
+}
 
-	err := shelf.Put(order)
+// unsafe setShelf
+func (order *Order) unsafeSetShelf(shelf Shelf, put func(*Order) error) error {
+	// already there, putting it again would remove it from the shelf below
+	if order.shelf == shelf {
+		return nil
+	}
+	// an order picked up or trashed since the caller looked at it stays off the shelves, the slot would
+	// otherwise never be freed
+	switch order.state {
+	case PickedUp, Trashed:
+		return &TransitionError{OrderID: order.id, State: order.state, Expected: Ready}
+	case Enroute:
+		// a courier has been dispatched to the shelf it's on, so it only leaves one a reload removed
+		if order.shelf != nil && !anyClosed([]Shelf{order.shelf}) {
+			return &TransitionError{OrderID: order.id, State: order.state, Expected: Ready}
+		}
+	}
+
+	// the put comes first and nothing after it can fail, so the order is always on at least one shelf: a
+	// failed put leaves it where it was, and it's only removed from the old shelf once it's on the new one
+	err := put(order)
 	if err != nil {
 		return err
 	}
+	order.unsafePlaced(shelf)
+	return nil
+}
 
+// unsafePlaced updates the order's shelf meta once it's been put on the shelf, taking it off its old shelf if it
+// had one. The caller must hold the order's lock.
+func (order *Order) unsafePlaced(shelf Shelf) {
 	// if there is an existing shelf, update the running decay and remove the order from it
+	if order.shelf != nil {
+		order.hops++
+	}
 	removeOrder(order)
 
 	// update shelf meta
 	order.shelf = shelf
 	order.placedAt = order.now()
-	return nil
+	if order.onMove != nil {
+		order.onMove(order)
+	}
 }
 
 // Helper function. removeOrder must be called by a function that is holding the lock for this order.
 func removeOrder(order *Order) {
 	if order.shelf != nil {
-		timeAt := order.now().Sub(order.placedAt)
-		decay := order.shelf.Decay() * float64(timeAt)
-		order.prevDecayed += decay
+		now := order.now()
+		order.prevDecayed += order.legDecay(order.shelf, order.placedAt, now)
+		// a preserving shelf can restore the order to its raw value but not bank credit beyond it,
+		// so the total decay at the time of the move is floored at zero
+		if base := order.baseDecayRate * float64(order.age(now)); order.prevDecayed+base < 0 {
+			order.prevDecayed = -base
+		}
 		order.shelf.Remove(order.ID())
 		order.shelf = nil
 	}
 }
 
-// TransitionOrder will update the Order to the given newState iff the current state is equal to the expectedState.
+// TransitionOrder will update the Order to the given newState iff the current state is equal to the expectedState
+// and the sideEffect succeeds.
 func (order *Order) TransitionOrder(
 	expectedState OrderState,
 	newState OrderState,
@@ -240,27 +1072,67 @@ func (order *Order) TransitionOrder(
 	order.Lock()
 	defer order.Unlock()
 	if order.state != expectedState {
-		return fmt.Errorf("order %s in incorrect state %s, expected %s", order.id, order.state, expectedState)
+		return &TransitionError{OrderID: order.id, State: order.state, Expected: expectedState}
 	}
 
 	switch order.state {
 	case PickedUp, Trashed:
-		return fmt.Errorf("order %s was in terminal state %s, invalid transition", order.id, order.state)
+		return &TransitionError{OrderID: order.id, State: order.state, Expected: expectedState}
 	}
 
 	// double check the value here and hijack the transition if the value is negative
-	if order.isExpired() {
+	if order.isExpired(order.now()) {
 		order.state = Trashed
 		order.trashedAt = order.now()
+		order.trashedReason = TrashExpired
 		removeOrder(order)
+		order.publish(expectedState, Trashed)
 		return fmt.Errorf("order %s expired", order.id)
 	}
 
-	order.state = newState
+	// the new state is only applied once the side effect succeeds, so a failed transition leaves the order
+	// as it was. side effects see the old state and must not leave partial changes behind when they fail.
 	err := sideEffect(order)
 	if err != nil {
 		return err
 	}
 
+	order.state = newState
+	order.publish(expectedState, newState)
 	return nil
 }
+
+// publish records a transition and notifies the kitchen of it. Must be called by a function that is holding the
+// lock for this order, so events for an order are published in order.
+func (order *Order) publish(oldState OrderState, newState OrderState) {
+	order.publishEvent(order.event(oldState, newState))
+}
+
+// event returns an event for a transition of the order as of now. The caller must hold the order's lock.
+func (order *Order) event(oldState OrderState, newState OrderState) OrderEvent {
+	return OrderEvent{
+		OrderID:   order.id,
+		OldState:  oldState,
+		NewState:  newState,
+		At:        order.now(),
+		Metadata:  order.metadata,
+		Reason:    order.trashedReason,
+		KitchenID: order.kitchenID,
+	}
+}
+
+// publishEvent is publish, for an event that isn't a plain transition.
+func (order *Order) publishEvent(event OrderEvent) {
+	order.events = append(order.events, event)
+	if order.onTransition == nil {
+		return
+	}
+	order.onTransition(order, event)
+}
+
+// Events returns a copy of every transition the order has made, oldest first.
+func (order *Order) Events() []OrderEvent {
+	order.RLock()
+	defer order.RUnlock()
+	return append([]OrderEvent(nil), order.events...)
+}
@@ -0,0 +1,60 @@
+package kitchen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Placer decides where a new order goes. Rank sorts the shelves that support the order in place, from best to
+// worst, and the kitchen puts the order on the first one with room. The decay minimizer doesn't use the placer,
+// it only ever moves orders to shelves they decay slower on, see optimizePlacement.
+type Placer interface {
+	Rank(order *Order, shelves []Shelf)
+}
+
+// WithPlacer replaces the placer chosen by the config's placer, for algorithms the kitchen doesn't provide.
+func WithPlacer(placer Placer) KitchenOption {
+	return func(k *Kitchen) {
+		k.placer = placer
+	}
+}
+
+// greedyPlacer places each order on the shelf it decays slowest on, after its preferred shelves. Shelves with
+// equal decay are ordered by the kitchen's tie-break.
+type greedyPlacer struct {
+	k *Kitchen
+}
+
+func (p greedyPlacer) Rank(order *Order, shelves []Shelf) {
+	p.k.rankShelves(order, shelves)
+}
+
+// balancedPlacer places each order on the least loaded shelf, after its preferred shelves, spreading orders
+// across the shelves that support them rather than filling the best shelf first. Shelves with equal load are
+// ordered by decay, then by the kitchen's tie-break.
+type balancedPlacer struct {
+	k *Kitchen
+}
+
+func (p balancedPlacer) Rank(order *Order, shelves []Shelf) {
+	p.k.rankShelvesBy(order, shelves, func(a, b shelfRank) bool {
+		if la, lb := a.load(), b.load(); la != lb {
+			return la < lb
+		}
+		if a.decay != b.decay {
+			return a.decay < b.decay
+		}
+		return p.k.tieBreak(a, b)
+	})
+}
+
+func buildPlacer(name string, k *Kitchen) (Placer, error) {
+	switch strings.ToLower(name) {
+	// greedy is the default
+	case "", "greedy":
+		return greedyPlacer{k: k}, nil
+	case "balanced":
+		return balancedPlacer{k: k}, nil
+	}
+	return nil, fmt.Errorf("unknown placer %q, expected greedy or balanced", name)
+}
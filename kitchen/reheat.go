@@ -0,0 +1,56 @@
+package kitchen
+
+import "fmt"
+
+// reheatConfig allows orders to be reheated, recovering value lost to decay. Reheating is disabled unless
+// MaxReheats is set.
+type reheatConfig struct {
+	// MaxReheats is how many times a single order can be reheated
+	MaxReheats int `yaml:"max_reheats"`
+	// Penalty is the fraction of an order's decay that a reheat doesn't recover, between 0 and 1
+	Penalty float64 `yaml:"penalty"`
+}
+
+func (cfg reheatConfig) validate() error {
+	if cfg.MaxReheats < 0 {
+		return fmt.Errorf("reheat: max_reheats %d must not be negative", cfg.MaxReheats)
+	}
+	if cfg.Penalty < 0 || cfg.Penalty > 1 {
+		return fmt.Errorf("reheat: penalty %v must be between 0 and 1", cfg.Penalty)
+	}
+	return nil
+}
+
+// Reheat recovers the decay a ready order has accrued so far, less the configured penalty, so its value moves
+// back toward its raw value but never above it. Age isn't recovered. Each reheat is recorded on the order, and
+// ErrReheatLimit is returned once it has been reheated max_reheats times. Orders that aren't ready return a
+// *TransitionError, and expired orders can't be reheated at all. A reheat is published as an OrderEvent with
+// Reheated set, and counts as a change, see Changes. A clone of an order that has left the shelves
+// returns ErrOrderNotFound.
+func (k *Kitchen) Reheat(order *Order) error {
+	order, err := k.resolve(order)
+	if err != nil {
+		return err
+	}
+	order.Lock()
+	defer order.Unlock()
+	if order.state != Ready {
+		return &TransitionError{OrderID: order.id, State: order.state, Expected: Ready}
+	}
+	if order.reheats >= k.reheat.MaxReheats {
+		return ErrReheatLimit
+	}
+	now := order.now()
+	if order.isExpired(now) {
+		return fmt.Errorf("order %s expired", order.id)
+	}
+	// decayed is floored at zero, so the remaining decay is too
+	order.prevDecayed -= order.decayed(now) * (1 - k.reheat.Penalty)
+	order.reheats++
+	order.reheatedAt = now
+	// the value jumped, so tell subscribers and long-polls as for a transition
+	event := order.event(Ready, Ready)
+	event.Reheated = true
+	order.publishEvent(event)
+	return nil
+}
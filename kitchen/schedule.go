@@ -0,0 +1,106 @@
+package kitchen
+
+import (
+	"fmt"
+	"time"
+)
+
+// scheduleConfig multiplies a shelf's decay rate from From until To, both "15:04" times of day in the
+// kitchen clock's location. A window ending before it starts wraps around midnight.
+type scheduleConfig struct {
+	From       string  `yaml:"from"`
+	To         string  `yaml:"to"`
+	Multiplier float64 `yaml:"multiplier"`
+}
+
+// decayWindow is a parsed scheduleConfig, from and to are offsets from midnight.
+type decayWindow struct {
+	from       time.Duration
+	to         time.Duration
+	multiplier float64
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected e.g. 13:30", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseSchedule(configs []scheduleConfig) ([]decayWindow, error) {
+	windows := make([]decayWindow, 0, len(configs))
+	for _, cfg := range configs {
+		from, err := parseTimeOfDay(cfg.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseTimeOfDay(cfg.To)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Multiplier < 0 {
+			return nil, fmt.Errorf("schedule multiplier %v must not be negative", cfg.Multiplier)
+		}
+		windows = append(windows, decayWindow{from: from, to: to, multiplier: cfg.Multiplier})
+	}
+	return windows, nil
+}
+
+// contains returns true if the time of day falls in the window, which includes from but not to.
+func (w decayWindow) contains(timeOfDay time.Duration) bool {
+	if w.from <= w.to {
+		return w.from <= timeOfDay && timeOfDay < w.to
+	}
+	return w.from <= timeOfDay || timeOfDay < w.to
+}
+
+// timeOfDay returns the time since t's midnight.
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+// multiplierAt returns the multiplier of the first window containing t, or 1 if none do.
+func multiplierAt(windows []decayWindow, t time.Time) float64 {
+	timeOfDay := timeOfDay(t)
+	for _, w := range windows {
+		if w.contains(timeOfDay) {
+			return w.multiplier
+		}
+	}
+	return 1
+}
+
+// scheduledDecay returns the decay at rate, multiplied by the windows, from start until end. The rate changes as
+// windows open and close, so an order's stay on a shelf is summed window by window.
+func scheduledDecay(rate float64, windows []decayWindow, start time.Time, end time.Time) float64 {
+	total := 0.0
+	for at := start; at.Before(end); {
+		next := nextBoundary(windows, at)
+		if next.After(end) {
+			next = end
+		}
+		total += rate * multiplierAt(windows, at) * float64(next.Sub(at))
+		at = next
+	}
+	return total
+}
+
+// nextBoundary returns the first time after t that any of the windows opens or closes.
+func nextBoundary(windows []decayWindow, t time.Time) time.Time {
+	timeOfDay := timeOfDay(t)
+	next := 24 * time.Hour
+	for _, w := range windows {
+		for _, boundary := range []time.Duration{w.from, w.to} {
+			until := boundary - timeOfDay
+			if until <= 0 {
+				until += 24 * time.Hour
+			}
+			if until < next {
+				next = until
+			}
+		}
+	}
+	return t.Add(next)
+}
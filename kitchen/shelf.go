@@ -2,7 +2,9 @@ package kitchen
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Shelf is a container interface for Orders. Shelf implementations must be thread-safe.
@@ -14,7 +16,7 @@ type Shelf interface {
 	// Supported returns the list of order types that are supported by this shelf.
 	Supported() []string
 
-	// Orders returns an unsorted array of Orders
+	// Orders returns an unsorted array of Orders. The order is random and may differ between calls.
 	Orders() []*Order
 
 	// Put places an order on the shelf
@@ -33,6 +35,305 @@ type Shelf interface {
 	Decay() float64
 }
 
+// supports returns true if the shelf supports the given order type.
+func supports(shelf Shelf, orderType string) bool {
+	for _, supported := range shelf.Supported() {
+		if orderType == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsAny returns true if the shelf supports at least one of the given order types.
+func supportsAny(shelf Shelf, orderTypes []string) bool {
+	for _, orderType := range orderTypes {
+		if supports(shelf, orderType) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsAll returns true if the shelf supports every one of the given order types.
+func supportsAll(shelf Shelf, orderTypes []string) bool {
+	for _, orderType := range orderTypes {
+		if !supports(shelf, orderType) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortOrders sorts the orders in place by less, breaking ties by ID.
+func sortOrders(orders []*Order, less func(a, b *Order) bool) {
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].ID() < orders[j].ID()
+	})
+	sort.SliceStable(orders, func(i, j int) bool {
+		return less(orders[i], orders[j])
+	})
+}
+
+// byValueAsc orders the least valuable orders first.
+func byValueAsc(a, b *Order) bool {
+	return a.Value() < b.Value()
+}
+
+// byDecayDesc orders the most decayed orders first.
+func byDecayDesc(a, b *Order) bool {
+	return a.Decayed() > b.Decayed()
+}
+
+// bufferedShelf is implemented by shelves that can list their orders into a buffer the caller reuses, so hot
+// paths don't allocate.
+type bufferedShelf interface {
+	// OrdersInto is Orders, but appends to buf[:0]
+	OrdersInto(buf []*Order) []*Order
+}
+
+// shelfOrdersInto appends the shelf's orders to buf[:0], without allocating if the shelf allows it and the
+// buffer is big enough.
+func shelfOrdersInto(shelf Shelf, buf []*Order) []*Order {
+	if bs, ok := shelf.(bufferedShelf); ok {
+		return bs.OrdersInto(buf)
+	}
+	return append(buf[:0], shelf.Orders()...)
+}
+
+// sortingShelf is implemented by shelves that sort their own orders, e.g. because they keep them in order.
+type sortingShelf interface {
+	// OrdersSorted returns the orders sorted by less. Orders that less considers equal are sorted by ID, so
+	// the result is deterministic.
+	OrdersSorted(less func(a, b *Order) bool) []*Order
+}
+
+// shelfOrdersSorted returns the shelf's orders sorted by less, breaking ties by ID.
+func shelfOrdersSorted(shelf Shelf, less func(a, b *Order) bool) []*Order {
+	if ss, ok := shelf.(sortingShelf); ok {
+		return ss.OrdersSorted(less)
+	}
+	orders := shelf.Orders()
+	sortOrders(orders, less)
+	return orders
+}
+
+// forcedPutter is implemented by shelves that hold back some capacity from new orders. PutForced may use
+// the held back capacity and is only used to move orders that are already in the kitchen.
+type forcedPutter interface {
+	PutForced(*Order) error
+}
+
+// putForced places an order on the shelf, using any capacity the shelf holds back from new orders.
+func putForced(shelf Shelf, o *Order) error {
+	if fp, ok := shelf.(forcedPutter); ok {
+		return fp.PutForced(o)
+	}
+	return shelf.Put(o)
+}
+
+// batchPutter is implemented by shelves that can place several new orders under a single acquisition of their
+// lock, see batcher.
+type batchPutter interface {
+	// PutBatch places the orders in turn until the shelf is full, returning how many it placed. The caller
+	// must hold every order's lock.
+	PutBatch(orders []*Order) int
+}
+
+// putBatch places the orders on the shelf in turn until it's full, returning how many it placed, under a
+// single lock if the shelf allows it.
+func putBatch(shelf Shelf, orders []*Order) int {
+	if bp, ok := shelf.(batchPutter); ok {
+		return bp.PutBatch(orders)
+	}
+	for i, o := range orders {
+		if shelf.Put(o) != nil {
+			return i
+		}
+	}
+	return len(orders)
+}
+
+// closableShelf is implemented by shelves that can be closed when a reload removes them from the topology.
+// Puts on a closed shelf fail with ErrShelfRemoved, so an order ranked against the old topology can't land on
+// a shelf that's already been emptied. Shelves that don't implement it are only emptied.
+type closableShelf interface {
+	close()
+	closed() bool
+}
+
+// closeShelf closes the shelf, if it can be.
+func closeShelf(shelf Shelf) {
+	if cs, ok := shelf.(closableShelf); ok {
+		cs.close()
+	}
+}
+
+// anyClosed returns true if any of the shelves was removed from the topology and closed.
+func anyClosed(shelves []Shelf) bool {
+	for _, shelf := range shelves {
+		if cs, ok := shelf.(closableShelf); ok && cs.closed() {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledShelf is implemented by shelves whose decay rate varies over time, see decayBetween.
+type scheduledShelf interface {
+	decayBetween(start time.Time, end time.Time) float64
+	// scheduled returns false if the shelf has no schedule after all, so its rate is constant
+	scheduled() bool
+}
+
+// decayBetween returns what the shelf's decay rate adds up to from start until end, following any schedule
+// the shelf has. Other shelves are assumed to decay at their current rate throughout.
+func decayBetween(shelf Shelf, start time.Time, end time.Time) float64 {
+	if ss, ok := shelf.(scheduledShelf); ok {
+		return ss.decayBetween(start, end)
+	}
+	return shelf.Decay() * float64(elapsed(start, end))
+}
+
+// resizableShelf is implemented by shelves whose capacity can be changed while they're in use.
+type resizableShelf interface {
+	// SetCapacity changes the shelf's capacity. If the shelf holds more orders than the new capacity it
+	// returns ErrShelfFull, unless force is set, in which case it's left over capacity and takes no more orders
+	// until enough are removed.
+	SetCapacity(capacity int, force bool) error
+}
+
+// groupedShelf is implemented by shelves that belong to a group, e.g. "refrigerated", which orders can have an
+// affinity or anti-affinity to.
+type groupedShelf interface {
+	Group() string
+}
+
+// shelfGroup returns the shelf's group, or the empty string if it has none.
+func shelfGroup(shelf Shelf) string {
+	if gs, ok := shelf.(groupedShelf); ok {
+		return gs.Group()
+	}
+	return ""
+}
+
+// reservedShelf is implemented by shelves that hold back capacity from new orders, see forcedPutter.
+type reservedShelf interface {
+	Reserve() int
+}
+
+// shelfReserve returns the capacity the shelf holds back from new orders.
+func shelfReserve(shelf Shelf) int {
+	if rs, ok := shelf.(reservedShelf); ok {
+		return rs.Reserve()
+	}
+	return 0
+}
+
+// hasRoom returns true if the shelf would accept a new order right now.
+func hasRoom(shelf Shelf) bool {
+	return len(shelf.Orders()) < shelf.Capacity()-shelfReserve(shelf)
+}
+
+// listableShelf is implemented by shelves whose orders can be listed while the caller holds the read lock, so
+// several shelves can be listed at the same instant.
+type listableShelf interface {
+	RLock()
+	RUnlock()
+	ordersInto(buf []*Order) []*Order
+}
+
+// listAtOnce lists the orders of every shelf while holding all of their read locks, for shelves that allow
+// it. Moves put an order on its new shelf before taking it off the old one, so every order being moved is
+// seen on at least one shelf. Shelves only ever lock themselves, so holding several read locks can't deadlock.
+func listAtOnce(shelves []Shelf) [][]*Order {
+	for _, shelf := range shelves {
+		if ls, ok := shelf.(listableShelf); ok {
+			ls.RLock()
+			defer ls.RUnlock()
+		}
+	}
+	listed := make([][]*Order, len(shelves))
+	for i, shelf := range shelves {
+		if ls, ok := shelf.(listableShelf); ok {
+			listed[i] = ls.ordersInto(nil)
+		} else {
+			listed[i] = shelf.Orders()
+		}
+	}
+	return listed
+}
+
+// shelfSnapshot is a read-only copy of a shelf's attributes, without its orders, for cloned orders.
+type shelfSnapshot struct {
+	name      string
+	supported []string
+	capacity  int
+	decay     float64
+	group     string
+	// a shelf's rate and schedule never change, so the snapshot decays the same as the shelf
+	schedule scheduledShelf
+}
+
+func newShelfSnapshot(shelf Shelf) *shelfSnapshot {
+	schedule, _ := shelf.(scheduledShelf)
+	return &shelfSnapshot{
+		name:      shelf.Name(),
+		supported: append([]string(nil), shelf.Supported()...),
+		capacity:  shelf.Capacity(),
+		decay:     shelf.Decay(),
+		group:     shelfGroup(shelf),
+		schedule:  schedule,
+	}
+}
+
+func (s *shelfSnapshot) Name() string {
+	return s.name
+}
+
+func (s *shelfSnapshot) Supported() []string {
+	return s.supported
+}
+
+func (s *shelfSnapshot) Orders() []*Order {
+	return nil
+}
+
+func (s *shelfSnapshot) Get(orderID string) (*Order, error) {
+	return nil, ErrShelfSnapshot
+}
+
+func (s *shelfSnapshot) Put(*Order) error {
+	return ErrShelfSnapshot
+}
+
+func (s *shelfSnapshot) Remove(string) error {
+	return ErrShelfSnapshot
+}
+
+func (s *shelfSnapshot) Capacity() int {
+	return s.capacity
+}
+
+func (s *shelfSnapshot) Decay() float64 {
+	return s.decay
+}
+
+func (s *shelfSnapshot) Group() string {
+	return s.group
+}
+
+func (s *shelfSnapshot) decayBetween(start time.Time, end time.Time) float64 {
+	if s.schedule != nil {
+		return s.schedule.decayBetween(start, end)
+	}
+	return s.decay * float64(elapsed(start, end))
+}
+
+func (s *shelfSnapshot) scheduled() bool {
+	return s.schedule != nil && s.schedule.scheduled()
+}
+
 // StaticShelf is an implementation of the Shelf interface that has a fixed decay rate, capacity and order types.
 type staticShelf struct {
 	sync.RWMutex
@@ -40,9 +341,21 @@ type staticShelf struct {
 	name      string
 	orders    map[string]*Order
 	numOrders int
-	capacity  int
+	capacity  int // can be changed by SetCapacity, so only read under the lock
+	reserve   int // held back from new orders, see PutForced
+	group     string
 	supported []string
 	decayRate float64
+
+	// multiplies decayRate at times of day, per the kitchen clock now
+	schedule []decayWindow
+	now      func() time.Time
+
+	// every order placed on, or moved to, the shelf by the kitchen must pass these
+	admission []AdmissionPredicate
+
+	// set once the shelf is removed from the topology, see closableShelf
+	isClosed bool
 }
 
 func (s *staticShelf) Name() string {
@@ -52,13 +365,27 @@ func (s *staticShelf) Name() string {
 func (s *staticShelf) Orders() []*Order {
 	s.RLock()
 	defer s.RUnlock()
-	orders := make([]*Order, s.numOrders)
-	count := 0
+	return s.ordersInto(make([]*Order, 0, s.numOrders))
+}
+
+func (s *staticShelf) OrdersInto(buf []*Order) []*Order {
+	s.RLock()
+	defer s.RUnlock()
+	return s.ordersInto(buf[:0])
+}
+
+func (s *staticShelf) OrdersSorted(less func(a, b *Order) bool) []*Order {
+	orders := s.Orders()
+	sortOrders(orders, less)
+	return orders
+}
+
+// unsafe ordersInto
+func (s *staticShelf) ordersInto(buf []*Order) []*Order {
 	for _, v := range s.orders {
-		orders[count] = v
-		count++
+		buf = append(buf, v)
 	}
-	return orders
+	return buf
 }
 
 func (s *staticShelf) Get(orderID string) (*Order, error) {
@@ -72,24 +399,65 @@ func (s *staticShelf) Get(orderID string) (*Order, error) {
 	return order, nil
 }
 
+// Put places a new order on the shelf. The shelf reports full once it reaches capacity - reserve.
 func (s *staticShelf) Put(o *Order) error {
+	return s.put(o, false)
+}
+
+// PutForced places an order on the shelf, ignoring the reserve.
+func (s *staticShelf) PutForced(o *Order) error {
+	return s.put(o, true)
+}
+
+func (s *staticShelf) put(o *Order, forced bool) error {
 	s.Lock()
 	defer s.Unlock()
+	_, err := s.unsafePut(o, forced)
+	return err
+}
+
+// PutBatch places new orders until the shelf is full, holding back the reserve.
+func (s *staticShelf) PutBatch(orders []*Order) int {
+	s.Lock()
+	defer s.Unlock()
+	for i, o := range orders {
+		if _, err := s.unsafePut(o, false); err != nil {
+			return i
+		}
+	}
+	return len(orders)
+}
+
+// unsafe put, returns true if the order was added rather than already there. Unless forced, the reserve is
+// held back.
+func (s *staticShelf) unsafePut(o *Order, forced bool) (bool, error) {
 	// check if its already there, noop
 	if _, exists := s.orders[o.ID()]; exists {
-		return nil
+		return false, nil
+	}
+	if s.isClosed {
+		return false, ErrShelfRemoved
 	}
-	if s.numOrders >= s.capacity {
-		return fmt.Errorf("failed to put order on shelf, staticShelf is at capacity %d", s.capacity)
+	limit := s.capacity
+	if !forced {
+		limit -= s.reserve
+	}
+	if s.numOrders >= limit {
+		return false, fmt.Errorf("failed to put order on shelf, staticShelf is at capacity %d", limit)
 	}
 	s.numOrders++
 	s.orders[o.ID()] = o
-	return nil
+	return true, nil
 }
 
 func (s *staticShelf) Remove(orderID string) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.unsafeRemove(orderID)
+}
+
+// unsafe remove
+func (s *staticShelf) unsafeRemove(orderID string) error {
 	if _, exists := s.orders[orderID]; !exists {
 		return fmt.Errorf("attempted to remove order %s that does not exist", orderID)
 	}
@@ -104,20 +472,85 @@ func (s *staticShelf) Supported() []string {
 }
 
 func (s *staticShelf) Capacity() int {
+	s.RLock()
+	defer s.RUnlock()
 	return s.capacity
 }
 
+func (s *staticShelf) SetCapacity(capacity int, force bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if !force && s.numOrders > capacity {
+		return ErrShelfFull
+	}
+	s.capacity = capacity
+	return nil
+}
+
+func (s *staticShelf) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.isClosed = true
+}
+
+func (s *staticShelf) closed() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.isClosed
+}
+
+func (s *staticShelf) Reserve() int {
+	return s.reserve
+}
+
+func (s *staticShelf) Group() string {
+	return s.group
+}
+
+func (s *staticShelf) admits(order *Order, at time.Time) bool {
+	for _, predicate := range s.admission {
+		if !predicate(order, at) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decay returns the shelf's decay rate, multiplied by its schedule at the current time, if it has one.
 func (s *staticShelf) Decay() float64 {
-	return s.decayRate
+	if len(s.schedule) == 0 {
+		return s.decayRate
+	}
+	return s.decayRate * multiplierAt(s.schedule, s.now())
+}
+
+// decayBetween sums the shelf's decay rate over its schedule from start until end.
+func (s *staticShelf) decayBetween(start time.Time, end time.Time) float64 {
+	if len(s.schedule) == 0 {
+		return s.decayRate * float64(elapsed(start, end))
+	}
+	return scheduledDecay(s.decayRate, s.schedule, start, end)
+}
+
+func (s *staticShelf) scheduled() bool {
+	return len(s.schedule) > 0
 }
 
 func NewStaticShelf(name string, capacity int, supported []string, decayRate float64) Shelf {
+	return NewReservedStaticShelf(name, capacity, 0, supported, decayRate)
+}
+
+// NewReservedStaticShelf returns a static shelf that turns away new orders once it holds capacity - reserve
+// orders. The remaining reserve can only be filled by moving orders already in the kitchen.
+func NewReservedStaticShelf(name string, capacity int, reserve int, supported []string, decayRate float64) Shelf {
 	orders := make(map[string]*Order, capacity)
 	return &staticShelf{
 		name:      name,
 		orders:    orders,
 		capacity:  capacity,
+		reserve:   reserve,
 		supported: supported,
 		decayRate: decayRate,
+		now:       time.Now,
 	}
 }
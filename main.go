@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/ben-mays/effective-robot/kitchen"
 	"github.com/ben-mays/effective-robot/server"
@@ -55,18 +57,73 @@ func getEnv() Env {
 //	     return Envoy{Config: cfg}
 //     }
 //
+//
+// Config is layered: config/base.yaml, if present, holds what's shared across environments and the
+// environment's file overrides it. Values can reference environment variables, e.g. ${PORT:8080}.
 func loadConfig(env Env) config.Provider {
-	configPath := fmt.Sprintf("config/%s.yaml", env)
-	return config.NewYAMLProviderFromFiles(configPath)
+	return loadConfigFrom("config", env)
+}
+
+func loadConfigFrom(dir string, env Env) config.Provider {
+	files := make([]string, 0, 2)
+	base := filepath.Join(dir, "base.yaml")
+	if _, err := os.Stat(base); err == nil {
+		files = append(files, base)
+	}
+	files = append(files, filepath.Join(dir, fmt.Sprintf("%s.yaml", env)))
+	return config.NewYAMLProviderWithExpand(os.LookupEnv, files...)
+}
+
+// requiredKeys must be set once all the config files are merged.
+var requiredKeys = []string{
+	"kitchen.topology",
+}
+
+// validateConfig fails fast on a config that's missing required keys.
+func validateConfig(provider config.Provider) error {
+	for _, key := range requiredKeys {
+		if !provider.Get(key).HasValue() {
+			return fmt.Errorf("missing required config key %q", key)
+		}
+	}
+	return nil
 }
 
+// version and gitSHA identify the build, set with -ldflags, e.g. -X main.version=1.0 -X main.gitSHA=abc123.
+// See the Makefile.
+var (
+	version = "dev"
+	gitSHA  = "unknown"
+)
+
 // ProvideXXX functions inject instances into the application DI container.
 func ProvideEnv() Env {
 	return getEnv()
 }
 
-func ProvideConfig(env Env) config.Provider {
-	return loadConfig(env)
+func ProvideBuildInfo() server.BuildInfo {
+	return server.BuildInfo{Version: version, GitSHA: gitSHA}
+}
+
+func ProvideConfig(env Env) (config.Provider, error) {
+	provider := loadConfig(env)
+	return provider, validateConfig(provider)
+}
+
+func ProvideConfigLoader(env Env) server.ConfigLoader {
+	return func() config.Provider {
+		return loadConfig(env)
+	}
+}
+
+// StopKitchen stops the kitchen's background work when the application stops. It's registered before the
+// server starts, so it runs after the server has shut down.
+func StopKitchen(lifecycle fx.Lifecycle, k *kitchen.Kitchen) {
+	lifecycle.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return k.Close()
+		},
+	})
 }
 
 func main() {
@@ -74,10 +131,10 @@ func main() {
 	// to attach to the application lifecycle afterwards.
 	app := fx.New(
 		fx.NopLogger,
-		fx.Provide(ProvideEnv, ProvideConfig),
+		fx.Provide(ProvideEnv, ProvideConfig, ProvideConfigLoader, ProvideBuildInfo),
 		fx.Provide(kitchen.NewKitchen),
 		fx.Provide(server.Provide),
-		fx.Invoke(server.Start),
+		fx.Invoke(StopKitchen, server.Start),
 	)
 	// Run will block until a SIGKILL or SIGTERM
 	app.Run()
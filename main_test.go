@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, dir string, name string, contents string) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+	assert.Nil(t, err)
+}
+
+type testShelf struct {
+	Name     string `yaml:"name"`
+	Capacity int    `yaml:"capacity"`
+}
+
+func TestLayeredConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeConfig(t, dir, "base.yaml", `
+server:
+  port: 8080
+kitchen:
+  minimize_decay: true
+  topology:
+    - name: "hot"
+      capacity: 15`)
+	writeConfig(t, dir, "production.yaml", `
+server:
+  port: 80
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: ${HOT_CAPACITY:30}
+    - name: "cold"
+      capacity: 30`)
+
+	provider := loadConfigFrom(dir, "production")
+	assert.Nil(t, validateConfig(provider))
+	assert.Equal(t, 80, provider.Get("server.port").AsInt())
+	// kept from base
+	assert.True(t, provider.Get("kitchen.minimize_decay").AsBool())
+
+	// lists are replaced, not merged
+	var topology []testShelf
+	assert.Nil(t, provider.Get("kitchen.topology").Populate(&topology))
+	assert.Equal(t, []testShelf{{Name: "hot", Capacity: 30}, {Name: "cold", Capacity: 30}}, topology)
+
+	// environment variables override the defaults
+	os.Setenv("HOT_CAPACITY", "40")
+	defer os.Unsetenv("HOT_CAPACITY")
+	provider = loadConfigFrom(dir, "production")
+	assert.Nil(t, provider.Get("kitchen.topology").Populate(&topology))
+	assert.Equal(t, 40, topology[0].Capacity)
+}
+
+func TestConfigWithoutBase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeConfig(t, dir, "development.yaml", `
+server:
+  port: 8080`)
+	provider := loadConfigFrom(dir, "development")
+	assert.Equal(t, 8080, provider.Get("server.port").AsInt())
+	// the topology is required
+	assert.NotNil(t, validateConfig(provider))
+}
+
+func TestRepoConfig(t *testing.T) {
+	provider := loadConfig("development")
+	assert.Nil(t, validateConfig(provider))
+	assert.True(t, provider.Get("kitchen.minimize_decay").AsBool())
+	assert.Equal(t, 4, len(provider.Get("kitchen.topology").ChildKeys()))
+}
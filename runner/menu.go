@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+)
+
+// span is a range values are drawn from uniformly. A fixed value has equal min and max.
+type span struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+func (s span) draw(r *rand.Rand) float64 {
+	return s.Min + r.Float64()*(s.Max-s.Min)
+}
+
+// food is an item on the menu. Weight is relative to the other foods, and the shelf life is in seconds.
+type food struct {
+	Name      string  `json:"name"`
+	Temp      string  `json:"temp"`
+	Weight    float64 `json:"weight"`
+	ShelfLife span    `json:"shelf_life"`
+	Decay     span    `json:"decay"`
+}
+
+// menu is the foods the runner generates orders for.
+type menu []food
+
+// defaultMenu has three foods, picked uniformly, with fixed shelf lives and decay.
+var defaultMenu = menu{
+	{Name: "icecream", Temp: "cold", Weight: 1, ShelfLife: span{25, 25}, Decay: span{1, 1}},
+	{Name: "soup", Temp: "hot", Weight: 1, ShelfLife: span{50, 50}, Decay: span{1, 1}},
+	{Name: "pizza", Temp: "frozen", Weight: 1, ShelfLife: span{100, 100}, Decay: span{1, 1}},
+}
+
+// loadMenu reads a menu from a json file, a list of foods.
+func loadMenu(path string) (menu, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m menu
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return nil, err
+	}
+	return m, m.validate()
+}
+
+func (m menu) validate() error {
+	total := 0.0
+	for _, f := range m {
+		if f.Weight < 0 {
+			return fmt.Errorf("%s: weight can't be negative", f.Name)
+		}
+		if f.ShelfLife.Min > f.ShelfLife.Max || f.Decay.Min > f.Decay.Max {
+			return fmt.Errorf("%s: min can't be more than max", f.Name)
+		}
+		total += f.Weight
+	}
+	if total <= 0 {
+		return errors.New("menu needs a food with a positive weight")
+	}
+	return nil
+}
+
+// pick returns a food, each with probability of its share of the total weight.
+func (m menu) pick(r *rand.Rand) food {
+	total := 0.0
+	for _, f := range m {
+		total += f.Weight
+	}
+	target := r.Float64() * total
+	for _, f := range m {
+		if target < f.Weight {
+			return f
+		}
+		target -= f.Weight
+	}
+	// only reachable through rounding, the last food with any weight
+	for i := len(m) - 1; i > 0; i-- {
+		if m[i].Weight > 0 {
+			return m[i]
+		}
+	}
+	return m[0]
+}
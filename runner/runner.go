@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -16,58 +17,60 @@ import (
 
 	"github.com/ben-mays/effective-robot/client"
 	"github.com/ben-mays/effective-robot/server"
+	exprand "golang.org/x/exp/rand"
 	"gonum.org/v1/gonum/stat/distuv"
 )
 
-func makeOrder() (string, string, float64, float64) {
-	foods := []struct {
-		name      string
-		temp      string
-		shelflife float64
-		decay     float64
-	}{
-		{
-			name:      "icecream",
-			temp:      "cold",
-			shelflife: 25,
-			decay:     1,
-		},
-		{
-			name:      "soup",
-			temp:      "hot",
-			shelflife: 50,
-			decay:     1,
-		},
-		{
-			name:      "pizza",
-			temp:      "frozen",
-			shelflife: 100,
-			decay:     1,
-		},
-	}
-	choice := rand.Intn(len(foods))
-	food := foods[choice]
-	return food.name, food.temp, food.shelflife, food.decay
+// unit is the time unit the server expresses durations in, which must match its units option.
+type unit struct {
+	suffix   string
+	duration time.Duration
 }
 
-// Optionally, can be given an order to use instead of generating one. If an order is not given, one is generated.
-func simulateOrder(kitchen *client.Client, orderRequest *server.CreateOrderRequest) *server.OrderResponse {
-	resp, err := kitchen.CreateOrder(*orderRequest)
-	if err != nil {
-		return nil
+var unitSeconds = unit{suffix: "s", duration: time.Second}
+
+func parseUnit(name string) (unit, error) {
+	switch strings.ToLower(name) {
+	case "s", "seconds":
+		return unitSeconds, nil
+	case "ms", "milliseconds":
+		return unit{suffix: "ms", duration: time.Millisecond}, nil
 	}
+	return unit{}, fmt.Errorf("unknown unit %q, expected s or ms", name)
+}
+
+// fromSeconds converts a number of seconds to the unit.
+func (u unit) fromSeconds(s float64) float64 {
+	return s * float64(time.Second) / float64(u.duration)
+}
+
+// makeOrder returns a random order from the menu, with its shelf life in the unit. Decay rates are a multiplier
+// of age, so they're the same in any unit.
+func makeOrder(m menu, r *rand.Rand, u unit) (string, string, float64, float64) {
+	food := m.pick(r)
+	return food.Name, food.Temp, u.fromSeconds(food.ShelfLife.draw(r)), food.Decay.draw(r)
+}
+
+// randSource draws gonum's random numbers from a math/rand generator, so one seed decides a whole run.
+type randSource struct {
+	*rand.Rand
+}
+
+var _ exprand.Source = randSource{}
+
+func (s randSource) Seed(seed uint64) {
+	s.Rand.Seed(int64(seed))
+}
+
+// courierWait returns a random time for the courier to arrive, between 0 and 9 seconds.
+func courierWait(r *rand.Rand) time.Duration {
+	return time.Duration((r.Int()+2)%10) * time.Second
+}
+
+// simulateOrder creates the order and has a courier pick it up once the wait is over.
+func simulateOrder(kitchen *client.Client, orderRequest *server.CreateOrderRequest, wait time.Duration) *server.OrderResponse {
 	// TODO: add dispatch time
-	order, err := kitchen.UpdateOrder(resp.OrderID, server.UpdateOrderRequest{
-		State: "enroute",
-	})
-	if err != nil {
-		return nil
-	}
-	sleep := (rand.Int() + 2) % 10 // get random duration in seconds
-	time.Sleep(time.Duration(sleep) * time.Second)
-	order, err = kitchen.UpdateOrder(resp.OrderID, server.UpdateOrderRequest{
-		State: "pickedup",
-	})
+	order, err := kitchen.RunLifecycle(context.Background(), *orderRequest, wait)
 	if err != nil {
 		return nil
 	}
@@ -116,14 +119,14 @@ func color(color, formatString string) string {
 	return on + formatString + off
 }
 
-func displayStatus(kitchen *client.Client, done chan bool) {
+func displayStatus(kitchen *client.Client, u unit, done chan bool) {
 	count := 0
 	for {
 		select {
 		case <-done:
 			return
 		default:
-			resp, err := kitchen.ListOrders()
+			resp, err := kitchen.ListOrdersWithShelves()
 			if err != nil {
 				continue
 			}
@@ -147,7 +150,17 @@ func displayStatus(kitchen *client.Client, done chan bool) {
 					valueString = color("yellow", valueString)
 				}
 
-				fmt.Printf("%30s\t%8s\t%8.2fs\t%s\t%8s\n", o.Name, o.State, o.Age, valueString, o.Shelf)
+				fmt.Printf("%30s\t%8s\t%8.2f%s\t%s\t%8s\n", o.Name, o.State, o.Age, u.suffix, valueString, o.Shelf)
+			}
+			fmt.Println()
+			names := make([]string, 0, len(resp.Shelves))
+			for name := range resp.Shelves {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				shelf := resp.Shelves[name]
+				fmt.Printf("%s %d/%d  ", name, shelf.Used, shelf.Capacity)
 			}
 			fmt.Println()
 			spin(count)
@@ -157,19 +170,21 @@ func displayStatus(kitchen *client.Client, done chan bool) {
 	}
 }
 
-func run(kitchen *client.Client, numSeconds int, rate float64, staticOrders []server.CreateOrderRequest) {
+// run creates orders for numSeconds real seconds, at rate a second, whatever the unit. Without static orders,
+// they're drawn from the menu with r, which also draws how many are created each second and the couriers' waits.
+func run(kitchen *client.Client, m menu, r *rand.Rand, u unit, numSeconds int, rate float64, staticOrders []server.CreateOrderRequest) {
 	// metrics captures each orders' metrics
 	metrics := make(chan *server.OrderResponse)
 	// done signals that all orders are processed
 	done := make(chan bool)
 
 	// launch a background routine to continuously display the kitchen status
-	go displayStatus(kitchen, done)
+	go displayStatus(kitchen, u, done)
 
 	// generate _rate_ orders, per second, in the main thread. we use a poisson distribution to determine how
 	// many orders to create per second.
 	orderCount := 0
-	dist := distuv.Poisson{Lambda: rate}
+	dist := distuv.Poisson{Lambda: rate, Src: randSource{r}}
 	for i := 0; i < numSeconds; i++ {
 		orders := int(dist.Rand())
 		orderCount += orders
@@ -178,7 +193,7 @@ func run(kitchen *client.Client, numSeconds int, rate float64, staticOrders []se
 			var createOrderReq *server.CreateOrderRequest
 			// if no static orders given, generate them randomly
 			if len(staticOrders) == 0 {
-				name, temp, shelf, decay := makeOrder()
+				name, temp, shelf, decay := makeOrder(m, r, u)
 				createOrderReq = &server.CreateOrderRequest{
 					Name:      name,
 					Temp:      temp,
@@ -191,9 +206,10 @@ func run(kitchen *client.Client, numSeconds int, rate float64, staticOrders []se
 			// no-op if nil. this is useful if the client wants to watch the display but stop creating
 			// orders after the file cursor is at eof.
 			if createOrderReq != nil {
-				go func(req *server.CreateOrderRequest) {
-					metrics <- simulateOrder(kitchen, req)
-				}(createOrderReq)
+				// r isn't safe for concurrent use, so draw the wait here rather than in the goroutine
+				go func(req *server.CreateOrderRequest, wait time.Duration) {
+					metrics <- simulateOrder(kitchen, req, wait)
+				}(createOrderReq, courierWait(r))
 			} else {
 				// avoid blocking on no-op orders
 				orderCount--
@@ -207,6 +223,7 @@ func run(kitchen *client.Client, numSeconds int, rate float64, staticOrders []se
 		"trashed":  0,
 		"pickedup": 0,
 	}
+	trashedReasons := make(map[string]int)
 	failed := 0
 	sumDecay := 0.0
 	sumValue := 0.0
@@ -226,6 +243,9 @@ func run(kitchen *client.Client, numSeconds int, rate float64, staticOrders []se
 			sumValue += o.Value
 			sumNorm += o.NormalValue
 			counts[o.State]++
+			if o.TrashedReason != "" {
+				trashedReasons[o.TrashedReason]++
+			}
 		}
 	}
 
@@ -246,6 +266,14 @@ func run(kitchen *client.Client, numSeconds int, rate float64, staticOrders []se
 		float64(counts["pickedup"])/float64(orderCount),
 		counts["pickedup"],
 		counts["trashed"])
+	reasons := make([]string, 0, len(trashedReasons))
+	for reason := range trashedReasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Printf("    %s: %d\n", reason, trashedReasons[reason])
+	}
 }
 
 type orderList []server.CreateOrderRequest
@@ -256,6 +284,9 @@ func main() {
 	host := "http://localhost:8080"
 	numSeconds := 60
 	rate := 3.5
+	u := unitSeconds
+	m := defaultMenu
+	seed := time.Now().UnixNano()
 	var orders orderList
 	// used to shift pos args when options are given
 	shift := 0
@@ -263,26 +294,56 @@ func main() {
 	// parse pos args
 	if len(os.Args) > 1 {
 		if strings.Contains(os.Args[1], "help") {
-			fmt.Println("usage: ./runner (options) [hostname] [duration] [orders per second]\noptions:\n\t-f\t A path to a json file containing order definitions.")
+			fmt.Println("usage: ./runner (options) [hostname] [duration] [orders per second]\noptions:\n\t-f\t A path to a json file containing order definitions.\n\t-unit\t s or ms, the server's units for durations, seconds by default.\n\t-menu\t A path to a json file of weighted foods to generate orders from.\n\t-seed\t Seeds the random orders, how many are created each second and when couriers arrive, for reproducible runs.")
 			os.Exit(0)
 		}
-		// handle -f option, shift by 1
-		if strings.Contains("-f", os.Args[1]) {
+		// handle options, each shifts by 2
+		for len(os.Args) > shift+2 && strings.HasPrefix(os.Args[shift+1], "-") {
+			option, value := os.Args[shift+1], os.Args[shift+2]
 			shift += 2
-			bytes, err := ioutil.ReadFile(os.Args[2])
-			if err != nil {
-				fmt.Printf("invalid file path given: %s", err.Error())
-				os.Exit(1)
-			}
-			err = json.Unmarshal(bytes, &orders)
-			if err != nil {
-				fmt.Printf("error reading order file: %s\n", err.Error())
+			switch option {
+			case "-f":
+				bytes, err := ioutil.ReadFile(value)
+				if err != nil {
+					fmt.Printf("invalid file path given: %s", err.Error())
+					os.Exit(1)
+				}
+				err = json.Unmarshal(bytes, &orders)
+				if err != nil {
+					fmt.Printf("error reading order file: %s\n", err.Error())
+					os.Exit(1)
+				}
+				fmt.Printf("using orders from %s", value)
+			case "-unit":
+				parsed, err := parseUnit(value)
+				if err != nil {
+					fmt.Printf("invalid unit given: %s\n", err.Error())
+					os.Exit(1)
+				}
+				u = parsed
+			case "-menu":
+				loaded, err := loadMenu(value)
+				if err != nil {
+					fmt.Printf("invalid menu given: %s\n", err.Error())
+					os.Exit(1)
+				}
+				m = loaded
+			case "-seed":
+				parsed, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					fmt.Printf("invalid seed given: %s\n", err.Error())
+					os.Exit(1)
+				}
+				seed = parsed
+			default:
+				fmt.Printf("unknown option %s\n", option)
 				os.Exit(1)
 			}
-			fmt.Printf("using orders from %s", os.Args[2])
 		}
+	}
+	if len(os.Args) > shift+1 {
 		host = os.Args[shift+1]
-		if len(os.Args) > 2 {
+		if len(os.Args) > shift+2 {
 			seconds, err := strconv.ParseInt(os.Args[shift+2], 10, 64)
 			if err != nil {
 				fmt.Printf("invalid duration given: %s", err.Error())
@@ -290,7 +351,7 @@ func main() {
 			}
 			numSeconds = int(seconds)
 		}
-		if len(os.Args) > 3 {
+		if len(os.Args) > shift+3 {
 			lambda, err := strconv.ParseFloat(os.Args[shift+3], 64)
 			if err != nil {
 				fmt.Printf("invalid rate given: %s", err.Error())
@@ -314,6 +375,10 @@ func main() {
 		fmt.Printf("cannot reach server: %s\n", url.String())
 		os.Exit(1)
 	}
+	if err := kitchen.CheckVersion(); err != nil {
+		fmt.Printf("cannot use server: %s\n", err.Error())
+		os.Exit(1)
+	}
 
-	run(kitchen, numSeconds, rate, orders)
+	run(kitchen, m, rand.New(rand.NewSource(seed)), u, numSeconds, rate, orders)
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+func TestUnit(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected float64
+		suffix   string
+	}{
+		{"s", 25, "s"},
+		{"seconds", 25, "s"},
+		{"ms", 25000, "ms"},
+		{"Milliseconds", 25000, "ms"},
+	}
+	for _, c := range cases {
+		u, err := parseUnit(c.name)
+		if err != nil {
+			t.Fatalf("parseUnit(%q): %v", c.name, err)
+		}
+		if got := u.fromSeconds(25); got != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, got)
+		}
+		if u.suffix != c.suffix {
+			t.Errorf("%s: expected suffix %s, got %s", c.name, c.suffix, u.suffix)
+		}
+	}
+	if _, err := parseUnit("minutes"); err == nil {
+		t.Error("expected an error for an unknown unit")
+	}
+}
+
+func TestMenuPick(t *testing.T) {
+	m, err := loadMenu("../resources/menu.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	draws := 100000
+	counts := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		name, _, shelfLife, decay := makeOrder(m, r, unitSeconds)
+		counts[name]++
+		if name == "soup" && (shelfLife < 40 || shelfLife > 60 || decay < 0.5 || decay > 1) {
+			t.Fatalf("soup drawn outside its ranges: shelf life %v, decay %v", shelfLife, decay)
+		}
+	}
+	expected := map[string]float64{"soup": 0.6, "icecream": 0.3, "pizza": 0.1}
+	for name, weight := range expected {
+		if got := float64(counts[name]) / float64(draws); math.Abs(got-weight) > 0.01 {
+			t.Errorf("%s: expected a share of %v, got %v", name, weight, got)
+		}
+	}
+
+	if err := (menu{{Name: "soup", Weight: 0}}).validate(); err == nil {
+		t.Error("expected an error for a menu without weight")
+	}
+}
+
+func TestSeededRun(t *testing.T) {
+	draw := func(seed int64) []float64 {
+		r := rand.New(rand.NewSource(seed))
+		dist := distuv.Poisson{Lambda: 10, Src: randSource{r}}
+		var draws []float64
+		for i := 0; i < 20; i++ {
+			draws = append(draws, dist.Rand(), float64(courierWait(r)))
+		}
+		return draws
+	}
+	first, again, other := draw(1), draw(1), draw(2)
+	if !reflect.DeepEqual(first, again) {
+		t.Errorf("the same seed drew %v, then %v", first, again)
+	}
+	if reflect.DeepEqual(first, other) {
+		t.Error("different seeds drew the same orders")
+	}
+}
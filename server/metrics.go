@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ben-mays/effective-robot/kitchen"
+)
+
+var metricHelp = map[string]string{
+	kitchen.CreatedToReadyMetric:  "Time from an order being created to being placed on a shelf.",
+	kitchen.ReadyToPickedUpMetric: "Time from an order being placed on a shelf to being picked up.",
+}
+
+// MetricsHandler exposes the kitchen's metrics in the Prometheus text format.
+func (s *ApplicationServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	histograms := s.kitchen.LifecycleMetrics()
+	names := make([]string, 0, len(histograms))
+	for name := range histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		writeHistogram(w, name, metricHelp[strings.TrimPrefix(name, s.kitchen.MetricPrefix())], histograms[name])
+	}
+}
+
+func writeHistogram(w io.Writer, name string, help string, h kitchen.HistogramSnapshot) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, bucket := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bucket, 'g', -1, 64), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries a request's ID. The server echoes the ID a client sends, or generates one, so a
+// request can be found in both the client's and the server's logs.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the IDs accepted from clients, longer ones are replaced.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request the context belongs to, or "" if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID returns true for IDs that are safe to echo and log, printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder records the status written to the response, for logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// SetLogger replaces the access log's logger, e.g. to write it somewhere other than stderr. nil disables it.
+// It must be called before the server starts serving.
+func (s *ApplicationServer) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
+// logf logs a line for a request, prefixed by its ID. It's a no-op unless the access log is enabled.
+func (s *ApplicationServer) logf(r *http.Request, format string, v ...interface{}) {
+	if s.logger == nil {
+		return
+	}
+	s.logger.Printf("[%s] "+format, append([]interface{}{RequestID(r.Context())}, v...)...)
+}
+
+// requestIDMiddleware gives every request an ID, the client's X-Request-ID or a generated one, puts it in the
+// request context and echoes it in the response. When the access log is enabled, each request is logged with it.
+func (s *ApplicationServer) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		if s.logger == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.logf(r, "%s %s %d in %s", r.Method, r.URL.RequestURI(), rec.status, time.Since(start))
+	})
+}
+
+// gzipResponseWriter compresses everything written to the response. The response is only marked as gzipped once
+// there's a body to compress, so empty responses, e.g. 204s and 304s, go out as they are.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	// nil until the body starts
+	writer *gzip.Writer
+	// the status to send when the body starts, zero until WriteHeader is called
+	status int
+	// set once the header has gone out uncompressed, for responses without a body
+	passthrough bool
+}
+
+var _ http.Flusher = (*gzipResponseWriter)(nil)
+
+// WriteHeader holds the status back until the first write, so Content-Encoding can still be set, unless the
+// status means there's no body.
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.writer != nil || w.passthrough || w.status != 0 {
+		return
+	}
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if w.writer == nil {
+		// sniff the content type from the uncompressed bytes, the default would sniff the gzip stream
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.start()
+	}
+	return w.writer.Write(b)
+}
+
+// start sends the held back header as gzipped and starts compressing the body.
+func (w *gzipResponseWriter) start() {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	w.writer = gzip.NewWriter(w.ResponseWriter)
+}
+
+// Flush flushes what's been compressed so far through to the client. Flushing before the first write starts
+// the body, as a streaming response does to send its header.
+func (w *gzipResponseWriter) Flush() {
+	if w.writer == nil && !w.passthrough {
+		w.start()
+	}
+	if w.writer != nil {
+		w.writer.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close finishes the gzip stream, or sends the held back header of a response that had no body.
+func (w *gzipResponseWriter) close() {
+	switch {
+	case w.writer != nil:
+		w.writer.Close()
+	case !w.passthrough && w.status != 0:
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// acceptsGzip returns true if the client can decode a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.Split(encoding, ";")[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipMiddleware compresses responses for clients that send Accept-Encoding: gzip.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// CORSConfig configures cross-origin requests, e.g. from a dashboard served from another host.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to call the API, e.g. https://dashboard.example.com, or * for any
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// AllowedMethods and AllowedHeaders default to the methods the API uses, and the headers its clients send
+	AllowedMethods []string `yaml:"allowed_methods"`
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	// MaxAge is how long browsers may cache a preflight response, zero leaves it up to the browser
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PATCH"}
+	defaultCORSHeaders = []string{"Content-Type", "If-None-Match", RequestIDHeader}
+	// response headers browsers hide from scripts unless they're exposed
+	corsExposedHeaders = []string{"ETag", "Retry-After", RequestIDHeader}
+)
+
+// allowsOrigin returns true if the origin may call the API.
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware adds CORS headers to responses to allowed origins, and answers their preflight requests.
+// Requests from other origins are served without them, so browsers won't let scripts read the response.
+func corsMiddleware(cfg CORSConfig, next http.Handler) http.Handler {
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !cfg.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			if cfg.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
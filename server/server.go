@@ -4,8 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ben-mays/effective-robot/kitchen"
@@ -14,48 +22,382 @@ import (
 	"go.uber.org/fx"
 )
 
+// ConfigLoader re-reads the configuration from its source, e.g. the config file on disk.
+type ConfigLoader func() config.Provider
+
 type ApplicationServer struct {
-	router  *mux.Router
-	server  *http.Server
-	kitchen *kitchen.Kitchen
-	port    int
+	router     *mux.Router
+	handler    http.Handler // the router, wrapped in any middleware that has to see unmatched requests too
+	server     *http.Server
+	kitchen    *kitchen.Kitchen
+	loadConfig ConfigLoader
+
+	// when set, the server listens on this unix socket instead of server.Addr
+	socket string
+
+	// durations in requests and responses are expressed in this unit
+	unit time.Duration
+
+	// logs every request with its ID when the access log is enabled, nil otherwise
+	logger *log.Logger
+
+	// returned by GET /version
+	build BuildInfo
+
+	// identifies this process in ETags, as versions start over when the kitchen does
+	epoch int64
+
+	// the longest GET /order?since waits, under the write timeout
+	maxLongPoll time.Duration
 }
 
 func (s *ApplicationServer) HealthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("✔"))
 }
 
+// ServeHTTP routes the request to the matching handler.
+func (s *ApplicationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+type ShelfResponse struct {
+	Used     int `json:"used"`
+	Capacity int `json:"capacity"`
+}
+
 type ListOrdersResponse struct {
-	Orders []OrderResponse `json:"orders"`
+	Orders  []OrderResponse          `json:"orders"`
+	Shelves map[string]ShelfResponse `json:"shelves,omitempty"`
+}
+
+// parseSort returns a less function for the ?sort and ?order query params, or nil if no sort was requested.
+// Ties are broken by order ID so the result is consistent.
+func parseSort(key string, order string) (func(a, b OrderResponse) bool, error) {
+	var less func(a, b OrderResponse) bool
+	switch key {
+	case "":
+		if order != "" {
+			return nil, fmt.Errorf("order %q given without sort", order)
+		}
+		return nil, nil
+	case "value":
+		less = func(a, b OrderResponse) bool { return a.Value < b.Value }
+	case "age":
+		less = func(a, b OrderResponse) bool { return a.Age < b.Age }
+	case "name":
+		less = func(a, b OrderResponse) bool { return a.Name < b.Name }
+	default:
+		return nil, fmt.Errorf("unknown sort %q, expected value, age or name", key)
+	}
+
+	var desc bool
+	switch order {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return nil, fmt.Errorf("unknown order %q, expected asc or desc", order)
+	}
+
+	return func(a, b OrderResponse) bool {
+		if less(a, b) {
+			return !desc
+		}
+		if less(b, a) {
+			return desc
+		}
+		return a.OrderID < b.OrderID
+	}, nil
 }
 
 func (s *ApplicationServer) ListOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("since") != "" {
+		s.changesHandler(w, r)
+		return
+	}
+	less, err := parseSort(r.URL.Query().Get("sort"), r.URL.Query().Get("order"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	fields, err := parseFields(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	// the ETag is the same for JSON and NDJSON, so caches must key on Accept too
+	w.Header().Add("Vary", "Accept")
+	// taken before listing, so a change during it makes the list's ETag stale rather than wrongly current
+	if s.notModified(w, r, s.kitchen.Version()) {
+		return
+	}
 	orders := s.kitchen.GetOrders()
-	var res ListOrdersResponse
-	res.Orders = make([]OrderResponse, len(orders))
+	opts := parseResponseOptions(r)
+	ndjson := acceptsNDJSON(r)
+	if ndjson && less == nil {
+		// nothing to sort, so each order is snapshotted as it's written rather than all held at once
+		writeNDJSON(w, len(orders), func(i int) OrderResponse {
+			return s.orderToOrderResponse(orders[i], opts)
+		}, fields)
+		return
+	}
+
+	// snapshot every order first so they're sorted on consistent values
+	responses := make([]OrderResponse, len(orders))
 	for i, order := range orders {
-		orderResp := orderToOrderResponse(order)
-		res.Orders[i] = orderResp
+		responses[i] = s.orderToOrderResponse(order, opts)
+	}
+	if less != nil {
+		sort.SliceStable(responses, func(i, j int) bool {
+			return less(responses[i], responses[j])
+		})
+	}
+	if ndjson {
+		writeNDJSON(w, len(responses), func(i int) OrderResponse {
+			return responses[i]
+		}, fields)
+		return
+	}
+
+	// every order is marshalled before anything is written, so a failure is still a 500 rather than a
+	// truncated 200
+	marshalled := make([][]byte, len(responses))
+	for i, res := range responses {
+		bytes, err := marshalOrder(res, fields)
+		if err != nil {
+			writeInternalError(w, fmt.Errorf("order %s: %v", res.OrderID, err))
+			return
+		}
+		marshalled[i] = bytes
+	}
+
+	// the response is a ListOrdersResponse, written one order at a time rather than concatenated
+	w.Write([]byte(`{"orders":[`))
+	for i, bytes := range marshalled {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		w.Write(bytes)
+	}
+	w.Write([]byte("]"))
+
+	// shelf utilization is opt-in to keep the default payload small
+	if r.URL.Query().Get("includeShelves") == "true" {
+		shelves := s.kitchen.Shelves()
+		res := make(map[string]ShelfResponse, len(shelves))
+		for _, shelf := range shelves {
+			res[shelf.Name()] = ShelfResponse{
+				Used:     len(shelf.Orders()),
+				Capacity: shelf.Capacity(),
+			}
+		}
+		bytes, err := json.Marshal(res)
+		if err != nil {
+			return
+		}
+		w.Write([]byte(`,"shelves":`))
+		w.Write(bytes)
+	}
+	w.Write([]byte("}"))
+}
+
+const (
+	// ndjsonContentType is the media type of GET /order streamed as one OrderResponse per line
+	ndjsonContentType = "application/x-ndjson"
+	// ndjsonFlushEvery is how many lines are written between flushes
+	ndjsonFlushEvery = 64
+)
+
+// acceptsNDJSON returns true if the client asked for orders as newline delimited JSON.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, mediaType := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.Split(mediaType, ";")[0]) == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNDJSON writes n orders, one JSON object per line, flushing as it goes so the client can start
+// decoding before the last is written. Shelves aren't included.
+func writeNDJSON(w http.ResponseWriter, n int, order func(i int) OrderResponse, fields map[string]bool) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	flusher, _ := w.(http.Flusher)
+	for i := 0; i < n; i++ {
+		bytes, err := marshalOrder(order(i), fields)
+		if err != nil {
+			// too late for a status code, leave the response truncated
+			return
+		}
+		w.Write(append(bytes, '\n'))
+		if flusher != nil && (i+1)%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+const (
+	// defaultLongPoll is how long GET /order?since waits for a change, unless ?timeout says otherwise
+	defaultLongPoll = 15 * time.Second
+	// maxLongPoll is the longest GET /order?since waits, less if the write_timeout would otherwise cut the
+	// response off, see longPollLimit
+	maxLongPoll = 25 * time.Second
+	// longPollMargin is left between the end of a long-poll and the write_timeout, to write the response in
+	longPollMargin = 5 * time.Second
+)
+
+// longPollLimit returns the longest a long-poll can wait under the write timeout, zero being none.
+func longPollLimit(writeTimeout time.Duration) time.Duration {
+	if writeTimeout <= 0 {
+		return maxLongPoll
+	}
+	limit := writeTimeout - longPollMargin
+	// a short timeout leaves half of it for the response instead
+	if limit < writeTimeout/2 {
+		limit = writeTimeout / 2
+	}
+	if limit > maxLongPoll {
+		return maxLongPoll
+	}
+	return limit
+}
+
+// ChangesResponse is the response to GET /order?since=<cursor>.
+type ChangesResponse struct {
+	// Orders changed state or shelf since the cursor, empty if the wait timed out
+	Orders []OrderResponse `json:"orders"`
+	// Cursor is passed as ?since on the next request
+	Cursor uint64 `json:"cursor"`
+	// Reset is true if the kitchen no longer remembers changes as far back as the cursor. Orders is then
+	// every order, and replaces whatever the caller had.
+	Reset bool `json:"reset,omitempty"`
+}
+
+// changesHandler long-polls for orders that changed state or shelf since ?since, a cursor from a previous response or
+// 0 to start. It returns as soon as any have, or with none after ?timeout, in the configured unit.
+func (s *ApplicationServer) changesHandler(w http.ResponseWriter, r *http.Request) {
+	cursor, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid cursor %q", r.URL.Query().Get("since")))
+		return
+	}
+	timeout := defaultLongPoll
+	if param := r.URL.Query().Get("timeout"); param != "" {
+		units, err := strconv.ParseFloat(param, 64)
+		if err != nil || units < 0 {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid timeout %q", param))
+			return
+		}
+		timeout = s.toDuration(units)
+	}
+	if timeout > s.maxLongPoll {
+		timeout = s.maxLongPoll
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	orders, next, ok, err := s.kitchen.WaitForChanges(ctx, cursor)
+	if err != nil && r.Context().Err() != nil {
+		// the client went away, there's no one to respond to
+		return
+	}
+	opts := parseResponseOptions(r)
+	res := ChangesResponse{Orders: make([]OrderResponse, len(orders)), Cursor: next, Reset: !ok}
+	for i, order := range orders {
+		res.Orders[i] = s.orderToOrderResponse(order, opts)
 	}
 	bytes, err := json.Marshal(res)
 	if err != nil {
-		w.Write([]byte(err.Error()))
+		writeInternalError(w, err)
 		return
 	}
-	w.Write([]byte(bytes))
+	w.Write(bytes)
+}
+
+// notModified sets a weak ETag for the version of the response, and writes a 304 if the request's
+// If-None-Match already has it. The ETag is weak because values change with age alone, only states, shelves,
+// priorities and reheats are versioned. It includes the server's epoch, so an ETag from before a restart
+// never matches.
+func (s *ApplicationServer) notModified(w http.ResponseWriter, r *http.Request, version uint64) bool {
+	etag := fmt.Sprintf(`W/"%d-%d"`, s.epoch, version)
+	w.Header().Set("ETag", etag)
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
 }
 
+// CreateOrderRequest describes a new order. Temp may be composite, e.g. "hot,cold", or given as a list in Temps.
 type CreateOrderRequest struct {
-	Name      string  `json:"name"`
-	Temp      string  `json:"temp"`
-	ShelfLife float64 `json:"shelfLife"`
-	DecayRate float64 `json:"decayRate"`
+	// ID is optional, a random one is generated if it's empty. It must not be used by another live order.
+	ID        string   `json:"id,omitempty"`
+	Name      string   `json:"name"`
+	Temp      string   `json:"temp"`
+	Temps     []string `json:"temps,omitempty"`
+	ShelfLife float64  `json:"shelfLife"`
+	DecayRate float64  `json:"decayRate"` // zero falls back to the temp's kitchen.default_decay_rates
+	MaxAge    float64  `json:"maxAge,omitempty"`
+	// Affinity and AntiAffinity name a shelf group the order must, or must not, be placed in
+	Affinity     string `json:"affinity,omitempty"`
+	AntiAffinity string `json:"antiAffinity,omitempty"`
+	// Priority lets the order displace lower priority orders from better shelves, see PriorityHandler
+	Priority int `json:"priority,omitempty"`
+	// ShelfDecayMultiplier multiplies the decay rate of every shelf the order is on, zero falls back to 1
+	ShelfDecayMultiplier float64 `json:"shelfDecayMultiplier,omitempty"`
+	// Metadata is echoed back on the order, e.g. to correlate it with a customer. At most maxMetadataBytes
+	// of keys and values.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// maxMetadataBytes bounds the total size of an order's metadata keys and values.
+const maxMetadataBytes = 1024
+
+func validateMetadata(metadata map[string]string) error {
+	size := 0
+	for key, value := range metadata {
+		size += len(key) + len(value)
+	}
+	if size > maxMetadataBytes {
+		return fmt.Errorf("metadata is %d bytes, at most %d are allowed", size, maxMetadataBytes)
+	}
+	return nil
 }
 
 type CreateOrderResponse struct {
 	OrderID string `json:"orderID"`
 }
 
+// newOrder builds the order described by req, without an ID unless req has one.
+func (s *ApplicationServer) newOrder(req CreateOrderRequest) (*kitchen.Order, error) {
+	if err := validateMetadata(req.Metadata); err != nil {
+		return nil, err
+	}
+	multiplier := req.ShelfDecayMultiplier
+	if multiplier < 0 {
+		return nil, fmt.Errorf("shelfDecayMultiplier %v must not be negative", multiplier)
+	}
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	temp := req.Temp
+	if len(req.Temps) > 0 {
+		temp = strings.Join(req.Temps, ",")
+	}
+	return kitchen.NewOrder(req.Name, temp, s.toDuration(req.ShelfLife), req.DecayRate,
+		kitchen.WithMaxAge(s.toDuration(req.MaxAge)),
+		kitchen.WithAffinity(req.Affinity),
+		kitchen.WithAntiAffinity(req.AntiAffinity),
+		kitchen.WithPriority(req.Priority),
+		kitchen.WithShelfDecayMultiplier(multiplier),
+		kitchen.WithMetadata(req.Metadata)), nil
+}
+
 func (s *ApplicationServer) CreateOrderHandler(w http.ResponseWriter, r *http.Request) {
 	var req CreateOrderRequest
 	var res CreateOrderResponse
@@ -63,19 +405,35 @@ func (s *ApplicationServer) CreateOrderHandler(w http.ResponseWriter, r *http.Re
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&req)
 	if err != nil {
-		w.WriteHeader(400)
+		writeDecodeError(w, err)
 		return
 	}
-	order := kitchen.NewOrder(req.Name, req.Temp, time.Duration(req.ShelfLife)*time.Second, req.DecayRate)
-	err = s.kitchen.CreateOrder(order)
+	order, err := s.newOrder(req)
 	if err != nil {
-		w.WriteHeader(500)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if req.ID != "" {
+		err = s.kitchen.CreateOrderWithID(req.ID, order)
+	} else {
+		err = s.kitchen.CreateOrder(order)
+	}
+	if err == kitchen.ErrOverloaded || err == kitchen.ErrKitchenFull {
+		s.writeUnavailable(w, err)
+		return
+	}
+	if err == kitchen.ErrDuplicateID {
+		writeError(w, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
 		return
 	}
 	res.OrderID = order.ID()
 	bytes, err := json.Marshal(res)
 	if err != nil {
-		w.WriteHeader(500)
+		writeInternalError(w, err)
 		return
 	}
 	w.Write(bytes)
@@ -83,6 +441,96 @@ func (s *ApplicationServer) CreateOrderHandler(w http.ResponseWriter, r *http.Re
 
 type UpdateOrderRequest struct {
 	State string `json:"state"`
+	// ExpectedState, if set, makes the update conditional: it's a 409 unless the order is in this state, so
+	// retrying an update is safe
+	ExpectedState string `json:"expectedState,omitempty"`
+}
+
+// validStates are the states an order can be moved into with UpdateOrder.
+var validStates = []string{
+	string(kitchen.Ready),
+	string(kitchen.Enroute),
+	string(kitchen.PickedUp),
+}
+
+// Error codes identify the kind of error in an ErrorResponse. Unlike messages they're stable, so clients can
+// switch on them.
+const (
+	CodeBadRequest        = "bad_request"        // 400, the request couldn't be parsed or is malformed, e.g. an unknown state
+	CodeInvalid           = "invalid"            // 422, the request parsed but isn't valid
+	CodeNotFound          = "not_found"          // 404
+	CodeMethodNotAllowed  = "method_not_allowed" // 405
+	CodeConflict          = "conflict"           // 409, e.g. a duplicate ID or a full shelf
+	CodeInvalidTransition = "invalid_transition" // 409, the order isn't in a state that allows the request
+	CodeUnavailable       = "unavailable"        // 503, the kitchen is full or overloaded, see Retry-After
+	CodeInternal          = "internal"           // 500
+)
+
+// ErrorResponse is the body of every error response, e.g. {"error":{"code":"not_found","message":"..."}}.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code          string   `json:"code"`
+	Message       string   `json:"message"`
+	State         string   `json:"state,omitempty"`
+	ExpectedState string   `json:"expectedState,omitempty"`
+	ValidStates   []string `json:"validStates,omitempty"`
+}
+
+// writeError writes an ErrorResponse with just a code and message.
+func writeError(w http.ResponseWriter, status int, code string, msg string) {
+	writeErrorResponse(w, status, ErrorDetail{Code: code, Message: msg})
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, detail ErrorDetail) {
+	bytes, err := json.Marshal(ErrorResponse{Error: detail})
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
+
+// writeDecodeError reports a request body that isn't valid JSON for the handler.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("invalid request body: %v", err))
+}
+
+// writeTransitionError reports an order that isn't in a state that allows the request.
+func writeTransitionError(w http.ResponseWriter, err *kitchen.TransitionError) {
+	writeErrorResponse(w, http.StatusConflict, transitionErrorDetail(err))
+}
+
+func transitionErrorDetail(err *kitchen.TransitionError) ErrorDetail {
+	return ErrorDetail{
+		Code:          CodeInvalidTransition,
+		Message:       err.Error(),
+		State:         string(err.State),
+		ExpectedState: string(err.Expected),
+	}
+}
+
+// writeUnavailable rejects a create the kitchen has no room for, with a Retry-After of when it might.
+func (s *ApplicationServer) writeUnavailable(w http.ResponseWriter, err error) {
+	retryAfter := int(math.Ceil(s.kitchen.RetryAfter().Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, http.StatusServiceUnavailable, CodeUnavailable, err.Error())
+}
+
+// writeInternalError reports an unexpected error, e.g. failing to encode the response.
+func writeInternalError(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
+}
+
+func writeOrderNotFound(w http.ResponseWriter, id string) {
+	writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("order %s not found", id))
 }
 
 func (s *ApplicationServer) UpdateOrderHandler(w http.ResponseWriter, r *http.Request) {
@@ -90,42 +538,129 @@ func (s *ApplicationServer) UpdateOrderHandler(w http.ResponseWriter, r *http.Re
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&req)
 	if err != nil {
-		w.WriteHeader(400)
+		writeDecodeError(w, err)
 		return
 	}
+
 	id := mux.Vars(r)["id"]
-	order := s.kitchen.GetOrder(id)
-	if order == nil {
-		w.WriteHeader(404)
-		return
-	}
-	if strings.ToLower(req.State) == "ready" {
-		err = s.kitchen.SetOrderReady(order)
-		if err != nil {
-			w.WriteHeader(500)
+	state := kitchen.OrderState(strings.ToLower(req.State))
+	var order *kitchen.Order
+	if req.ExpectedState != "" {
+		expected := kitchen.OrderState(strings.ToLower(req.ExpectedState))
+		if !knownState(expected) {
+			writeErrorResponse(w, http.StatusBadRequest, ErrorDetail{
+				Code:        CodeBadRequest,
+				Message:     fmt.Sprintf("unknown expectedState %q", req.ExpectedState),
+				ValidStates: validStates,
+			})
 			return
 		}
-		writeOrderResponse(w, order)
+		order, err = s.kitchen.UpdateOrderFrom(id, expected, state)
+	} else {
+		order, err = s.kitchen.UpdateOrder(id, state)
+	}
+	if err != nil {
+		status, detail := updateError(id, req.State, err)
+		writeErrorResponse(w, status, detail)
 		return
 	}
-	if strings.ToLower(req.State) == "enroute" {
-		err = s.kitchen.SetOrderEnroute(order)
-		if err != nil {
-			w.WriteHeader(500)
-			return
+	s.writeOrderResponse(w, r, order)
+}
+
+// knownState returns true if the state is one an order can be in.
+func knownState(state kitchen.OrderState) bool {
+	switch state {
+	case kitchen.Created, kitchen.Ready, kitchen.Enroute, kitchen.PickedUp, kitchen.Trashed:
+		return true
+	}
+	return false
+}
+
+// updateError returns the status and error to respond with when updating the order to the state failed.
+func updateError(id string, state string, err error) (int, ErrorDetail) {
+	if err == kitchen.ErrUnknownState {
+		return http.StatusBadRequest, ErrorDetail{
+			Code:        CodeBadRequest,
+			Message:     fmt.Sprintf("unknown state %q", state),
+			ValidStates: validStates,
 		}
-		writeOrderResponse(w, order)
+	}
+	if err == kitchen.ErrOrderNotFound {
+		return http.StatusNotFound, ErrorDetail{Code: CodeNotFound, Message: fmt.Sprintf("order %s not found", id)}
+	}
+	if terr, ok := err.(*kitchen.TransitionError); ok {
+		return http.StatusConflict, transitionErrorDetail(terr)
+	}
+	return http.StatusInternalServerError, ErrorDetail{Code: CodeInternal, Message: err.Error()}
+}
+
+// maxBulkUpdates bounds the orders a single bulk update can move.
+const maxBulkUpdates = 1000
+
+// BulkUpdateRequest moves the order with the ID to the state, see UpdateOrderRequest.
+type BulkUpdateRequest struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
+// BulkUpdateResult is the outcome of one update in a bulk update. Status is what updating the order alone
+// would have returned, with the order on success and the error otherwise.
+type BulkUpdateResult struct {
+	ID     string         `json:"id"`
+	Status int            `json:"status"`
+	Order  *OrderResponse `json:"order,omitempty"`
+	Error  *ErrorDetail   `json:"error,omitempty"`
+}
+
+type BulkUpdateResponse struct {
+	Results []BulkUpdateResult `json:"results"`
+}
+
+// BulkUpdateHandler applies a list of updates concurrently, e.g. when many couriers arrive at once. It responds
+// 200 with a result per update, in the order they were given, even if some of them failed.
+func (s *ApplicationServer) BulkUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var req []BulkUpdateRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeDecodeError(w, err)
 		return
 	}
-	if strings.ToLower(req.State) == "pickedup" {
-		err = s.kitchen.SetOrderPickedUp(order)
-		if err != nil {
-			w.WriteHeader(500)
-			return
-		}
-		writeOrderResponse(w, order)
+	if len(req) > maxBulkUpdates {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid,
+			fmt.Sprintf("at most %d orders can be updated at once, got %d", maxBulkUpdates, len(req)))
 		return
 	}
+
+	opts := parseResponseOptions(r)
+	res := BulkUpdateResponse{Results: make([]BulkUpdateResult, len(req))}
+	var wg sync.WaitGroup
+	for i, update := range req {
+		wg.Add(1)
+		go func(i int, update BulkUpdateRequest) {
+			defer wg.Done()
+			result := BulkUpdateResult{ID: update.ID, Status: http.StatusOK}
+			order, err := s.kitchen.UpdateOrder(update.ID, kitchen.OrderState(strings.ToLower(update.State)))
+			if err != nil {
+				var detail ErrorDetail
+				result.Status, detail = updateError(update.ID, update.State, err)
+				result.Error = &detail
+			} else {
+				response := s.orderToOrderResponse(order, opts)
+				result.Order = &response
+			}
+			// each goroutine writes its own result
+			res.Results[i] = result
+		}(i, update)
+	}
+	wg.Wait()
+
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
 }
 
 type OrderResponse struct {
@@ -138,32 +673,179 @@ type OrderResponse struct {
 	NormalValue float64 `json:"normal"`
 	Decay       float64 `json:"decay"`
 	Age         float64 `json:"age"`
+	Priority    int     `json:"priority"`
+	// Hops is how many times the order moved from one shelf to another
+	Hops int `json:"hops"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// TrashedReason is why the order was trashed, e.g. expired or no_capacity, omitted unless it was
+	TrashedReason string `json:"trashedReason,omitempty"`
+
+	// TimeToExpiry is how long until the order expires at its current decay rates, omitted for orders that
+	// aren't decaying, i.e. not ready yet or picked up
+	TimeToExpiry *float64 `json:"timeToExpiry,omitempty"`
+
+	// RFC3339 timestamps of each transition, only set with ?includeTimestamps=true. A state the order
+	// hasn't reached is omitted.
+	CreatedAt  string `json:"createdAt,omitempty"`
+	ReadyAt    string `json:"readyAt,omitempty"`
+	EnrouteAt  string `json:"enrouteAt,omitempty"`
+	PickedUpAt string `json:"pickedUpAt,omitempty"`
+	TrashedAt  string `json:"trashedAt,omitempty"`
+
+	// the components of Decay, only set with ?includeDecay=true
+	DecayBreakdown *DecayBreakdownResponse `json:"decayBreakdown,omitempty"`
 }
 
-func orderToOrderResponse(order *kitchen.Order) OrderResponse {
-	var shelfName string
-	if shelf := order.Shelf(); shelf != nil {
-		shelfName = shelf.Name()
+type DecayBreakdownResponse struct {
+	Base            float64 `json:"base"`
+	CurrentShelf    float64 `json:"currentShelf"`
+	PreviousShelves float64 `json:"previousShelves"`
+	Floor           float64 `json:"floor"`
+}
+
+// responseOptions are the optional parts of an OrderResponse a request opted into.
+type responseOptions struct {
+	timestamps bool
+	decay      bool
+}
+
+func parseResponseOptions(r *http.Request) responseOptions {
+	return responseOptions{
+		timestamps: r.URL.Query().Get("includeTimestamps") == "true",
+		decay:      r.URL.Query().Get("includeDecay") == "true",
+	}
+}
+
+// orderFields are the JSON names of OrderResponse's fields, which ?fields selects from.
+var orderFields = jsonFields(reflect.TypeOf(OrderResponse{}))
+
+// jsonFields returns the JSON names of the struct's fields.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// parseFields returns the fields of OrderResponse selected with ?fields=orderID,state,value, or nil if every
+// field is wanted.
+func parseFields(r *http.Request) (map[string]bool, error) {
+	param := r.URL.Query().Get("fields")
+	if param == "" {
+		return nil, nil
 	}
-	// We convert from internal time.Duration here to seconds.
-	return OrderResponse{
-		OrderID:     order.ID(),
-		Name:        order.Name(),
-		State:       string(order.State()),
-		Shelf:       shelfName,
-		ShelfLife:   float64(order.ShelfLife() / time.Second),
-		Value:       order.Value() / float64(time.Second),
-		NormalValue: order.NormalizedValue(),
-		Decay:       order.Decayed() / float64(time.Second),
-		Age:         float64(order.Age() / time.Second),
+	fields := make(map[string]bool)
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if !orderFields[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		fields[field] = true
 	}
+	return fields, nil
 }
 
-func writeOrderResponse(w http.ResponseWriter, order *kitchen.Order) {
-	res := orderToOrderResponse(order)
+// marshalOrder marshals the response with only the given fields, or every field if fields is nil. Fields the
+// response omits when empty, e.g. the timestamps, are still omitted if they're selected.
+func marshalOrder(res OrderResponse, fields map[string]bool) ([]byte, error) {
+	bytes, err := json.Marshal(res)
+	if err != nil || fields == nil {
+		return bytes, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return json.Marshal(selected)
+}
+
+// formatTimestamp formats t as RFC3339, or returns the empty string if t is unset.
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// finite returns f, or 0 if it's NaN or infinite, which JSON can't represent. An order with a zero shelf
+// life has a NaN normalized value, for one.
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+// toDuration converts a duration given in the configured unit to a time.Duration.
+func (s *ApplicationServer) toDuration(units float64) time.Duration {
+	return time.Duration(units * float64(s.unit))
+}
+
+// fromDuration converts an internal time.Duration, or a value measured in one, to the configured unit.
+// Fractional units are kept.
+func (s *ApplicationServer) fromDuration(d float64) float64 {
+	return d / float64(s.unit)
+}
+
+func (s *ApplicationServer) orderToOrderResponse(order *kitchen.Order, opts responseOptions) OrderResponse {
+	snapshot := order.ResponseSnapshot()
+	// We convert from internal time.Duration here to the configured unit.
+	res := OrderResponse{
+		OrderID:       snapshot.Order.ID,
+		Name:          snapshot.Order.Name,
+		State:         string(snapshot.Order.State),
+		Shelf:         snapshot.Order.Shelf,
+		ShelfLife:     s.fromDuration(float64(snapshot.Order.ShelfLife)),
+		Value:         finite(s.fromDuration(snapshot.Value.Value)),
+		NormalValue:   finite(snapshot.Value.NormalizedValue),
+		Decay:         finite(s.fromDuration(snapshot.Value.Decayed)),
+		Age:           s.fromDuration(float64(snapshot.Value.Age)),
+		Priority:      snapshot.Order.Priority,
+		Hops:          snapshot.Order.Hops,
+		Metadata:      snapshot.Order.Metadata,
+		TrashedReason: string(snapshot.Order.TrashedReason),
+	}
+	if snapshot.TimeToExpiry != kitchen.NeverExpires {
+		ttl := s.fromDuration(float64(snapshot.TimeToExpiry))
+		res.TimeToExpiry = &ttl
+	}
+	if opts.timestamps {
+		res.CreatedAt = formatTimestamp(snapshot.Order.CreatedAt)
+		res.ReadyAt = formatTimestamp(snapshot.Order.ReadyAt)
+		res.EnrouteAt = formatTimestamp(snapshot.Order.EnrouteAt)
+		res.PickedUpAt = formatTimestamp(snapshot.Order.PickedUpAt)
+		res.TrashedAt = formatTimestamp(snapshot.Order.TrashedAt)
+	}
+	if opts.decay {
+		breakdown := snapshot.Value.Breakdown
+		res.DecayBreakdown = &DecayBreakdownResponse{
+			Base:            finite(s.fromDuration(breakdown.Base)),
+			CurrentShelf:    finite(s.fromDuration(breakdown.CurrentShelf)),
+			PreviousShelves: finite(s.fromDuration(breakdown.PreviousShelves)),
+			Floor:           finite(s.fromDuration(breakdown.Floor)),
+		}
+	}
+	return res
+}
+
+func (s *ApplicationServer) writeOrderResponse(w http.ResponseWriter, r *http.Request, order *kitchen.Order) {
+	res := s.orderToOrderResponse(order, parseResponseOptions(r))
 	bytes, err := json.Marshal(res)
 	if err != nil {
-		w.WriteHeader(500)
+		writeInternalError(w, err)
+		return
 	}
 	w.Write([]byte(bytes))
 }
@@ -172,53 +854,716 @@ func (s *ApplicationServer) GetOrderHandler(w http.ResponseWriter, r *http.Reque
 	id := mux.Vars(r)["id"]
 	order := s.kitchen.GetOrder(id)
 	if order == nil {
-		w.WriteHeader(404)
+		writeOrderNotFound(w, id)
 		return
 	}
-	res := orderToOrderResponse(order)
-	bytes, err := json.Marshal(res)
+	fields, err := parseFields(r)
 	if err != nil {
-		w.WriteHeader(500)
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if s.notModified(w, r, order.Version()) {
+		return
+	}
+	res := s.orderToOrderResponse(order, parseResponseOptions(r))
+	bytes, err := marshalOrder(res, fields)
+	if err != nil {
+		writeInternalError(w, err)
 		return
 	}
 	w.Write([]byte(bytes))
 }
 
+type MoveOrderRequest struct {
+	Shelf string `json:"shelf"`
+}
+
+// MoveOrderHandler forces an order onto a specific shelf, useful for debugging placement.
+func (s *ApplicationServer) MoveOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var req MoveOrderRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	err = s.kitchen.MoveOrder(id, req.Shelf)
+	if terr, ok := err.(*kitchen.TransitionError); ok {
+		writeTransitionError(w, terr)
+		return
+	}
+	switch err {
+	case nil:
+	case kitchen.ErrOrderNotFound, kitchen.ErrUnknownShelf:
+		writeError(w, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	case kitchen.ErrUnsupportedTemp:
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	case kitchen.ErrNotAdmitted:
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err.Error())
+		return
+	case kitchen.ErrShelfFull:
+		writeError(w, http.StatusConflict, CodeConflict, err.Error())
+		return
+	default:
+		writeInternalError(w, err)
+		return
+	}
+	order := s.kitchen.GetOrder(id)
+	if order == nil {
+		writeOrderNotFound(w, id)
+		return
+	}
+	s.writeOrderResponse(w, r, order)
+}
+
+// CancelHandler trashes a ready order, returning it in its final state. A 409 is returned once a courier is
+// enroute, or if the order was already picked up or trashed.
+func (s *ApplicationServer) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	order, err := s.kitchen.CancelOrder(id)
+	if err == kitchen.ErrOrderNotFound {
+		writeOrderNotFound(w, id)
+		return
+	}
+	if terr, ok := err.(*kitchen.TransitionError); ok {
+		writeTransitionError(w, terr)
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	s.writeOrderResponse(w, r, order)
+}
+
+type PriorityRequest struct {
+	Priority int `json:"priority"`
+}
+
+// PriorityHandler changes an order's priority, moving it to a better shelf if it now outranks an order there.
+func (s *ApplicationServer) PriorityHandler(w http.ResponseWriter, r *http.Request) {
+	var req PriorityRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	order, err := s.kitchen.SetPriority(id, req.Priority)
+	if err == kitchen.ErrOrderNotFound {
+		writeOrderNotFound(w, id)
+		return
+	}
+	if terr, ok := err.(*kitchen.TransitionError); ok {
+		writeTransitionError(w, terr)
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	s.writeOrderResponse(w, r, order)
+}
+
+// ImportOrderRequest is an order to import with POST /admin/import, see ImportHandler.
+type ImportOrderRequest struct {
+	CreateOrderRequest
+	State string `json:"state"`
+	Shelf string `json:"shelf"`
+	// Timestamps default to the time of the import
+	CreatedAt time.Time `json:"createdAt"`
+	ReadyAt   time.Time `json:"readyAt"`
+	EnrouteAt time.Time `json:"enrouteAt"`
+}
+
+type ImportResponse struct {
+	OrderIDs []string `json:"orderIDs"`
+}
+
+// ImportHandler places a JSON array of orders directly on shelves, in the ready or enroute state, e.g. to
+// reproduce the state of the kitchen during an incident. An unknown shelf or state imports nothing.
+func (s *ApplicationServer) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	var reqs []ImportOrderRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&reqs)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	imports := make([]kitchen.OrderImport, len(reqs))
+	res := ImportResponse{OrderIDs: make([]string, len(reqs))}
+	for i, req := range reqs {
+		order, err := s.newOrder(req.CreateOrderRequest)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("order %d: %v", i, err))
+			return
+		}
+		if req.ID != "" {
+			kitchen.WithID(req.ID)(order)
+		}
+		imports[i] = kitchen.OrderImport{
+			Order:     order,
+			State:     kitchen.OrderState(req.State),
+			Shelf:     req.Shelf,
+			CreatedAt: req.CreatedAt,
+			ReadyAt:   req.ReadyAt,
+			EnrouteAt: req.EnrouteAt,
+		}
+		res.OrderIDs[i] = order.ID()
+	}
+	err = s.kitchen.Import(imports)
+	if ierr, ok := err.(*kitchen.ImportError); ok {
+		switch ierr.Err {
+		case kitchen.ErrKitchenFull:
+			s.writeUnavailable(w, err)
+		case kitchen.ErrDuplicateID, kitchen.ErrShelfFull:
+			writeError(w, http.StatusConflict, CodeConflict, err.Error())
+		default:
+			writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err.Error())
+		}
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
+type ShelfRequest struct {
+	Capacity *int `json:"capacity"`
+}
+
+// ShelfHandler changes a shelf's capacity while it's in use, returning its new utilization. Shrinking it below
+// the orders it holds is a 409, unless the kitchen's shrink_policy trashes the least valuable of them.
+func (s *ApplicationServer) ShelfHandler(w http.ResponseWriter, r *http.Request) {
+	var req ShelfRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if req.Capacity == nil {
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, "capacity is required")
+		return
+	}
+	name := mux.Vars(r)["name"]
+	err = s.kitchen.SetShelfCapacity(name, *req.Capacity)
+	switch err {
+	case nil:
+	case kitchen.ErrUnknownShelf:
+		writeError(w, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	case kitchen.ErrInvalidCapacity, kitchen.ErrNotResizable:
+		writeError(w, http.StatusUnprocessableEntity, CodeInvalid, err.Error())
+		return
+	case kitchen.ErrShelfFull:
+		writeError(w, http.StatusConflict, CodeConflict, "shelf holds more orders than the new capacity")
+		return
+	default:
+		writeInternalError(w, err)
+		return
+	}
+	for _, shelf := range s.kitchen.Shelves() {
+		if shelf.Name() == name {
+			bytes, err := json.Marshal(ShelfResponse{Used: len(shelf.Orders()), Capacity: shelf.Capacity()})
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			w.Write(bytes)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, CodeNotFound, kitchen.ErrUnknownShelf.Error())
+}
+
+// ReloadHandler re-reads the config and applies the new kitchen topology without a restart.
+func (s *ApplicationServer) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.kitchen.Reconfigure(s.loadConfig())
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write([]byte("✔"))
+}
+
+type LayoutResponse struct {
+	// Shelves maps each shelf's name to the IDs of the orders on it, sorted
+	Shelves map[string][]string `json:"shelves"`
+}
+
+// LayoutHandler returns which orders are on which shelf.
+func (s *ApplicationServer) LayoutHandler(w http.ResponseWriter, r *http.Request) {
+	res := LayoutResponse{Shelves: make(map[string][]string)}
+	for shelf, orders := range s.kitchen.OrdersByShelf() {
+		ids := make([]string, len(orders))
+		for i, order := range orders {
+			ids[i] = order.ID()
+		}
+		sort.Strings(ids)
+		res.Shelves[shelf] = ids
+	}
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
+type ShelfInfoResponse struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Group     string   `json:"group,omitempty"`
+	Supported []string `json:"supported"`
+	Capacity  int      `json:"capacity"`
+	Reserve   int      `json:"reserve"`
+	// DecayRate is the configured rate, Decay the rate now, which the shelf's schedule may multiply
+	DecayRate float64              `json:"decayRate"`
+	Decay     float64              `json:"decay"`
+	Orders    []ShelfOrderResponse `json:"orders"`
+}
+
+type ShelfOrderResponse struct {
+	OrderID string  `json:"orderID"`
+	State   string  `json:"state"`
+	Value   float64 `json:"value"`
+	Age     float64 `json:"age"`
+}
+
+// GetShelfHandler returns a shelf's config and the orders on it, sorted by ID, e.g. to debug placement.
+func (s *ApplicationServer) GetShelfHandler(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.kitchen.ShelfByName(mux.Vars(r)["name"])
+	if !ok {
+		writeError(w, http.StatusNotFound, CodeNotFound, kitchen.ErrUnknownShelf.Error())
+		return
+	}
+	res := ShelfInfoResponse{
+		Name:      info.Name,
+		Type:      info.Type,
+		Group:     info.Group,
+		Supported: info.Supported,
+		Capacity:  info.Capacity,
+		Reserve:   info.Reserve,
+		DecayRate: info.DecayRate,
+		Decay:     info.Decay,
+		Orders:    make([]ShelfOrderResponse, len(info.Orders)),
+	}
+	for i, order := range info.Orders {
+		snapshot := order.ValueSnapshot()
+		res.Orders[i] = ShelfOrderResponse{
+			OrderID: order.ID(),
+			State:   string(snapshot.State),
+			Value:   s.fromDuration(snapshot.Value),
+			Age:     s.fromDuration(float64(snapshot.Age)),
+		}
+	}
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
+type SweepResponse struct {
+	Trashed int `json:"trashed"`
+}
+
+// SweepHandler trashes every expired order, without relocating anything.
+func (s *ApplicationServer) SweepHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(SweepResponse{Trashed: s.kitchen.SweepExpired()})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
+// LeastValuableHandler returns the lowest value order on the shelves supporting ?temp, the next in line to
+// be evicted.
+func (s *ApplicationServer) LeastValuableHandler(w http.ResponseWriter, r *http.Request) {
+	temp := r.URL.Query().Get("temp")
+	if temp == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "temp is required")
+		return
+	}
+	order := s.kitchen.LeastValuableOrder(temp)
+	if order == nil {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no orders on the shelves supporting %s", temp))
+		return
+	}
+	s.writeOrderResponse(w, r, order)
+}
+
+type PreviewResponse struct {
+	// Shelf is empty when Placed is false
+	Shelf  string `json:"shelf,omitempty"`
+	Placed bool   `json:"placed"`
+}
+
+// PreviewHandler returns the shelf a new order of ?temp would be placed on, without creating it.
+func (s *ApplicationServer) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	temp := r.URL.Query().Get("temp")
+	if temp == "" {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "temp is required")
+		return
+	}
+	shelf, placed := s.kitchen.PreviewPlacement(temp)
+	bytes, err := json.Marshal(PreviewResponse{Shelf: shelf, Placed: placed})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
+type OrderValueResponse struct {
+	State       string  `json:"state"`
+	Value       float64 `json:"value"`
+	NormalValue float64 `json:"normal"`
+	Decay       float64 `json:"decay"`
+	Age         float64 `json:"age"`
+}
+
+// GetOrderValueHandler returns just the value fields of an order, for cheap polling.
+func (s *ApplicationServer) GetOrderValueHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	order := s.kitchen.GetOrder(id)
+	if order == nil {
+		writeOrderNotFound(w, id)
+		return
+	}
+	value := order.ValueSnapshot()
+	res := OrderValueResponse{
+		State:       string(value.State),
+		Value:       s.fromDuration(value.Value),
+		NormalValue: value.NormalizedValue,
+		Decay:       s.fromDuration(value.Decayed),
+		Age:         s.fromDuration(float64(value.Age)),
+	}
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
+const (
+	// defaultHorizon and defaultStep are used by GET /order/{id}/projection without ?horizon or ?step
+	defaultHorizon = time.Minute
+	defaultStep    = 5 * time.Second
+	// maxProjectionPoints bounds the points in a projection, so a tiny step can't be used to make the server
+	// do arbitrary work
+	maxProjectionPoints = 1000
+)
+
+// ProjectionPoint is an order's projected value Offset from now, both in the configured unit.
+type ProjectionPoint struct {
+	Offset float64 `json:"offset"`
+	Value  float64 `json:"value"`
+}
+
+// ProjectionResponse is the response to GET /order/{id}/projection.
+type ProjectionResponse struct {
+	OrderID string            `json:"orderID"`
+	Shelf   string            `json:"shelf"`
+	Points  []ProjectionPoint `json:"points"`
+}
+
+// durationParam parses the query param as a number in the configured unit, or a Go duration like 60s, returning
+// def if it's missing.
+func (s *ApplicationServer) durationParam(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return def, nil
+	}
+	if units, err := strconv.ParseFloat(param, 64); err == nil && !math.IsNaN(units) && !math.IsInf(units, 0) {
+		return s.toDuration(units), nil
+	}
+	d, err := time.ParseDuration(param)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, param)
+	}
+	return d, nil
+}
+
+// ProjectionHandler projects the order's value every ?step until ?horizon from now, assuming it stays on its
+// current shelf, e.g. for a chart. Both are in the configured unit, or Go durations like 5s.
+func (s *ApplicationServer) ProjectionHandler(w http.ResponseWriter, r *http.Request) {
+	horizon, err := s.durationParam(r, "horizon", defaultHorizon)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	step, err := s.durationParam(r, "step", defaultStep)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if horizon < 0 || step <= 0 {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "horizon must not be negative and step must be positive")
+		return
+	}
+	if horizon/step >= maxProjectionPoints {
+		writeError(w, http.StatusBadRequest, CodeBadRequest,
+			fmt.Sprintf("horizon over step is more than %d points", maxProjectionPoints))
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	order := s.kitchen.GetOrder(id)
+	if order == nil {
+		writeOrderNotFound(w, id)
+		return
+	}
+	res := ProjectionResponse{OrderID: order.ID()}
+	if shelf := order.Shelf(); shelf != nil {
+		res.Shelf = shelf.Name()
+	}
+	points := order.Projection(horizon, step)
+	res.Points = make([]ProjectionPoint, len(points))
+	for i, point := range points {
+		res.Points[i] = ProjectionPoint{
+			Offset: s.fromDuration(float64(point.Offset)),
+			Value:  s.fromDuration(point.Value),
+		}
+	}
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
+// OrderEventResponse is one transition, or reheat, of an order. OldState is empty for the order's creation.
+type OrderEventResponse struct {
+	OldState  string `json:"oldState"`
+	NewState  string `json:"newState"`
+	Timestamp string `json:"timestamp"`
+	// Reason is why the order was trashed, omitted unless NewState is trashed
+	Reason string `json:"reason,omitempty"`
+	// Reheated is set for a reheat, which doesn't change the state
+	Reheated bool `json:"reheated,omitempty"`
+}
+
+type OrderEventsResponse struct {
+	OrderID string               `json:"orderID"`
+	Events  []OrderEventResponse `json:"events"`
+}
+
+// OrderEventsHandler returns every transition of an order, oldest first. Orders that were recently picked up or
+// trashed are still found.
+func (s *ApplicationServer) OrderEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	events, err := s.kitchen.OrderEvents(id)
+	if err == kitchen.ErrOrderNotFound {
+		writeOrderNotFound(w, id)
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	res := OrderEventsResponse{OrderID: id, Events: make([]OrderEventResponse, len(events))}
+	for i, event := range events {
+		res.Events[i] = OrderEventResponse{
+			OldState:  string(event.OldState),
+			NewState:  string(event.NewState),
+			Timestamp: formatTimestamp(event.At),
+			Reason:    string(event.Reason),
+			Reheated:  event.Reheated,
+		}
+	}
+	bytes, err := json.Marshal(res)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}
+
 type Config struct {
-	Port int `yaml:"port"`
+	// Host is the interface to bind, e.g. 0.0.0.0 to accept connections from other hosts
+	Host  string `yaml:"host"`
+	Port  int    `yaml:"port"`
+	Units string `yaml:"units"`
+	// Socket is the path of a unix socket to listen on instead of Host and Port, e.g. for a sidecar
+	Socket string `yaml:"socket"`
+	// Compression gzips responses for clients that accept it
+	Compression bool `yaml:"compression"`
+	// ReadTimeout bounds reading a whole request, headers and body, so slow clients can't hold connections.
+	// WriteTimeout bounds writing the response and IdleTimeout how long a keep-alive connection can idle.
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// CORS lets browser apps on other origins call the API, it's disabled unless origins are allowed
+	CORS CORSConfig `yaml:"cors"`
+	// AccessLog logs every request to stderr, with its method, path, status, latency and request ID
+	AccessLog bool `yaml:"access_log"`
 }
 
-// allow zero values and set defaults
+func parseUnits(units string) (time.Duration, error) {
+	switch strings.ToLower(units) {
+	// seconds is the default
+	case "", "s", "seconds":
+		return time.Second, nil
+	case "ms", "milliseconds":
+		return time.Millisecond, nil
+	}
+	return 0, fmt.Errorf("unknown units %q, expected seconds or milliseconds", units)
+}
+
+// set defaults, keys present in the config override them. an explicit port of 0 picks an ephemeral port.
 func loadConfig(provider config.Provider) Config {
-	var cfg Config
-	provider.Get("server").Populate(&cfg)
-	if cfg.Port == 0 {
-		cfg.Port = 8080
+	cfg := Config{
+		Host:         "127.0.0.1",
+		Port:         8080,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  2 * time.Minute,
 	}
+	provider.Get("server").Populate(&cfg)
 	return cfg
 }
 
-func Provide(provider config.Provider, k *kitchen.Kitchen) (*ApplicationServer, error) {
+// validateHost returns an error unless host is an IP address or a plausible hostname.
+func validateHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if host == "" || len(host) > 253 {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid host %q", host)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid host %q", host)
+			}
+		}
+	}
+	return nil
+}
+
+func Provide(provider config.Provider, loader ConfigLoader, k *kitchen.Kitchen, build BuildInfo) (*ApplicationServer, error) {
 	cfg := loadConfig(provider)
-	app := ApplicationServer{kitchen: k, port: cfg.Port}
+	unit, err := parseUnits(cfg.Units)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Socket == "" {
+		if err := validateHost(cfg.Host); err != nil {
+			return nil, err
+		}
+	}
+	app := ApplicationServer{kitchen: k, loadConfig: loader, unit: unit, socket: cfg.Socket, build: build, epoch: time.Now().UnixNano()}
+	app.maxLongPoll = longPollLimit(cfg.WriteTimeout)
+	if cfg.AccessLog {
+		app.logger = log.New(os.Stderr, "server: ", log.LstdFlags)
+	}
 	app.router = mux.NewRouter()
+	if cfg.Compression {
+		app.router.Use(gzipMiddleware)
+	}
+	app.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, CodeNotFound, fmt.Sprintf("no route for %s", r.URL.Path))
+	})
+	app.router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Sprintf("%s not allowed on %s", r.Method, r.URL.Path))
+	})
 	app.router.HandleFunc("/order", app.CreateOrderHandler).Methods("POST")
 	app.router.HandleFunc("/order", app.ListOrdersHandler).Methods("GET")
+	// registered before /order/{id}, which would otherwise match it
+	app.router.HandleFunc("/order/preview", app.PreviewHandler).Methods("GET")
+	app.router.HandleFunc("/orders/update", app.BulkUpdateHandler).Methods("POST")
 	app.router.HandleFunc("/order/{id}", app.GetOrderHandler).Methods("GET")
 	app.router.HandleFunc("/order/{id}", app.UpdateOrderHandler).Methods("POST")
+	app.router.HandleFunc("/order/{id}/value", app.GetOrderValueHandler).Methods("GET")
+	app.router.HandleFunc("/order/{id}/events", app.OrderEventsHandler).Methods("GET")
+	app.router.HandleFunc("/order/{id}/projection", app.ProjectionHandler).Methods("GET")
+	app.router.HandleFunc("/order/{id}/priority", app.PriorityHandler).Methods("POST")
+	app.router.HandleFunc("/order/{id}/cancel", app.CancelHandler).Methods("POST")
 	app.router.HandleFunc("/health", app.HealthHandler).Methods("GET")
+	app.router.HandleFunc("/version", app.VersionHandler).Methods("GET")
+	app.router.HandleFunc("/metrics", app.MetricsHandler).Methods("GET")
+	app.router.HandleFunc("/admin/reload", app.ReloadHandler).Methods("POST")
+	app.router.HandleFunc("/admin/import", app.ImportHandler).Methods("POST")
+	app.router.HandleFunc("/admin/shelf/{name}", app.ShelfHandler).Methods("PATCH")
+	app.router.HandleFunc("/admin/shelf/{name}", app.GetShelfHandler).Methods("GET")
+	app.router.HandleFunc("/admin/order/{id}/move", app.MoveOrderHandler).Methods("POST")
+	app.router.HandleFunc("/admin/least-valuable", app.LeastValuableHandler).Methods("GET")
+	app.router.HandleFunc("/admin/sweep", app.SweepHandler).Methods("POST")
+	app.router.HandleFunc("/admin/layout", app.LayoutHandler).Methods("GET")
+	app.handler = app.router
+	if len(cfg.CORS.AllowedOrigins) > 0 {
+		// outside the router, which would reject preflight OPTIONS requests before any middleware ran
+		app.handler = corsMiddleware(cfg.CORS, app.handler)
+	}
+	// outermost, so every response carries an ID and every request is logged, even preflights
+	app.handler = app.requestIDMiddleware(app.handler)
 	app.server = &http.Server{
-		Addr:    fmt.Sprintf("127.0.0.1:%d", cfg.Port),
-		Handler: app.router,
+		Addr:         net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Handler:      app.handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
 	}
 	return &app, nil
 }
 
+// Listen binds the configured address, or unix socket. Binding before serving surfaces errors, e.g. the port
+// being taken, and lets callers read back an ephemeral port.
+func (s *ApplicationServer) Listen() (net.Listener, error) {
+	if s.socket != "" {
+		if err := removeStaleSocket(s.socket); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", s.socket)
+	}
+	return net.Listen("tcp", s.server.Addr)
+}
+
+// removeStaleSocket removes a socket left behind by a previous server that didn't shut down cleanly, which
+// would otherwise fail the listen. Anything other than a socket at the path is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
 func Start(lifecycle fx.Lifecycle, server *ApplicationServer) error {
 	lifecycle.Append(fx.Hook{
 		OnStart: func(context.Context) error {
-			go server.server.ListenAndServe()
-			fmt.Printf("Server listening on %d\n", server.port)
+			listener, err := server.Listen()
+			if err != nil {
+				return err
+			}
+			go server.server.Serve(listener)
+			fmt.Printf("Server listening on %s\n", listener.Addr())
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
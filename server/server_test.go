@@ -0,0 +1,1239 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ben-mays/effective-robot/kitchen"
+	"github.com/stretchr/testify/assert"
+
+	"go.uber.org/config"
+)
+
+var testConfig = []byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported: 
+        - hot
+    - name: "cold"
+      capacity: 5
+      decay_rate: 0.5
+      supported: 
+        - cold`)
+
+func newTestServer(t *testing.T, overrides ...[]byte) *ApplicationServer {
+	provider := config.NewYAMLProviderFromBytes(append([][]byte{testConfig}, overrides...)...)
+	k, err := kitchen.NewKitchen(provider)
+	assert.Nil(t, err)
+	loader := func() config.Provider {
+		return provider
+	}
+	app, err := Provide(provider, loader, k, BuildInfo{Version: "1.2.3", GitSHA: "abc123"})
+	assert.Nil(t, err)
+	return app
+}
+
+func do(app *ApplicationServer, method, uri string, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req := httptest.NewRequest(method, uri, &buf)
+	rec := httptest.NewRecorder()
+	app.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func createOrder(t *testing.T, app *ApplicationServer, temp string) string {
+	rec := do(app, "POST", "/order", CreateOrderRequest{
+		Name:      "test",
+		Temp:      temp,
+		ShelfLife: 100,
+		DecayRate: .2,
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res CreateOrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	return res.OrderID
+}
+
+func TestUpdateOrderUnknownState(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	rec := do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "eaten"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeBadRequest, res.Error.Code)
+	assert.Contains(t, res.Error.Message, "eaten")
+	assert.Equal(t, validStates, res.Error.ValidStates)
+}
+
+func TestUpdateOrderExpectedState(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	// satisfied
+	rec := do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute", ExpectedState: "ready"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var order OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(t, "enroute", order.State)
+
+	// violated, e.g. by a retry of the update that already succeeded
+	rec = do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute", ExpectedState: "ready"})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeInvalidTransition, res.Error.Code)
+	assert.Equal(t, "enroute", res.Error.State)
+	assert.Equal(t, "ready", res.Error.ExpectedState)
+
+	rec = do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "pickedup", ExpectedState: "cooking"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(app, "GET", "/order/"+id, nil)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(t, "enroute", order.State)
+
+	// a retry of the pickup, once the order has left the shelves, conflicts too
+	rec = do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "pickedup", ExpectedState: "enroute"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "pickedup", ExpectedState: "enroute"})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	res = ErrorResponse{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeInvalidTransition, res.Error.Code)
+	assert.Equal(t, "pickedup", res.Error.State)
+	assert.Equal(t, "enroute", res.Error.ExpectedState)
+}
+
+func TestUpdateOrderValidTransition(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	rec := do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, id, res.OrderID)
+	assert.Equal(t, "enroute", res.State)
+}
+
+func TestUpdateOrderIllegalTransition(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	// can't be picked up before a courier is enroute
+	rec := do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "pickedup"})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "ready", res.Error.State)
+	assert.Equal(t, "enroute", res.Error.ExpectedState)
+	assert.NotEmpty(t, res.Error.Message)
+
+	// or readied again once it's on a shelf
+	rec = do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "ready"})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeInvalidTransition, res.Error.Code)
+	assert.Equal(t, "ready", res.Error.State)
+	assert.Equal(t, "created", res.Error.ExpectedState)
+
+	rec = do(app, "GET", "/order/"+id, nil)
+	var order OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(t, "ready", order.State)
+}
+
+func TestUpdateOrderNotFound(t *testing.T) {
+	app := newTestServer(t)
+	rec := do(app, "POST", "/order/missing", UpdateOrderRequest{State: "enroute"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeNotFound, res.Error.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+}
+
+func TestSetPriority(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	rec := do(app, "POST", "/order/"+id+"/priority", PriorityRequest{Priority: 5})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 5, res.Priority)
+	assert.Equal(t, "hot", res.Shelf)
+
+	rec = do(app, "POST", "/order/missing/priority", PriorityRequest{Priority: 5})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestMoveOrder(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	rec := do(app, "POST", "/admin/order/"+id+"/move", MoveOrderRequest{Shelf: "cold"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(app, "POST", "/admin/order/"+id+"/move", MoveOrderRequest{Shelf: "freezer"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(app, "POST", "/admin/order/missing/move", MoveOrderRequest{Shelf: "hot"})
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(app, "POST", "/admin/order/"+id+"/move", MoveOrderRequest{Shelf: "hot"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "hot", res.Shelf)
+
+	// a courier is on the way for it
+	app = newTestServer(t, []byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported:
+        - hot`))
+	id = createOrder(t, app, "hot")
+	rec = do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = do(app, "POST", "/admin/order/"+id+"/move", MoveOrderRequest{Shelf: "overflow"})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	var errRes ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&errRes))
+	assert.Equal(t, CodeInvalidTransition, errRes.Error.Code)
+	assert.Equal(t, "enroute", errRes.Error.State)
+}
+
+func TestOrderResponseUnits(t *testing.T) {
+	// seconds by default, without truncating fractions
+	app := newTestServer(t)
+	rec := do(app, "POST", "/order", CreateOrderRequest{Name: "test", Temp: "hot", ShelfLife: 1.5, DecayRate: .2})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var created CreateOrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+
+	rec = do(app, "GET", "/order/"+created.OrderID, nil)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 1.5, res.ShelfLife)
+	assert.True(t, res.Age > 0 && res.Age < 1)
+
+	app = newTestServer(t, []byte(`
+server:
+  units: milliseconds`))
+	rec = do(app, "POST", "/order", CreateOrderRequest{Name: "test", Temp: "hot", ShelfLife: 1500, DecayRate: .2})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+
+	rec = do(app, "GET", "/order/"+created.OrderID, nil)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 1500.0, res.ShelfLife)
+	assert.True(t, res.Value > 1000 && res.Value <= 1500)
+
+	provider := config.NewYAMLProviderFromBytes(testConfig, []byte(`
+server:
+  units: fortnights`))
+	k, err := kitchen.NewKitchen(provider)
+	assert.Nil(t, err)
+	_, err = Provide(provider, nil, k, BuildInfo{})
+	assert.NotNil(t, err)
+}
+
+func TestCreateCompositeOrder(t *testing.T) {
+	app := newTestServer(t)
+	rec := do(app, "POST", "/order", CreateOrderRequest{Name: "test", Temps: []string{"cold", "frozen"}, ShelfLife: 100})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var created CreateOrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+
+	rec = do(app, "GET", "/order/"+created.OrderID, nil)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "cold", res.Shelf)
+}
+
+func TestOrderTimestamps(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+	do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute"})
+
+	// opt-in only
+	rec := do(app, "GET", "/order/"+id, nil)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "", res.CreatedAt)
+
+	// picked up orders leave the kitchen, so read them off the update
+	rec = do(app, "POST", "/order/"+id+"?includeTimestamps=true", UpdateOrderRequest{State: "pickedup"})
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "", res.TrashedAt)
+
+	var prev time.Time
+	for _, ts := range []string{res.CreatedAt, res.ReadyAt, res.EnrouteAt, res.PickedUpAt} {
+		parsed, err := time.Parse(time.RFC3339, ts)
+		assert.Nil(t, err)
+		assert.False(t, parsed.Before(prev))
+		prev = parsed
+	}
+}
+
+func TestOrderMetadata(t *testing.T) {
+	app := newTestServer(t)
+	metadata := map[string]string{"customer": "42", "promo": "FREEFRIES"}
+	rec := do(app, "POST", "/order", CreateOrderRequest{Name: "test", Temp: "hot", ShelfLife: 100, Metadata: metadata})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var created CreateOrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+
+	rec = do(app, "GET", "/order/"+created.OrderID, nil)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, metadata, res.Metadata)
+
+	// omitted when there is none
+	id := createOrder(t, app, "cold")
+	rec = do(app, "GET", "/order/"+id, nil)
+	assert.NotContains(t, rec.Body.String(), "metadata")
+
+	large := map[string]string{"notes": strings.Repeat("x", maxMetadataBytes)}
+	rec = do(app, "POST", "/order", CreateOrderRequest{Name: "test", Temp: "hot", ShelfLife: 100, Metadata: large})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestSweep(t *testing.T) {
+	app := newTestServer(t)
+	createOrder(t, app, "hot")
+	rec := do(app, "POST", "/admin/sweep", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res SweepResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 0, res.Trashed)
+}
+
+func TestCreateOrderWithID(t *testing.T) {
+	app := newTestServer(t)
+	req := CreateOrderRequest{ID: "pizza-1", Name: "test", Temp: "hot", ShelfLife: 100}
+	rec := do(app, "POST", "/order", req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var created CreateOrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+	assert.Equal(t, "pizza-1", created.OrderID)
+
+	rec = do(app, "GET", "/order/pizza-1", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = do(app, "POST", "/order", req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestLayout(t *testing.T) {
+	app := newTestServer(t)
+	hot := createOrder(t, app, "hot")
+	cold := createOrder(t, app, "cold")
+	rec := do(app, "GET", "/admin/layout", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res LayoutResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, []string{hot}, res.Shelves["hot"])
+	assert.Equal(t, []string{cold}, res.Shelves["cold"])
+}
+
+func TestGetShelf(t *testing.T) {
+	app := newTestServer(t)
+	hot := []string{createOrder(t, app, "hot"), createOrder(t, app, "hot")}
+	sort.Strings(hot)
+	createOrder(t, app, "cold")
+
+	rec := do(app, "GET", "/admin/shelf/hot", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res ShelfInfoResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "hot", res.Name)
+	assert.Equal(t, "static", res.Type)
+	assert.Equal(t, []string{"hot"}, res.Supported)
+	assert.Equal(t, 5, res.Capacity)
+	assert.Equal(t, 1.0, res.DecayRate)
+	ids := make([]string, len(res.Orders))
+	for i, order := range res.Orders {
+		ids[i] = order.OrderID
+		assert.Equal(t, "ready", order.State)
+		assert.True(t, order.Value > 0 && order.Value <= 100, "%v", order)
+		assert.True(t, order.Age >= 0, "%v", order)
+	}
+	assert.Equal(t, hot, ids)
+
+	rec = do(app, "GET", "/admin/shelf/freezer", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestPreview(t *testing.T) {
+	app := newTestServer(t)
+	rec := do(app, "GET", "/order/preview", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = do(app, "GET", "/order/preview?temp=hot", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res PreviewResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.True(t, res.Placed)
+
+	id := createOrder(t, app, "hot")
+	rec = do(app, "GET", "/order/"+id, nil)
+	var order OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(t, res.Shelf, order.Shelf)
+}
+
+func TestLeastValuable(t *testing.T) {
+	app := newTestServer(t)
+	rec := do(app, "GET", "/admin/least-valuable?temp=hot", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = do(app, "GET", "/admin/least-valuable", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	createOrder(t, app, "hot")
+	rec = do(app, "POST", "/order", CreateOrderRequest{Name: "short", Temp: "hot", ShelfLife: 10})
+	var created CreateOrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+
+	rec = do(app, "GET", "/admin/least-valuable?temp=hot", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, created.OrderID, res.OrderID)
+}
+
+func TestGzipListOrders(t *testing.T) {
+	app := newTestServer(t, []byte(`
+server:
+  compression: true
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 200
+      decay_rate: 1
+      supported: 
+        - hot`))
+	for i := 0; i < 200; i++ {
+		createOrder(t, app, "hot")
+	}
+
+	plain := do(app, "GET", "/order", nil)
+	assert.Equal(t, "", plain.Header().Get("Content-Encoding"))
+	plainLen := plain.Body.Len()
+	var expected ListOrdersResponse
+	assert.Nil(t, json.NewDecoder(plain.Body).Decode(&expected))
+
+	req := httptest.NewRequest("GET", "/order", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.True(t, rec.Body.Len() < plainLen)
+
+	reader, err := gzip.NewReader(rec.Body)
+	assert.Nil(t, err)
+	var actual ListOrdersResponse
+	assert.Nil(t, json.NewDecoder(reader).Decode(&actual))
+
+	// values move with time, so compare what doesn't
+	ids := func(res ListOrdersResponse) map[string]string {
+		ids := make(map[string]string)
+		for _, order := range res.Orders {
+			ids[order.OrderID] = order.Shelf
+		}
+		return ids
+	}
+	assert.Equal(t, 200, len(actual.Orders))
+	assert.Equal(t, ids(expected), ids(actual))
+
+	// a 304 has no body, so isn't marked as gzipped
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, 0, rec.Body.Len())
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	serve := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		gzipMiddleware(handler).ServeHTTP(rec, req)
+		return rec
+	}
+
+	// empty responses go out as they are, with their status
+	rec := serve(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	rec = serve(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(nil)
+	})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, 0, rec.Body.Len())
+
+	// a body is gzipped with the held back status, and can be flushed as it's streamed
+	rec = serve(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("second\n"))
+	})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.True(t, rec.Flushed)
+	reader, err := gzip.NewReader(rec.Body)
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "first\nsecond\n", string(body))
+}
+
+func TestBindAddress(t *testing.T) {
+	app := newTestServer(t, []byte(`
+server:
+  host: 127.0.0.1
+  port: 0`))
+	listener, err := app.Listen()
+	assert.Nil(t, err)
+	defer listener.Close()
+	go app.server.Serve(listener)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	assert.Equal(t, "127.0.0.1", addr.IP.String())
+	assert.NotEqual(t, 0, addr.Port)
+
+	resp, err := http.Get("http://" + addr.String() + "/health")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReadTimeout(t *testing.T) {
+	app := newTestServer(t, []byte(`
+server:
+  port: 0
+  read_timeout: 100ms`))
+	assert.Equal(t, 30*time.Second, app.server.WriteTimeout)
+	listener, err := app.Listen()
+	assert.Nil(t, err)
+	defer listener.Close()
+	go app.server.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// start a request but never finish the headers
+	start := time.Now()
+	_, err = conn.Write([]byte("GET /health HTTP/1.1\r\nHost: kitchen\r\n"))
+	assert.Nil(t, err)
+	response, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Empty(t, response)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 100*time.Millisecond, elapsed)
+	assert.True(t, elapsed < time.Second, elapsed)
+}
+
+func TestVersion(t *testing.T) {
+	app := newTestServer(t)
+	rec := do(app, "GET", "/version", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res VersionResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, VersionResponse{Version: "1.2.3", GitSHA: "abc123", APIVersion: APIVersion}, res)
+}
+
+func TestDefaultBindAddress(t *testing.T) {
+	app := newTestServer(t)
+	assert.Equal(t, "127.0.0.1:8080", app.server.Addr)
+}
+
+func TestInvalidHost(t *testing.T) {
+	for _, host := range []string{"not a host", "-bad.example", "a..b"} {
+		provider := config.NewYAMLProviderFromBytes(testConfig, []byte("server:\n  host: \""+host+"\""))
+		k, err := kitchen.NewKitchen(provider)
+		assert.Nil(t, err)
+		_, err = Provide(provider, func() config.Provider { return provider }, k, BuildInfo{})
+		assert.NotNil(t, err, host)
+	}
+}
+
+func TestListOrdersSort(t *testing.T) {
+	app := newTestServer(t)
+	for i, name := range []string{"b", "c", "a"} {
+		rec := do(app, "POST", "/order", CreateOrderRequest{Name: name, Temp: "hot", ShelfLife: float64(100 * (i + 1))})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	names := func(query string) []string {
+		rec := do(app, "GET", "/order?"+query, nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var res ListOrdersResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		names := make([]string, len(res.Orders))
+		for i, order := range res.Orders {
+			names[i] = order.Name
+		}
+		return names
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names("sort=name"))
+	assert.Equal(t, []string{"a", "b", "c"}, names("sort=name&order=asc"))
+	assert.Equal(t, []string{"c", "b", "a"}, names("sort=name&order=desc"))
+	// value follows shelf life
+	assert.Equal(t, []string{"b", "c", "a"}, names("sort=value"))
+	assert.Equal(t, []string{"a", "c", "b"}, names("sort=value&order=desc"))
+	// created in order b, c, a so b is the oldest
+	assert.Equal(t, []string{"a", "c", "b"}, names("sort=age"))
+	assert.Equal(t, []string{"b", "c", "a"}, names("sort=age&order=desc"))
+
+	for _, query := range []string{"sort=temp", "sort=name&order=up", "order=desc"} {
+		rec := do(app, "GET", "/order?"+query, nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestListOrdersNonFinite(t *testing.T) {
+	app := newTestServer(t)
+	createOrder(t, app, "hot")
+	// a zero shelf life makes the normalized value 0/0
+	rec := do(app, "POST", "/order", CreateOrderRequest{Name: "empty", Temp: "hot"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var created CreateOrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+
+	rec = do(app, "GET", "/order?includeDecay=true", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res ListOrdersResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 2, len(res.Orders))
+	for _, order := range res.Orders {
+		if order.OrderID == created.OrderID {
+			assert.Equal(t, 0.0, order.NormalValue)
+		}
+	}
+
+	rec = do(app, "GET", "/order/"+created.OrderID, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestOrderDecayBreakdown(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	rec := do(app, "GET", "/order/"+id, nil)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Nil(t, res.DecayBreakdown)
+
+	rec = do(app, "GET", "/order/"+id+"?includeDecay=true", nil)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	breakdown := res.DecayBreakdown
+	assert.NotNil(t, breakdown)
+	assert.InDelta(t, res.Decay, breakdown.Base+breakdown.CurrentShelf+breakdown.PreviousShelves+breakdown.Floor, 1e-9)
+	assert.Equal(t, 0.0, breakdown.PreviousShelves)
+}
+
+func TestCreateOrderShelfDecayMultiplier(t *testing.T) {
+	app := newTestServer(t)
+	create := func(multiplier float64) *httptest.ResponseRecorder {
+		return do(app, "POST", "/order", CreateOrderRequest{
+			Name:                 "test",
+			Temp:                 "hot",
+			ShelfLife:            100,
+			DecayRate:            .2,
+			ShelfDecayMultiplier: multiplier,
+		})
+	}
+	multiplier := func(rec *httptest.ResponseRecorder) float64 {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var res CreateOrderResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		return app.kitchen.GetOrder(res.OrderID).ShelfDecayMultiplier()
+	}
+
+	assert.Equal(t, 1.0, multiplier(create(0)))
+	assert.Equal(t, 2.5, multiplier(create(2.5)))
+
+	rec := create(-1)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeBadRequest, res.Error.Code)
+	assert.Contains(t, res.Error.Message, "shelfDecayMultiplier")
+}
+
+func TestMetrics(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+	do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute"})
+	do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "pickedup"})
+
+	rec := do(app, "GET", "/metrics", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE order_ready_to_pickedup_seconds histogram\n")
+	assert.Contains(t, body, "order_ready_to_pickedup_seconds_bucket{le=\"+Inf\"} 1\n")
+	assert.Contains(t, body, "order_ready_to_pickedup_seconds_bucket{le=\"300\"} 1\n")
+	assert.Contains(t, body, "order_ready_to_pickedup_seconds_count 1\n")
+	assert.Contains(t, body, "order_created_to_ready_seconds_count 1\n")
+}
+
+func TestMetricsKitchenName(t *testing.T) {
+	app := newTestServer(t, []byte("kitchen:\n  name: north"))
+	rec := do(app, "GET", "/metrics", nil)
+	body := rec.Body.String()
+	assert.Contains(t, body, "# HELP north_order_created_to_ready_seconds Time from an order being created")
+	assert.Contains(t, body, "north_order_ready_to_pickedup_seconds_count 0\n")
+}
+
+func TestErrorResponses(t *testing.T) {
+	app := newTestServer(t)
+	for _, tc := range []struct {
+		method string
+		uri    string
+		body   string
+		status int
+		code   string
+	}{
+		{"POST", "/order", "{", http.StatusBadRequest, CodeBadRequest},
+		{"GET", "/order/missing/value", "", http.StatusNotFound, CodeNotFound},
+		{"GET", "/nowhere", "", http.StatusNotFound, CodeNotFound},
+		{"DELETE", "/order", "", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(tc.method, tc.uri, strings.NewReader(tc.body))
+		rec := httptest.NewRecorder()
+		app.router.ServeHTTP(rec, req)
+		assert.Equal(t, tc.status, rec.Code, tc.uri)
+		var res ErrorResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res), tc.uri)
+		assert.Equal(t, tc.code, res.Error.Code, tc.uri)
+		assert.NotEmpty(t, res.Error.Message, tc.uri)
+	}
+}
+
+func TestLongPollChanges(t *testing.T) {
+	app := newTestServer(t)
+
+	// nothing has changed yet, a zero timeout returns straight away
+	rec := do(app, "GET", "/order?since=0&timeout=0", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res ChangesResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Empty(t, res.Orders)
+	assert.Equal(t, uint64(0), res.Cursor)
+
+	polled := make(chan *httptest.ResponseRecorder)
+	go func() {
+		polled <- do(app, "GET", "/order?since=0&timeout=10", nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	id := createOrder(t, app, "hot")
+
+	select {
+	case rec = <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the create didn't unblock the long-poll")
+	}
+	assert.Equal(t, http.StatusOK, rec.Code)
+	res = ChangesResponse{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 1, len(res.Orders))
+	assert.Equal(t, id, res.Orders[0].OrderID)
+	assert.True(t, res.Cursor > 0)
+	assert.False(t, res.Reset)
+
+	rec = do(app, "GET", "/order?since=abc", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// waits end before the write timeout would cut the response off
+	assert.Equal(t, maxLongPoll, app.maxLongPoll)
+	app = newTestServer(t, []byte(`
+server:
+  write_timeout: 100ms`))
+	assert.Equal(t, 50*time.Millisecond, app.maxLongPoll)
+	start := time.Now()
+	rec = do(app, "GET", "/order?since=0&timeout=10", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, 20*time.Second, longPollLimit(25*time.Second))
+	assert.Equal(t, maxLongPoll, longPollLimit(0))
+}
+
+func TestETag(t *testing.T) {
+	app := newTestServer(t, []byte(`
+kitchen:
+  reheat:
+    max_reheats: 1`))
+	id := createOrder(t, app, "hot")
+
+	rec := do(app, "GET", "/order", nil)
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	req := httptest.NewRequest("GET", "/order", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	app.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.Bytes())
+
+	// a reheat changes the value more than age alone does
+	assert.Nil(t, app.kitchen.Reheat(app.kitchen.GetOrder(id)))
+	rec = httptest.NewRecorder()
+	app.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	etag = rec.Header().Get("ETag")
+
+	// as does a change of priority
+	orderReq := httptest.NewRequest("GET", "/order/"+id, nil)
+	orderReq.Header.Set("If-None-Match", do(app, "GET", "/order/"+id, nil).Header().Get("ETag"))
+	assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+id+"/priority", PriorityRequest{Priority: 5}).Code)
+	rec = httptest.NewRecorder()
+	app.router.ServeHTTP(rec, orderReq)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// any transition or move is a change
+	req.Header.Set("If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute"}).Code)
+	rec = httptest.NewRecorder()
+	app.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+
+	// versions start over with the kitchen, so another server's ETags never match
+	etag = rec.Header().Get("ETag")
+	other := newTestServer(t)
+	rec = httptest.NewRecorder()
+	other.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+}
+
+func TestImport(t *testing.T) {
+	app := newTestServer(t)
+	readyAt := time.Now().Add(-time.Minute)
+	rec := do(app, "POST", "/admin/import", []ImportOrderRequest{
+		{CreateOrderRequest: CreateOrderRequest{ID: "a", Name: "a", Temp: "hot", ShelfLife: 300, DecayRate: 1}, State: "ready", Shelf: "hot", ReadyAt: readyAt},
+		{CreateOrderRequest: CreateOrderRequest{ID: "b", Name: "b", Temp: "cold", ShelfLife: 300, DecayRate: 1}, State: "enroute", Shelf: "cold"},
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res ImportResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, []string{"a", "b"}, res.OrderIDs)
+
+	for id, want := range map[string][2]string{"a": {"ready", "hot"}, "b": {"enroute", "cold"}} {
+		var order OrderResponse
+		rec = do(app, "GET", "/order/"+id, nil)
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+		assert.Equal(t, want[0], order.State)
+		assert.Equal(t, want[1], order.Shelf)
+	}
+
+	rec = do(app, "POST", "/admin/import", []ImportOrderRequest{
+		{CreateOrderRequest: CreateOrderRequest{Name: "c", Temp: "hot", ShelfLife: 300, DecayRate: 1}, State: "ready", Shelf: "freezer"},
+	})
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = do(app, "POST", "/admin/import", []ImportOrderRequest{
+		{CreateOrderRequest: CreateOrderRequest{ID: "a", Name: "a", Temp: "hot", ShelfLife: 300, DecayRate: 1}, State: "ready", Shelf: "hot"},
+	})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+}
+
+func TestDefaultDecayRate(t *testing.T) {
+	app := newTestServer(t, []byte(`
+kitchen:
+  default_decay_rates:
+    hot: 0.25`))
+	for _, tc := range []struct {
+		decayRate float64
+		want      float64
+	}{
+		{0, 0.25},
+		{3, 3},
+	} {
+		rec := do(app, "POST", "/order", CreateOrderRequest{Name: "a", Temp: "hot", ShelfLife: 300, DecayRate: tc.decayRate})
+		var created CreateOrderResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&created))
+		assert.Equal(t, tc.want, app.kitchen.GetOrder(created.OrderID).DecayRate())
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	app := newTestServer(t, []byte(`
+kitchen:
+  max_total_orders: 1`))
+	createOrder(t, app, "hot")
+	rec := do(app, "POST", "/order", CreateOrderRequest{Name: "a", Temp: "hot", ShelfLife: 300, DecayRate: 1})
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeUnavailable, res.Error.Code)
+}
+
+func TestCancel(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+	rec := do(app, "POST", "/order/"+id+"/cancel", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var order OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(t, "trashed", order.State)
+	assert.Equal(t, "cancelled", order.TrashedReason)
+
+	id = createOrder(t, app, "hot")
+	assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute"}).Code)
+	assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "pickedup"}).Code)
+	rec = do(app, "POST", "/order/"+id+"/cancel", nil)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, CodeInvalidTransition, res.Error.Code)
+	assert.Equal(t, "pickedup", res.Error.State)
+
+	assert.Equal(t, http.StatusNotFound, do(app, "POST", "/order/missing/cancel", nil).Code)
+}
+
+func TestSetShelfCapacity(t *testing.T) {
+	app := newTestServer(t, []byte(`
+kitchen:
+  shrink_policy: evict_least_valuable`))
+	createOrder(t, app, "hot")
+	createOrder(t, app, "hot")
+
+	rec := do(app, "PATCH", "/admin/shelf/hot", ShelfRequest{Capacity: intPtr(10)})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res ShelfResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, ShelfResponse{Used: 2, Capacity: 10}, res)
+
+	rec = do(app, "PATCH", "/admin/shelf/hot", ShelfRequest{Capacity: intPtr(1)})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, ShelfResponse{Used: 1, Capacity: 1}, res)
+
+	// an enroute order can't be evicted
+	for _, order := range app.kitchen.GetOrders() {
+		assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+order.ID(), UpdateOrderRequest{State: "enroute"}).Code)
+	}
+	rec = do(app, "PATCH", "/admin/shelf/hot", ShelfRequest{Capacity: intPtr(0)})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	assert.Equal(t, http.StatusNotFound, do(app, "PATCH", "/admin/shelf/freezer", ShelfRequest{Capacity: intPtr(1)}).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, do(app, "PATCH", "/admin/shelf/hot", ShelfRequest{}).Code)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestCORS(t *testing.T) {
+	app := newTestServer(t, []byte(`
+server:
+  cors:
+    allowed_origins:
+      - https://dashboard.example.com
+    max_age: 10m`))
+
+	serve := func(method, origin string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/order", nil)
+		req.Header.Set("Origin", origin)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("OPTIONS", "https://dashboard.example.com", map[string]string{"Access-Control-Request-Method": "POST"})
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://dashboard.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, POST, PATCH", rec.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type, If-None-Match, X-Request-ID", rec.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+
+	rec = serve("GET", "https://dashboard.example.com", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "https://dashboard.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), "ETag")
+
+	// other origins get no CORS headers, so browsers block them
+	rec = serve("GET", "https://evil.example.com", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// and it's disabled by default
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("OPTIONS", "/order", nil)
+	req.Header.Set("Origin", "https://dashboard.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	newTestServer(t).ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestListOrdersNDJSON(t *testing.T) {
+	app := newTestServer(t)
+	for _, name := range []string{"b", "c", "a"} {
+		rec := do(app, "POST", "/order", CreateOrderRequest{Name: name, Temp: "hot", ShelfLife: 100})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	list := func(query string) []OrderResponse {
+		req := httptest.NewRequest("GET", "/order"+query, nil)
+		req.Header.Set("Accept", "application/x-ndjson")
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+		assert.True(t, rec.Flushed)
+		// every line is an order on its own
+		orders := make([]OrderResponse, 0)
+		for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+			var order OrderResponse
+			assert.Nil(t, json.Unmarshal([]byte(line), &order), line)
+			orders = append(orders, order)
+		}
+		return orders
+	}
+
+	orders := list("")
+	assert.Equal(t, 3, len(orders))
+	names := make(map[string]bool)
+	for _, order := range orders {
+		names[order.Name] = true
+		assert.Equal(t, "ready", order.State)
+		assert.Equal(t, "hot", order.Shelf)
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, names)
+
+	// sorting and fields apply the same as to the JSON list
+	orders = list("?sort=name&order=desc&fields=name")
+	assert.Equal(t, []OrderResponse{{Name: "c"}, {Name: "b"}, {Name: "a"}}, orders)
+}
+
+func TestRequestID(t *testing.T) {
+	app := newTestServer(t)
+	var logs bytes.Buffer
+	app.logger = log.New(&logs, "", 0)
+
+	// the client's ID is echoed and logged
+	req := httptest.NewRequest("GET", "/order/missing", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "abc-123", rec.Header().Get(RequestIDHeader))
+	assert.Contains(t, logs.String(), "[abc-123] GET /order/missing 404")
+
+	// one is generated if the client sends none, or an invalid one
+	for _, id := range []string{"", "has spaces", strings.Repeat("a", maxRequestIDLength+1)} {
+		logs.Reset()
+		req = httptest.NewRequest("GET", "/health", nil)
+		req.Header.Set(RequestIDHeader, id)
+		rec = httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		generated := rec.Header().Get(RequestIDHeader)
+		assert.NotEmpty(t, generated)
+		assert.NotEqual(t, id, generated)
+		assert.Contains(t, logs.String(), "["+generated+"] GET /health 200")
+	}
+}
+
+func TestOrderEvents(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+	assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+id+"/cancel", nil).Code)
+
+	rec := do(app, "GET", "/order/"+id+"/events", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res OrderEventsResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, id, res.OrderID)
+	assert.Equal(t, 3, len(res.Events))
+	last := res.Events[2]
+	assert.Equal(t, "ready", last.OldState)
+	assert.Equal(t, "trashed", last.NewState)
+	assert.Equal(t, "cancelled", last.Reason)
+	assert.NotEmpty(t, last.Timestamp)
+
+	assert.Equal(t, http.StatusNotFound, do(app, "GET", "/order/missing/events", nil).Code)
+}
+
+func TestTimeToExpiry(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+	rec := do(app, "GET", "/order/"+id, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var order OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	// value falls at 1 from age, .2 from the order's decay and 1 from the shelf's
+	assert.NotNil(t, order.TimeToExpiry)
+	assert.InDelta(t, 100/2.2, *order.TimeToExpiry, 0.1)
+
+	assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "enroute"}).Code)
+	rec = do(app, "POST", "/order/"+id, UpdateOrderRequest{State: "pickedup"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	order = OrderResponse{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Nil(t, order.TimeToExpiry)
+}
+
+func TestProjection(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	for _, query := range []string{"?horizon=60&step=5", "?horizon=1m&step=5s", ""} {
+		rec := do(app, "GET", "/order/"+id+"/projection"+query, nil)
+		assert.Equal(t, http.StatusOK, rec.Code, query)
+		var res ProjectionResponse
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+		assert.Equal(t, id, res.OrderID)
+		assert.Equal(t, "hot", res.Shelf)
+		assert.Equal(t, 13, len(res.Points), query)
+		// value falls at 2.2 a second, so it expires after 100/2.2 ~ 45.5 seconds
+		for i, point := range res.Points {
+			assert.Equal(t, float64(5*i), point.Offset)
+			if point.Offset < 45 {
+				assert.True(t, point.Value > 0, "%v", point)
+			} else if point.Offset > 46 {
+				assert.Equal(t, 0.0, point.Value, "%v", point)
+			}
+			if i > 0 && res.Points[i-1].Value > 0 {
+				assert.True(t, point.Value < res.Points[i-1].Value, "%v", point)
+			}
+		}
+	}
+
+	for _, query := range []string{"?step=0", "?horizon=-1", "?step=soon", "?horizon=1000&step=0.001"} {
+		assert.Equal(t, http.StatusBadRequest, do(app, "GET", "/order/"+id+"/projection"+query, nil).Code, query)
+	}
+	assert.Equal(t, http.StatusNotFound, do(app, "GET", "/order/missing/projection", nil).Code)
+}
+
+func TestBulkUpdate(t *testing.T) {
+	app := newTestServer(t)
+	ready, enroute := createOrder(t, app, "hot"), createOrder(t, app, "cold")
+	assert.Equal(t, http.StatusOK, do(app, "POST", "/order/"+enroute, UpdateOrderRequest{State: "enroute"}).Code)
+
+	rec := do(app, "POST", "/orders/update", []BulkUpdateRequest{
+		{ID: ready, State: "enroute"},
+		{ID: enroute, State: "pickedup"},
+		// only enroute orders can be picked up
+		{ID: createOrder(t, app, "hot"), State: "pickedup"},
+		{ID: "missing", State: "enroute"},
+	})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res BulkUpdateResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, 4, len(res.Results))
+
+	assert.Equal(t, ready, res.Results[0].ID)
+	assert.Equal(t, http.StatusOK, res.Results[0].Status)
+	assert.Equal(t, "enroute", res.Results[0].Order.State)
+	assert.Nil(t, res.Results[0].Error)
+	assert.Equal(t, http.StatusOK, res.Results[1].Status)
+	assert.Equal(t, "pickedup", res.Results[1].Order.State)
+
+	assert.Equal(t, http.StatusConflict, res.Results[2].Status)
+	assert.Nil(t, res.Results[2].Order)
+	assert.Equal(t, CodeInvalidTransition, res.Results[2].Error.Code)
+	assert.Equal(t, "ready", res.Results[2].Error.State)
+	assert.Equal(t, http.StatusNotFound, res.Results[3].Status)
+	assert.Equal(t, CodeNotFound, res.Results[3].Error.Code)
+
+	assert.Equal(t, http.StatusBadRequest, do(app, "POST", "/orders/update", UpdateOrderRequest{State: "enroute"}).Code)
+}
+
+func TestHops(t *testing.T) {
+	app := newTestServer(t, []byte(`
+kitchen:
+  topology:
+    - name: "hot"
+      capacity: 5
+      decay_rate: 1
+      supported:
+        - hot
+    - name: "overflow"
+      capacity: 5
+      decay_rate: 2
+      supported:
+        - hot`))
+	id := createOrder(t, app, "hot")
+	rec := do(app, "POST", "/admin/order/"+id+"/move", MoveOrderRequest{Shelf: "overflow"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res OrderResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Equal(t, "overflow", res.Shelf)
+	assert.Equal(t, 1, res.Hops)
+}
+
+func TestFields(t *testing.T) {
+	app := newTestServer(t)
+	id := createOrder(t, app, "hot")
+
+	rec := do(app, "GET", "/order/"+id+"?fields=orderID,state,value", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var order map[string]interface{}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&order))
+	assert.Equal(t, 3, len(order))
+	assert.Equal(t, id, order["orderID"])
+	assert.Equal(t, "ready", order["state"])
+	assert.Contains(t, order, "value")
+	assert.NotContains(t, order, "shelf")
+
+	rec = do(app, "GET", "/order?fields=orderID,shelf", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var list struct {
+		Orders []map[string]interface{} `json:"orders"`
+	}
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&list))
+	assert.Equal(t, []map[string]interface{}{{"orderID": id, "shelf": "hot"}}, list.Orders)
+
+	rec = do(app, "GET", "/order/"+id+"?fields=orderID,color", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var res ErrorResponse
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(&res))
+	assert.Contains(t, res.Error.Message, "color")
+	assert.Equal(t, http.StatusBadRequest, do(app, "GET", "/order?fields=orderID,", nil).Code)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// APIVersion is the version of the HTTP API, as major.minor. The major version changes with every incompatible
+// change, so a client built against another major version can refuse to talk to the server.
+const APIVersion = "1.0"
+
+// BuildInfo identifies the server's build. It's set at build time, see main.
+type BuildInfo struct {
+	Version string
+	GitSHA  string
+}
+
+type VersionResponse struct {
+	Version    string `json:"version"`
+	GitSHA     string `json:"gitSHA"`
+	APIVersion string `json:"apiVersion"`
+}
+
+// VersionHandler returns the server's build and API versions.
+func (s *ApplicationServer) VersionHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(VersionResponse{
+		Version:    s.build.Version,
+		GitSHA:     s.build.GitSHA,
+		APIVersion: APIVersion,
+	})
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Write(bytes)
+}